@@ -0,0 +1,235 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package manifest provides an interface to manifests independent of the
+// backing implementation, either mantaray tries or simple JSON manifests.
+package manifest
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ethersphere/manifest/mantaray"
+	"github.com/ethersphere/manifest/simple"
+)
+
+// Entry is a manifest entry.
+type Entry struct {
+	Reference []byte
+	Metadata  map[string]string
+}
+
+// WalkFunc is the type of the function called for each entry visited by
+// Walk. Walking stops on the first error returned by the function.
+type WalkFunc func(path string, entry Entry) error
+
+// Walker is implemented by the manifests of all implementations.
+type Walker interface {
+	// Walk calls walkFn for each entry of the manifest.
+	Walk(ctx context.Context, walkFn WalkFunc) error
+}
+
+// NewMantarayWalker returns a Walker over the mantaray trie rooted at n.
+func NewMantarayWalker(n *mantaray.Node, l mantaray.Loader) Walker {
+	return &mantarayWalker{node: n, loader: l}
+}
+
+type mantarayWalker struct {
+	node   *mantaray.Node
+	loader mantaray.Loader
+}
+
+func (w *mantarayWalker) Walk(ctx context.Context, walkFn WalkFunc) error {
+	return w.node.WalkNode(ctx, []byte{}, w.loader, func(path []byte, node *mantaray.Node, err error) error {
+		if err != nil {
+			return err
+		}
+		if !node.IsValueType() {
+			return nil
+		}
+		return walkFn(string(path), Entry{
+			Reference: node.Entry(),
+			Metadata:  node.Metadata(),
+		})
+	})
+}
+
+// NewSimpleWalker returns a Walker over the simple manifest m.
+func NewSimpleWalker(m simple.Manifest) Walker {
+	return &simpleWalker{manifest: m}
+}
+
+type simpleWalker struct {
+	manifest simple.Manifest
+}
+
+func (w *simpleWalker) Walk(ctx context.Context, walkFn WalkFunc) error {
+	return w.manifest.WalkEntry("", func(path string, entry simple.Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ref, err := hex.DecodeString(entry.Reference())
+		if err != nil {
+			return fmt.Errorf("entry on '%s': %w", path, err)
+		}
+		return walkFn(path, Entry{
+			Reference: ref,
+			Metadata:  entry.Metadata(),
+		})
+	})
+}
+
+// FromSimpleWalkEntryFunc adapts a simple.WalkEntryFunc to a WalkFunc.
+func FromSimpleWalkEntryFunc(fn simple.WalkEntryFunc) WalkFunc {
+	return func(path string, entry Entry) error {
+		return fn(path, simpleEntry{entry}, nil)
+	}
+}
+
+// FromMantarayWalkFunc adapts a mantaray.WalkFunc to a WalkFunc. Entries are
+// reported as files.
+func FromMantarayWalkFunc(fn mantaray.WalkFunc) WalkFunc {
+	return func(path string, _ Entry) error {
+		return fn([]byte(path), false, nil)
+	}
+}
+
+// simpleEntry implements simple.Entry for an Entry.
+type simpleEntry struct {
+	entry Entry
+}
+
+func (e simpleEntry) Reference() string {
+	return hex.EncodeToString(e.entry.Reference)
+}
+
+func (e simpleEntry) Metadata() map[string]string {
+	return e.entry.Metadata
+}
+
+// Bulk is implemented by the manifests of all implementations to add and look
+// up entries in bulk, so that the implementations can be driven by the same
+// code, for example to compare them in benchmarks.
+type Bulk interface {
+	// AddAll adds the references to the paths of the same index.
+	AddAll(ctx context.Context, paths []string, refs [][]byte) error
+	// LookupAll returns the references of the paths, failing if any of them
+	// is not found.
+	LookupAll(ctx context.Context, paths []string) ([][]byte, error)
+	// Save persists the manifest with s and returns its reference.
+	Save(ctx context.Context, s mantaray.Saver) ([]byte, error)
+}
+
+// NewMantarayBulk returns a Bulk over the mantaray trie rooted at n, loading
+// and saving nodes with ls.
+func NewMantarayBulk(n *mantaray.Node, ls mantaray.LoadSaver) Bulk {
+	return &mantarayBulk{node: n, ls: ls}
+}
+
+type mantarayBulk struct {
+	node *mantaray.Node
+	ls   mantaray.LoadSaver
+}
+
+func (b *mantarayBulk) AddAll(ctx context.Context, paths []string, refs [][]byte) error {
+	return b.node.AddAll(ctx, bytePaths(paths), refs, b.ls)
+}
+
+func (b *mantarayBulk) LookupAll(ctx context.Context, paths []string) ([][]byte, error) {
+	return b.node.LookupAll(ctx, bytePaths(paths), b.ls)
+}
+
+func (b *mantarayBulk) Save(ctx context.Context, s mantaray.Saver) ([]byte, error) {
+	if err := b.node.Save(ctx, s); err != nil {
+		return nil, err
+	}
+	return b.node.Reference(), nil
+}
+
+func bytePaths(paths []string) [][]byte {
+	b := make([][]byte, len(paths))
+	for i, p := range paths {
+		b[i] = []byte(p)
+	}
+	return b
+}
+
+// NewSimpleBulk returns a Bulk over the simple manifest m, which is saved as
+// its binary encoding. Entries are added and looked up one by one unless m
+// is a simple.BulkManifest.
+func NewSimpleBulk(m simple.Manifest) Bulk {
+	return &simpleBulk{manifest: m}
+}
+
+type simpleBulk struct {
+	manifest simple.Manifest
+}
+
+func (b *simpleBulk) AddAll(ctx context.Context, paths []string, refs [][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entries := make([]string, len(refs))
+	for i, ref := range refs {
+		entries[i] = hex.EncodeToString(ref)
+	}
+	if m, ok := b.manifest.(simple.BulkManifest); ok {
+		return m.AddAll(paths, entries)
+	}
+	if len(paths) != len(entries) {
+		return fmt.Errorf("%w: %d paths for %d entries", simple.ErrInvalid, len(paths), len(entries))
+	}
+	for i, path := range paths {
+		if err := b.manifest.Add(path, entries[i], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *simpleBulk) LookupAll(ctx context.Context, paths []string) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries, err := lookupAll(b.manifest, paths)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([][]byte, len(entries))
+	for i, e := range entries {
+		if refs[i], err = hex.DecodeString(e.Reference()); err != nil {
+			return nil, fmt.Errorf("entry on '%s': %w", paths[i], err)
+		}
+	}
+	return refs, nil
+}
+
+// lookupAll looks up the entries of the paths in m, in bulk if m is a
+// simple.BulkManifest.
+func lookupAll(m simple.Manifest, paths []string) ([]simple.Entry, error) {
+	if m, ok := m.(simple.BulkManifest); ok {
+		return m.LookupAll(paths)
+	}
+	entries := make([]simple.Entry, len(paths))
+	for i, path := range paths {
+		e, err := m.Lookup(path)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+func (b *simpleBulk) Save(ctx context.Context, s mantaray.Saver) ([]byte, error) {
+	data, err := b.manifest.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return s.Save(ctx, data)
+}
@@ -0,0 +1,238 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manifest_test
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ethersphere/manifest"
+	"github.com/ethersphere/manifest/manifesttest"
+	"github.com/ethersphere/manifest/mantaray"
+	"github.com/ethersphere/manifest/simple"
+)
+
+func TestWalkerParity(t *testing.T) {
+	ctx := context.Background()
+	entries := map[string]manifest.Entry{}
+	for _, p := range []string{"index.html", "img/1.png", "img/2.png", "robots.txt", "a/b/c/d.txt"} {
+		ref := append(make([]byte, 32-len(p)), p...)
+		entries[p] = manifest.Entry{
+			Reference: ref,
+			Metadata:  map[string]string{"name": p},
+		}
+	}
+
+	n := mantaray.New()
+	m := simple.NewManifest()
+	for p, e := range entries {
+		err := n.Add(ctx, []byte(p), e.Reference, e.Metadata, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		err = m.Add(p, hex.EncodeToString(e.Reference), e.Metadata)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	manifesttest.AssertEquivalent(t, m, n, nil)
+
+	for name, w := range map[string]manifest.Walker{
+		"mantaray": manifest.NewMantarayWalker(n, nil),
+		"simple":   manifest.NewSimpleWalker(m),
+	} {
+		t.Run(name, func(t *testing.T) {
+			visited := map[string]manifest.Entry{}
+			err := w.Walk(ctx, func(path string, entry manifest.Entry) error {
+				visited[path] = entry
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(visited, entries) {
+				t.Fatalf("expected entries %v, got %v", entries, visited)
+			}
+
+			// adapted functions see the same entries
+			paths := map[string]string{}
+			err = w.Walk(ctx, manifest.FromSimpleWalkEntryFunc(func(path string, entry simple.Entry, err error) error {
+				paths[path] = entry.Reference()
+				return err
+			}))
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			for p, e := range entries {
+				if paths[p] != hex.EncodeToString(e.Reference) {
+					t.Fatalf("expected reference %x on %s, got %s", e.Reference, p, paths[p])
+				}
+			}
+
+			count := 0
+			err = w.Walk(ctx, manifest.FromMantarayWalkFunc(func(path []byte, isDir bool, err error) error {
+				if isDir {
+					return fmt.Errorf("unexpected directory %s", path)
+				}
+				count++
+				return err
+			}))
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if count != len(entries) {
+				t.Fatalf("expected %d entries, got %d", len(entries), count)
+			}
+		})
+	}
+}
+
+func TestCanonicalMetadataJSON(t *testing.T) {
+	metadata := map[string]string{
+		"content-type":   "text/html; charset=utf-8",
+		"Filename":       `"quoted" <name> & more.html`,
+		"index-document": "index.html",
+		"unicode":        "żółw   ✓",
+		"":               "empty key",
+	}
+	b, err := mantaray.EncodeMetadata(metadata)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	direct, err := mantaray.CanonicalMetadataJSON(metadata)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(b) != string(direct) {
+		t.Fatalf("expected codec encoding %s, got %s", direct, b)
+	}
+
+	m := simple.NewManifest()
+	ref := hex.EncodeToString(make([]byte, 32))
+	if err := m.Add("index.html", ref, metadata); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	c, err := m.(simple.CanonicalMarshaler).MarshalCanonical()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := `{"entries":{"index.html":{"reference":"` + ref + `","metadata":` + string(b) + `}}}`
+	if string(c) != expected {
+		t.Fatalf("expected simple encoding %s, got %s", expected, c)
+	}
+
+	decoded, err := mantaray.DecodeMetadata(b)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(decoded, metadata) {
+		t.Fatalf("expected metadata %v, got %v", metadata, decoded)
+	}
+}
+
+func bulkEntries(count int) (paths []string, refs [][]byte) {
+	for i := 0; i < count; i++ {
+		p := fmt.Sprintf("site/dir%d/sub%d/file%d.html", i%50, i%7, i)
+		ref := make([]byte, 32)
+		copy(ref, p)
+		paths = append(paths, p)
+		refs = append(refs, ref)
+	}
+	return paths, refs
+}
+
+func TestBulk(t *testing.T) {
+	ctx := context.Background()
+	paths, refs := bulkEntries(500)
+	for name, newBulk := range map[string]func() manifest.Bulk{
+		"mantaray": func() manifest.Bulk { return manifest.NewMantarayBulk(mantaray.New(), nil) },
+		"simple":   func() manifest.Bulk { return manifest.NewSimpleBulk(simple.NewManifest()) },
+		// a manifest implementing none of the optional interfaces
+		"simple-base": func() manifest.Bulk {
+			return manifest.NewSimpleBulk(struct{ simple.Manifest }{simple.NewManifest()})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := newBulk()
+			if err := b.AddAll(ctx, paths[:300], refs[:300]); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			// adding to a manifest holding entries
+			if err := b.AddAll(ctx, paths[300:], refs[300:]); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			got, err := b.LookupAll(ctx, paths)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(got, refs) {
+				t.Fatal("expected the added references")
+			}
+			if got, err := b.LookupAll(ctx, nil); err != nil || len(got) != 0 {
+				t.Fatalf("expected no references, got %v, %v", got, err)
+			}
+			if _, err := b.LookupAll(ctx, []string{paths[0], "missing"}); err == nil {
+				t.Fatal("expected error on missing path")
+			}
+			if err := b.AddAll(ctx, paths[:2], refs[:1]); err == nil {
+				t.Fatal("expected error on mismatched lengths")
+			}
+			if _, err := b.Save(ctx, mantaray.DiscardSaver); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func BenchmarkBulk(b *testing.B) {
+	ctx := context.Background()
+	backends := []struct {
+		name    string
+		newBulk func() manifest.Bulk
+	}{
+		{"mantaray", func() manifest.Bulk { return manifest.NewMantarayBulk(mantaray.New(), nil) }},
+		{"simple", func() manifest.Bulk { return manifest.NewSimpleBulk(simple.NewManifest()) }},
+	}
+	for _, count := range []int{1000, 100000} {
+		paths, refs := bulkEntries(count)
+		for _, backend := range backends {
+			newFilled := func(b *testing.B) manifest.Bulk {
+				m := backend.newBulk()
+				if err := m.AddAll(ctx, paths, refs); err != nil {
+					b.Fatal(err)
+				}
+				return m
+			}
+			b.Run(fmt.Sprintf("%s/add/%d", backend.name, count), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					newFilled(b)
+				}
+			})
+			b.Run(fmt.Sprintf("%s/lookup/%d", backend.name, count), func(b *testing.B) {
+				m := newFilled(b)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := m.LookupAll(ctx, paths); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run(fmt.Sprintf("%s/marshal/%d", backend.name, count), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					m := newFilled(b)
+					b.StartTimer()
+					if _, err := m.Save(ctx, mantaray.DiscardSaver); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package manifesttest provides utilities for testing code converting
+// between manifest implementations.
+package manifesttest
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ethersphere/manifest/mantaray"
+	"github.com/ethersphere/manifest/simple"
+)
+
+// AssertEquivalent reports an error on t for every difference between the
+// simple manifest m and the mantaray trie rooted at root: entries stored in
+// only one of them, and entries with different references or metadata. The
+// references of m are compared hex decoded; missing and empty metadata are
+// equivalent. The trie is loaded with l as needed.
+func AssertEquivalent(t testing.TB, m simple.Manifest, root *mantaray.Node, l mantaray.Loader) {
+	t.Helper()
+	ctx := context.Background()
+
+	paths := make(map[string]struct{})
+	err := m.WalkEntry("", func(path string, entry simple.Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths[path] = struct{}{}
+		node, err := root.LookupNode(ctx, []byte(path), l)
+		if errors.Is(err, mantaray.ErrNotFound) || err == nil && !node.IsValueType() {
+			t.Errorf("entry on %q missing in mantaray trie", path)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ref, err := hex.DecodeString(entry.Reference())
+		if err != nil {
+			t.Errorf("entry on %q: invalid simple reference %q: %v", path, entry.Reference(), err)
+			return nil
+		}
+		if !bytes.Equal(ref, node.Entry()) {
+			t.Errorf("entry on %q: simple reference %x, mantaray reference %x", path, ref, node.Entry())
+		}
+		if !metadataEqual(entry.Metadata(), node.Metadata()) {
+			t.Errorf("entry on %q: simple metadata %v, mantaray metadata %v", path, entry.Metadata(), node.Metadata())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walking simple manifest: %v", err)
+	}
+
+	err = root.WalkNode(ctx, []byte{}, l, func(path []byte, node *mantaray.Node, err error) error {
+		if err != nil {
+			return err
+		}
+		if !node.IsValueType() {
+			return nil
+		}
+		if _, ok := paths[string(path)]; !ok {
+			t.Errorf("entry on %q missing in simple manifest", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walking mantaray trie: %v", err)
+	}
+}
+
+func metadataEqual(a, b map[string]string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manifesttest_test
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/ethersphere/manifest/manifesttest"
+	"github.com/ethersphere/manifest/mantaray"
+	"github.com/ethersphere/manifest/simple"
+)
+
+// recorder records the errors reported by AssertEquivalent.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertEquivalent(t *testing.T) {
+	ctx := context.Background()
+	build := func() (simple.Manifest, *mantaray.Node) {
+		m := simple.NewManifest()
+		n := mantaray.New()
+		for _, p := range []string{"index.html", "img/1.png", "img/2.png"} {
+			ref := append(make([]byte, 32-len(p)), p...)
+			md := map[string]string{"name": p}
+			if err := m.Add(p, hex.EncodeToString(ref), md); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if err := n.Add(ctx, []byte(p), ref, md, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		return m, n
+	}
+
+	m, n := build()
+	manifesttest.AssertEquivalent(t, m, n, nil)
+
+	for _, tc := range []struct {
+		name string
+		edit func(m simple.Manifest, n *mantaray.Node) error
+	}{
+		{
+			name: "missing-in-mantaray",
+			edit: func(m simple.Manifest, _ *mantaray.Node) error {
+				return m.Add("robots.txt", hex.EncodeToString(make([]byte, 32)), nil)
+			},
+		},
+		{
+			name: "missing-in-simple",
+			edit: func(_ simple.Manifest, n *mantaray.Node) error {
+				return n.Add(ctx, []byte("robots.txt"), make([]byte, 32), nil, nil)
+			},
+		},
+		{
+			name: "reference",
+			edit: func(_ simple.Manifest, n *mantaray.Node) error {
+				return n.Add(ctx, []byte("img/1.png"), make([]byte, 32), map[string]string{"name": "img/1.png"}, nil)
+			},
+		},
+		{
+			name: "metadata",
+			edit: func(m simple.Manifest, _ *mantaray.Node) error {
+				p := "index.html"
+				return m.Add(p, hex.EncodeToString(append(make([]byte, 32-len(p)), p...)), map[string]string{"name": "other"})
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, n := build()
+			if err := tc.edit(m, n); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			r := &recorder{TB: t}
+			manifesttest.AssertEquivalent(r, m, n, nil)
+			if len(r.errors) != 1 {
+				t.Fatalf("expected one reported difference, got %q", r.errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+// Audited operation names.
+const (
+	AuditAdd    = "add"
+	AuditRemove = "remove"
+)
+
+// AuditFunc is called after every entry added to or removed from a node by
+// its caller, with the operation, the path of the entry and its reference.
+// The reference is nil for removals, inline values and explicit directory
+// entries.
+type AuditFunc func(op string, path []byte, ref []byte)
+
+// SetAuditFunc sets the audit function of the node. Only operations called
+// on the node itself are audited, not the ones it performs on the nodes
+// under it, so that an entry is audited once however the trie is split. A
+// nil function disables auditing.
+func (n *Node) SetAuditFunc(fn AuditFunc) {
+	n.audit = fn
+}
+
+// auditOp calls the audit function of the node, if set.
+func (n *Node) auditOp(op string, path []byte, ref []byte) {
+	if n.audit == nil {
+		return
+	}
+	n.audit(op, append([]byte{}, path...), append([]byte(nil), ref...))
+}
+
+// auditRef returns the reference a value is audited with, nil for inline
+// values and explicit directory entries. Loaded inline values and
+// directories have zero padded entries.
+func auditRef(entry []byte, inline bool) []byte {
+	if inline || isZero(entry) {
+		return nil
+	}
+	return entry
+}
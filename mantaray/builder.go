@@ -0,0 +1,333 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// ErrInvalidOptions is returned by Builder on invalid option combinations,
+// and by operations conflicting with the options a trie was built with.
+var ErrInvalidOptions = errors.New("invalid options")
+
+// config holds the settings shared by all nodes of a trie.
+type config struct {
+	separator         byte
+	maxMetadata       int // maximum encoded metadata size, 0 for no limit
+	deterministicKeys bool
+	maxDepth          int // maximum depth of nodes below the root
+	rejectConflicts   bool
+	checksums         bool
+	maxForks          int // maximum number of forks of a node, 0 for no limit
+	refSize           int // reference size of empty tries, 0 to take the size of the first entry
+	pruneDirectories  bool
+}
+
+// DefaultMaxDepth is the default maximum depth of nodes below the root.
+const DefaultMaxDepth = 4096
+
+var defaultConfig = &config{
+	separator: PathSeparator,
+	maxDepth:  DefaultMaxDepth,
+}
+
+// configOrDefault returns the settings of the trie of the node.
+func (n *Node) configOrDefault() *config {
+	if n.cfg == nil {
+		return defaultConfig
+	}
+	return n.cfg
+}
+
+// checkDepth returns ErrMaxDepthExceeded if depth exceeds the limit of the
+// trie.
+func (n *Node) checkDepth(depth int) error {
+	if max := n.configOrDefault().maxDepth; depth > max {
+		return fmt.Errorf("%w: %d", ErrMaxDepthExceeded, max)
+	}
+	return nil
+}
+
+// checkForks returns ErrTooManyForks if a fork cannot be added to the node
+// without exceeding the limit of the trie.
+func (n *Node) checkForks() error {
+	if max := n.configOrDefault().maxForks; max > 0 && len(n.forks) >= max {
+		return fmt.Errorf("%w: limit %d", ErrTooManyForks, max)
+	}
+	return nil
+}
+
+// Builder constructs configured nodes.
+type Builder struct {
+	obfuscationKey []byte
+	refSize        int
+	cfg            config
+}
+
+// NewBuilder returns a builder with the default settings.
+func NewBuilder() *Builder {
+	return &Builder{cfg: *defaultConfig}
+}
+
+// WithObfuscationKey sets the obfuscation key of the node and the nodes
+// created under it.
+func (b *Builder) WithObfuscationKey(key []byte) *Builder {
+	b.obfuscationKey = append([]byte{}, key...)
+	return b
+}
+
+// WithRefSize sets the size of the references stored in the trie.
+func (b *Builder) WithRefSize(size int) *Builder {
+	b.refSize = size
+	return b
+}
+
+// WithSeparator sets the path separator used for the path separator node
+// type and by Walk.
+func (b *Builder) WithSeparator(separator byte) *Builder {
+	b.cfg.separator = separator
+	return b
+}
+
+// WithMaxMetadata limits the encoded size of the metadata of a single entry.
+func (b *Builder) WithMaxMetadata(size int) *Builder {
+	b.cfg.maxMetadata = size
+	return b
+}
+
+// WithDeterministicKeys derives the obfuscation key of every node from its
+// contents instead of generating a random one, so that equal tries are
+// stored under equal references.
+func (b *Builder) WithDeterministicKeys() *Builder {
+	b.cfg.deterministicKeys = true
+	return b
+}
+
+// WithMaxDepth limits the depth of nodes below the root which are saved,
+// looked up or walked, protecting against deeply chained malicious tries.
+func (b *Builder) WithMaxDepth(depth int) *Builder {
+	b.cfg.maxDepth = depth
+	return b
+}
+
+// WithRejectPathConflicts makes adding entries fail with ErrPathConflict
+// where a path would be both a file and a directory, like in filesystems:
+// adding an entry under a file, or a file on the directory of other entries.
+// By default such paths are allowed, so that for example both "a/b" and
+// "a/b/c" can be served.
+func (b *Builder) WithRejectPathConflicts() *Builder {
+	b.cfg.rejectConflicts = true
+	return b
+}
+
+// WithChecksums makes every saved node end with a checksum of its contents,
+// which is verified when the node is loaded, so that corruption not changing
+// the reference, such as a store returning the data of another reference or
+// bit rot, fails with ErrChecksumMismatch. Nodes with checksums are saved in
+// the "mantaray:0.3" format.
+func (b *Builder) WithChecksums() *Builder {
+	b.cfg.checksums = true
+	return b
+}
+
+// WithMaxForks limits the number of forks of a node, so that adding an entry
+// which would branch a node beyond the limit fails with ErrTooManyForks. As
+// every fork is serialised with its prefix and reference, the limit bounds
+// the size of saved nodes and the cost of decoding them. By default a node
+// may have a fork for every byte value.
+//
+// Nodes beyond the limit are not split automatically: the forks of a node
+// start with different bytes, so they share no prefix under which a part of
+// them could be moved to a child node without changing the paths.
+func (b *Builder) WithMaxForks(forks int) *Builder {
+	b.cfg.maxForks = forks
+	return b
+}
+
+// WithPruneDirectories makes Remove delete the explicit directory entries
+// emptied by removing the last entry below them, as web manifests have no use
+// for empty directories. By default explicit directory entries are kept like
+// empty directories in filesystems.
+func (b *Builder) WithPruneDirectories() *Builder {
+	b.cfg.pruneDirectories = true
+	return b
+}
+
+// Build returns a new node with the configured settings.
+func (b *Builder) Build() (*Node, error) {
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+	n := New()
+	b.apply(n)
+	return n, nil
+}
+
+// BuildRef returns a new node with the configured settings, referencing a
+// persisted node.
+func (b *Builder) BuildRef(ref []byte) (*Node, error) {
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+	n := NewNodeRef(ref)
+	b.apply(n)
+	return n, nil
+}
+
+// BuildFromSorted returns a new node with the configured settings holding
+// entries. The trie is built in a single pass over the entries sorted by
+// path, which are sorted first if they are not, so that every node is created
+// once in its final form instead of being split by successive adds. The trie
+// is the same as the one built by adding the entries in any order, and the
+// last of entries with equal paths wins as with Add.
+func (b *Builder) BuildFromSorted(entries []Entry) (*Node, error) {
+	n, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	if err := n.addSorted(entries); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// addSorted builds the trie of entries in the node holding no entries yet.
+func (n *Node) addSorted(entries []Entry) error {
+	less := func(i, j int) bool { return bytes.Compare(entries[i].Path, entries[j].Path) < 0 }
+	if !sort.SliceIsSorted(entries, less) {
+		// sorting the indices with the index as tie breaker keeps the order of
+		// equal paths faster than a stable sort of the entries
+		idx := make([]int, len(entries))
+		for i := range idx {
+			idx[i] = i
+		}
+		sort.Slice(idx, func(i, j int) bool {
+			c := bytes.Compare(entries[idx[i]].Path, entries[idx[j]].Path)
+			return c < 0 || c == 0 && idx[i] < idx[j]
+		})
+		sorted := make([]Entry, len(entries))
+		for i, k := range idx {
+			sorted[i] = entries[k]
+		}
+		entries = sorted
+	}
+	for _, e := range entries {
+		if err := n.checkEntrySize(e.Ref); err != nil {
+			return fmt.Errorf("entry on %q: %w", e.Path, err)
+		}
+		if err := n.checkMetadata(e.Metadata); err != nil {
+			return fmt.Errorf("entry on %q: %w", e.Path, err)
+		}
+		if err := checkBinaryMetadata(e.BinaryMetadata); err != nil {
+			return fmt.Errorf("entry on %q: %w", e.Path, err)
+		}
+		if n.refBytesSize == 0 && len(e.Ref) > 0 {
+			n.refBytesSize = len(e.Ref)
+		}
+	}
+	if err := n.buildSorted(entries, 0); err != nil {
+		return err
+	}
+	if n.configOrDefault().rejectConflicts {
+		for _, e := range entries {
+			if err := n.checkPathConflict(context.Background(), e.Path, len(e.Ref) > 0, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BuildFromSorted returns a new node holding entries like
+// Builder.BuildFromSorted with the default settings.
+func BuildFromSorted(entries []Entry) (*Node, error) {
+	return NewBuilder().BuildFromSorted(entries)
+}
+
+// buildSorted creates the forks of the node for entries sorted by path, which
+// share the first offset bytes of their paths with the node.
+func (n *Node) buildSorted(entries []Entry, offset int) error {
+	for len(entries) > 0 && len(entries[0].Path) == offset {
+		n.setValue(entries[0].Ref, entries[0].Metadata, false)
+		if len(entries[0].BinaryMetadata) > 0 {
+			n.setBinaryValue(entries[0].BinaryMetadata)
+		}
+		entries = entries[1:]
+	}
+	for len(entries) > 0 {
+		k := entries[0].Path[offset]
+		end := 1
+		for end < len(entries) && entries[end].Path[offset] == k {
+			end++
+		}
+		group := entries[:end]
+		entries = entries[end:]
+
+		// the common prefix of sorted paths is the one of the first and last
+		c := common(group[0].Path[offset:], group[len(group)-1].Path[offset:])
+		if c > nodePrefixMaxSize {
+			c = nodePrefixMaxSize
+		}
+		prefix := append([]byte{}, group[0].Path[offset:offset+c]...)
+		if err := n.checkForks(); err != nil {
+			return fmt.Errorf("entry on %q: %w", group[0].Path, err)
+		}
+		nn := n.newChild()
+		if err := nn.buildSorted(group, offset+c); err != nil {
+			return err
+		}
+		nn.updateIsWithPathSeparator(prefix)
+		n.forks[k] = &fork{prefix, nn}
+		n.makeEdge()
+	}
+	return nil
+}
+
+func (b *Builder) validate() error {
+	if b.obfuscationKey != nil && len(b.obfuscationKey) != nodeObfuscationKeySize {
+		return fmt.Errorf("%w: obfuscation key size %d, expected %d", ErrInvalidOptions, len(b.obfuscationKey), nodeObfuscationKeySize)
+	}
+	if b.obfuscationKey != nil && b.cfg.deterministicKeys {
+		return fmt.Errorf("%w: obfuscation key set with deterministic keys", ErrInvalidOptions)
+	}
+	if b.refSize < 0 || b.refSize > 255 {
+		return fmt.Errorf("%w: reference size %d", ErrInvalidOptions, b.refSize)
+	}
+	if b.cfg.maxDepth <= 0 {
+		return fmt.Errorf("%w: max depth %d", ErrInvalidOptions, b.cfg.maxDepth)
+	}
+	if b.cfg.maxForks < 0 {
+		return fmt.Errorf("%w: max forks %d", ErrInvalidOptions, b.cfg.maxForks)
+	}
+	if b.cfg.maxMetadata < 0 {
+		return fmt.Errorf("%w: max metadata size %d", ErrInvalidOptions, b.cfg.maxMetadata)
+	}
+	return nil
+}
+
+func (b *Builder) apply(n *Node) {
+	if b.obfuscationKey != nil {
+		// the size of the key is validated
+		n.obfuscationKey = append([]byte{}, b.obfuscationKey...)
+	}
+	n.refBytesSize = b.refSize
+	cfg := b.cfg
+	cfg.refSize = b.refSize
+	n.cfg = &cfg
+}
+
+// deterministicObfuscationKey derives the obfuscation key from the plain
+// serialised node following the key.
+func deterministicObfuscationKey(data []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	_, _ = h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,340 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ethersphere/manifest/mantaray"
+)
+
+func TestBuilder(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("obfuscation-key-and-ref-size", func(t *testing.T) {
+		key := bytes.Repeat([]byte{1}, 32)
+		n, err := mantaray.NewBuilder().WithObfuscationKey(key).WithRefSize(32).Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		err = n.Add(ctx, []byte("index.html"), make([]byte, 64), nil, nil)
+		if err == nil {
+			t.Fatal("expected error on entry of wrong size")
+		}
+		e := bytes.Repeat([]byte{2}, 32)
+		err = n.Add(ctx, []byte("index.html"), e, nil, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		ls := newMockLoadSaver()
+		err = n.Save(ctx, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		nn := mantaray.NewNodeRef(n.Reference())
+		got, err := nn.Lookup(ctx, []byte("index.html"), ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !bytes.Equal(got, e) {
+			t.Fatalf("expected entry %x, got %x", e, got)
+		}
+		if !bytes.Equal(nn.ObfuscationKey(), key) {
+			t.Fatalf("expected obfuscation key %x, got %x", key, nn.ObfuscationKey())
+		}
+	})
+
+	t.Run("separator", func(t *testing.T) {
+		n, err := mantaray.NewBuilder().WithSeparator('\\').Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		err = n.Add(ctx, []byte("img\\1.png"), make([]byte, 32), nil, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		ls := newMockLoadSaver()
+		err = n.Save(ctx, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		nn, err := mantaray.NewBuilder().WithSeparator('\\').BuildRef(n.Reference())
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		node, err := nn.LookupNode(ctx, []byte("img\\1.png"), ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !node.IsWithPathSeparatorType() {
+			t.Fatal("expected path separator node type")
+		}
+
+		var dirs []string
+		err = nn.Walk(ctx, []byte{}, ls, func(path []byte, isDir bool, err error) error {
+			if isDir {
+				dirs = append(dirs, string(path))
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(dirs) != 1 || dirs[0] != "img" {
+			t.Fatalf("expected directory img, got %v", dirs)
+		}
+	})
+
+	t.Run("max-metadata", func(t *testing.T) {
+		n, err := mantaray.NewBuilder().WithMaxMetadata(32).Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		err = n.Add(ctx, []byte("index.html"), make([]byte, 32), map[string]string{"a": "b"}, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		err = n.Add(ctx, []byte("robots.txt"), make([]byte, 32), map[string]string{"content-type": "text/plain; charset=utf-8"}, nil)
+		if !errors.Is(err, mantaray.ErrMetadataTooLarge) {
+			t.Fatalf("expected metadata too large error, got %v", err)
+		}
+	})
+
+	t.Run("deterministic-keys", func(t *testing.T) {
+		var refs [][]byte
+		for i := 0; i < 2; i++ {
+			n, err := mantaray.NewBuilder().WithDeterministicKeys().Build()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			for _, c := range []string{"index.html", "img/1.png", "img/2.png"} {
+				err = n.Add(ctx, []byte(c), append(make([]byte, 32-len(c)), c...), nil, nil)
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+			}
+			ls := newMockLoadSaver()
+			err = n.Save(ctx, ls)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			refs = append(refs, n.Reference())
+
+			nn := mantaray.NewNodeRef(n.Reference())
+			_, err = nn.Lookup(ctx, []byte("img/2.png"), ls)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if bytes.Equal(nn.ObfuscationKey(), make([]byte, 32)) {
+				t.Fatal("expected non-zero obfuscation key")
+			}
+			if !bytes.Equal(n.ObfuscationKey(), nn.ObfuscationKey()) {
+				t.Fatalf("expected obfuscation key %x of the saved node, got %x", nn.ObfuscationKey(), n.ObfuscationKey())
+			}
+		}
+		if !bytes.Equal(refs[0], refs[1]) {
+			t.Fatalf("expected equal references, got %x and %x", refs[0], refs[1])
+		}
+	})
+
+	t.Run("checksums", func(t *testing.T) {
+		n, err := mantaray.NewBuilder().WithChecksums().Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, c := range []string{"index.html", "img/1.png", "img/2.png"} {
+			err = n.Add(ctx, []byte(c), append(make([]byte, 32-len(c)), c...), nil, nil)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		ls := newMockLoadSaver()
+		err = n.Save(ctx, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		nn := mantaray.NewNodeRef(n.Reference())
+		_, err = nn.Lookup(ctx, []byte("img/2.png"), ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if v := nn.FormatVersion(); v != "mantaray:0.3" {
+			t.Fatalf("expected format version mantaray:0.3, got %s", v)
+		}
+
+		// flip a byte of the entry, leaving the reference unchanged
+		var a addr
+		copy(a[:], n.Reference())
+		ls.store[a][70] ^= 1
+		_, err = mantaray.NewNodeRef(n.Reference()).Lookup(ctx, []byte("img/2.png"), ls)
+		if !errors.Is(err, mantaray.ErrChecksumMismatch) {
+			t.Fatalf("expected checksum mismatch error, got %v", err)
+		}
+	})
+
+	t.Run("max-forks", func(t *testing.T) {
+		var entries []mantaray.Entry
+		for i := 0; i < 256; i++ {
+			entries = append(entries, mantaray.Entry{Path: []byte{'d', '/', byte(i)}, Ref: make([]byte, 32)})
+		}
+
+		// by default a node forks on every byte value
+		n := mantaray.New()
+		for _, e := range entries {
+			if err := n.Add(ctx, e.Path, e.Ref, nil, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		ls := newMockLoadSaver()
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, err := mantaray.NewNodeRef(n.Reference()).Lookup(ctx, []byte{'d', '/', 255}, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		b := mantaray.NewBuilder().WithMaxForks(16)
+		n, err := b.Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for i, e := range entries {
+			err := n.Add(ctx, e.Path, e.Ref, nil, nil)
+			if i < 16 && err != nil {
+				t.Fatalf("expected no error for entry %d, got %v", i, err)
+			}
+			if i >= 16 && !errors.Is(err, mantaray.ErrTooManyForks) {
+				t.Fatalf("expected too many forks error for entry %d, got %v", i, err)
+			}
+		}
+		// replacing values does not add forks
+		if err := n.Add(ctx, entries[0].Path, bytes.Repeat([]byte{1}, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, err := n.Lookup(ctx, entries[16].Path, nil); !errors.Is(err, mantaray.ErrNotFound) {
+			t.Fatalf("expected not found error, got %v", err)
+		}
+
+		if _, err := b.BuildFromSorted(entries); !errors.Is(err, mantaray.ErrTooManyForks) {
+			t.Fatalf("expected too many forks error, got %v", err)
+		}
+		if _, err := b.BuildFromSorted(entries[:16]); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, b := range []*mantaray.Builder{
+			mantaray.NewBuilder().WithObfuscationKey(make([]byte, 32)).WithDeterministicKeys(),
+			mantaray.NewBuilder().WithObfuscationKey(make([]byte, 16)),
+			mantaray.NewBuilder().WithRefSize(256),
+			mantaray.NewBuilder().WithMaxMetadata(-1),
+			mantaray.NewBuilder().WithMaxForks(-1),
+		} {
+			_, err := b.Build()
+			if !errors.Is(err, mantaray.ErrInvalidOptions) {
+				t.Fatalf("expected invalid options error, got %v", err)
+			}
+		}
+	})
+}
+
+func TestBuildFromSorted(t *testing.T) {
+	ctx := context.Background()
+	var entries []mantaray.Entry
+	for i := 0; i < 300; i++ {
+		p := fmt.Sprintf("dir%d/sub%d/file%d.txt", i%7, i%3, i)
+		if i%10 == 0 {
+			p = fmt.Sprintf("assets/%s/%d.js", strings.Repeat("x", 40+i%50), i)
+		}
+		var md map[string]string
+		if i%4 == 0 {
+			md = map[string]string{mantaray.MetadataContentType: "text/plain"}
+		}
+		entries = append(entries, mantaray.Entry{Path: []byte(p), Ref: append(make([]byte, 32-len(p)%32), p[len(p)-len(p)%32:]...), Metadata: md})
+	}
+	entries = append(entries,
+		mantaray.Entry{Path: []byte("a/b"), Ref: bytes.Repeat([]byte{1}, 32)},
+		mantaray.Entry{Path: []byte("a/b/c"), Ref: bytes.Repeat([]byte{2}, 32)},
+		mantaray.Entry{Path: []byte{}, Ref: bytes.Repeat([]byte{3}, 32), Metadata: map[string]string{mantaray.MetadataIndexDocument: "a/b"}},
+	)
+
+	b := mantaray.NewBuilder().WithDeterministicKeys()
+	added, err := b.Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	r := mrand.New(mrand.NewSource(1))
+	for _, i := range r.Perm(len(entries)) {
+		e := entries[i]
+		if err := added.Add(ctx, e.Path, e.Ref, e.Metadata, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	built, err := b.BuildFromSorted(entries)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(built, added) {
+		t.Fatalf("expected trie\n%s\ngot\n%s", added, built)
+	}
+
+	ls := newMockLoadSaver()
+	for _, n := range []*mantaray.Node{added, built} {
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if !bytes.Equal(built.Reference(), added.Reference()) {
+		t.Fatalf("expected reference %x, got %x", added.Reference(), built.Reference())
+	}
+
+	_, err = mantaray.BuildFromSorted([]mantaray.Entry{
+		{Path: []byte("a"), Ref: make([]byte, 32)},
+		{Path: []byte("b"), Ref: make([]byte, 64)},
+	})
+	if !errors.Is(err, mantaray.ErrInvalidReference) {
+		t.Fatalf("expected invalid reference error, got %v", err)
+	}
+}
+
+func BenchmarkBuildFromSorted(b *testing.B) {
+	ctx := context.Background()
+	var entries []mantaray.Entry
+	for i := 0; i < 10000; i++ {
+		p := fmt.Sprintf("site/dir%d/sub%d/file%d.html", i%50, i%7, i)
+		entries = append(entries, mantaray.Entry{Path: []byte(p), Ref: make([]byte, 32)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].Path, entries[j].Path) < 0 })
+
+	b.Run("add", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			n := mantaray.New()
+			for _, e := range entries {
+				if err := n.Add(ctx, e.Path, e.Ref, e.Metadata, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("sorted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := mantaray.BuildFromSorted(entries); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"context"
+	"sync"
+)
+
+// ConcurrentBuilder builds a trie from concurrent adds and commits
+// checkpoints of it while the adds continue. Each commit saves a snapshot of
+// the trie as it was when the commit started, so the returned reference is an
+// immutable checkpoint holding a consistent subset of the added entries.
+// The LoadSaver passed to its methods must be safe for concurrent use.
+type ConcurrentBuilder struct {
+	mtx sync.Mutex
+	n   *Node
+	gen uint64 // number of changes made to the trie
+}
+
+// NewConcurrentBuilder returns a ConcurrentBuilder adding entries to n. The
+// node must not be used directly while the builder is in use.
+func NewConcurrentBuilder(n *Node) *ConcurrentBuilder {
+	return &ConcurrentBuilder{n: n}
+}
+
+// Add adds an entry to the trie like Node.Add. It is safe for concurrent use
+// and does not wait for commits in progress.
+func (b *ConcurrentBuilder) Add(ctx context.Context, path, entry []byte, metadata map[string]string, ls LoadSaver) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.gen++
+	return b.n.Add(ctx, path, entry, metadata, ls)
+}
+
+// Remove removes the entry on path like Node.Remove. It is safe for
+// concurrent use and does not wait for commits in progress.
+func (b *ConcurrentBuilder) Remove(ctx context.Context, path []byte, ls LoadSaver) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.gen++
+	return b.n.Remove(ctx, path, ls)
+}
+
+// Commit saves a snapshot of the trie and returns its reference. Adding is
+// only blocked while the modified nodes are copied, not while they are
+// saved. If the trie was not changed meanwhile, the references of the saved
+// nodes are set on the trie, so that the next commit only copies and saves
+// the nodes changed after this one.
+func (b *ConcurrentBuilder) Commit(ctx context.Context, ls LoadSaver) ([]byte, error) {
+	if ls == nil {
+		return nil, ErrNoSaver
+	}
+	b.mtx.Lock()
+	snapshot := b.n.snapshot()
+	var copies []nodeCopy
+	b.n.pairCopies(snapshot, &copies)
+	gen := b.gen
+	b.mtx.Unlock()
+	if err := snapshot.save(ctx, ls, 0); err != nil {
+		return nil, err
+	}
+	b.mtx.Lock()
+	if b.gen == gen {
+		for _, c := range copies {
+			c.node.ref = c.copy.ref
+			c.node.base = c.copy.ref
+			c.node.obfuscationKey = append([]byte{}, c.copy.obfuscationKey...)
+		}
+	}
+	b.mtx.Unlock()
+	return append([]byte{}, snapshot.ref...), nil
+}
+
+// nodeCopy is an unsaved node of a trie and its copy in a snapshot.
+type nodeCopy struct {
+	node, copy *Node
+}
+
+// pairCopies collects the unsaved nodes of the trie with their copies in the
+// snapshot c, taken before it is saved.
+func (n *Node) pairCopies(c *Node, copies *[]nodeCopy) {
+	if n.ref != nil {
+		return
+	}
+	*copies = append(*copies, nodeCopy{node: n, copy: c})
+	for k, f := range n.forks {
+		f.Node.pairCopies(c.forks[k].Node, copies)
+	}
+}
+
+// snapshot returns a copy of the nodes of the trie modified since they were
+// loaded or saved. Persisted subtrees are copied as reference-only nodes, so
+// the copy shares no mutable state with the trie. These keep their type and
+// value, which are saved in the forks of their parents.
+func (n *Node) snapshot() *Node {
+	c := *n
+	c.audit = nil
+	c.obfuscationKey = append([]byte(nil), n.obfuscationKey...)
+	c.entry = append([]byte(nil), n.entry...)
+	if n.metadata != nil {
+		c.metadata = make(map[string]string, len(n.metadata))
+		for k, v := range n.metadata {
+			c.metadata[k] = v
+		}
+	}
+	if n.binaryMetadata != nil {
+		c.binaryMetadata = make(map[string][]byte, len(n.binaryMetadata))
+		for k, v := range n.binaryMetadata {
+			c.binaryMetadata[k] = append([]byte(nil), v...)
+		}
+	}
+	if n.ref != nil {
+		c.forks = nil
+		return &c
+	}
+	if n.forks != nil {
+		c.forks = make(map[byte]*fork, len(n.forks))
+		for k, f := range n.forks {
+			c.forks[k] = &fork{prefix: append([]byte(nil), f.prefix...), Node: f.Node.snapshot()}
+		}
+	}
+	return &c
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ethersphere/manifest/mantaray"
+)
+
+func TestConcurrentBuilder(t *testing.T) {
+	const (
+		workers = 4
+		entries = 50
+	)
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	b := mantaray.NewConcurrentBuilder(mantaray.New())
+
+	entry := func(w, i int) []byte {
+		e := make([]byte, 32)
+		copy(e, fmt.Sprintf("%d/%d", w, i))
+		return e
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mtx  sync.Mutex
+		refs [][]byte
+	)
+	done := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < entries; i++ {
+				path := []byte(fmt.Sprintf("w%d/%03d", w, i))
+				if err := b.Add(ctx, path, entry(w, i), nil, ls); err != nil {
+					t.Errorf("expected no error, got %v", err)
+					return
+				}
+			}
+		}()
+	}
+	commitDone := make(chan struct{})
+	go func() {
+		defer close(commitDone)
+		for {
+			ref, err := b.Commit(ctx, ls)
+			if err != nil {
+				t.Errorf("expected no error, got %v", err)
+				return
+			}
+			mtx.Lock()
+			refs = append(refs, ref)
+			mtx.Unlock()
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	<-commitDone
+
+	ref, err := b.Commit(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	refs = append(refs, ref)
+
+	for j, ref := range refs {
+		m, err := mantaray.NewNodeRef(ref).ToMap(ctx, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		// adds of a worker are sequential, so each commit holds a prefix of them
+		for w := 0; w < workers; w++ {
+			count := 0
+			for count < entries {
+				e, ok := m[fmt.Sprintf("w%d/%03d", w, count)]
+				if !ok {
+					break
+				}
+				if !bytes.Equal(e, entry(w, count)) {
+					t.Fatalf("expected entry %x, got %x", entry(w, count), e)
+				}
+				count++
+			}
+			for i := count; i < entries; i++ {
+				if _, ok := m[fmt.Sprintf("w%d/%03d", w, i)]; ok {
+					t.Fatalf("commit %d: entry %d of worker %d present without entry %d", j, i, w, count)
+				}
+			}
+		}
+		if j == len(refs)-1 && len(m) != workers*entries {
+			t.Fatalf("expected %d entries in the last commit, got %d", workers*entries, len(m))
+		}
+	}
+}
+
+// savesCounter counts the saves to the wrapped LoadSaver.
+type savesCounter struct {
+	*mockLoadSaver
+	mtx   sync.Mutex
+	saves int
+}
+
+func (s *savesCounter) Save(ctx context.Context, data []byte) ([]byte, error) {
+	s.mtx.Lock()
+	s.saves++
+	s.mtx.Unlock()
+	return s.mockLoadSaver.Save(ctx, data)
+}
+
+func TestConcurrentBuilderPersisted(t *testing.T) {
+	ctx := context.Background()
+	ls := &savesCounter{mockLoadSaver: newMockLoadSaver()}
+	n := mantaray.New()
+	md := map[string]string{mantaray.MetadataContentType: "text/html"}
+	if err := n.Add(ctx, []byte("a.html"), bytes.Repeat([]byte{1}, 32), md, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Add(ctx, []byte("b.html"), bytes.Repeat([]byte{2}, 32), nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// the values of the persisted nodes are kept in the forks of the copy
+	b := mantaray.NewConcurrentBuilder(mantaray.NewNodeRef(n.Reference()))
+	if err := b.Add(ctx, []byte("c.html"), bytes.Repeat([]byte{3}, 32), nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ref, err := b.Commit(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	m, err := mantaray.NewNodeRef(ref).ToMap(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(m) != 3 || !bytes.Equal(m["a.html"], bytes.Repeat([]byte{1}, 32)) {
+		t.Fatalf("expected 3 entries, got %v", m)
+	}
+	node, err := mantaray.NewNodeRef(ref).LookupNode(ctx, []byte("a.html"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !node.IsValueType() || node.Metadata()[mantaray.MetadataContentType] != "text/html" {
+		t.Fatalf("expected value with metadata %v, got value %v and %v", md, node.IsValueType(), node.Metadata())
+	}
+
+	// the saved references are set on the trie, so nothing is saved again
+	ls.saves = 0
+	again, err := b.Commit(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(again, ref) || ls.saves != 0 {
+		t.Fatalf("expected reference %x without saves, got %x after %d saves", ref, again, ls.saves)
+	}
+}
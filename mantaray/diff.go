@@ -0,0 +1,127 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChangeType is the kind of change of a value between two tries.
+type ChangeType int
+
+// Change types.
+const (
+	ChangeAdded ChangeType = iota + 1
+	ChangeRemoved
+	ChangeModified
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	}
+	return fmt.Sprintf("ChangeType(%d)", int(t))
+}
+
+// Change describes a value which differs between two tries.
+type Change struct {
+	Type ChangeType
+	Path []byte
+	Old  Entry // value in the old trie, zero for added values
+	New  Entry // value in the new trie, zero for removed values
+}
+
+// String formats the change as a line of a diff listing.
+func (c Change) String() string {
+	switch c.Type {
+	case ChangeAdded:
+		return fmt.Sprintf("+ %s", c.Path)
+	case ChangeRemoved:
+		return fmt.Sprintf("- %s", c.Path)
+	case ChangeModified:
+		return fmt.Sprintf("~ %s (%x -> %x)", c.Path, c.Old.Ref, c.New.Ref)
+	}
+	return fmt.Sprintf("? %s", c.Path)
+}
+
+// Diff returns the changes of values from the trie from to the trie to, in
+// byte order of their paths. A value is modified if its entry, metadata or
+// binary metadata differ.
+func Diff(ctx context.Context, from, to *Node, l Loader) ([]Change, error) {
+	oldEntries, err := collectEntries(ctx, from, l)
+	if err != nil {
+		return nil, err
+	}
+	newEntries, err := collectEntries(ctx, to, l)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	i, j := 0, 0
+	for i < len(oldEntries) || j < len(newEntries) {
+		var c int
+		switch {
+		case i == len(oldEntries):
+			c = 1
+		case j == len(newEntries):
+			c = -1
+		default:
+			c = bytes.Compare(oldEntries[i].Path, newEntries[j].Path)
+		}
+		switch {
+		case c < 0:
+			changes = append(changes, Change{Type: ChangeRemoved, Path: oldEntries[i].Path, Old: oldEntries[i]})
+			i++
+		case c > 0:
+			changes = append(changes, Change{Type: ChangeAdded, Path: newEntries[j].Path, New: newEntries[j]})
+			j++
+		default:
+			o, n := oldEntries[i], newEntries[j]
+			if !valueEqual(o, n) {
+				changes = append(changes, Change{Type: ChangeModified, Path: o.Path, Old: o, New: n})
+			}
+			i++
+			j++
+		}
+	}
+	return changes, nil
+}
+
+// collectEntries returns the values of the trie in byte order of their paths.
+func collectEntries(ctx context.Context, n *Node, l Loader) ([]Entry, error) {
+	var entries []Entry
+	err := walkValues(ctx, []byte{}, l, n, func(path []byte, n *Node) error {
+		entries = append(entries, n.valueEntry(path))
+		return nil
+	})
+	return entries, err
+}
+
+// FormatDiff renders changes as a listing sorted by path, one change per
+// line: "+ path" for added, "- path" for removed and
+// "~ path (old -> new)" for modified values.
+func FormatDiff(changes []Change) string {
+	sorted := make([]Change, len(changes))
+	copy(sorted, changes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Path, sorted[j].Path) < 0
+	})
+	var b strings.Builder
+	for _, c := range sorted {
+		b.WriteString(c.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
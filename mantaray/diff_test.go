@@ -0,0 +1,254 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+const testFormatDiff = `- img/1.png
+~ img/2.png (0000000000000000000000000000000000000000000000000000000000000002 -> 0000000000000000000000000000000000000000000000000000000000000003)
++ img/3.png
+~ index.html (0000000000000000000000000000000000000000000000000000000000000001 -> 0000000000000000000000000000000000000000000000000000000000000001)
+`
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	ref := func(b byte) []byte {
+		r := make([]byte, 32)
+		r[31] = b
+		return r
+	}
+
+	old := New()
+	next := New()
+	for _, e := range []struct {
+		node     *Node
+		path     string
+		ref      []byte
+		metadata map[string]string
+	}{
+		{old, "index.html", ref(1), nil},
+		{old, "img/1.png", ref(1), nil},
+		{old, "img/2.png", ref(2), nil},
+		{old, "robots.txt", ref(4), nil},
+		{next, "index.html", ref(1), map[string]string{"content-type": "text/html"}},
+		{next, "img/2.png", ref(3), nil},
+		{next, "img/3.png", ref(3), nil},
+		{next, "robots.txt", ref(4), nil},
+	} {
+		err := e.node.Add(ctx, []byte(e.path), e.ref, e.metadata, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	changes, err := Diff(ctx, old, next, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := []ChangeType{ChangeRemoved, ChangeModified, ChangeAdded, ChangeModified}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %v", len(expected), changes)
+	}
+	for i, c := range changes {
+		if c.Type != expected[i] {
+			t.Fatalf("expected %s change on %s, got %s", expected[i], c.Path, c.Type)
+		}
+	}
+
+	// reversed order must not change the listing
+	for i, j := 0, len(changes)-1; i < j; i, j = i+1, j-1 {
+		changes[i], changes[j] = changes[j], changes[i]
+	}
+	if got := FormatDiff(changes); got != testFormatDiff {
+		t.Fatalf("expected diff\n%s\ngot\n%s", testFormatDiff, got)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	ctx := context.Background()
+	ref := func(b byte) []byte {
+		r := make([]byte, 32)
+		r[31] = b
+		return r
+	}
+	b := NewBuilder().WithDeterministicKeys()
+	old, err := b.Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	next, err := b.Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, e := range []struct {
+		node     *Node
+		path     string
+		ref      []byte
+		metadata map[string]string
+	}{
+		{old, "", ref(9), map[string]string{MetadataIndexDocument: "index.html"}},
+		{old, "index.html", ref(1), map[string]string{"content-type": "text/html"}},
+		{old, "img/1.png", ref(1), nil},
+		{old, "img/2.png", ref(2), nil},
+		{old, "docs/", nil, map[string]string{MetadataIndexDocument: "readme.md"}},
+		{old, "docs/readme.md", ref(5), nil},
+		{old, "robots.txt", ref(4), nil},
+		{next, "", ref(9), map[string]string{MetadataIndexDocument: "home.html"}},
+		{next, "index.html", ref(1), nil},
+		{next, "img/2.png", ref(3), nil},
+		{next, "img/3.png", ref(3), nil},
+		{next, "img/sub/4.png", ref(4), map[string]string{"content-type": "image/png"}},
+		{next, "docs/readme.md", ref(5), nil},
+		{next, "robots.txt", ref(4), nil},
+	} {
+		err := e.node.Add(ctx, []byte(e.path), e.ref, e.metadata, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	for _, n := range []*Node{old, next} {
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	changes, err := Diff(ctx, old, next, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	patch, err := EncodePatch(changes)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	base, err := b.BuildRef(old.Reference())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	patched, err := ApplyPatch(ctx, base, patch, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if base.ref == nil {
+		t.Fatal("expected base to be left unchanged")
+	}
+	rest, err := Diff(ctx, patched, next, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("expected no changes to the target, got %v", rest)
+	}
+	if err := patched.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(patched.Reference(), next.Reference()) {
+		t.Fatalf("expected reference %x, got %x", next.Reference(), patched.Reference())
+	}
+
+	// a modified base keeps the values of its persisted nodes in the patch
+	dirty, err := b.BuildRef(old.Reference())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := dirty.Add(ctx, []byte("robots.txt"), ref(4), nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	patched, err = ApplyPatch(ctx, dirty, patch, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := patched.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(patched.Reference(), next.Reference()) {
+		t.Fatalf("expected reference %x, got %x", next.Reference(), patched.Reference())
+	}
+
+	if patch[0] != patchVersion {
+		t.Fatalf("expected patch version %d without binary metadata, got %d", patchVersion, patch[0])
+	}
+	for _, invalid := range [][]byte{nil, {3}, patch[:len(patch)-1], append(patch[:len(patch):len(patch)], 0)} {
+		if _, err := DecodePatch(invalid); !errors.Is(err, ErrInvalidPatch) {
+			t.Fatalf("expected invalid patch error for %x, got %v", invalid, err)
+		}
+	}
+	_, err = ApplyPatch(ctx, New(), patch, ls)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestPatchBinaryMetadata(t *testing.T) {
+	ctx := context.Background()
+	ref := make([]byte, 32)
+	b := NewBuilder().WithDeterministicKeys()
+	ls := mapLoadSaver{}
+	build := func(binary map[string][]byte) *Node {
+		n, err := b.Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, p := range []string{"index.html", "robots.txt"} {
+			if err := n.Add(ctx, []byte(p), ref, nil, ls); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		if binary != nil {
+			if err := n.SetBinaryMetadata(ctx, []byte("robots.txt"), binary, ls); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		n, err = b.BuildRef(n.Reference())
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return n
+	}
+	old := build(nil)
+	next := build(map[string][]byte{"hash": {0, 1, 2}})
+
+	// a change of binary metadata alone modifies the value
+	changes, err := Diff(ctx, old, next, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(changes) != 1 || changes[0].Type != ChangeModified || string(changes[0].Path) != "robots.txt" {
+		t.Fatalf("expected modified robots.txt, got %v", changes)
+	}
+
+	patch, err := EncodePatch(changes)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if patch[0] != patchVersionBinaryMetadata {
+		t.Fatalf("expected patch version %d, got %d", patchVersionBinaryMetadata, patch[0])
+	}
+	decoded, err := DecodePatch(patch)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !valueEqual(decoded[0].New, changes[0].New) {
+		t.Fatalf("expected decoded value %v, got %v", changes[0].New, decoded[0].New)
+	}
+	patched, err := ApplyPatch(ctx, old, patch, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := patched.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(patched.Reference(), next.Reference()) {
+		t.Fatalf("expected reference %x, got %x", next.Reference(), patched.Reference())
+	}
+}
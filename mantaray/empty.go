@@ -0,0 +1,38 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"encoding/hex"
+)
+
+// EmptyManifestReferenceHex is the reference of the empty manifest in hex: a
+// new node saved with deterministic keys as a Swarm chunk, also after
+// removing all of its entries. Empty manifests saved with random keys or a
+// reference size set with WithRefSize are stored under other references.
+const EmptyManifestReferenceHex = "2665f377f14197aa9c9ffda81126973ec2aefbb2e07c1d7e96d57e239f7bf131"
+
+// emptyManifestReference is EmptyManifestReferenceHex decoded.
+var emptyManifestReference = mustDecodeHex(EmptyManifestReferenceHex)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// EmptyManifestReference returns a copy of the reference of the empty
+// manifest.
+func EmptyManifestReference() []byte {
+	return append([]byte{}, emptyManifestReference...)
+}
+
+// IsEmpty returns true if root is the reference of the empty manifest.
+func IsEmpty(root []byte) bool {
+	return bytes.Equal(root, emptyManifestReference)
+}
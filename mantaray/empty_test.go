@@ -0,0 +1,182 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// chunkSegmentSize is the size of the segments hashed by the chunk hash.
+const chunkSegmentSize = 32
+
+// chunkLoadSaver stores nodes under their Swarm chunk addresses.
+type chunkLoadSaver struct {
+	mapLoadSaver
+}
+
+func (c chunkLoadSaver) Save(_ context.Context, b []byte) ([]byte, error) {
+	ref := chunkAddress(b)
+	mapLoadSaverMtx.Lock()
+	defer mapLoadSaverMtx.Unlock()
+	c.mapLoadSaver[string(ref)] = b
+	return ref, nil
+}
+
+// emptyManifestData returns the serialised node without entries with a
+// deterministic key.
+func emptyManifestData() []byte {
+	n, err := NewBuilder().WithDeterministicKeys().Build()
+	if err != nil {
+		panic(err)
+	}
+	b, err := n.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// chunkAddress returns the address of data stored as a single Swarm chunk,
+// the Keccak-256 hash of the little endian data length followed by the root
+// of the binary Merkle tree over the zero padded data. The data must not be
+// longer than a chunk.
+func chunkAddress(data []byte) []byte {
+	level := make([]byte, ChunkSize)
+	copy(level, data)
+	for len(level) > chunkSegmentSize {
+		next := make([]byte, 0, len(level)/2)
+		for i := 0; i < len(level); i += 2 * chunkSegmentSize {
+			next = append(next, keccak256(level[i:i+2*chunkSegmentSize])...)
+		}
+		level = next
+	}
+	span := make([]byte, 8)
+	binary.LittleEndian.PutUint64(span, uint64(len(data)))
+	return keccak256(span, level)
+}
+
+func keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		_, _ = h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func TestEmptyManifestReference(t *testing.T) {
+	ctx := context.Background()
+	ls := chunkLoadSaver{mapLoadSaver{}}
+	n, err := NewBuilder().WithDeterministicKeys().Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(n.Reference(), EmptyManifestReference()) {
+		t.Fatalf("expected reference %x, got %x", EmptyManifestReference(), n.Reference())
+	}
+	// the constant follows the serialisation of the empty node
+	if ref := chunkAddress(emptyManifestData()); !bytes.Equal(ref, EmptyManifestReference()) {
+		t.Fatalf("expected reference %x, got %x", ref, EmptyManifestReference())
+	}
+	if !IsEmpty(n.Reference()) {
+		t.Fatalf("expected %x to be empty", n.Reference())
+	}
+	paths, err := NewNodeRef(EmptyManifestReference()).ToMap(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(paths) != 0 {
+		t.Fatalf("expected no entries, got %v", paths)
+	}
+
+	if err := n.Add(ctx, []byte("index.html"), make([]byte, 32), nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if IsEmpty(n.Reference()) || IsEmpty(nil) {
+		t.Fatal("expected references not to be empty")
+	}
+	ref := EmptyManifestReference()
+	ref[0]++
+	if !IsEmpty(EmptyManifestReference()) {
+		t.Fatal("expected the empty manifest reference to be a copy")
+	}
+}
+
+func TestRemoveLastEntry(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	if err := n.Add(ctx, []byte("index.html"), make([]byte, 32), map[string]string{"a": "b"}, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Remove(ctx, []byte("index.html"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(n, New()) {
+		t.Fatalf("expected node equal to a new one, got %+v", n)
+	}
+	// an entry of another reference size can be added again
+	if err := n.Add(ctx, []byte("index.html"), make([]byte, 64), nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// a persisted trie emptied after loading is saved as the empty manifest
+	ls := chunkLoadSaver{mapLoadSaver{}}
+	b := NewBuilder().WithDeterministicKeys()
+	n, err := b.Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, p := range []string{"index.html", "img/1.png"} {
+		if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n, err = b.BuildRef(n.Reference()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, p := range []string{"index.html", "img/1.png"} {
+		if err := n.Remove(ctx, []byte(p), ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if n.IsEdgeType() || n.refBytesSize != 0 {
+		t.Fatalf("expected empty root, got type %d and reference size %d", n.nodeType, n.refBytesSize)
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !IsEmpty(n.Reference()) {
+		t.Fatalf("expected empty manifest reference, got %x", n.Reference())
+	}
+
+	// a configured reference size is kept
+	n, err = NewBuilder().WithRefSize(64).Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Add(ctx, []byte("a"), make([]byte, 64), nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Remove(ctx, []byte("a"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n.refBytesSize != 64 {
+		t.Fatalf("expected reference size 64, got %d", n.refBytesSize)
+	}
+}
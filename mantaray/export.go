@@ -0,0 +1,96 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+)
+
+// ToMap returns the entries of the trie keyed by their full paths. Nodes are
+// loaded as needed.
+func (n *Node) ToMap(ctx context.Context, l Loader) (map[string][]byte, error) {
+	m := make(map[string][]byte)
+	err := walkValues(ctx, []byte{}, l, n, func(path []byte, n *Node) error {
+		m[string(path)] = append([]byte{}, n.entry...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ToHexMap returns the entries of the trie like ToMap, hex encoded as the
+// references of the simple manifest.
+func (n *Node) ToHexMap(ctx context.Context, l Loader) (map[string]string, error) {
+	m := make(map[string]string)
+	err := walkValues(ctx, []byte{}, l, n, func(path []byte, n *Node) error {
+		m[string(path)] = hex.EncodeToString(n.entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IndexEntry is an entry of the trie as listed by Index.
+type IndexEntry struct {
+	// Path is the full path of the entry.
+	Path []byte
+	// Depth is the number of directories leading to the entry, 0 for entries
+	// in the root directory.
+	Depth int
+	// Parent is the path of the directory holding the entry, with its
+	// trailing separator, or empty for entries in the root directory.
+	Parent []byte
+	// Reference is the reference of the entry, the zero Reference for
+	// explicit directory entries.
+	Reference Reference
+	// Metadata is the metadata of the entry.
+	Metadata map[string]string
+}
+
+// Index returns the entries of the trie in byte order of their paths, along
+// with their directories, for building search indexes over a manifest. The
+// directories are taken from the separators of the full paths, so that they
+// do not depend on how the paths are split into nodes. The trailing
+// separator of an explicit directory entry does not count as a directory of
+// its own.
+func (n *Node) Index(ctx context.Context, l Loader) ([]IndexEntry, error) {
+	separator := n.configOrDefault().separator
+	var entries []IndexEntry
+	err := walkValues(ctx, []byte{}, l, n, func(path []byte, node *Node) error {
+		e := IndexEntry{Path: append([]byte{}, path...), Parent: []byte{}}
+		if node.metadata != nil {
+			e.Metadata = make(map[string]string, len(node.metadata))
+			for k, v := range node.metadata {
+				e.Metadata[k] = v
+			}
+		}
+		name := path
+		if node.IsDirectoryType() {
+			name = bytes.TrimSuffix(path, []byte{separator})
+		} else {
+			ref, err := node.reference(path)
+			if err != nil {
+				return err
+			}
+			e.Reference = ref
+		}
+		if i := bytes.LastIndexByte(name, separator); i >= 0 {
+			e.Parent = append(e.Parent, name[:i+1]...)
+			e.Depth = bytes.Count(e.Parent, []byte{separator})
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestToMap(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		toAdd []string
+	}{
+		{
+			name:  "nested-prefix-is-not-collapsed",
+			toAdd: []string{"index.html", "img/1.png", "img/2/test1.png", "img/2/test2.png", "robots.txt"},
+		},
+		{
+			name: "long-paths",
+			toAdd: []string{
+				"assets/" + string(bytes.Repeat([]byte("a"), 70)) + "/1.js",
+				"assets/" + string(bytes.Repeat([]byte("a"), 70)) + "/2.js",
+				"assets/" + string(bytes.Repeat([]byte("b"), 40)),
+			},
+		},
+		{
+			name:  "spa-website",
+			toAdd: []string{"css/", "css/app.css", "favicon.ico", "img/", "img/logo.png", "index.html", "js/app.js.map", "js/app.js"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			n := New()
+			exp := make(map[string][]byte)
+			expHex := make(map[string]string)
+			for _, p := range tc.toAdd {
+				e := make([]byte, 32)
+				copy(e, p)
+				if err := n.Add(ctx, []byte(p), e, nil, nil); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				exp[p] = e
+				expHex[p] = hex.EncodeToString(e)
+			}
+
+			ls := mapLoadSaver{}
+			if err := n.Save(ctx, ls); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			m, err := NewNodeRef(n.Reference()).ToMap(ctx, ls)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(m, exp) {
+				t.Fatalf("expected map %v, got %v", exp, m)
+			}
+			hm, err := NewNodeRef(n.Reference()).ToHexMap(ctx, ls)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(hm, expHex) {
+				t.Fatalf("expected map %v, got %v", expHex, hm)
+			}
+		})
+	}
+}
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	ref := func(p string) []byte {
+		e := make([]byte, 32)
+		copy(e, p)
+		return e
+	}
+	md := map[string]string{MetadataContentType: "image/png"}
+	// "img" prefixes both a directory and a file, and "img/2/test" is a
+	// single prefix spanning a directory
+	for _, p := range []string{"index.html", "img/1.png", "img/2/test1.png", "img/2/test2.png", "img2.png"} {
+		if err := n.Add(ctx, []byte(p), ref(p), md, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Add(ctx, []byte("img/2/"), nil, nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.AddInline(ctx, []byte("robots.txt"), []byte("User-agent: *"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	entries, err := NewNodeRef(n.Reference()).Index(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	content := func(p string) Reference { return Reference{Kind: ReferenceContent, Bytes: ref(p)} }
+	for i, exp := range []struct {
+		path   string
+		depth  int
+		parent string
+		ref    Reference
+	}{
+		{path: "img/1.png", depth: 1, parent: "img/", ref: content("img/1.png")},
+		{path: "img/2/", depth: 1, parent: "img/"},
+		{path: "img/2/test1.png", depth: 2, parent: "img/2/", ref: content("img/2/test1.png")},
+		{path: "img/2/test2.png", depth: 2, parent: "img/2/", ref: content("img/2/test2.png")},
+		{path: "img2.png", depth: 0, parent: "", ref: content("img2.png")},
+		{path: "index.html", depth: 0, parent: "", ref: content("index.html")},
+		{path: "robots.txt", depth: 0, parent: "", ref: Reference{Kind: ReferenceInline, Bytes: []byte("User-agent: *")}},
+	} {
+		if i >= len(entries) {
+			t.Fatalf("expected %s on index %d, got %d entries", exp.path, i, len(entries))
+		}
+		e := entries[i]
+		if string(e.Path) != exp.path || e.Depth != exp.depth || string(e.Parent) != exp.parent {
+			t.Fatalf("expected %s of depth %d in %q, got %s of depth %d in %q", exp.path, exp.depth, exp.parent, e.Path, e.Depth, e.Parent)
+		}
+		if e.Reference.Kind != exp.ref.Kind || !bytes.Equal(e.Reference.Bytes, exp.ref.Bytes) {
+			t.Fatalf("expected reference %s %x for %s, got %s %x", exp.ref.Kind, exp.ref.Bytes, exp.path, e.Reference.Kind, e.Reference.Bytes)
+		}
+		if exp.ref.Kind == ReferenceContent && !reflect.DeepEqual(e.Metadata, md) {
+			t.Fatalf("expected metadata %v for %s, got %v", md, exp.path, e.Metadata)
+		}
+	}
+	if len(entries) != 7 {
+		t.Fatalf("expected 7 entries, got %d", len(entries))
+	}
+}
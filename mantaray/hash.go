@@ -0,0 +1,51 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"context"
+	"sort"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// SubtreeHash returns the Keccak-256 hash of the canonical contents of the
+// subtree under prefix: the paths relative to prefix in byte order, together
+// with their entries and metadata. The hash does not depend on obfuscation
+// keys, node references or on how the subtree is split into nodes, so equal
+// subtrees have equal hashes regardless of where they are stored.
+func (n *Node) SubtreeHash(ctx context.Context, prefix []byte, l Loader) ([]byte, error) {
+	node, rest, err := n.lookupPrefix(ctx, prefix, l)
+	if err != nil {
+		return nil, err
+	}
+	hasher := sha3.NewLegacyKeccak256()
+	var b []byte
+	err = walkValues(ctx, rest, l, node, func(path []byte, n *Node) error {
+		b = appendUvarint(b[:0], uint64(len(path)))
+		b = append(b, path...)
+		b = appendUvarint(b, uint64(len(n.entry)))
+		b = append(b, n.entry...)
+
+		keys := make([]string, 0, len(n.metadata))
+		for k := range n.metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendUvarint(b, uint64(len(keys)))
+		for _, k := range keys {
+			b = appendUvarint(b, uint64(len(k)))
+			b = append(b, k...)
+			b = appendUvarint(b, uint64(len(n.metadata[k])))
+			b = append(b, n.metadata[k]...)
+		}
+		_, err := hasher.Write(b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
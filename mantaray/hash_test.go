@@ -0,0 +1,74 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ethersphere/manifest/mantaray"
+)
+
+func TestSubtreeHash(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+
+	build := func(t *testing.T, paths []string, metadata map[string]string) *mantaray.Node {
+		t.Helper()
+		n := mantaray.New()
+		for _, p := range paths {
+			var e [32]byte
+			copy(e[:], p)
+			if err := n.Add(ctx, []byte(p), e[:], metadata, ls); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		return n
+	}
+
+	a := build(t, []string{"img/1.png", "img/2.png", "index.html"}, nil)
+	if err := a.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	a = mantaray.NewNodeRef(a.Reference())
+
+	// same subtree added in a different order next to a path splitting it
+	// into different nodes
+	b := build(t, []string{"imgs.txt", "img/2.png", "img/1.png"}, nil)
+
+	hashA, err := a.SubtreeHash(ctx, []byte("img/"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	hashB, err := b.SubtreeHash(ctx, []byte("img/"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(hashA, hashB) {
+		t.Fatalf("expected equal subtree hashes, got %x and %x", hashA, hashB)
+	}
+
+	rootA, err := a.SubtreeHash(ctx, nil, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	rootB, err := b.SubtreeHash(ctx, nil, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if bytes.Equal(rootA, rootB) {
+		t.Fatalf("expected different root hashes, got %x", rootA)
+	}
+
+	c := build(t, []string{"img/1.png", "img/2.png"}, map[string]string{"content-type": "image/png"})
+	hashC, err := c.SubtreeHash(ctx, []byte("img/"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if bytes.Equal(hashA, hashC) {
+		t.Fatalf("expected different subtree hashes for different metadata, got %x", hashA)
+	}
+}
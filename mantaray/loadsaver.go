@@ -0,0 +1,144 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// DiscardSaver is a Saver returning the Keccak-256 hash of the data as its
+// reference without storing it, for dry runs.
+var DiscardSaver Saver = discardSaver{}
+
+type discardSaver struct{}
+
+func (discardSaver) Save(_ context.Context, data []byte) ([]byte, error) {
+	h := sha3.NewLegacyKeccak256()
+	_, _ = h.Write(data)
+	return h.Sum(nil), nil
+}
+
+// CountingSaver is a Saver counting the saves and saved bytes of the
+// wrapped Saver. It is safe for concurrent use.
+type CountingSaver struct {
+	bytes int64 // accessed atomically, first for alignment
+	calls int64 // accessed atomically
+	s     Saver
+}
+
+// NewCountingSaver returns a CountingSaver wrapping s.
+func NewCountingSaver(s Saver) *CountingSaver {
+	return &CountingSaver{s: s}
+}
+
+// Save saves data with the wrapped Saver, counting successful saves.
+func (c *CountingSaver) Save(ctx context.Context, data []byte) ([]byte, error) {
+	ref, err := c.s.Save(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.calls, 1)
+	atomic.AddInt64(&c.bytes, int64(len(data)))
+	return ref, nil
+}
+
+// Calls returns the number of successful saves.
+func (c *CountingSaver) Calls() int {
+	return int(atomic.LoadInt64(&c.calls))
+}
+
+// Bytes returns the number of bytes saved.
+func (c *CountingSaver) Bytes() int {
+	return int(atomic.LoadInt64(&c.bytes))
+}
+
+// ErrBudgetExceeded is returned by BudgetLoader once its budget is used up.
+var ErrBudgetExceeded = errors.New("load budget exceeded")
+
+// BudgetLoader is a Loader limiting the number of nodes loaded with the
+// wrapped Loader, protecting the resolution of untrusted manifests against
+// tries crafted to load an unbounded number of nodes. Walks, lookups and
+// checks given a BudgetLoader abort with ErrBudgetExceeded once the budget is
+// used up. It is safe for concurrent use, so the budget is shared by the
+// goroutines of asynchronous walks.
+type BudgetLoader struct {
+	loads int64 // accessed atomically, first for alignment
+	max   int64
+	l     Loader
+}
+
+// NewBudgetLoader returns a BudgetLoader allowing at most max loads with l.
+func NewBudgetLoader(l Loader, max int) *BudgetLoader {
+	return &BudgetLoader{max: int64(max), l: l}
+}
+
+// Load loads the node with the wrapped Loader if the budget allows it.
+func (b *BudgetLoader) Load(ctx context.Context, ref []byte) ([]byte, error) {
+	if atomic.AddInt64(&b.loads, 1) > b.max {
+		return nil, fmt.Errorf("%w: %d nodes", ErrBudgetExceeded, b.max)
+	}
+	return b.l.Load(ctx, ref)
+}
+
+// Loads returns the number of loads attempted, including rejected ones.
+func (b *BudgetLoader) Loads() int {
+	return int(atomic.LoadInt64(&b.loads))
+}
+
+// NewReadThroughLoadSaver returns a LoadSaver caching the nodes of a slow
+// store, such as the network, in a fast local one. Nodes are loaded from fast
+// if it has them, and otherwise from slow and saved into fast, so that later
+// loads of the same node do not reach slow. Both stores must address nodes
+// the same way, as fast must store a node under the reference it was loaded
+// with from slow. Failing to cache a node does not fail the load. Nodes are
+// saved to fast only.
+func NewReadThroughLoadSaver(fast LoadSaver, slow Loader) LoadSaver {
+	return &readThroughLoadSaver{fast: fast, slow: slow}
+}
+
+// NewWriteThroughLoadSaver returns a LoadSaver caching like
+// NewReadThroughLoadSaver which saves nodes to both stores.
+func NewWriteThroughLoadSaver(fast, slow LoadSaver) LoadSaver {
+	return &readThroughLoadSaver{fast: fast, slow: slow, slowSaver: slow}
+}
+
+type readThroughLoadSaver struct {
+	fast      LoadSaver
+	slow      Loader
+	slowSaver Saver // nil if saving to fast only
+}
+
+func (r *readThroughLoadSaver) Load(ctx context.Context, ref []byte) ([]byte, error) {
+	if data, err := r.fast.Load(ctx, ref); err == nil {
+		return data, nil
+	}
+	data, err := r.slow.Load(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = r.fast.Save(ctx, data)
+	return data, nil
+}
+
+func (r *readThroughLoadSaver) Save(ctx context.Context, data []byte) ([]byte, error) {
+	ref, err := r.fast.Save(ctx, data)
+	if err != nil || r.slowSaver == nil {
+		return ref, err
+	}
+	slowRef, err := r.slowSaver.Save(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(ref, slowRef) {
+		return nil, fmt.Errorf("%w: saved as %x and %x", ErrInvalidReference, ref, slowRef)
+	}
+	return ref, nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDiscardAndCountingSaver(t *testing.T) {
+	ctx := context.Background()
+	build := func() *Node {
+		n := New()
+		n.SetObfuscationKey(ZeroObfuscationKey)
+		for _, p := range []string{"index.html", "img/1.png", "img/2.png", "robots.txt"} {
+			err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, nil)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		return n
+	}
+
+	// dry run
+	n := build()
+	s := NewCountingSaver(DiscardSaver)
+	err := n.Save(ctx, s)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	stats, err := build().Stats(ctx, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if s.Calls() != stats.Nodes {
+		t.Fatalf("expected %d saves, got %d", stats.Nodes, s.Calls())
+	}
+	if s.Bytes() == 0 {
+		t.Fatal("expected saved bytes")
+	}
+
+	// the same references as when storing
+	ls := mapLoadSaver{}
+	stored := NewCountingSaver(ls)
+	m := build()
+	err = m.Save(ctx, stored)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(m.Reference(), n.Reference()) {
+		t.Fatalf("expected reference %x, got %x", n.Reference(), m.Reference())
+	}
+	if stored.Calls() != s.Calls() || stored.Bytes() != s.Bytes() || len(ls) != s.Calls() {
+		t.Fatalf("expected %d saves of %d bytes, got %d of %d", s.Calls(), s.Bytes(), stored.Calls(), stored.Bytes())
+	}
+
+	// saving again writes nothing
+	err = m.Save(ctx, stored)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if stored.Calls() != s.Calls() {
+		t.Fatalf("expected no more saves, got %d", stored.Calls()-s.Calls())
+	}
+}
+
+func TestBudgetLoader(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 20; j++ {
+			p := []byte(fmt.Sprintf("dir%d/sub%d/file%d", i, j, j))
+			if err := n.Add(ctx, p, make([]byte, 32), nil, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	const budget = 25
+
+	for _, tc := range []struct {
+		name string
+		run  func(n *Node, l Loader) error
+	}{
+		{
+			name: "walk",
+			run: func(n *Node, l Loader) error {
+				return n.Walk(ctx, []byte{}, l, func(_ []byte, _ bool, err error) error { return err })
+			},
+		},
+		{
+			name: "walk-async",
+			run: func(n *Node, l Loader) error {
+				return n.WalkNodeAsync(ctx, []byte{}, l, false, func(_ []byte, _ *Node, err error) error { return err })
+			},
+		},
+		{
+			name: "check-ref-sizes",
+			run: func(n *Node, l Loader) error {
+				return n.CheckRefSizes(ctx, l)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewBudgetLoader(ls, budget)
+			err := tc.run(NewNodeRef(n.Reference()), l)
+			if !errors.Is(err, ErrBudgetExceeded) {
+				t.Fatalf("expected budget exceeded error, got %v", err)
+			}
+
+			// the whole trie fits a large enough budget
+			l = NewBudgetLoader(ls, len(ls))
+			if err := tc.run(NewNodeRef(n.Reference()), l); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if l.Loads() != len(ls) {
+				t.Fatalf("expected %d loads, got %d", len(ls), l.Loads())
+			}
+		})
+	}
+}
+
+// loadCounter counts the loads of the wrapped loader.
+type loadCounter struct {
+	l     Loader
+	loads int
+}
+
+func (c *loadCounter) Load(ctx context.Context, ref []byte) ([]byte, error) {
+	c.loads++
+	return c.l.Load(ctx, ref)
+}
+
+func TestReadThroughLoadSaver(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, p := range []string{"index.html", "img/1.png", "img/2.png", "robots.txt"} {
+		err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	remote := mapLoadSaver{}
+	if err := n.Save(ctx, remote); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	slow := &loadCounter{l: remote}
+	fast := mapLoadSaver{}
+	ls := NewReadThroughLoadSaver(fast, slow)
+	path := []byte("img/2.png")
+	for i := 0; i < 2; i++ {
+		e, err := NewNodeRef(n.Reference()).Lookup(ctx, path, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !bytes.Equal(e, append(make([]byte, 32-len(path)), path...)) {
+			t.Fatalf("expected entry of %s, got %x", path, e)
+		}
+		if i == 0 && slow.loads == 0 {
+			t.Fatal("expected loads from the slow store")
+		}
+	}
+	// the second lookup was served by the fast store
+	if slow.loads != len(fast) {
+		t.Fatalf("expected %d slow loads, got %d", len(fast), slow.loads)
+	}
+
+	// saves go to the fast store only
+	m := New()
+	if err := m.Add(ctx, []byte("new.html"), make([]byte, 32), nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := m.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := fast.Load(ctx, m.Reference()); err != nil {
+		t.Fatalf("expected node in fast store, got %v", err)
+	}
+	if _, err := remote.Load(ctx, m.Reference()); err == nil {
+		t.Fatal("expected node not to be saved to the slow store")
+	}
+
+	// unless saving through
+	m = New()
+	if err := m.Add(ctx, []byte("other.html"), make([]byte, 32), nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := m.Save(ctx, NewWriteThroughLoadSaver(fast, remote)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for name, s := range map[string]mapLoadSaver{"fast": fast, "slow": remote} {
+		if _, err := s.Load(ctx, m.Reference()); err != nil {
+			t.Fatalf("expected node in %s store, got %v", name, err)
+		}
+	}
+}
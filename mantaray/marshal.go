@@ -9,9 +9,11 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"math/bits"
+	"sort"
 )
 
 const (
@@ -23,6 +25,9 @@ const (
 	versionNameString   = "mantaray"
 	versionCode01String = "0.1"
 	versionCode02String = "0.2"
+	versionCode03String = "0.3"
+	versionCode04String = "0.4"
+	versionCode05String = "0.5"
 
 	versionSeparatorString = ":"
 
@@ -31,6 +36,15 @@ const (
 
 	version02String     = versionNameString + versionSeparatorString + versionCode02String   // "mantaray:0.2"
 	version02HashString = "5768b3b6a7db56d21d1abff40d41cebfc83448fed8d7e9b06ec0d3b073f28f7b" // pre-calculated version string, Keccak-256
+
+	version03String     = versionNameString + versionSeparatorString + versionCode03String   // "mantaray:0.3"
+	version03HashString = "760a7d78f92c7c81d713d76188f4f65d74427a937ccc471f0b8fbef7ca526270" // pre-calculated version string, Keccak-256
+
+	version04String     = versionNameString + versionSeparatorString + versionCode04String   // "mantaray:0.4"
+	version04HashString = "8986925bb7cf29bb936dfbb54cc6f31f48fe3219c3f6c36515a531b055a01378" // pre-calculated version string, Keccak-256
+
+	version05String     = versionNameString + versionSeparatorString + versionCode05String   // "mantaray:0.5"
+	version05HashString = "5457b8e3b19b43e56110629981b437310c3b26b682a50907d902d4b60fa12340" // pre-calculated version string, Keccak-256
 )
 
 // Node header fields constants.
@@ -44,6 +58,13 @@ const (
 )
 
 // Node fork constats.
+//
+// The prefix of a fork is stored in the fixed size region preceding the
+// reference, together with the one byte node type and the one byte prefix
+// length, so that the whole region aligns with the 32 byte obfuscation key.
+// This leaves 30 bytes for the prefix; longer paths are split into a chain
+// of edge nodes, see LongestPrefixChain. Carrying longer prefixes would need
+// a new format version with a wider prefix length field and a larger region.
 const (
 	nodeForkTypeBytesSize    = 1
 	nodeForkPrefixBytesSize  = 1
@@ -52,16 +73,70 @@ const (
 	nodePrefixMaxSize        = nodeForkPreReferenceSize - nodeForkHeaderSize // 30
 	// "mantaray:0.2"
 	nodeForkMetadataBytesSize = 2
+	// "mantaray:0.4"
+	nodeForkBinaryMetadataBytesSize = 2
+)
+
+// Node trailer constants.
+//
+// Since "mantaray:0.3" a node may end with a trailer following the forks,
+// holding records of the node itself which are otherwise only stored in the
+// fork of its parent and therefore lost for root nodes. Each record is a one
+// byte tag, a two byte big endian length and the value. Records with unknown
+// tags are skipped.
+const (
+	nodeTrailerTagSize    = 1
+	nodeTrailerLengthSize = 2
+
+	// trailerTagNodeType holds the node type of the node
+	trailerTagNodeType = 1
+	// trailerTagMetadata holds the encoded metadata of the node
+	trailerTagMetadata = 2
+	// trailerTagChecksum holds the CRC-32C checksum of the decrypted node
+	// following the obfuscation key up to the record, which must be the last
+	trailerTagChecksum = 3
+
+	// trailerTagBinaryMetadata holds the encoded binary metadata of the node,
+	// since "mantaray:0.4"
+	trailerTagBinaryMetadata = 4
+
+	nodeChecksumSize = 4
 )
 
+// Binary metadata.
+//
+// Since "mantaray:0.4" forks of nodes with binary metadata, which have the
+// nodeTypeWithBinaryMetadata type, carry a second section following the
+// metadata section: a two byte big endian size and the binary metadata
+// encoded as the uvarint number of pairs followed by the uvarint length
+// prefixed key and value of each pair, sorted by key. Nodes are only
+// marshalled in this version if they or their forks hold binary metadata,
+// so that other nodes keep their references.
+
+// Metadata codecs.
+//
+// Since "mantaray:0.5" the metadata of a node and of its forks may be encoded
+// with any of the registered metadata codecs, identified by the first byte of
+// the encoded metadata. Earlier versions only hold JSON metadata. The format
+// is otherwise that of "mantaray:0.4", and nodes are only marshalled in this
+// version if they or their forks hold metadata of another codec.
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
 var (
 	version01HashBytes []byte
 	version02HashBytes []byte
+	version03HashBytes []byte
+	version04HashBytes []byte
+	version05HashBytes []byte
 )
 
 func init() {
 	initVersion(version01HashString, &version01HashBytes)
 	initVersion(version02HashString, &version02HashBytes)
+	initVersion(version03HashString, &version03HashBytes)
+	initVersion(version04HashString, &version04HashBytes)
+	initVersion(version05HashString, &version05HashBytes)
 }
 
 func initVersion(hash string, bytes *[]byte) {
@@ -81,6 +156,14 @@ var (
 	ErrInvalid = errors.New("input invalid")
 	// ErrForkIvalid shows embedded node on a fork has no reference
 	ErrForkIvalid = errors.New("fork node without reference")
+	// ErrInvalidPrefixLength fork prefix length out of range
+	ErrInvalidPrefixLength = errors.New("invalid prefix length")
+	// ErrRefTooLarge reference does not fit the one byte size field
+	ErrRefTooLarge = errors.New("reference too large")
+	// ErrInvalidVersion unknown version hash
+	ErrInvalidVersion = errors.New("invalid version hash")
+	// ErrChecksumMismatch node contents do not match the stored checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
 )
 
 var obfuscationKeyFn = func(p []byte) (n int, err error) {
@@ -95,8 +178,55 @@ func SetObfuscationKeyFn(fn func([]byte) (int, error)) {
 	obfuscationKeyFn = fn
 }
 
-// MarshalBinary serialises the node
+// FormatVersion returns the format version of the node, such as
+// "mantaray:0.2", as last marshalled or unmarshalled. It is empty for nodes
+// which were neither.
+func (n *Node) FormatVersion() string {
+	return n.version
+}
+
+// MarshalBinary serialises the node. The type and metadata of a node which
+// is a value or has metadata are kept in a trailer, so that they survive the
+// round trip even if the node is the root of a trie.
 func (n *Node) MarshalBinary() (bytes []byte, err error) {
+	return n.marshal(true)
+}
+
+// MarshalBinaryWithKey serialises the node like MarshalBinary, using key as
+// the obfuscation key of the node instead of generating one. Savers of many
+// nodes can generate the keys in bulk or derive them deterministically. The
+// key must be 32 bytes long. Nodes of tries built with deterministic keys
+// derive their key from their content and fail with ErrInvalidOptions.
+func (n *Node) MarshalBinaryWithKey(key []byte) ([]byte, error) {
+	if len(key) != nodeObfuscationKeySize {
+		return nil, fmt.Errorf("%w: obfuscation key size %d", ErrInvalid, len(key))
+	}
+	if n.configOrDefault().deterministicKeys {
+		return nil, fmt.Errorf("%w: obfuscation key set with deterministic keys", ErrInvalidOptions)
+	}
+	n.obfuscationKey = append([]byte{}, key...)
+	return n.marshal(true)
+}
+
+// MarshalCanonical serialises the node like MarshalBinary with the
+// obfuscation key derived from its content, as done for tries built with
+// deterministic keys. The bytes are thus the same on every call, and those
+// Save stores for a root of such a trie, so that hashing them gives its
+// Address. The node must be loaded and its forks saved. The key of the node
+// is left unchanged.
+func (n *Node) MarshalCanonical() ([]byte, error) {
+	cfg := *n.configOrDefault()
+	cfg.deterministicKeys = true
+	c := *n
+	c.cfg = &cfg
+	c.obfuscationKey = nil
+	return c.marshal(true)
+}
+
+// marshal serialises the node, with the trailer if withTrailer is set and the
+// node has a type or metadata of its own to keep. The trailer is not needed
+// for nodes saved below a root, as their parents hold the same in the forks.
+func (n *Node) marshal(withTrailer bool) (bytes []byte, err error) {
 	if n.forks == nil {
 		return nil, ErrInvalid
 	}
@@ -105,7 +235,8 @@ func (n *Node) MarshalBinary() (bytes []byte, err error) {
 
 	headerBytes := make([]byte, nodeHeaderSize)
 
-	if len(n.obfuscationKey) == 0 {
+	deterministic := n.configOrDefault().deterministicKeys
+	if len(n.obfuscationKey) == 0 && !deterministic {
 		// generate obfuscation key
 		obfuscationKey := make([]byte, nodeObfuscationKeySize)
 		for i := 0; i < nodeObfuscationKeySize; {
@@ -116,7 +247,19 @@ func (n *Node) MarshalBinary() (bytes []byte, err error) {
 	}
 	copy(headerBytes[0:nodeObfuscationKeySize], n.obfuscationKey)
 
-	copy(headerBytes[nodeObfuscationKeySize:nodeObfuscationKeySize+versionHashSize], version02HashBytes)
+	withTrailer = withTrailer && n.hasTrailer()
+	withChecksum := n.configOrDefault().checksums
+	versionHashBytes, version := version02HashBytes, version02String
+	if withTrailer || withChecksum {
+		versionHashBytes, version = version03HashBytes, version03String
+	}
+	if withTrailer && n.IsWithBinaryMetadataType() || n.hasForkBinaryMetadata() {
+		versionHashBytes, version = version04HashBytes, version04String
+	}
+	if withTrailer && n.hasCodecMetadata() || n.hasForkCodecMetadata() {
+		versionHashBytes, version = version05HashBytes, version05String
+	}
+	copy(headerBytes[nodeObfuscationKeySize:nodeObfuscationKeySize+versionHashSize], versionHashBytes)
 
 	headerBytes[nodeObfuscationKeySize+versionHashSize] = uint8(n.refBytesSize)
 
@@ -153,6 +296,29 @@ func (n *Node) MarshalBinary() (bytes []byte, err error) {
 		return nil, err
 	}
 
+	// trailer
+
+	if withTrailer {
+		trailerBytes, err := n.trailerBytes()
+		if err != nil {
+			return nil, err
+		}
+		bytes = append(bytes, trailerBytes...)
+	}
+	if withChecksum {
+		var sum [nodeChecksumSize]byte
+		binary.BigEndian.PutUint32(sum[:], crc32.Checksum(bytes[nodeObfuscationKeySize:], checksumTable))
+		bytes = appendTrailerRecord(bytes, trailerTagChecksum, sum[:])
+	}
+
+	if deterministic {
+		// the derived key is kept, so that ObfuscationKey returns the key
+		// of the stored chunk
+		n.obfuscationKey = deterministicObfuscationKey(bytes[nodeObfuscationKeySize:])
+		copy(bytes[0:nodeObfuscationKeySize], n.obfuscationKey)
+	}
+	obfuscationKey := n.obfuscationKey
+
 	// perform XOR encryption on bytes after obfuscation key
 	xorEncryptedBytes := make([]byte, len(bytes))
 
@@ -164,13 +330,183 @@ func (n *Node) MarshalBinary() (bytes []byte, err error) {
 			end = len(bytes)
 		}
 
-		encrypted := encryptDecrypt(bytes[i:end], n.obfuscationKey)
+		encrypted := encryptDecrypt(bytes[i:end], obfuscationKey)
 		copy(xorEncryptedBytes[i:end], encrypted)
 	}
 
+	n.version = version
+
 	return xorEncryptedBytes, nil
 }
 
+// hasTrailer returns true if the node has a type or metadata of its own which
+// is kept in the trailer.
+func (n *Node) hasTrailer() bool {
+	return n.IsValueType() || n.IsWithMetadataType() || n.IsWithBinaryMetadataType()
+}
+
+// hasForkBinaryMetadata returns true if a fork of the node has binary
+// metadata, which needs the "mantaray:0.4" format.
+func (n *Node) hasForkBinaryMetadata() bool {
+	for _, f := range n.forks {
+		if f.Node.IsWithBinaryMetadataType() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCodecMetadata returns true if the node has metadata encoded with another
+// codec than JSONMetadataCodec, which needs the "mantaray:0.5" format.
+func (n *Node) hasCodecMetadata() bool {
+	return n.IsWithMetadataType() && n.metadataCodecOrDefault().ID() != JSONMetadataCodec.ID()
+}
+
+// hasForkCodecMetadata returns true if a fork of the node has metadata
+// encoded with another codec than JSONMetadataCodec.
+func (n *Node) hasForkCodecMetadata() bool {
+	for _, f := range n.forks {
+		if f.Node.hasCodecMetadata() {
+			return true
+		}
+	}
+	return false
+}
+
+// trailerBytes returns the trailer records of the node.
+func (n *Node) trailerBytes() ([]byte, error) {
+	b := appendTrailerRecord(nil, trailerTagNodeType, []byte{n.nodeType})
+	if n.IsWithMetadataType() {
+		metadataBytes, err := n.metadataCodecOrDefault().Encode(n.metadata)
+		if err != nil {
+			return nil, err
+		}
+		if len(metadataBytes) > int(maxUint16) {
+			return nil, ErrMetadataTooLarge
+		}
+		b = appendTrailerRecord(b, trailerTagMetadata, metadataBytes)
+	}
+	if n.IsWithBinaryMetadataType() {
+		binaryBytes := encodeBinaryMetadata(n.binaryMetadata)
+		if len(binaryBytes) > int(maxUint16) {
+			return nil, ErrMetadataTooLarge
+		}
+		b = appendTrailerRecord(b, trailerTagBinaryMetadata, binaryBytes)
+	}
+	return b, nil
+}
+
+// encodeBinaryMetadata encodes binary metadata as the number of pairs
+// followed by the length prefixed key and value of each pair, sorted by key.
+func encodeBinaryMetadata(metadata map[string][]byte) []byte {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := appendUvarint(nil, uint64(len(keys)))
+	for _, k := range keys {
+		b = appendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		b = appendUvarint(b, uint64(len(metadata[k])))
+		b = append(b, metadata[k]...)
+	}
+	return b
+}
+
+// decodeBinaryMetadata decodes binary metadata encoded by
+// encodeBinaryMetadata.
+func decodeBinaryMetadata(b []byte) (map[string][]byte, error) {
+	count, b, err := readUvarint(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: binary metadata size", ErrInvalidMetadata)
+	}
+	// every pair takes at least two bytes
+	if count > uint64(len(b)) {
+		return nil, fmt.Errorf("%w: %d binary metadata pairs", ErrInvalidMetadata, count)
+	}
+	metadata := make(map[string][]byte, count)
+	for i := uint64(0); i < count; i++ {
+		var key, value []byte
+		if key, b, err = readLengthPrefixed(b); err != nil {
+			return nil, fmt.Errorf("%w: binary metadata key %d", ErrInvalidMetadata, i)
+		}
+		if value, b, err = readLengthPrefixed(b); err != nil {
+			return nil, fmt.Errorf("%w: binary metadata value of %q", ErrInvalidMetadata, key)
+		}
+		if _, ok := metadata[string(key)]; ok {
+			return nil, fmt.Errorf("%w: duplicate binary metadata key %q", ErrInvalidMetadata, key)
+		}
+		metadata[string(key)] = append([]byte{}, value...)
+	}
+	if len(b) > 0 {
+		return nil, fmt.Errorf("%w: %d bytes following binary metadata", ErrInvalidMetadata, len(b))
+	}
+	return metadata, nil
+}
+
+func appendTrailerRecord(b []byte, tag byte, value []byte) []byte {
+	b = append(b, tag)
+	var size [nodeTrailerLengthSize]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(value)))
+	b = append(b, size[:]...)
+	return append(b, value...)
+}
+
+// unmarshalTrailer restores the type and metadata of the node from the
+// trailer records in data, verifying a checksum record against the decrypted
+// node bytes preceding the trailer and the records before it.
+func (n *Node) unmarshalTrailer(data, preceding []byte) error {
+	trailer := data
+	for len(data) > 0 {
+		start := len(trailer) - len(data)
+		if len(data) < nodeTrailerTagSize+nodeTrailerLengthSize {
+			return fmt.Errorf("%w: trailer record of %d bytes", ErrTooShort, len(data))
+		}
+		tag := data[0]
+		size := int(binary.BigEndian.Uint16(data[nodeTrailerTagSize:]))
+		data = data[nodeTrailerTagSize+nodeTrailerLengthSize:]
+		if len(data) < size {
+			return fmt.Errorf("%w: trailer record value of %d bytes, expected %d", ErrTooShort, len(data), size)
+		}
+		value := data[:size]
+		data = data[size:]
+
+		switch tag {
+		case trailerTagNodeType:
+			if size != 1 {
+				return fmt.Errorf("%w: node type of %d bytes", ErrInvalid, size)
+			}
+			n.nodeType = value[0]
+		case trailerTagMetadata:
+			metadata, codec, err := decodeMetadata(value, n.version == version05String)
+			if err != nil {
+				return err
+			}
+			n.metadata = metadata
+			n.metadataCodec = codec
+		case trailerTagBinaryMetadata:
+			metadata, err := decodeBinaryMetadata(value)
+			if err != nil {
+				return err
+			}
+			n.binaryMetadata = metadata
+		case trailerTagChecksum:
+			if size != nodeChecksumSize {
+				return fmt.Errorf("%w: checksum of %d bytes", ErrInvalid, size)
+			}
+			if len(data) > 0 {
+				return fmt.Errorf("%w: %d bytes following checksum", ErrInvalid, len(data))
+			}
+			sum := crc32.Update(crc32.Checksum(preceding, checksumTable), checksumTable, trailer[:start])
+			if sum != binary.BigEndian.Uint32(value) {
+				return ErrChecksumMismatch
+			}
+		}
+	}
+	return nil
+}
+
 // bitsForBytes is a set of bytes represented as a 256-length bitvector
 type bitsForBytes struct {
 	bits [32]byte
@@ -198,6 +534,15 @@ func (bb *bitsForBytes) getUint8(i uint8) bool {
 	return (bb.bits[i/8]>>(i%8))&1 > 0
 }
 
+// count returns the number of bytes in the set.
+func (bb *bitsForBytes) count() int {
+	c := 0
+	for _, b := range bb.bits {
+		c += bits.OnesCount8(b)
+	}
+	return c
+}
+
 func (bb *bitsForBytes) iter(f func(byte) error) error {
 	for i := uint8(0); ; i++ {
 		if bb.getUint8(i) {
@@ -211,6 +556,24 @@ func (bb *bitsForBytes) iter(f func(byte) error) error {
 	}
 }
 
+// UnmarshalBinaryWithKey deserialises a node like UnmarshalBinary, using key
+// as the obfuscation key of the node instead of the one at the start of the
+// data. Nodes whose key was damaged can thus be recovered if the key is known
+// otherwise. The version hash is still verified, so that decrypting with a
+// wrong key fails. The key must be 32 bytes long.
+func (n *Node) UnmarshalBinaryWithKey(data, key []byte) error {
+	if len(key) != nodeObfuscationKeySize {
+		return fmt.Errorf("%w: obfuscation key size %d", ErrInvalid, len(key))
+	}
+	if len(data) < nodeHeaderSize {
+		return ErrTooShort
+	}
+	b := make([]byte, len(data))
+	copy(b, key)
+	copy(b[nodeObfuscationKeySize:], data[nodeObfuscationKeySize:])
+	return n.UnmarshalBinary(b)
+}
+
 // UnmarshalBinary deserialises a node
 func (n *Node) UnmarshalBinary(data []byte) error {
 	if len(data) < nodeHeaderSize {
@@ -240,21 +603,25 @@ func (n *Node) UnmarshalBinary(data []byte) error {
 	versionHash := data[nodeObfuscationKeySize : nodeObfuscationKeySize+versionHashSize]
 
 	if bytes.Equal(versionHash, version01HashBytes) {
+		n.version = version01String
 
 		refBytesSize := int(data[nodeHeaderSize-1])
+		if len(data) < nodeHeaderSize+refBytesSize {
+			return fmt.Errorf("%w: entry of %d bytes", ErrTooShort, refBytesSize)
+		}
 
+		n.refBytesSize = refBytesSize
 		n.entry = append([]byte{}, data[nodeHeaderSize:nodeHeaderSize+refBytesSize]...)
 		offset := nodeHeaderSize + refBytesSize // skip entry
-		n.forks = make(map[byte]*fork)
 		bb := &bitsForBytes{}
 		bb.fromBytes(data[offset:])
+		n.forks = make(map[byte]*fork, bb.count())
 		offset += 32 // skip forks
 		return bb.iter(func(b byte) error {
 			f := &fork{}
 
 			if len(data) < offset+nodeForkPreReferenceSize+refBytesSize {
-				err := fmt.Errorf("not enough bytes for node fork: %d (%d)", (len(data) - offset), (nodeForkPreReferenceSize + refBytesSize))
-				return fmt.Errorf("%w on byte '%x'", err, []byte{b})
+				return fmt.Errorf("%w: node fork of %d bytes, expected %d on byte '%x'", ErrTooShort, (len(data) - offset), (nodeForkPreReferenceSize + refBytesSize), []byte{b})
 			}
 
 			err := f.fromBytes(data[offset : offset+nodeForkPreReferenceSize+refBytesSize])
@@ -266,67 +633,124 @@ func (n *Node) UnmarshalBinary(data []byte) error {
 			offset += nodeForkPreReferenceSize + refBytesSize
 			return nil
 		})
-	} else if bytes.Equal(versionHash, version02HashBytes) {
+	} else if bytes.Equal(versionHash, version02HashBytes) || bytes.Equal(versionHash, version03HashBytes) || bytes.Equal(versionHash, version04HashBytes) || bytes.Equal(versionHash, version05HashBytes) {
+		n.version = version02String
+		if bytes.Equal(versionHash, version03HashBytes) {
+			n.version = version03String
+		} else if bytes.Equal(versionHash, version04HashBytes) {
+			n.version = version04String
+		} else if bytes.Equal(versionHash, version05HashBytes) {
+			n.version = version05String
+		}
 
 		refBytesSize := int(data[nodeHeaderSize-1])
+		if len(data) < nodeHeaderSize+refBytesSize {
+			return fmt.Errorf("%w: entry of %d bytes", ErrTooShort, refBytesSize)
+		}
 
+		n.refBytesSize = refBytesSize
 		n.entry = append([]byte{}, data[nodeHeaderSize:nodeHeaderSize+refBytesSize]...)
 		offset := nodeHeaderSize + refBytesSize // skip entry
-		n.forks = make(map[byte]*fork)
-		bb := &bitsForBytes{}
-		bb.fromBytes(data[offset:])
-		offset += 32 // skip forks
-		return bb.iter(func(b byte) error {
-			f := &fork{}
-
-			if len(data) < offset+nodeForkTypeBytesSize {
-				return fmt.Errorf("not enough bytes for node fork: %d (%d) on byte '%x'", (len(data) - offset), (nodeForkTypeBytesSize), []byte{b})
+		withBinary := n.version == version04String || n.version == version05String
+		offset, err := n.unmarshalForks02(data, offset, refBytesSize, withBinary)
+		if err != nil {
+			return err
+		}
+		if n.version != version02String {
+			if err := n.unmarshalTrailer(data[offset:], data[nodeObfuscationKeySize:offset]); err != nil {
+				return err
 			}
+		}
+		return nil
+	}
 
-			nodeType := uint8(data[offset])
+	return fmt.Errorf("%w: %x", ErrInvalidVersion, versionHash)
+}
 
-			nodeForkSize := nodeForkPreReferenceSize + refBytesSize
+// unmarshalForks02 deserialises the fork index and the forks starting at
+// offset in the "mantaray:0.2" format, returning the offset following them.
+// Forks carry the binary metadata section of "mantaray:0.4" if withBinary is
+// set.
+func (n *Node) unmarshalForks02(data []byte, offset, refBytesSize int, withBinary bool) (int, error) {
+	bb := &bitsForBytes{}
+	bb.fromBytes(data[offset:])
+	n.forks = make(map[byte]*fork, bb.count())
+	offset += 32 // skip forks
+	err := bb.iter(func(b byte) error {
+		f := &fork{}
+
+		if len(data) < offset+nodeForkTypeBytesSize {
+			return fmt.Errorf("%w: node fork of %d bytes, expected %d on byte '%x'", ErrTooShort, (len(data) - offset), (nodeForkTypeBytesSize), []byte{b})
+		}
 
-			if nodeTypeIsWithMetadataType(nodeType) {
-				if len(data) < offset+nodeForkPreReferenceSize+refBytesSize+nodeForkMetadataBytesSize {
-					return fmt.Errorf("not enough bytes for node fork: %d (%d) on byte '%x'", (len(data) - offset), (nodeForkPreReferenceSize + refBytesSize + nodeForkMetadataBytesSize), []byte{b})
-				}
+		nodeType := uint8(data[offset])
 
-				metadataBytesSize := binary.BigEndian.Uint16(data[offset+nodeForkSize : offset+nodeForkSize+nodeForkMetadataBytesSize])
+		nodeForkSize := nodeForkPreReferenceSize + refBytesSize
 
-				nodeForkSize += nodeForkMetadataBytesSize
-				nodeForkSize += int(metadataBytesSize)
+		if nodeTypeIsWithMetadataType(nodeType) {
+			if len(data) < offset+nodeForkPreReferenceSize+refBytesSize+nodeForkMetadataBytesSize {
+				return fmt.Errorf("%w: node fork of %d bytes, expected %d on byte '%x'", ErrTooShort, (len(data) - offset), (nodeForkPreReferenceSize + refBytesSize + nodeForkMetadataBytesSize), []byte{b})
+			}
 
-				err := f.fromBytes02(data[offset:offset+nodeForkSize], refBytesSize, int(metadataBytesSize))
-				if err != nil {
-					return fmt.Errorf("%w on byte '%x'", err, []byte{b})
-				}
-			} else {
-				if len(data) < offset+nodeForkPreReferenceSize+refBytesSize {
-					return fmt.Errorf("not enough bytes for node fork: %d (%d) on byte '%x'", (len(data) - offset), (nodeForkPreReferenceSize + refBytesSize), []byte{b})
-				}
+			metadataBytesSize := binary.BigEndian.Uint16(data[offset+nodeForkSize : offset+nodeForkSize+nodeForkMetadataBytesSize])
 
-				err := f.fromBytes(data[offset : offset+nodeForkSize])
-				if err != nil {
-					return fmt.Errorf("%w on byte '%x'", err, []byte{b})
-				}
+			nodeForkSize += nodeForkMetadataBytesSize
+			nodeForkSize += int(metadataBytesSize)
+			if len(data) < offset+nodeForkSize {
+				return fmt.Errorf("%w: node fork of %d bytes, expected %d on byte '%x'", ErrTooShort, (len(data) - offset), nodeForkSize, []byte{b})
 			}
 
-			n.forks[b] = f
-			offset += nodeForkSize
-			return nil
-		})
-	}
+			err := f.fromBytes02(data[offset:offset+nodeForkSize], refBytesSize, int(metadataBytesSize), n.version == version05String)
+			if err != nil {
+				return fmt.Errorf("%w on byte '%x'", err, []byte{b})
+			}
+		} else {
+			if len(data) < offset+nodeForkPreReferenceSize+refBytesSize {
+				return fmt.Errorf("%w: node fork of %d bytes, expected %d on byte '%x'", ErrTooShort, (len(data) - offset), (nodeForkPreReferenceSize + refBytesSize), []byte{b})
+			}
+
+			err := f.fromBytes(data[offset : offset+nodeForkSize])
+			if err != nil {
+				return fmt.Errorf("%w on byte '%x'", err, []byte{b})
+			}
+		}
+
+		if !withBinary {
+			// the type is only known since "mantaray:0.4"
+			f.Node.makeNotWithBinaryMetadata()
+		} else if nodeTypeIsWithBinaryMetadataType(nodeType) {
+			if len(data) < offset+nodeForkSize+nodeForkBinaryMetadataBytesSize {
+				return fmt.Errorf("%w: node fork of %d bytes, expected %d on byte '%x'", ErrTooShort, (len(data) - offset), nodeForkSize+nodeForkBinaryMetadataBytesSize, []byte{b})
+			}
+			binaryBytesSize := int(binary.BigEndian.Uint16(data[offset+nodeForkSize:]))
+			nodeForkSize += nodeForkBinaryMetadataBytesSize
+			if len(data) < offset+nodeForkSize+binaryBytesSize {
+				return fmt.Errorf("%w: node fork of %d bytes, expected %d on byte '%x'", ErrTooShort, (len(data) - offset), nodeForkSize+binaryBytesSize, []byte{b})
+			}
+			metadata, err := decodeBinaryMetadata(data[offset+nodeForkSize : offset+nodeForkSize+binaryBytesSize])
+			if err != nil {
+				return fmt.Errorf("%w on byte '%x'", err, []byte{b})
+			}
+			f.Node.binaryMetadata = metadata
+			nodeForkSize += binaryBytesSize
+		}
 
-	return fmt.Errorf("invalid version hash %x", versionHash)
+		n.forks[b] = f
+		offset += nodeForkSize
+		return nil
+	})
+	return offset, err
 }
 
 func (f *fork) fromBytes(b []byte) error {
+	if len(b) < nodeForkPreReferenceSize {
+		return fmt.Errorf("%w: fork of %d bytes", ErrInvalid, len(b))
+	}
 	nodeType := uint8(b[0])
 	prefixLen := int(uint8(b[1]))
 
 	if prefixLen == 0 || prefixLen > nodePrefixMaxSize {
-		return fmt.Errorf("invalid prefix length: %d", prefixLen)
+		return fmt.Errorf("%w: %d", ErrInvalidPrefixLength, prefixLen)
 	}
 
 	f.prefix = b[nodeForkHeaderSize : nodeForkHeaderSize+prefixLen]
@@ -336,12 +760,19 @@ func (f *fork) fromBytes(b []byte) error {
 	return nil
 }
 
-func (f *fork) fromBytes02(b []byte, refBytesSize, metadataBytesSize int) error {
+func (f *fork) fromBytes02(b []byte, refBytesSize, metadataBytesSize int, withCodecs bool) error {
+	size := nodeForkPreReferenceSize + refBytesSize
+	if metadataBytesSize > 0 {
+		size += nodeForkMetadataBytesSize + metadataBytesSize
+	}
+	if len(b) < size {
+		return fmt.Errorf("%w: fork of %d bytes, expected %d", ErrInvalid, len(b), size)
+	}
 	nodeType := uint8(b[0])
 	prefixLen := int(uint8(b[1]))
 
 	if prefixLen == 0 || prefixLen > nodePrefixMaxSize {
-		return fmt.Errorf("invalid prefix length: %d", prefixLen)
+		return fmt.Errorf("%w: %d", ErrInvalidPrefixLength, prefixLen)
 	}
 
 	f.prefix = b[nodeForkHeaderSize : nodeForkHeaderSize+prefixLen]
@@ -351,14 +782,13 @@ func (f *fork) fromBytes02(b []byte, refBytesSize, metadataBytesSize int) error
 	if metadataBytesSize > 0 {
 		metadataBytes := b[nodeForkPreReferenceSize+refBytesSize+nodeForkMetadataBytesSize:]
 
-		metadata := make(map[string]string)
-		// using JSON encoding for metadata
-		err := json.Unmarshal(metadataBytes, &metadata)
+		metadata, codec, err := decodeMetadata(metadataBytes, withCodecs)
 		if err != nil {
 			return err
 		}
 
 		f.Node.metadata = metadata
+		f.Node.metadataCodec = codec
 	}
 
 	return nil
@@ -368,7 +798,7 @@ func (f *fork) bytes() (b []byte, err error) {
 	r := refBytes(f)
 	// using 1 byte ('f.Node.refBytesSize') for size
 	if len(r) > 256 {
-		err = fmt.Errorf("node reference size > 256: %d", len(r))
+		err = fmt.Errorf("%w: node reference size %d", ErrRefTooLarge, len(r))
 		return
 	}
 	b = append(b, f.Node.nodeType)
@@ -383,46 +813,57 @@ func (f *fork) bytes() (b []byte, err error) {
 	b = append(b, refBytes...)
 
 	if f.Node.IsWithMetadataType() {
-		// using JSON encoding for metadata
-		metadataJSONBytes, err1 := json.Marshal(f.Node.metadata)
+		metadataBytes, err1 := f.Node.metadataCodecOrDefault().Encode(f.Node.metadata)
 		if err1 != nil {
 			return b, err1
 		}
 
-		metadataJSONBytesSizeWithSize := len(metadataJSONBytes) + nodeForkMetadataBytesSize
-
-		// pad JSON bytes if necessary
-		if metadataJSONBytesSizeWithSize < nodeObfuscationKeySize {
-			paddingLength := nodeObfuscationKeySize - metadataJSONBytesSizeWithSize
-			padding := make([]byte, paddingLength)
-			for i := range padding {
-				padding[i] = '\n'
-			}
-			metadataJSONBytes = append(metadataJSONBytes, padding...)
-		} else if metadataJSONBytesSizeWithSize > nodeObfuscationKeySize {
-			paddingLength := nodeObfuscationKeySize - metadataJSONBytesSizeWithSize%nodeObfuscationKeySize
-			padding := make([]byte, paddingLength)
-			for i := range padding {
-				padding[i] = '\n'
-			}
-			metadataJSONBytes = append(metadataJSONBytes, padding...)
-		}
+		metadataBytes = padMetadata(metadataBytes)
 
-		metadataJSONBytesSize := len(metadataJSONBytes)
-		if metadataJSONBytesSize > int(maxUint16) {
+		metadataBytesSize := len(metadataBytes)
+		if metadataBytesSize > int(maxUint16) {
 			return b, ErrMetadataTooLarge
 		}
 
 		mBytesSize := make([]byte, nodeForkMetadataBytesSize)
-		binary.BigEndian.PutUint16(mBytesSize, uint16(metadataJSONBytesSize))
+		binary.BigEndian.PutUint16(mBytesSize, uint16(metadataBytesSize))
 		b = append(b, mBytesSize...)
 
-		b = append(b, metadataJSONBytes...)
+		b = append(b, metadataBytes...)
+	}
+
+	if f.Node.IsWithBinaryMetadataType() {
+		binaryBytes := encodeBinaryMetadata(f.Node.binaryMetadata)
+		if len(binaryBytes) > int(maxUint16) {
+			return b, ErrMetadataTooLarge
+		}
+		var size [nodeForkBinaryMetadataBytesSize]byte
+		binary.BigEndian.PutUint16(size[:], uint16(len(binaryBytes)))
+		b = append(b, size[:]...)
+		b = append(b, binaryBytes...)
 	}
 
 	return b, nil
 }
 
+// padMetadata pads the encoded metadata with newlines so that, together with
+// its size field, it aligns with the obfuscation key.
+func padMetadata(metadataBytes []byte) []byte {
+	metadataBytesSizeWithSize := len(metadataBytes) + nodeForkMetadataBytesSize
+
+	paddingLength := 0
+	if metadataBytesSizeWithSize < nodeObfuscationKeySize {
+		paddingLength = nodeObfuscationKeySize - metadataBytesSizeWithSize
+	} else if metadataBytesSizeWithSize > nodeObfuscationKeySize {
+		paddingLength = nodeObfuscationKeySize - metadataBytesSizeWithSize%nodeObfuscationKeySize
+	}
+	padding := make([]byte, paddingLength)
+	for i := range padding {
+		padding[i] = '\n'
+	}
+	return append(metadataBytes, padding...)
+}
+
 var refBytes = nodeRefBytes
 
 func nodeRefBytes(f *fork) []byte {
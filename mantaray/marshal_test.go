@@ -7,9 +7,14 @@ package mantaray
 import (
 	"bytes"
 	"context"
+	crand "crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	mrand "math/rand"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"golang.org/x/crypto/sha3"
@@ -147,6 +152,139 @@ func TestUnmarshal02(t *testing.T) {
 	}
 }
 
+func TestFormatVersion(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{testMarshalOutput01, "mantaray:0.1"},
+		{testMarshalOutput02, "mantaray:0.2"},
+	} {
+		input, _ := hex.DecodeString(tc.input)
+		n := &Node{}
+		err := n.UnmarshalBinary(input)
+		if err != nil {
+			t.Fatalf("expected no error unmarshaling, got %v", err)
+		}
+		if v := n.FormatVersion(); v != tc.expected {
+			t.Fatalf("expected version %s, got %s", tc.expected, v)
+		}
+	}
+
+	n := New()
+	if v := n.FormatVersion(); v != "" {
+		t.Fatalf("expected no version, got %s", v)
+	}
+	_, err := n.MarshalBinary()
+	if err != nil {
+		t.Fatalf("expected no error marshaling, got %v", err)
+	}
+	if v := n.FormatVersion(); v != "mantaray:0.2" {
+		t.Fatalf("expected version mantaray:0.2, got %s", v)
+	}
+}
+
+func TestObfuscationKey(t *testing.T) {
+	input, _ := hex.DecodeString(testMarshalOutput02)
+	n := &Node{}
+	err := n.UnmarshalBinary(input)
+	if err != nil {
+		t.Fatalf("expected no error unmarshaling, got %v", err)
+	}
+
+	key := n.ObfuscationKey()
+	if !bytes.Equal(key, input[:nodeObfuscationKeySize]) {
+		t.Fatalf("expected obfuscation key %x, got %x", input[:nodeObfuscationKeySize], key)
+	}
+
+	// modifying the returned key must not modify the node
+	key[0]++
+	if !bytes.Equal(n.ObfuscationKey(), input[:nodeObfuscationKeySize]) {
+		t.Fatalf("expected obfuscation key %x, got %x", input[:nodeObfuscationKeySize], n.ObfuscationKey())
+	}
+}
+
+func TestSetObfuscationKey(t *testing.T) {
+	n := New()
+	key := bytes.Repeat([]byte{1}, nodeObfuscationKeySize)
+	if err := n.SetObfuscationKey(key); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	key[0]++
+	if !bytes.Equal(n.ObfuscationKey(), bytes.Repeat([]byte{1}, nodeObfuscationKeySize)) {
+		t.Fatalf("expected copied obfuscation key, got %x", n.ObfuscationKey())
+	}
+
+	for _, size := range []int{0, 16, 31, 33, 64} {
+		err := n.SetObfuscationKey(make([]byte, size))
+		if !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected invalid error for key size %d, got %v", size, err)
+		}
+		if !bytes.Equal(n.ObfuscationKey(), bytes.Repeat([]byte{1}, nodeObfuscationKeySize)) {
+			t.Fatalf("expected unchanged obfuscation key for key size %d, got %x", size, n.ObfuscationKey())
+		}
+	}
+}
+
+func TestResaveKeepsKeys(t *testing.T) {
+	ctx := context.Background()
+	ls := mapLoadSaver{}
+	n := New()
+	for i := 0; i < 40; i++ {
+		path := []byte(fmt.Sprintf("dir%d/sub%d/file%d.txt", i%4, i%3, i))
+		if err := n.Add(ctx, path, make([]byte, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	refs := func(root []byte) map[string][]byte {
+		m := make(map[string][]byte)
+		err := NewNodeRef(root).WalkNode(ctx, []byte{}, ls, func(path []byte, node *Node, err error) error {
+			m[string(path)] = node.ref
+			return err
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return m
+	}
+	before := refs(n.Reference())
+
+	// the edited nodes keep their keys, so no key is generated
+	generated := 0
+	defer func(fn func([]byte) (int, error)) { obfuscationKeyFn = fn }(obfuscationKeyFn)
+	obfuscationKeyFn = func(p []byte) (int, error) {
+		generated++
+		return crand.Read(p)
+	}
+	edited := "dir1/sub1/file1.txt"
+	nn := NewNodeRef(n.Reference())
+	if err := nn.Add(ctx, []byte(edited), bytes.Repeat([]byte{1}, 32), nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := nn.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if generated != 0 {
+		t.Fatalf("expected no generated keys, got %d", generated)
+	}
+
+	after := refs(nn.Reference())
+	for path, ref := range before {
+		if strings.HasPrefix(edited, path) {
+			if bytes.Equal(after[path], ref) {
+				t.Fatalf("expected new reference for edited node on %q", path)
+			}
+			continue
+		}
+		if !bytes.Equal(after[path], ref) {
+			t.Fatalf("expected reference %x for unchanged node on %q, got %x", ref, path, after[path])
+		}
+	}
+}
+
 func TestMarshal(t *testing.T) {
 	ctx := context.Background()
 	n := New()
@@ -195,3 +333,591 @@ func TestMarshal(t *testing.T) {
 	// 	}
 	// }
 }
+
+// mapLoadSaver is a minimal in-memory LoadSaver keyed by the content hash.
+// Saves and loads are serialised by mapLoadSaverMtx, as the forks of a node
+// are saved concurrently.
+type mapLoadSaver map[string][]byte
+
+var mapLoadSaverMtx sync.Mutex
+
+func (m mapLoadSaver) Save(_ context.Context, b []byte) ([]byte, error) {
+	h := sha3.NewLegacyKeccak256()
+	_, _ = h.Write(b)
+	ref := h.Sum(nil)
+	mapLoadSaverMtx.Lock()
+	defer mapLoadSaverMtx.Unlock()
+	m[string(ref)] = b
+	return ref, nil
+}
+
+func (m mapLoadSaver) Load(_ context.Context, ref []byte) ([]byte, error) {
+	mapLoadSaverMtx.Lock()
+	defer mapLoadSaverMtx.Unlock()
+	b, ok := m[string(ref)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return b, nil
+}
+
+func TestLeafRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	build := func() *Node {
+		n := New()
+		for _, c := range []string{"index.html", "img/1.png", "img/2.png"} {
+			err := n.Add(ctx, []byte(c), append(make([]byte, 32-len(c)), c...), nil, nil)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		return n
+	}
+
+	fresh, err := build().LookupNode(ctx, []byte("img/2.png"), nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	ls := mapLoadSaver{}
+	n := build()
+	err = n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	loaded, err := NewNodeRef(n.Reference()).LookupNode(ctx, []byte("img/2.png"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if loaded.forks == nil || len(loaded.forks) != 0 {
+		t.Fatalf("expected empty forks on loaded leaf, got %v", loaded.forks)
+	}
+
+	// references, obfuscation key and format version are only set on
+	// persisted nodes
+	loaded.ref = nil
+	loaded.base = nil
+	loaded.ancestors = nil
+	loaded.obfuscationKey = nil
+	loaded.version = ""
+	if !reflect.DeepEqual(fresh, loaded) {
+		t.Fatalf("expected loaded leaf %+v, got %+v", fresh, loaded)
+	}
+}
+
+func TestUnmarshalRefBytesSizeTooLarge(t *testing.T) {
+	for _, version := range [][]byte{version01HashBytes, version02HashBytes} {
+		data := make([]byte, nodeHeaderSize+10)
+		copy(data[nodeObfuscationKeySize:], version)
+		data[nodeHeaderSize-1] = 255
+
+		n := &Node{}
+		err := n.UnmarshalBinary(data)
+		if !errors.Is(err, ErrTooShort) {
+			t.Fatalf("expected too short error, got %v", err)
+		}
+	}
+}
+
+func TestForkFromBytesShort(t *testing.T) {
+	valid := make([]byte, nodeForkPreReferenceSize+32)
+	valid[1] = nodePrefixMaxSize
+
+	for _, b := range [][]byte{
+		nil,
+		{0},
+		valid[:nodeForkHeaderSize+10],
+		valid[:nodeForkPreReferenceSize-1],
+	} {
+		f := &fork{}
+		if err := f.fromBytes(b); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected invalid error on %d bytes, got %v", len(b), err)
+		}
+		if err := f.fromBytes02(b, 32, 0, false); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected invalid error on %d bytes, got %v", len(b), err)
+		}
+	}
+
+	// declared metadata exceeding the fork
+	f := &fork{}
+	if err := f.fromBytes02(valid, 32, 64, false); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected invalid error, got %v", err)
+	}
+
+	if err := f.fromBytes(valid); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := f.fromBytes02(valid, 32, 0, false); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	// a zero obfuscation key leaves the marshalled node in plain text
+	n.SetObfuscationKey(make([]byte, nodeObfuscationKeySize))
+	if err := n.Add(ctx, []byte("a"), make([]byte, 32), nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	data := ls[string(n.Reference())]
+	// the only fork follows the header, the root entry and the index
+	forkOffset := nodeHeaderSize + 32 + 32
+
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, data...))
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{
+			name: "version",
+			data: corrupt(func(b []byte) []byte { b[nodeObfuscationKeySize] ^= 0xff; return b }),
+			err:  ErrInvalidVersion,
+		},
+		{
+			name: "zero-prefix-length",
+			data: corrupt(func(b []byte) []byte { b[forkOffset+1] = 0; return b }),
+			err:  ErrInvalidPrefixLength,
+		},
+		{
+			name: "prefix-length-over-max",
+			data: corrupt(func(b []byte) []byte { b[forkOffset+1] = nodePrefixMaxSize + 1; return b }),
+			err:  ErrInvalidPrefixLength,
+		},
+		{
+			name: "truncated-fork",
+			data: corrupt(func(b []byte) []byte { return b[:len(b)-1] }),
+			err:  ErrTooShort,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := (&Node{}).UnmarshalBinary(tc.data)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+		})
+	}
+
+	t.Run("ref-too-large", func(t *testing.T) {
+		err := New().Add(ctx, []byte("a"), make([]byte, 257), nil, nil)
+		if !errors.Is(err, ErrRefTooLarge) {
+			t.Fatalf("expected ref too large error, got %v", err)
+		}
+		f := &fork{prefix: []byte("a"), Node: &Node{ref: make([]byte, 257)}}
+		if _, err := f.bytes(); !errors.Is(err, ErrRefTooLarge) {
+			t.Fatalf("expected ref too large error, got %v", err)
+		}
+	})
+}
+
+func TestRootRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	rootEntry := bytes.Repeat([]byte{1}, 32)
+	metadata := map[string]string{MetadataIndexDocument: "index.html"}
+	if err := n.Add(ctx, []byte{}, rootEntry, metadata, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Add(ctx, []byte("index.html"), make([]byte, 32), nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	loaded := NewNodeRef(n.Reference())
+	if err := loaded.load(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if v := loaded.FormatVersion(); v != version03String {
+		t.Fatalf("expected version %s, got %s", version03String, v)
+	}
+	if !loaded.IsValueType() || !loaded.IsWithMetadataType() {
+		t.Fatalf("expected value node with metadata, got type %d", loaded.nodeType)
+	}
+	if !bytes.Equal(loaded.Entry(), rootEntry) {
+		t.Fatalf("expected entry %x, got %x", rootEntry, loaded.Entry())
+	}
+	if !reflect.DeepEqual(loaded.Metadata(), metadata) {
+		t.Fatalf("expected metadata %v, got %v", metadata, loaded.Metadata())
+	}
+
+	// the children are stored without the trailer
+	child, err := loaded.LookupNode(ctx, []byte("index.html"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if v := child.FormatVersion(); v != version02String {
+		t.Fatalf("expected version %s, got %s", version02String, v)
+	}
+
+	// roots without a value of their own keep the previous format
+	n = New()
+	if err := n.Add(ctx, []byte("index.html"), make([]byte, 32), nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if v := n.FormatVersion(); v != version02String {
+		t.Fatalf("expected version %s, got %s", version02String, v)
+	}
+}
+
+func TestUnmarshalTrailerErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		trailer []byte
+		err     error
+	}{
+		{name: "short-record", trailer: []byte{trailerTagNodeType, 0}, err: ErrTooShort},
+		{name: "short-value", trailer: []byte{trailerTagNodeType, 0, 2, 1}, err: ErrTooShort},
+		{name: "node-type-size", trailer: []byte{trailerTagNodeType, 0, 2, 1, 2}, err: ErrInvalid},
+		{name: "metadata", trailer: []byte{trailerTagMetadata, 0, 1, '{'}, err: ErrInvalidMetadata},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := (&Node{}).unmarshalTrailer(tc.trailer, nil)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+		})
+	}
+
+	// unknown records are skipped
+	n := &Node{}
+	err := n.unmarshalTrailer([]byte{0xff, 0, 1, 0, trailerTagNodeType, 0, 1, nodeTypeValue}, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !n.IsValueType() {
+		t.Fatalf("expected value type, got %d", n.nodeType)
+	}
+}
+
+func TestMarshalBinaryWithKey(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	if err := n.Add(ctx, []byte{}, make([]byte, 32), nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := n.MarshalBinaryWithKey(make([]byte, 16)); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected invalid error, got %v", err)
+	}
+	key := bytes.Repeat([]byte{7}, nodeObfuscationKeySize)
+	b, err := n.MarshalBinaryWithKey(key)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(b[:nodeObfuscationKeySize], key) {
+		t.Fatalf("expected obfuscation key %x, got %x", key, b[:nodeObfuscationKeySize])
+	}
+	nn := New()
+	if err := nn.UnmarshalBinary(b); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(nn.Entry(), n.Entry()) {
+		t.Fatalf("expected entry %x, got %x", n.Entry(), nn.Entry())
+	}
+
+	// the keys of deterministic tries are derived from the content
+	d, err := NewBuilder().WithDeterministicKeys().Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := d.Add(ctx, []byte{}, make([]byte, 32), nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := d.MarshalBinaryWithKey(key); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+	if d.ObfuscationKey() != nil {
+		t.Fatalf("expected no obfuscation key, got %x", d.ObfuscationKey())
+	}
+}
+
+func TestUnmarshalBinaryWithKey(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, p := range []string{"index.html", "img/1.png"} {
+		if err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), map[string]string{"name": p}, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	for _, f := range n.forks {
+		if err := f.Node.save(ctx, ls, 1); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	key := bytes.Repeat([]byte{7}, nodeObfuscationKeySize)
+	data, err := n.MarshalBinaryWithKey(key)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// damage the key in the header
+	for i := 0; i < nodeObfuscationKeySize; i++ {
+		data[i] ^= 0xff
+	}
+	if err := New().UnmarshalBinary(data); !errors.Is(err, ErrInvalidVersion) {
+		t.Fatalf("expected %v, got %v", ErrInvalidVersion, err)
+	}
+
+	nn := New()
+	if err := nn.UnmarshalBinaryWithKey(data, key); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(nn.obfuscationKey, key) {
+		t.Fatalf("expected obfuscation key %x, got %x", key, nn.obfuscationKey)
+	}
+	for _, p := range []string{"index.html", "img/1.png"} {
+		node, err := nn.LookupNode(ctx, []byte(p), ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !bytes.Equal(node.Entry(), append(make([]byte, 32-len(p)), p...)) || node.Metadata()["name"] != p {
+			t.Fatalf("expected entry and metadata of %s, got %x %v", p, node.Entry(), node.Metadata())
+		}
+	}
+
+	// the version hash is verified after decrypting
+	if err := New().UnmarshalBinaryWithKey(data, bytes.Repeat([]byte{8}, nodeObfuscationKeySize)); !errors.Is(err, ErrInvalidVersion) {
+		t.Fatalf("expected %v, got %v", ErrInvalidVersion, err)
+	}
+	if err := New().UnmarshalBinaryWithKey(data, key[:16]); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected %v, got %v", ErrInvalid, err)
+	}
+	if err := New().UnmarshalBinaryWithKey(data[:nodeHeaderSize-1], key); !errors.Is(err, ErrTooShort) {
+		t.Fatalf("expected %v, got %v", ErrTooShort, err)
+	}
+}
+
+func BenchmarkMarshalKeys(b *testing.B) {
+	ctx := context.Background()
+	n := New()
+	if err := n.Add(ctx, []byte{}, make([]byte, 32), nil, nil); err != nil {
+		b.Fatalf("expected no error, got %v", err)
+	}
+
+	b.Run("per-call-rand", func(b *testing.B) {
+		defer func(fn func([]byte) (int, error)) { obfuscationKeyFn = fn }(obfuscationKeyFn)
+		obfuscationKeyFn = crand.Read
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			n.obfuscationKey = nil
+			if _, err := n.MarshalBinary(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("bulk-keys", func(b *testing.B) {
+		b.ReportAllocs()
+		keys := make([]byte, b.N*nodeObfuscationKeySize)
+		if _, err := crand.Read(keys); err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < b.N; i++ {
+			if _, err := n.MarshalBinaryWithKey(keys[i*nodeObfuscationKeySize : (i+1)*nodeObfuscationKeySize]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestBinaryMetadata(t *testing.T) {
+	ctx := context.Background()
+	signature := []byte{0xff, 0x00, 0xfe, 0x80, 0xc3, 0x28, '\n', 0x00}
+	acl := []byte{0x00, 0x01, 0xff}
+	build := func(binary bool) (*Node, mapLoadSaver) {
+		t.Helper()
+		ls := mapLoadSaver{}
+		n, err := NewBuilder().WithDeterministicKeys().Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, p := range []string{"", "index.html", "img/1.png", "img/2.png"} {
+			if err := n.Add(ctx, []byte(p), make([]byte, 32), map[string]string{"name": p}, ls); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		if binary {
+			for _, p := range []string{"", "img/1.png"} {
+				md := map[string][]byte{"signature": signature, "acl": acl, "empty": {}}
+				if err := n.SetBinaryMetadata(ctx, []byte(p), md, ls); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+			}
+		}
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return n, ls
+	}
+
+	n, ls := build(true)
+	if n.FormatVersion() != version04String {
+		t.Fatalf("expected version %s, got %s", version04String, n.FormatVersion())
+	}
+	expected := map[string][]byte{"signature": signature, "acl": acl, "empty": {}}
+	for _, p := range []string{"", "img/1.png"} {
+		node, err := NewNodeRef(n.Reference()).LookupNode(ctx, []byte(p), ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !reflect.DeepEqual(node.BinaryMetadata(), expected) {
+			t.Fatalf("expected binary metadata %v on %q, got %v", expected, p, node.BinaryMetadata())
+		}
+		if node.Metadata()["name"] != p {
+			t.Fatalf("expected metadata on %q, got %v", p, node.Metadata())
+		}
+	}
+	node, err := NewNodeRef(n.Reference()).LookupNode(ctx, []byte("img/2.png"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if node.BinaryMetadata() != nil {
+		t.Fatalf("expected no binary metadata, got %v", node.BinaryMetadata())
+	}
+
+	// removing the binary metadata restores the earlier format and references
+	plain, _ := build(false)
+	if plain.FormatVersion() == version04String {
+		t.Fatalf("expected version before %s", version04String)
+	}
+	loaded, err := NewBuilder().WithDeterministicKeys().BuildRef(n.Reference())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, p := range []string{"", "img/1.png"} {
+		if err := loaded.SetBinaryMetadata(ctx, []byte(p), nil, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := loaded.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(loaded.Reference(), plain.Reference()) {
+		t.Fatalf("expected reference %x, got %x", plain.Reference(), loaded.Reference())
+	}
+
+	if err := n.SetBinaryMetadata(ctx, []byte("img/"), expected, ls); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	big := map[string][]byte{"big": make([]byte, 1<<16)}
+	if err := n.SetBinaryMetadata(ctx, []byte("index.html"), big, ls); !errors.Is(err, ErrMetadataTooLarge) {
+		t.Fatalf("expected metadata too large error, got %v", err)
+	}
+}
+
+func TestDecodeBinaryMetadataErrors(t *testing.T) {
+	valid := encodeBinaryMetadata(map[string][]byte{"a": {0xff}, "b": nil})
+	if _, err := decodeBinaryMetadata(valid); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for name, b := range map[string][]byte{
+		"empty":     {},
+		"truncated": valid[:len(valid)-1],
+		"trailing":  append(append([]byte{}, valid...), 0),
+		"count":     {0x7f},
+		"duplicate": {2, 1, 'a', 0, 1, 'a', 0},
+	} {
+		if _, err := decodeBinaryMetadata(b); !errors.Is(err, ErrInvalidMetadata) {
+			t.Fatalf("expected invalid metadata error on %s, got %v", name, err)
+		}
+	}
+}
+
+func TestVersion04(t *testing.T) {
+	hasher := sha3.NewLegacyKeccak256()
+
+	_, err := hasher.Write([]byte(version04String))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := hasher.Sum(nil)
+
+	sumHex := hex.EncodeToString(sum)
+
+	if version04HashString != sumHex {
+		t.Fatalf("expecting version hash '%s', got '%s'", version04String, sumHex)
+	}
+}
+
+func TestVersion05(t *testing.T) {
+	hasher := sha3.NewLegacyKeccak256()
+
+	_, err := hasher.Write([]byte(version05String))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := hasher.Sum(nil)
+
+	sumHex := hex.EncodeToString(sum)
+
+	if version05HashString != sumHex {
+		t.Fatalf("expecting version hash '%s', got '%s'", version05String, sumHex)
+	}
+}
+
+func TestMarshalCanonical(t *testing.T) {
+	ctx := context.Background()
+	ls := mapLoadSaver{}
+	n, err := NewBuilder().WithDeterministicKeys().Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, p := range []string{"index.html", "img/1.png", "img/2.png"} {
+		if err := n.Add(ctx, []byte(p), keccak256([]byte(p)), map[string]string{"name": p}, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	loaded := NewNodeRef(n.Reference())
+	if err := loaded.load(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	key := append([]byte{}, loaded.obfuscationKey...)
+	a, err := loaded.MarshalCanonical()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	b, err := loaded.MarshalCanonical()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Fatalf("expected identical bytes, got %x and %x", a, b)
+	}
+	if got := Address(keccak256(a)); !bytes.Equal(got, n.Address()) {
+		t.Fatalf("expected hash %s, got %s", n.Address(), got)
+	}
+	if !bytes.Equal(loaded.obfuscationKey, key) {
+		t.Fatalf("expected key %x to be kept, got %x", key, loaded.obfuscationKey)
+	}
+
+	// the canonical bytes do not depend on the key of the node
+	loaded.obfuscationKey = ZeroObfuscationKey
+	c, err := loaded.MarshalCanonical()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(a, c) {
+		t.Fatalf("expected identical bytes, got %x and %x", a, c)
+	}
+
+	if _, err := NewNodeRef(n.Reference()).MarshalCanonical(); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected %v, got %v", ErrInvalid, err)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"errors"
+)
+
+// Conflict describes a path on which both merged tries store a value, but
+// with a different entry, metadata or binary metadata.
+type Conflict struct {
+	Path []byte
+	Dst  Entry // value stored in the destination trie before the merge
+	Src  Entry // value stored in the source trie
+}
+
+// Merge adds all values of src to dst. Values of src replace the values
+// stored on the same path in dst, along with their metadata and binary
+// metadata. Paths on which both tries store different values are returned as
+// conflicts, so that callers can decide whether the overlap is expected.
+//
+// Without conflicts, the merged trie holds the same nodes as a trie built by
+// adding all values, so with deterministic keys it is saved under the same
+// reference whichever of the tries is the destination.
+func Merge(ctx context.Context, dst, src *Node, ls LoadSaver) ([]Conflict, error) {
+	var (
+		entries []Entry
+		inline  []bool
+	)
+	err := src.WalkNode(ctx, []byte{}, ls, func(path []byte, node *Node, err error) error {
+		if err != nil {
+			return err
+		}
+		if node.IsValueType() {
+			entries = append(entries, node.valueEntry(path))
+			inline = append(inline, node.IsInlineType())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []Conflict
+	for i, e := range entries {
+		node, err := dst.LookupNode(ctx, e.Path, ls)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		conflict := err == nil && node.IsValueType() && !valueEqual(node.valueEntry(e.Path), e)
+		if conflict {
+			conflicts = append(conflicts, Conflict{
+				Path: e.Path,
+				Dst:  node.valueEntry(e.Path),
+				Src:  e,
+			})
+		}
+		if err := checkBinaryMetadata(e.BinaryMetadata); err != nil {
+			return nil, err
+		}
+		if conflict && len(e.Metadata) == 0 {
+			// values added without metadata keep the metadata they replace
+			node.metadata = nil
+			node.makeNotWithMetadata()
+		}
+		// inline values are added as such, so that the merge stores the same
+		// nodes whichever trie is the destination
+		if err := dst.addValue(ctx, e.Path, e.Ref, e.Metadata, inline[i], ls); err != nil {
+			return nil, err
+		}
+		if conflict || len(e.BinaryMetadata) > 0 {
+			if err := dst.SetBinaryMetadata(ctx, e.Path, e.BinaryMetadata, ls); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// valueEqual returns true if both entries, metadata and binary metadata are
+// the same.
+func valueEqual(a, b Entry) bool {
+	if !bytes.Equal(a.Ref, b.Ref) || len(a.Metadata) != len(b.Metadata) || len(a.BinaryMetadata) != len(b.BinaryMetadata) {
+		return false
+	}
+	for k, v := range a.Metadata {
+		if w, ok := b.Metadata[k]; !ok || v != w {
+			return false
+		}
+	}
+	for k, v := range a.BinaryMetadata {
+		if w, ok := b.BinaryMetadata[k]; !ok || !bytes.Equal(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersect returns a new trie holding the values stored on the same paths
+// with equal entries and metadata in both a and b, such as the assets not
+// changed between two releases. Subtrees of a are only loaded if b stores
+// paths under them.
+func Intersect(ctx context.Context, a, b *Node, l Loader) (*Node, error) {
+	res := New()
+	res.cfg = a.cfg
+	if err := intersect(ctx, []byte{}, 0, a, b, res, l); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func intersect(ctx context.Context, path []byte, depth int, n, b, res *Node, l Loader) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if err := n.checkDepth(depth); err != nil {
+		return err
+	}
+	if n.forks == nil {
+		if err := n.loadPath(ctx, path, l); err != nil {
+			return err
+		}
+	}
+	if n.IsValueType() {
+		node, err := b.LookupNode(ctx, path, l)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err == nil && node.IsValueType() && valueEqual(n.valueEntry(path), node.valueEntry(path)) {
+			if err := res.add(ctx, path, n.entry, n.metadata, n.IsInlineType(), nil); err != nil {
+				return err
+			}
+			if len(n.binaryMetadata) > 0 {
+				if err := res.SetBinaryMetadata(ctx, path, n.binaryMetadata, nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, k := range n.sortedForkKeys() {
+		f := n.forks[k]
+		nextPath := append(path[:0:0], path...)
+		nextPath = append(nextPath, f.prefix...)
+		// skip subtrees without counterpart in b
+		overlaps, err := b.HasPrefix(ctx, nextPath, l)
+		if err != nil {
+			return err
+		}
+		if !overlaps {
+			continue
+		}
+		if err := intersect(ctx, nextPath, depth+1, f.Node, b, res, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
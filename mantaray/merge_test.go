@@ -0,0 +1,302 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ethersphere/manifest/mantaray"
+)
+
+func TestMergeConflicts(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+
+	ref := func(s string) []byte {
+		var r [32]byte
+		copy(r[:], s)
+		return r[:]
+	}
+
+	dst := mantaray.New()
+	for _, e := range []mantaray.Entry{
+		{Path: []byte("index.html"), Ref: ref("dst-index")},
+		{Path: []byte("img/1.png"), Ref: ref("img-1")},
+		{Path: []byte("robots.txt"), Ref: ref("robots"), Metadata: map[string]string{"content-type": "text/plain"}},
+	} {
+		if err := dst.Add(ctx, e.Path, e.Ref, e.Metadata, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := dst.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	src := mantaray.New()
+	for _, e := range []mantaray.Entry{
+		{Path: []byte("index.html"), Ref: ref("src-index")},
+		{Path: []byte("img/1.png"), Ref: ref("img-1")},
+		{Path: []byte("img/2.png"), Ref: ref("img-2")},
+		{Path: []byte("robots.txt"), Ref: ref("robots"), Metadata: map[string]string{"content-type": "text/html"}},
+	} {
+		if err := src.Add(ctx, e.Path, e.Ref, e.Metadata, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	conflicts, err := mantaray.Merge(ctx, dst, src, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(conflicts) != 2 {
+		t.Fatalf("expected 2 conflicts, got %d", len(conflicts))
+	}
+	for _, c := range conflicts {
+		switch string(c.Path) {
+		case "index.html":
+			if !bytes.Equal(c.Dst.Ref, ref("dst-index")) || !bytes.Equal(c.Src.Ref, ref("src-index")) {
+				t.Fatalf("unexpected conflicting references %x, %x", c.Dst.Ref, c.Src.Ref)
+			}
+		case "robots.txt":
+			if c.Dst.Metadata["content-type"] != "text/plain" || c.Src.Metadata["content-type"] != "text/html" {
+				t.Fatalf("unexpected conflicting metadata %v, %v", c.Dst.Metadata, c.Src.Metadata)
+			}
+		default:
+			t.Fatalf("unexpected conflict on path %s", c.Path)
+		}
+	}
+
+	for path, exp := range map[string][]byte{
+		"index.html": ref("src-index"),
+		"img/1.png":  ref("img-1"),
+		"img/2.png":  ref("img-2"),
+		"robots.txt": ref("robots"),
+	} {
+		e, err := dst.Lookup(ctx, []byte(path), ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !bytes.Equal(e, exp) {
+			t.Fatalf("expected value %x on path %s, got %x", exp, path, e)
+		}
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+
+	ref := func(s string) []byte {
+		var r [32]byte
+		copy(r[:], s)
+		return r[:]
+	}
+	build := func(entries []mantaray.Entry) *mantaray.Node {
+		n := mantaray.New()
+		for _, e := range entries {
+			if err := n.Add(ctx, e.Path, e.Ref, e.Metadata, ls); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return mantaray.NewNodeRef(n.Reference())
+	}
+
+	a := build([]mantaray.Entry{
+		{Path: []byte("index.html"), Ref: ref("index-v1")},
+		{Path: []byte("img/1.png"), Ref: ref("img-1")},
+		{Path: []byte("img/2.png"), Ref: ref("img-2")},
+		{Path: []byte("css/app.css"), Ref: ref("css"), Metadata: map[string]string{"content-type": "text/css"}},
+		{Path: []byte("robots.txt"), Ref: ref("robots"), Metadata: map[string]string{"content-type": "text/plain"}},
+		{Path: []byte("old/a.html"), Ref: ref("old-a")},
+		{Path: []byte("old/b.html"), Ref: ref("old-b")},
+	})
+	b := build([]mantaray.Entry{
+		{Path: []byte("index.html"), Ref: ref("index-v2")},
+		{Path: []byte("img/1.png"), Ref: ref("img-1")},
+		{Path: []byte("img/3.png"), Ref: ref("img-3")},
+		{Path: []byte("css/app.css"), Ref: ref("css"), Metadata: map[string]string{"content-type": "text/css"}},
+		{Path: []byte("robots.txt"), Ref: ref("robots"), Metadata: map[string]string{"content-type": "text/html"}},
+		{Path: []byte("new/a.html"), Ref: ref("old-a")},
+	})
+
+	res, err := mantaray.Intersect(ctx, a, b, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	m, err := res.ToMap(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	exp := map[string][]byte{
+		"img/1.png":   ref("img-1"),
+		"css/app.css": ref("css"),
+	}
+	if len(m) != len(exp) {
+		t.Fatalf("expected %d entries, got %d", len(exp), len(m))
+	}
+	for p, r := range exp {
+		if !bytes.Equal(m[p], r) {
+			t.Fatalf("expected value %x on path %s, got %x", r, p, m[p])
+		}
+	}
+	node, err := res.LookupNode(ctx, []byte("css/app.css"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if node.Metadata()["content-type"] != "text/css" {
+		t.Fatalf("expected metadata, got %v", node.Metadata())
+	}
+}
+
+func TestMergeDeterministic(t *testing.T) {
+	ctx := context.Background()
+	long := "assets/" + strings.Repeat("x", 40)
+	a := []string{"index.html", "img/1.png", long + "/a.js", "a/b", "docs/"}
+	b := []string{"img/2.png", "img/sub/3.png", long + "/b.js", "a/b/c", "about.html", "docs/intro.md"}
+	build := func(t *testing.T, paths []string, inline string, ls mantaray.LoadSaver) *mantaray.Node {
+		t.Helper()
+		n, err := mantaray.NewBuilder().WithDeterministicKeys().Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, p := range paths {
+			ref := make([]byte, 32)
+			copy(ref, p)
+			md := map[string]string{mantaray.MetadataContentType: "text/plain"}
+			if err := n.Add(ctx, []byte(p), ref, md, ls); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		if err := n.AddInline(ctx, []byte(inline), []byte("tiny"), ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		// save one side, so that merging loads it
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		n, err = mantaray.NewBuilder().WithDeterministicKeys().BuildRef(n.Reference())
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return n
+	}
+	merge := func(t *testing.T, dstPaths, srcPaths []string, dstInline, srcInline string) []byte {
+		t.Helper()
+		ls := newMockLoadSaver()
+		dst := build(t, dstPaths, dstInline, ls)
+		src := build(t, srcPaths, srcInline, ls)
+		conflicts, err := mantaray.Merge(ctx, dst, src, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(conflicts) != 0 {
+			t.Fatalf("expected no conflicts, got %d", len(conflicts))
+		}
+		if err := dst.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return dst.Reference()
+	}
+
+	ab := merge(t, a, b, "a.txt", "b.txt")
+	ba := merge(t, b, a, "b.txt", "a.txt")
+	if !bytes.Equal(ab, ba) {
+		t.Fatalf("expected equal references merging either way, got %x and %x", ab, ba)
+	}
+
+	// the merge is the trie holding all values
+	ls := newMockLoadSaver()
+	all := build(t, append(append([]string{}, a...), b...), "a.txt", ls)
+	if err := all.AddInline(ctx, []byte("b.txt"), []byte("tiny"), ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := all.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(ab, all.Reference()) {
+		t.Fatalf("expected reference %x of the trie of all values, got %x", all.Reference(), ab)
+	}
+}
+
+func TestMergeBinaryMetadata(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	ref := make([]byte, 32)
+	binary := map[string][]byte{"hash": {0, 1, 2}}
+
+	src := mantaray.New()
+	if err := src.Add(ctx, []byte("img/1.png"), ref, nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := src.SetBinaryMetadata(ctx, []byte("img/1.png"), binary, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := src.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	src = mantaray.NewNodeRef(src.Reference())
+
+	// the same entry without binary metadata is a conflict
+	dst := mantaray.New()
+	if err := dst.Add(ctx, []byte("img/1.png"), ref, nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	conflicts, err := mantaray.Merge(ctx, dst, src, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(conflicts) != 1 || len(conflicts[0].Src.BinaryMetadata) != 1 || len(conflicts[0].Dst.BinaryMetadata) != 0 {
+		t.Fatalf("expected a conflict on binary metadata, got %v", conflicts)
+	}
+
+	node, err := dst.LookupNode(ctx, []byte("img/1.png"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(node.BinaryMetadata()["hash"], binary["hash"]) {
+		t.Fatalf("expected merged binary metadata %v, got %v", binary, node.BinaryMetadata())
+	}
+}
+
+func TestMergeReplacesMetadata(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+
+	src := mantaray.New()
+	if err := src.Add(ctx, []byte("img/1.png"), bytes.Repeat([]byte{1}, 32), nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	dst := mantaray.New()
+	if err := dst.Add(ctx, []byte("img/1.png"), bytes.Repeat([]byte{2}, 32), map[string]string{"name": "old"}, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := dst.SetBinaryMetadata(ctx, []byte("img/1.png"), map[string][]byte{"hash": {0, 1, 2}}, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	conflicts, err := mantaray.Merge(ctx, dst, src, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("expected a conflict, got %v", conflicts)
+	}
+	node, err := dst.LookupNode(ctx, []byte("img/1.png"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(node.Entry(), bytes.Repeat([]byte{1}, 32)) {
+		t.Fatalf("expected entry of src, got %x", node.Entry())
+	}
+	if len(node.Metadata()) != 0 || len(node.BinaryMetadata()) != 0 || node.IsWithMetadataType() {
+		t.Fatalf("expected no metadata, got %v and %v", node.Metadata(), node.BinaryMetadata())
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Metadata keys with a meaning for serving manifests.
+const (
+	// MetadataIndexDocument is the document served for a directory, relative
+	// to the served directory. It applies to all directories below the entry
+	// it is set on.
+	MetadataIndexDocument = "index-document"
+	// MetadataErrorDocument is the document served for missing paths,
+	// relative to the directory entry it is set on. It applies to all paths
+	// below the entry.
+	MetadataErrorDocument = "error-document"
+)
+
+// MetadataInlineValue is the reserved metadata key holding the base64
+// encoded value of entries added with AddInline.
+const MetadataInlineValue = "inline-value"
+
+// MetadataContentLength is the reserved metadata key holding the decimal
+// size of the content referenced by entries added with AddSized.
+const MetadataContentLength = "content-length"
+
+// MetadataChunked is the reserved metadata key marking whether the content
+// referenced by entries added with AddFile is a tree of chunks, "true", or a
+// single chunk, "false".
+const MetadataChunked = "chunked"
+
+// MetadataManifest is the reserved metadata key marking entries added with
+// AddReference which reference another manifest, "true".
+const MetadataManifest = "manifest"
+
+// MetadataContentType is the metadata key holding the MIME type of the
+// content referenced by an entry.
+const MetadataContentType = "content-type"
+
+// MetadataRedirectCode is the metadata key holding the HTTP status code,
+// 3xx, with which a redirecting entry is served.
+const MetadataRedirectCode = "redirect-code"
+
+// MetadataRedirectTarget is the metadata key holding the path in the
+// manifest to which a redirecting entry redirects.
+const MetadataRedirectTarget = "redirect-target"
+
+// MaxInlineValueSize is the maximum size of a value added with AddInline.
+const MaxInlineValueSize = 256
+
+var (
+	// ErrUnknownMetadataCodec encoded metadata starts with an unknown codec id
+	ErrUnknownMetadataCodec = errors.New("unknown metadata codec")
+	// ErrInvalidMetadata encoded metadata can not be decoded
+	ErrInvalidMetadata = errors.New("invalid metadata")
+)
+
+// MetadataCodec defines a generic interface to serialise node metadata.
+//
+// The encoded metadata must start with the codec ID, which is used to select
+// the codec when unmarshaling. The encoded metadata may be followed by
+// padding, which Decode has to ignore.
+type MetadataCodec interface {
+	ID() byte
+	Encode(metadata map[string]string) ([]byte, error)
+	Decode(data []byte) (map[string]string, error)
+}
+
+var (
+	// JSONMetadataCodec encodes metadata as a JSON object. It is the default
+	// codec, identified by the opening brace of the object.
+	JSONMetadataCodec MetadataCodec = jsonMetadataCodec{}
+	// CompactMetadataCodec encodes metadata as length-prefixed keys and
+	// values, avoiding the JSON overhead for small maps.
+	CompactMetadataCodec MetadataCodec = compactMetadataCodec{}
+)
+
+var metadataCodecs = map[byte]MetadataCodec{
+	JSONMetadataCodec.ID():    JSONMetadataCodec,
+	CompactMetadataCodec.ID(): CompactMetadataCodec,
+}
+
+// SetMetadataCodec sets the codec used to serialise the metadata of the node.
+// Nodes created under the node inherit the codec.
+func (n *Node) SetMetadataCodec(codec MetadataCodec) {
+	n.metadataCodec = codec
+}
+
+// metadataCodecOrDefault returns the codec used by the node.
+func (n *Node) metadataCodecOrDefault() MetadataCodec {
+	if n.metadataCodec == nil {
+		return JSONMetadataCodec
+	}
+	return n.metadataCodec
+}
+
+// EncodeMetadata encodes metadata like the node marshaler does with the
+// default codec.
+func EncodeMetadata(metadata map[string]string) ([]byte, error) {
+	return JSONMetadataCodec.Encode(metadata)
+}
+
+// DecodeMetadata decodes metadata encoded with any of the registered codecs,
+// as the node unmarshaler does. Trailing padding is ignored.
+func DecodeMetadata(data []byte) (map[string]string, error) {
+	metadata, _, err := decodeMetadata(data, true)
+	return metadata, err
+}
+
+// decodeMetadata decodes metadata with the codec identified by the first byte
+// if withCodecs is set, as in "mantaray:0.5" nodes. The metadata of earlier
+// versions is always JSON, which may start with whitespace.
+func decodeMetadata(data []byte, withCodecs bool) (map[string]string, MetadataCodec, error) {
+	if !withCodecs {
+		metadata, err := JSONMetadataCodec.Decode(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return metadata, JSONMetadataCodec, nil
+	}
+	if len(data) == 0 {
+		return nil, nil, ErrInvalidMetadata
+	}
+	codec, ok := metadataCodecs[data[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %x", ErrUnknownMetadataCodec, data[0])
+	}
+	metadata, err := codec.Decode(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return metadata, codec, nil
+}
+
+type jsonMetadataCodec struct{}
+
+func (jsonMetadataCodec) ID() byte {
+	return '{'
+}
+
+func (jsonMetadataCodec) Encode(metadata map[string]string) ([]byte, error) {
+	return CanonicalMetadataJSON(metadata)
+}
+
+// CanonicalMetadataJSON encodes metadata as a JSON object with the keys in
+// byte order and the strings escaped like encoding/json does. It is the
+// encoding of JSONMetadataCodec and of the metadata of canonical simple
+// manifests, so that metadata converted between the implementations stays
+// the same byte for byte.
+func CanonicalMetadataJSON(metadata map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		for j, s := range []string{k, metadata[k]} {
+			if j > 0 {
+				buf.WriteByte(':')
+			}
+			b, err := json.Marshal(s)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(b)
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (jsonMetadataCodec) Decode(data []byte) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
+	}
+	return metadata, nil
+}
+
+type compactMetadataCodec struct{}
+
+func (compactMetadataCodec) ID() byte {
+	return 1
+}
+
+// Encode serialises the number of entries followed by the keys and values in
+// key order, each as uvarint length followed by the bytes.
+func (c compactMetadataCodec) Encode(metadata map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := []byte{c.ID()}
+	b = appendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = appendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		b = appendUvarint(b, uint64(len(metadata[k])))
+		b = append(b, metadata[k]...)
+	}
+	return b, nil
+}
+
+func (c compactMetadataCodec) Decode(data []byte) (map[string]string, error) {
+	if len(data) == 0 || data[0] != c.ID() {
+		return nil, ErrInvalidMetadata
+	}
+	data = data[1:]
+	count, data, err := readUvarint(data)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(data)) {
+		return nil, ErrInvalidMetadata
+	}
+	metadata := make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+		var k, v []byte
+		if k, data, err = readLengthPrefixed(data); err != nil {
+			return nil, err
+		}
+		if v, data, err = readLengthPrefixed(data); err != nil {
+			return nil, err
+		}
+		metadata[string(k)] = string(v)
+	}
+	return metadata, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, ErrInvalidMetadata
+	}
+	return v, data[n:], nil
+}
+
+func readLengthPrefixed(data []byte) ([]byte, []byte, error) {
+	l, data, err := readUvarint(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if l > uint64(len(data)) {
+		return nil, nil, ErrInvalidMetadata
+	}
+	return data[:l], data[l:], nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var testMetadata = map[string]string{
+	"content-type": "text/html; charset=utf-8",
+	"filename":     "index.html",
+}
+
+func TestMetadataCodecs(t *testing.T) {
+	for _, codec := range []MetadataCodec{JSONMetadataCodec, CompactMetadataCodec} {
+		b, err := codec.Encode(testMetadata)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if b[0] != codec.ID() {
+			t.Fatalf("expected encoded metadata to start with codec id %x, got %x", codec.ID(), b[0])
+		}
+
+		// decoding has to ignore padding
+		b = append(b, bytes.Repeat([]byte{'\n'}, 7)...)
+		metadata, c, err := decodeMetadata(b, true)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if c != codec {
+			t.Fatalf("expected codec %T, got %T", codec, c)
+		}
+		if !reflect.DeepEqual(metadata, testMetadata) {
+			t.Fatalf("expected metadata %v, got %v", testMetadata, metadata)
+		}
+	}
+
+	_, _, err := decodeMetadata([]byte{0xff, 0x00}, true)
+	if !errors.Is(err, ErrUnknownMetadataCodec) {
+		t.Fatalf("expected unknown metadata codec error, got %v", err)
+	}
+	_, _, err = decodeMetadata([]byte{CompactMetadataCodec.ID(), 0x01, 0x05, 'a'}, true)
+	if !errors.Is(err, ErrInvalidMetadata) {
+		t.Fatalf("expected invalid metadata error, got %v", err)
+	}
+}
+
+func TestEncodeDecodeMetadata(t *testing.T) {
+	b, err := EncodeMetadata(testMetadata)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// the encoding of the node marshaler
+	n := New()
+	n.metadata = testMetadata
+	n.makeWithMetadata()
+	f, err := (&fork{prefix: []byte("index.html"), Node: n}).bytes()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Contains(f, b) {
+		t.Fatalf("expected marshalled fork %x to contain metadata %x", f, b)
+	}
+
+	metadata, err := DecodeMetadata(b)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(metadata, testMetadata) {
+		t.Fatalf("expected metadata %v, got %v", testMetadata, metadata)
+	}
+
+	for _, malformed := range [][]byte{
+		nil,
+		[]byte(`{"content-type":`),
+		[]byte(`{"size":1}`),
+		{CompactMetadataCodec.ID(), 0x02, 0x01, 'a'},
+	} {
+		_, err := DecodeMetadata(malformed)
+		if !errors.Is(err, ErrInvalidMetadata) {
+			t.Fatalf("expected invalid metadata error on %q, got %v", malformed, err)
+		}
+	}
+}
+
+func TestCompactMetadataCodecMarshal(t *testing.T) {
+	ctx := context.Background()
+	defer func(r func(*fork) []byte) { refBytes = r }(refBytes)
+	refBytes = func(*fork) []byte {
+		return make([]byte, 32)
+	}
+	n := New()
+	n.SetMetadataCodec(CompactMetadataCodec)
+	for _, c := range [][]byte{
+		[]byte("index.html"),
+		[]byte("robots.txt"),
+	} {
+		e := append(make([]byte, 32-len(c)), c...)
+		err := n.Add(ctx, c, e, testMetadata, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	b, err := n.MarshalBinary()
+	if err != nil {
+		t.Fatalf("expected no error marshaling, got %v", err)
+	}
+	if !bytes.Contains(encryptDecrypt(b, n.obfuscationKey), []byte{CompactMetadataCodec.ID(), 0x02, 0x0c}) {
+		t.Fatalf("expected compact metadata in marshalled output")
+	}
+
+	nn := &Node{}
+	err = nn.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatalf("expected no error unmarshaling, got %v", err)
+	}
+	if nn.FormatVersion() != version05String {
+		t.Fatalf("expected version %s, got %s", version05String, nn.FormatVersion())
+	}
+	for _, f := range nn.forks {
+		if f.Node.metadataCodec != CompactMetadataCodec {
+			t.Fatalf("expected compact metadata codec, got %T", f.Node.metadataCodec)
+		}
+		if !reflect.DeepEqual(f.Node.metadata, testMetadata) {
+			t.Fatalf("expected metadata %v, got %v", testMetadata, f.Node.metadata)
+		}
+	}
+
+	// earlier versions only hold JSON metadata
+	old := append([]byte{}, b...)
+	for i, h := range version04HashBytes {
+		old[nodeObfuscationKeySize+i] = h ^ b[i%nodeObfuscationKeySize]
+	}
+	if err := (&Node{}).UnmarshalBinary(old); !errors.Is(err, ErrInvalidMetadata) {
+		t.Fatalf("expected %v, got %v", ErrInvalidMetadata, err)
+	}
+
+	// nodes with JSON metadata keep their version
+	n.SetMetadataCodec(JSONMetadataCodec)
+	for _, f := range n.forks {
+		f.Node.SetMetadataCodec(JSONMetadataCodec)
+	}
+	if _, err := n.MarshalBinary(); err != nil {
+		t.Fatalf("expected no error marshaling, got %v", err)
+	}
+	if n.FormatVersion() != version02String {
+		t.Fatalf("expected version %s, got %s", version02String, n.FormatVersion())
+	}
+}
+
+func TestMetadataLeadingWhitespace(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	metadata := map[string]string{"k": "v"}
+	if err := n.Add(ctx, []byte("a"), make([]byte, 32), metadata, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n.FormatVersion() != version02String {
+		t.Fatalf("expected version %s, got %s", version02String, n.FormatVersion())
+	}
+	b := append([]byte{}, ls[string(n.Reference())]...)
+
+	// the metadata of legacy writers may start with whitespace, which
+	// takes a byte of the padding
+	xor := func(b []byte) {
+		for i := nodeObfuscationKeySize; i < len(b); i++ {
+			b[i] ^= b[i%nodeObfuscationKeySize]
+		}
+	}
+	xor(b)
+	encoded := []byte(`{"k":"v"}`)
+	i := bytes.Index(b, encoded)
+	if i < 0 || b[i+len(encoded)] != '\n' {
+		t.Fatalf("expected padded metadata in %x", b)
+	}
+	copy(b[i:], append([]byte("\n"), encoded...))
+	xor(b)
+
+	for j := 0; j < 2; j++ {
+		nn := &Node{}
+		if err := nn.UnmarshalBinary(b); err != nil {
+			t.Fatalf("expected no error unmarshaling, got %v", err)
+		}
+		if !reflect.DeepEqual(nn.forks['a'].Node.metadata, metadata) {
+			t.Fatalf("expected metadata %v, got %v", metadata, nn.forks['a'].Node.metadata)
+		}
+		var err error
+		if b, err = nn.MarshalBinary(); err != nil {
+			t.Fatalf("expected no error marshaling, got %v", err)
+		}
+	}
+}
+
+func BenchmarkMetadataCodec(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		codec MetadataCodec
+	}{
+		{"json", JSONMetadataCodec},
+		{"compact", CompactMetadataCodec},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			encoded, err := bc.codec.Encode(testMetadata)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(encoded)), "bytes/encoded")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				encoded, err := bc.codec.Encode(testMetadata)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := bc.codec.Decode(encoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -7,8 +7,11 @@ package mantaray
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strconv"
 )
 
 const (
@@ -25,9 +28,18 @@ func init() {
 
 // Error used when lookup path does not match
 var (
-	ErrNotFound         = errors.New("not found")
-	ErrEmptyPath        = errors.New("empty path")
-	ErrMetadataTooLarge = errors.New("metadata too large")
+	ErrNotFound            = errors.New("not found")
+	ErrEmptyPath           = errors.New("empty path")
+	ErrMetadataTooLarge    = errors.New("metadata too large")
+	ErrInvalidReference    = errors.New("invalid reference")
+	ErrInlineValueTooLarge = errors.New("inline value too large")
+	ErrPathExists          = errors.New("path exists")
+	ErrNotSaved            = errors.New("node has unsaved changes")
+	ErrMaxDepthExceeded    = errors.New("max depth exceeded")
+	ErrPathConflict        = errors.New("path is both a file and a directory")
+	ErrNoContentLength     = errors.New("no content length")
+	ErrCycleDetected       = errors.New("reference cycle detected")
+	ErrTooManyForks        = errors.New("too many forks")
 )
 
 // Node represents a mantaray Node
@@ -36,9 +48,32 @@ type Node struct {
 	refBytesSize   int
 	obfuscationKey []byte
 	ref            []byte // reference to uninstantiated Node persisted serialised
+	base           []byte // reference the node was last loaded from or saved as
 	entry          []byte
 	metadata       map[string]string
-	forks          map[byte]*fork
+	binaryMetadata map[string][]byte
+	forks          map[byte]*fork // nil if not loaded, empty for loaded leaves
+	metadataCodec  MetadataCodec
+	loader         Loader // loader remembered by SaveLoad
+	cfg            *config
+	version        string // format version as last marshalled or unmarshalled
+	tracer         Tracer
+	audit          AuditFunc
+	ancestors      *ancestor // references of the loaded nodes above the node
+}
+
+// ancestor is a link of the list of references a node was reached through.
+type ancestor struct {
+	ref    []byte
+	parent *ancestor
+}
+
+// Entry is a value stored on a path of the trie.
+type Entry struct {
+	Path           []byte
+	Ref            []byte
+	Metadata       map[string]string
+	BinaryMetadata map[string][]byte
 }
 
 type fork struct {
@@ -47,10 +82,13 @@ type fork struct {
 }
 
 const (
-	nodeTypeValue             = uint8(2)
-	nodeTypeEdge              = uint8(4)
-	nodeTypeWithPathSeparator = uint8(8)
-	nodeTypeWithMetadata      = uint8(16)
+	nodeTypeValue              = uint8(2)
+	nodeTypeEdge               = uint8(4)
+	nodeTypeWithPathSeparator  = uint8(8)
+	nodeTypeWithMetadata       = uint8(16)
+	nodeTypeDirectory          = uint8(32)
+	nodeTypeInline             = uint8(64)
+	nodeTypeWithBinaryMetadata = uint8(128)
 
 	nodeTypeMask = uint8(255)
 )
@@ -59,6 +97,10 @@ func nodeTypeIsWithMetadataType(nodeType uint8) bool {
 	return nodeType&nodeTypeWithMetadata == nodeTypeWithMetadata
 }
 
+func nodeTypeIsWithBinaryMetadataType(nodeType uint8) bool {
+	return nodeType&nodeTypeWithBinaryMetadata == nodeTypeWithBinaryMetadata
+}
+
 // NewNodeRef is the exported Node constructor used to represent manifests by reference
 func NewNodeRef(ref []byte) *Node {
 	return &Node{ref: ref}
@@ -93,6 +135,23 @@ func (n *Node) IsWithMetadataType() bool {
 	return n.nodeType&nodeTypeWithMetadata == nodeTypeWithMetadata
 }
 
+// IsDirectoryType returns true if the node is an explicit directory entry,
+// added with an empty entry.
+func (n *Node) IsDirectoryType() bool {
+	return n.nodeType&nodeTypeDirectory == nodeTypeDirectory
+}
+
+// IsInlineType returns true if the node holds an inline value added with
+// AddInline instead of an entry.
+func (n *Node) IsInlineType() bool {
+	return n.nodeType&nodeTypeInline == nodeTypeInline
+}
+
+// IsWithBinaryMetadataType returns true if the node holds binary metadata.
+func (n *Node) IsWithBinaryMetadataType() bool {
+	return nodeTypeIsWithBinaryMetadataType(n.nodeType)
+}
+
 func (n *Node) makeValue() {
 	n.nodeType = n.nodeType | nodeTypeValue
 }
@@ -109,12 +168,22 @@ func (n *Node) makeWithMetadata() {
 	n.nodeType = n.nodeType | nodeTypeWithMetadata
 }
 
-//nolint,unused
+func (n *Node) makeInline() {
+	n.nodeType = n.nodeType | nodeTypeInline
+}
+
+func (n *Node) makeNotInline() {
+	n.nodeType = (nodeTypeMask ^ nodeTypeInline) & n.nodeType
+}
+
+func (n *Node) makeDirectory() {
+	n.nodeType = n.nodeType | nodeTypeDirectory
+}
+
 func (n *Node) makeNotValue() {
 	n.nodeType = (nodeTypeMask ^ nodeTypeValue) & n.nodeType
 }
 
-//nolint,unused
 func (n *Node) makeNotEdge() {
 	n.nodeType = (nodeTypeMask ^ nodeTypeEdge) & n.nodeType
 }
@@ -123,20 +192,74 @@ func (n *Node) makeNotWithPathSeparator() {
 	n.nodeType = (nodeTypeMask ^ nodeTypeWithPathSeparator) & n.nodeType
 }
 
-//nolint,unused
+func (n *Node) makeNotDirectory() {
+	n.nodeType = (nodeTypeMask ^ nodeTypeDirectory) & n.nodeType
+}
+
 func (n *Node) makeNotWithMetadata() {
 	n.nodeType = (nodeTypeMask ^ nodeTypeWithMetadata) & n.nodeType
 }
 
-func (n *Node) SetObfuscationKey(obfuscationKey []byte) {
-	bytes := make([]byte, 32)
-	copy(bytes, obfuscationKey)
-	n.obfuscationKey = bytes
+func (n *Node) makeWithBinaryMetadata() {
+	n.nodeType = n.nodeType | nodeTypeWithBinaryMetadata
+}
+
+func (n *Node) makeNotWithBinaryMetadata() {
+	n.nodeType = (nodeTypeMask ^ nodeTypeWithBinaryMetadata) & n.nodeType
+}
+
+// SetObfuscationKey sets the obfuscation key used when the node is saved. The
+// key must be 32 bytes long; keys of other sizes are rejected with ErrInvalid
+// instead of being truncated or padded, leaving the key of the node as it is.
+func (n *Node) SetObfuscationKey(obfuscationKey []byte) error {
+	if len(obfuscationKey) != nodeObfuscationKeySize {
+		return fmt.Errorf("%w: obfuscation key size %d", ErrInvalid, len(obfuscationKey))
+	}
+	n.obfuscationKey = append([]byte{}, obfuscationKey...)
+	return nil
+}
+
+// ObfuscationKey returns a copy of the obfuscation key of the node.
+func (n *Node) ObfuscationKey() []byte {
+	if n.obfuscationKey == nil {
+		return nil
+	}
+	return append([]byte{}, n.obfuscationKey...)
 }
 
-// Reference returns the address of the mantaray node if saved.
+// Reference returns a copy of the address of the mantaray node if saved.
 func (n *Node) Reference() []byte {
-	return n.ref
+	if n.ref == nil {
+		return nil
+	}
+	return append([]byte{}, n.ref...)
+}
+
+// Address is the reference of a saved node.
+type Address []byte
+
+// String returns the address in hex.
+func (a Address) String() string {
+	return hex.EncodeToString(a)
+}
+
+// Address returns a copy of the reference of the node if saved, or nil.
+func (n *Node) Address() Address {
+	return Address(n.Reference())
+}
+
+// ChildReferences returns the references of the forks of a loaded node in
+// byte order of their keys, without loading them. Forks not saved yet have
+// no reference and are skipped. Nil is returned for leaves and for nodes
+// which are not loaded.
+func (n *Node) ChildReferences() [][]byte {
+	var refs [][]byte
+	for _, k := range n.sortedForkKeys() {
+		if ref := n.forks[k].Node.ref; ref != nil {
+			refs = append(refs, append([]byte{}, ref...))
+		}
+	}
+	return refs
 }
 
 // Entry returns the value stored on the specific path.
@@ -149,210 +272,1510 @@ func (n *Node) Metadata() map[string]string {
 	return n.metadata
 }
 
-// LookupNode finds the node for a path or returns error if not found
-func (n *Node) LookupNode(ctx context.Context, path []byte, l Loader) (*Node, error) {
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	default:
-	}
-	if n.forks == nil {
-		if err := n.load(ctx, l); err != nil {
-			return nil, err
-		}
+// BinaryMetadata returns the binary metadata stored on the specific path.
+func (n *Node) BinaryMetadata() map[string][]byte {
+	return n.binaryMetadata
+}
+
+// SetBinaryMetadata sets the binary metadata of the value stored on path,
+// replacing its previous binary metadata, or removing it if metadata is
+// empty. Binary metadata holds values such as signatures or access control
+// lists which would need an encoding to be kept in the string metadata.
+// Nodes with binary metadata and their parents are saved in the
+// "mantaray:0.4" format. ErrNotFound is returned if no value is stored on
+// path.
+func (n *Node) SetBinaryMetadata(ctx context.Context, path []byte, metadata map[string][]byte, ls LoadSaver) error {
+	if err := checkBinaryMetadata(metadata); err != nil {
+		return err
 	}
-	if len(path) == 0 {
-		return n, nil
+	return n.setBinaryMetadata(ctx, path, 0, 0, metadata, ls)
+}
+
+// checkBinaryMetadata returns ErrMetadataTooLarge if the encoded binary
+// metadata does not fit a fork.
+func checkBinaryMetadata(metadata map[string][]byte) error {
+	size := len(encodeBinaryMetadata(metadata))
+	if size > int(maxUint16) {
+		return fmt.Errorf("%w: binary metadata of %d bytes", ErrMetadataTooLarge, size)
 	}
-	f := n.forks[path[0]]
-	if f == nil {
-		return nil, notFound(path)
+	return nil
+}
+
+// setBinaryValue replaces the binary metadata of the value of the node, or
+// removes it if metadata is empty.
+func (n *Node) setBinaryValue(metadata map[string][]byte) {
+	if len(metadata) == 0 {
+		n.binaryMetadata = nil
+		n.makeNotWithBinaryMetadata()
+		return
 	}
-	c := common(f.prefix, path)
-	if len(c) == len(f.prefix) {
-		return f.Node.LookupNode(ctx, path[len(c):], l)
+	n.binaryMetadata = make(map[string][]byte, len(metadata))
+	for k, v := range metadata {
+		n.binaryMetadata[k] = append([]byte{}, v...)
 	}
-	return nil, notFound(path)
+	n.makeWithBinaryMetadata()
 }
 
-// Lookup finds the entry for a path or returns error if not found
-func (n *Node) Lookup(ctx context.Context, path []byte, l Loader) ([]byte, error) {
-	node, err := n.LookupNode(ctx, path, l)
-	if err != nil {
-		return nil, err
+// valueEntry returns the value of the node stored on path.
+func (n *Node) valueEntry(path []byte) Entry {
+	return Entry{
+		Path:           path,
+		Ref:            n.entry,
+		Metadata:       n.metadata,
+		BinaryMetadata: n.binaryMetadata,
 	}
-	return node.entry, nil
 }
 
-// Add adds an entry to the path
-func (n *Node) Add(ctx context.Context, path []byte, entry []byte, metadata map[string]string, ls LoadSaver) error {
+func (n *Node) setBinaryMetadata(ctx context.Context, path []byte, i, depth int, metadata map[string][]byte, ls LoadSaver) error {
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
 	}
-	if n.refBytesSize == 0 {
-		if len(entry) > 256 {
-			return fmt.Errorf("node entry size > 256: %d", len(entry))
-		}
-		// empty entry for directories
-		if len(entry) > 0 {
-			n.refBytesSize = len(entry)
-		}
-	} else {
-		if len(entry) > 0 && n.refBytesSize != len(entry) {
-			return fmt.Errorf("invalid entry size: %d, expected: %d", len(entry), n.refBytesSize)
+	if err := n.checkDepth(depth); err != nil {
+		return err
+	}
+	if n.forks == nil {
+		if err := n.loadPath(ctx, path[:i], ls); err != nil {
+			return err
 		}
 	}
-
-	if len(path) == 0 {
-		n.entry = entry
-		if len(metadata) > 0 {
-			n.metadata = metadata
-			n.makeWithMetadata()
+	rest := path[i:]
+	if len(rest) == 0 {
+		if !n.IsValueType() {
+			return notFound(path)
 		}
+		n.setBinaryValue(metadata)
 		n.ref = nil
 		return nil
 	}
+	f := n.forks[rest[0]]
+	if f == nil || !bytes.HasPrefix(rest, f.prefix) {
+		return notFound(path)
+	}
+	if err := f.Node.setBinaryMetadata(ctx, path, i+len(f.prefix), depth+1, metadata, ls); err != nil {
+		return err
+	}
+	// the node is modified and has to be saved again
+	n.ref = nil
+	return nil
+}
+
+// LookupNode finds the node for a path or returns error if not found
+func (n *Node) LookupNode(ctx context.Context, path []byte, l Loader) (*Node, error) {
+	return n.lookupNode(ctx, path, 0, 0, l)
+}
+
+// lookupNode descends path from index i, path[:i] being the path of the
+// node at the given depth.
+func (n *Node) lookupNode(ctx context.Context, path []byte, i, depth int, l Loader) (*Node, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	if err := n.checkDepth(depth); err != nil {
+		return nil, err
+	}
 	if n.forks == nil {
-		if err := n.load(ctx, ls); err != nil {
-			return err
+		if err := n.loadPath(ctx, path[:i], l); err != nil {
+			return nil, err
 		}
-		n.ref = nil
 	}
-	f := n.forks[path[0]]
+	rest := path[i:]
+	if len(rest) == 0 {
+		return n, nil
+	}
+	f := n.forks[rest[0]]
 	if f == nil {
-		nn := New()
-		if len(n.obfuscationKey) > 0 {
-			nn.SetObfuscationKey(n.obfuscationKey)
+		return nil, notFound(rest)
+	}
+	c := common(f.prefix, rest)
+	if c == len(f.prefix) {
+		return f.Node.lookupNode(ctx, path, i+c, depth+1, l)
+	}
+	return nil, notFound(rest)
+}
+
+// LookupOrNil finds the entry for a path like Lookup, reporting a missing
+// value with found set to false instead of ErrNotFound, so that lookups
+// which often miss do not build and match an error. The error is only set if
+// the lookup fails, for example because a node cannot be loaded.
+func (n *Node) LookupOrNil(ctx context.Context, path []byte, l Loader) (entry []byte, found bool, err error) {
+	node := n
+	i := 0
+	for depth := 0; ; depth++ {
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		default:
 		}
-		nn.refBytesSize = n.refBytesSize
-		// check for prefix size limit
-		if len(path) > nodePrefixMaxSize {
-			prefix := path[:nodePrefixMaxSize]
-			rest := path[nodePrefixMaxSize:]
-			err := nn.Add(ctx, rest, entry, metadata, ls)
-			if err != nil {
-				return err
+		if err := node.checkDepth(depth); err != nil {
+			return nil, false, err
+		}
+		if node.forks == nil {
+			if err := node.loadPath(ctx, path[:i], l); err != nil {
+				return nil, false, err
 			}
-			nn.updateIsWithPathSeparator(prefix)
-			n.forks[path[0]] = &fork{prefix, nn}
-			n.makeEdge()
-			return nil
 		}
-		nn.entry = entry
-		if len(metadata) > 0 {
-			nn.metadata = metadata
-			nn.makeWithMetadata()
+		if i == len(path) {
+			if !node.IsValueType() {
+				return nil, false, nil
+			}
+			return node.entry, true, nil
 		}
-		nn.makeValue()
-		nn.updateIsWithPathSeparator(path)
-		n.forks[path[0]] = &fork{path, nn}
-		n.makeEdge()
-		return nil
+		f := node.forks[path[i]]
+		if f == nil || !bytes.HasPrefix(path[i:], f.prefix) {
+			return nil, false, nil
+		}
+		i += len(f.prefix)
+		node = f.Node
 	}
-	c := common(f.prefix, path)
-	rest := f.prefix[len(c):]
-	nn := f.Node
-	if len(rest) > 0 {
-		// move current common prefix node
-		nn = New()
-		if len(n.obfuscationKey) > 0 {
-			nn.SetObfuscationKey(n.obfuscationKey)
+}
+
+// LookupNearest looks up the value stored on path and, if there is none,
+// returns the longest prefix of path which exists in the trie, for error
+// messages such as "a/b/ exists but a/b/c.txt does not". A prefix exists if
+// a value is stored on it, or if it ends with the separator and values are
+// stored below it, whether or not the directory has an entry of its own. The
+// empty path is returned if no such prefix exists. If a value is stored on
+// path, path is returned and found is true.
+func (n *Node) LookupNearest(ctx context.Context, path []byte, l Loader) (nearest []byte, found bool, err error) {
+	separator := n.configOrDefault().separator
+	// matched is the length of the prefix of path stored in the trie, and
+	// exists the length of the longest prefix which exists
+	matched, exists := 0, 0
+	// the type of a persisted root is only known once it is loaded, the
+	// other nodes take theirs from the forks of their parents
+	if n.forks == nil {
+		if err := n.loadPath(ctx, path[:0], l); err != nil {
+			return nil, false, err
 		}
-		nn.refBytesSize = n.refBytesSize
-		f.Node.updateIsWithPathSeparator(rest)
-		nn.forks[rest[0]] = &fork{rest, f.Node}
-		nn.makeEdge()
-		// if common path is full path new node is value type
-		if len(path) == len(c) {
-			nn.makeValue()
+	}
+	node := n
+	for depth := 0; ; depth++ {
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		default:
+		}
+		if node.IsValueType() {
+			exists = matched
+		}
+		if matched == len(path) {
+			found = node.IsValueType()
+			break
+		}
+		if err := node.checkDepth(depth); err != nil {
+			return nil, false, err
+		}
+		if node.forks == nil {
+			if err := node.loadPath(ctx, path[:matched], l); err != nil {
+				return nil, false, err
+			}
+		}
+		f := node.forks[path[matched]]
+		if f == nil {
+			break
+		}
+		c := common(f.prefix, path[matched:])
+		matched += c
+		if c < len(f.prefix) {
+			break
 		}
+		node = f.Node
 	}
-	// NOTE: special case on edge split
-	nn.updateIsWithPathSeparator(path)
-	// add new for shared prefix
-	err := nn.Add(ctx, path[len(c):], entry, metadata, ls)
-	if err != nil {
-		return err
+	if found {
+		return append([]byte{}, path...), true, nil
 	}
-	n.forks[path[0]] = &fork{c, nn}
-	n.makeEdge()
-	return nil
+	// directories are implied by the separators of the stored paths
+	if i := bytes.LastIndexByte(path[:matched], separator); i+1 > exists {
+		exists = i + 1
+	}
+	return append([]byte{}, path[:exists]...), false, nil
 }
 
-func (n *Node) updateIsWithPathSeparator(path []byte) {
-	if bytes.IndexRune(path, PathSeparator) > 0 {
-		n.makeWithPathSeparator()
-	} else {
-		n.makeNotWithPathSeparator()
-	}
+// lookupPrefix descends to the node under which all paths starting with path
+// are stored. If path ends inside the prefix of a fork, the node of that fork
+// is returned together with the unmatched rest of the fork prefix.
+func (n *Node) lookupPrefix(ctx context.Context, path []byte, l Loader) (*Node, []byte, error) {
+	return n.lookupPrefixFrom(ctx, path, 0, 0, l)
 }
 
-// Remove removes a path from the node
-func (n *Node) Remove(ctx context.Context, path []byte, ls LoadSaver) error {
+func (n *Node) lookupPrefixFrom(ctx context.Context, path []byte, i, depth int, l Loader) (*Node, []byte, error) {
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, nil, ctx.Err()
 	default:
 	}
-	if len(path) == 0 {
-		return ErrEmptyPath
+	if err := n.checkDepth(depth); err != nil {
+		return nil, nil, err
 	}
 	if n.forks == nil {
-		if err := n.load(ctx, ls); err != nil {
-			return err
+		if err := n.loadPath(ctx, path[:i], l); err != nil {
+			return nil, nil, err
 		}
 	}
-	f := n.forks[path[0]]
+	rest := path[i:]
+	if len(rest) == 0 {
+		return n, nil, nil
+	}
+	f := n.forks[rest[0]]
 	if f == nil {
-		return ErrNotFound
+		return nil, nil, notFound(rest)
 	}
-	prefixIndex := bytes.Index(path, f.prefix)
-	if prefixIndex != 0 {
-		return ErrNotFound
+	c := common(f.prefix, rest)
+	if c == len(f.prefix) {
+		return f.Node.lookupPrefixFrom(ctx, path, i+c, depth+1, l)
 	}
-	rest := path[len(f.prefix):]
-	if len(rest) == 0 {
-		// full path matched
-		delete(n.forks, path[0])
-		return nil
+	if c == len(rest) {
+		return f.Node, f.prefix[c:], nil
 	}
-	return f.Node.Remove(ctx, rest, ls)
+	return nil, nil, notFound(rest)
 }
 
-func common(a, b []byte) (c []byte) {
-	for i := 0; i < len(a) && i < len(b) && a[i] == b[i]; i++ {
-		c = append(c, a[i])
+// LookupCaseInsensitive finds the value for a path ignoring ASCII case and
+// returns its entry together with the stored path it resolved to, for
+// example "index.html" for "Index.HTML". If several stored paths match, the
+// first one in byte order is returned, so upper case letters take
+// precedence over lower case ones. Non-ASCII bytes are matched exactly.
+func (n *Node) LookupCaseInsensitive(ctx context.Context, path []byte, l Loader) ([]byte, []byte, error) {
+	node, stored, err := n.lookupFold(ctx, path, 0, 0, []byte{}, l)
+	if err != nil {
+		return nil, nil, err
+	}
+	if node == nil {
+		return nil, nil, notFound(path)
 	}
-	return c
+	return node.entry, stored, nil
 }
 
-// HasPrefix tests whether the node contains prefix path.
-func (n *Node) HasPrefix(ctx context.Context, path []byte, l Loader) (bool, error) {
+// lookupFold descends the forks matching path from index i ignoring ASCII
+// case in byte order, returning the first value found and its stored path,
+// or nil if there is none.
+func (n *Node) lookupFold(ctx context.Context, path []byte, i, depth int, stored []byte, l Loader) (*Node, []byte, error) {
 	select {
 	case <-ctx.Done():
-		return false, ctx.Err()
+		return nil, nil, ctx.Err()
 	default:
 	}
+	if err := n.checkDepth(depth); err != nil {
+		return nil, nil, err
+	}
 	if n.forks == nil {
-		if err := n.load(ctx, l); err != nil {
-			return false, err
+		if err := n.loadPath(ctx, stored, l); err != nil {
+			return nil, nil, err
 		}
 	}
-	if len(path) == 0 {
-		return true, nil
+	rest := path[i:]
+	if len(rest) == 0 {
+		if n.IsValueType() {
+			return n, stored, nil
+		}
+		return nil, nil, nil
 	}
-	f := n.forks[path[0]]
-	if f == nil {
-		return false, nil
+	upper, lower := asciiUpper(rest[0]), asciiLower(rest[0])
+	for _, k := range []byte{upper, lower} {
+		f := n.forks[k]
+		if f == nil || len(f.prefix) > len(rest) || !asciiEqualFold(f.prefix, rest[:len(f.prefix)]) {
+			continue
+		}
+		next := append(stored[:len(stored):len(stored)], f.prefix...)
+		node, s, err := f.Node.lookupFold(ctx, path, i+len(f.prefix), depth+1, next, l)
+		if err != nil || node != nil {
+			return node, s, err
+		}
+		if upper == lower {
+			break
+		}
 	}
-	c := common(f.prefix, path)
-	if len(c) == len(f.prefix) {
-		return f.Node.HasPrefix(ctx, path[len(c):], l)
+	return nil, nil, nil
+}
+
+func asciiLower(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
 	}
-	if bytes.HasPrefix(f.prefix, path) {
-		return true, nil
+	return b
+}
+
+func asciiUpper(b byte) byte {
+	if 'a' <= b && b <= 'z' {
+		return b - ('a' - 'A')
 	}
-	return false, nil
+	return b
+}
+
+func asciiEqualFold(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if asciiLower(a[i]) != asciiLower(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Lookup finds the entry for a path or returns error if not found
+func (n *Node) Lookup(ctx context.Context, path []byte, l Loader) ([]byte, error) {
+	node, err := n.LookupNode(ctx, path, l)
+	if err != nil {
+		return nil, err
+	}
+	return node.entry, nil
+}
+
+// LookupMany finds the entries for a batch of paths like Lookup, descending
+// the trie once for paths sharing a prefix, so that every node is loaded at
+// most once. The entries are keyed by path; paths which are not found are
+// missing from the result. An error is returned only if the lookup fails.
+func (n *Node) LookupMany(ctx context.Context, paths [][]byte, l Loader) (map[string][]byte, error) {
+	queries := make([]pathQuery, len(paths))
+	for i, p := range paths {
+		queries[i] = pathQuery{path: p}
+	}
+	entries := make(map[string][]byte, len(paths))
+	if err := n.lookupMany(ctx, queries, 0, l, entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// LookupAll returns the entries for paths like LookupMany, in the order of
+// paths. ErrNotFound is returned if any of the paths is not found.
+func (n *Node) LookupAll(ctx context.Context, paths [][]byte, l Loader) ([][]byte, error) {
+	found, err := n.LookupMany(ctx, paths, l)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([][]byte, len(paths))
+	for i, p := range paths {
+		e, ok := found[string(p)]
+		if !ok {
+			return nil, notFound(p)
+		}
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+// AddAll adds the references refs on the paths of the same index like Add,
+// without metadata. A node holding no entries yet is built in a single pass
+// over the sorted paths like BuildFromSorted, so that bulk loading a new trie
+// does not split nodes on every add. The node may hold some of the entries if
+// an error is returned.
+func (n *Node) AddAll(ctx context.Context, paths, refs [][]byte, ls LoadSaver) error {
+	if len(paths) != len(refs) {
+		return fmt.Errorf("%w: %d paths for %d references", ErrInvalid, len(paths), len(refs))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if n.ref == nil && n.forks != nil && len(n.forks) == 0 && !n.IsValueType() {
+		entries := make([]Entry, len(paths))
+		for i := range paths {
+			entries[i] = Entry{Path: paths[i], Ref: refs[i]}
+		}
+		if err := n.addSorted(entries); err != nil {
+			return err
+		}
+		for i := range paths {
+			n.auditOp(AuditAdd, paths[i], refs[i])
+		}
+		return nil
+	}
+	for i := range paths {
+		if err := n.Add(ctx, paths[i], refs[i], nil, ls); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pathQuery is a path looked up by LookupMany, matched up to index i.
+type pathQuery struct {
+	path []byte
+	i    int
+}
+
+func (n *Node) lookupMany(ctx context.Context, queries []pathQuery, depth int, l Loader, entries map[string][]byte) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if err := n.checkDepth(depth); err != nil {
+		return err
+	}
+	if len(queries) == 0 {
+		return nil
+	}
+	if n.forks == nil {
+		q := queries[0]
+		if err := n.loadPath(ctx, q.path[:q.i], l); err != nil {
+			return err
+		}
+	}
+	groups := make(map[byte][]pathQuery)
+	for _, q := range queries {
+		rest := q.path[q.i:]
+		if len(rest) == 0 {
+			entries[string(q.path)] = n.entry
+			continue
+		}
+		f := n.forks[rest[0]]
+		if f == nil || !bytes.HasPrefix(rest, f.prefix) {
+			continue
+		}
+		q.i += len(f.prefix)
+		groups[rest[0]] = append(groups[rest[0]], q)
+	}
+	for k, g := range groups {
+		if err := n.forks[k].Node.lookupMany(ctx, g, depth+1, l, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResolutionPath returns the references of the nodes traversed to resolve
+// the value stored on path, ordered from the node itself to the node holding
+// the value. These are the only chunks needed to look up the path, so a
+// client can fetch or prove a single entry without the rest of the manifest.
+// If no value is stored on path, ErrNotFound is returned together with the
+// references traversed so far. ErrNotSaved is returned if a node on the way
+// has unsaved changes, as it has no reference.
+func (n *Node) ResolutionPath(ctx context.Context, path []byte, l Loader) ([][]byte, error) {
+	var refs [][]byte
+	node := n
+	for i, depth := 0, 0; ; depth++ {
+		select {
+		case <-ctx.Done():
+			return refs, ctx.Err()
+		default:
+		}
+		if err := node.checkDepth(depth); err != nil {
+			return refs, err
+		}
+		if node.ref == nil {
+			return refs, fmt.Errorf("node for path %q: %w", path[:i], ErrNotSaved)
+		}
+		if node.forks == nil {
+			if err := node.loadPath(ctx, path[:i], l); err != nil {
+				return refs, err
+			}
+		}
+		refs = append(refs, node.Reference())
+		rest := path[i:]
+		if len(rest) == 0 {
+			if !node.IsValueType() {
+				return refs, notFound(path)
+			}
+			return refs, nil
+		}
+		f := node.forks[rest[0]]
+		if f == nil || !bytes.HasPrefix(rest, f.prefix) {
+			return refs, notFound(rest)
+		}
+		i += len(f.prefix)
+		node = f.Node
+	}
+}
+
+// LookupEntry finds the entry for a path or returns error if no value is
+// stored on the path. For explicit directory entries, added with an empty
+// entry, isDir is true and the entry is nil.
+func (n *Node) LookupEntry(ctx context.Context, path []byte, l Loader) (entry []byte, isDir bool, err error) {
+	node, err := n.LookupNode(ctx, path, l)
+	if err != nil {
+		return nil, false, err
+	}
+	if !node.IsValueType() {
+		return nil, false, notFound(path)
+	}
+	if node.IsDirectoryType() {
+		return nil, true, nil
+	}
+	return node.entry, false, nil
+}
+
+// LookupValue finds the value for a path or returns error if no value is
+// stored on the path. For values added with AddInline, the inline value is
+// returned and inline is true; otherwise the value is the entry.
+func (n *Node) LookupValue(ctx context.Context, path []byte, l Loader) (value []byte, inline bool, err error) {
+	node, err := n.LookupNode(ctx, path, l)
+	if err != nil {
+		return nil, false, err
+	}
+	if !node.IsValueType() {
+		return nil, false, notFound(path)
+	}
+	if !node.IsInlineType() {
+		return node.entry, false, nil
+	}
+	value, err = base64.StdEncoding.DecodeString(node.metadata[MetadataInlineValue])
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: inline value: %v", ErrInvalidMetadata, err)
+	}
+	return value, true, nil
+}
+
+// AddHex adds a hex encoded reference to the path. The decoded reference must
+// match the reference size of the node, if already set.
+func (n *Node) AddHex(ctx context.Context, path string, hexRef string, metadata map[string]string, ls LoadSaver) error {
+	entry, err := hex.DecodeString(hexRef)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidReference, err)
+	}
+	if n.refBytesSize != 0 && len(entry) != n.refBytesSize {
+		return fmt.Errorf("%w: size %d, expected %d", ErrInvalidReference, len(entry), n.refBytesSize)
+	}
+	return n.Add(ctx, []byte(path), entry, metadata, ls)
+}
+
+// AddChecked adds a reference to the path like Add, validating it first. The
+// reference must match the reference size of the node, or be the size of a
+// plain or encrypted Swarm reference if the size is not yet set, and must not
+// be all zeros.
+func (n *Node) AddChecked(ctx context.Context, path []byte, ref []byte, metadata map[string]string, ls LoadSaver) error {
+	if n.forks == nil {
+		if err := n.load(ctx, ls); err != nil {
+			return err
+		}
+	}
+	if n.refBytesSize != 0 {
+		if len(ref) != n.refBytesSize {
+			return fmt.Errorf("%w: size %d, expected %d", ErrInvalidReference, len(ref), n.refBytesSize)
+		}
+	} else if len(ref) != swarmRefSize && len(ref) != swarmEncryptedRefSize {
+		return fmt.Errorf("%w: size %d, expected %d or %d", ErrInvalidReference, len(ref), swarmRefSize, swarmEncryptedRefSize)
+	}
+	if isZero(ref) {
+		return fmt.Errorf("%w: zero reference", ErrInvalidReference)
+	}
+	return n.Add(ctx, path, ref, metadata, ls)
+}
+
+// Sizes of plain and encrypted Swarm references.
+const (
+	swarmRefSize          = 32
+	swarmEncryptedRefSize = 64
+)
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Add adds an entry to the path. An empty entry adds an explicit directory.
+//
+// A path may hold a file and be the directory of other entries at the same
+// time, such as "a/b" and "a/b/c", unless the trie is built with
+// WithRejectPathConflicts.
+func (n *Node) Add(ctx context.Context, path []byte, entry []byte, metadata map[string]string, ls LoadSaver) error {
+	return n.addValue(ctx, path, entry, metadata, false, ls)
+}
+
+// addValue checks the metadata and the path of a value, adds it and audits
+// it. It is the common part of the ways to add a single value.
+func (n *Node) addValue(ctx context.Context, path []byte, entry []byte, metadata map[string]string, inline bool, ls LoadSaver) error {
+	if err := n.checkMetadata(metadata); err != nil {
+		return err
+	}
+	if err := n.checkPathConflict(ctx, path, len(entry) > 0 || inline, ls); err != nil {
+		return err
+	}
+	if err := n.add(ctx, path, entry, metadata, inline, ls); err != nil {
+		return err
+	}
+	n.auditOp(AuditAdd, path, auditRef(entry, inline))
+	return nil
+}
+
+// AddInline adds a value stored inline in the node instead of a reference
+// to it, saving the retrieval of a separate chunk for tiny resources. The
+// value must not be larger than MaxInlineValueSize.
+func (n *Node) AddInline(ctx context.Context, path []byte, value []byte, ls LoadSaver) error {
+	if len(value) > MaxInlineValueSize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrInlineValueTooLarge, len(value), MaxInlineValueSize)
+	}
+	metadata := map[string]string{MetadataInlineValue: base64.StdEncoding.EncodeToString(value)}
+	return n.addValue(ctx, path, nil, metadata, true, ls)
+}
+
+// AddSized adds a reference to the path like Add, storing the size of the
+// referenced content under MetadataContentLength, so that it can be served
+// with a length and ranges without fetching the content first.
+func (n *Node) AddSized(ctx context.Context, path []byte, ref []byte, size int64, metadata map[string]string, ls LoadSaver) error {
+	if size < 0 {
+		return fmt.Errorf("%w: content length %d", ErrInvalidMetadata, size)
+	}
+	md := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		md[k] = v
+	}
+	md[MetadataContentLength] = strconv.FormatInt(size, 10)
+	return n.Add(ctx, path, ref, md, ls)
+}
+
+// ContentLength returns the size of the content referenced on the path, as
+// stored by AddSized. ErrNoContentLength is returned if the entry has no
+// size, and ErrInvalidMetadata if it is not a non-negative integer.
+func (n *Node) ContentLength(ctx context.Context, path []byte, l Loader) (int64, error) {
+	node, err := n.LookupNode(ctx, path, l)
+	if err != nil {
+		return 0, err
+	}
+	v, ok := node.metadata[MetadataContentLength]
+	if !ok {
+		return 0, fmt.Errorf("entry on '%s': %w", path, ErrNoContentLength)
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("%w: content length %q on '%s'", ErrInvalidMetadata, v, path)
+	}
+	return size, nil
+}
+
+// AddFile adds a reference to a file of size bytes like AddSized, also
+// storing under MetadataChunked whether the reference is the root of a tree
+// of chunks, which is the case for files larger than a single chunk. Range
+// requests can then be served knowing the layout of the file without
+// fetching its root chunk first.
+func (n *Node) AddFile(ctx context.Context, path []byte, ref []byte, size int64, metadata map[string]string, ls LoadSaver) error {
+	md := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		md[k] = v
+	}
+	md[MetadataChunked] = strconv.FormatBool(size > ChunkSize)
+	return n.AddSized(ctx, path, ref, size, md, ls)
+}
+
+// EntryKind is the kind of entry stored on a path.
+type EntryKind int
+
+// Kinds of entries.
+const (
+	// EntryFile is a reference to content of unknown layout.
+	EntryFile EntryKind = iota + 1
+	// EntrySingleChunk is a reference to content stored in a single chunk.
+	EntrySingleChunk
+	// EntryChunkedFile is a reference to the root of a tree of chunks.
+	EntryChunkedFile
+	// EntryInline is a value stored in the node, added with AddInline.
+	EntryInline
+	// EntryDirectory is an explicit directory entry.
+	EntryDirectory
+)
+
+// String returns the name of the entry kind.
+func (k EntryKind) String() string {
+	switch k {
+	case EntryFile:
+		return "file"
+	case EntrySingleChunk:
+		return "single chunk"
+	case EntryChunkedFile:
+		return "chunked file"
+	case EntryInline:
+		return "inline"
+	case EntryDirectory:
+		return "directory"
+	default:
+		return "unknown"
+	}
+}
+
+// EntryKind returns the kind of the entry stored on path. The layout of
+// referenced content is taken from MetadataChunked, or else derived from
+// MetadataContentLength; entries with neither are of kind EntryFile.
+// ErrNotFound is returned if no value is stored on path.
+func (n *Node) EntryKind(ctx context.Context, path []byte, l Loader) (EntryKind, error) {
+	node, err := n.LookupNode(ctx, path, l)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case !node.IsValueType():
+		return 0, notFound(path)
+	case node.IsInlineType():
+		return EntryInline, nil
+	case node.IsDirectoryType():
+		return EntryDirectory, nil
+	}
+	if v, ok := node.metadata[MetadataChunked]; ok {
+		chunked, err := strconv.ParseBool(v)
+		if err != nil {
+			return 0, fmt.Errorf("%w: chunked flag %q on '%s'", ErrInvalidMetadata, v, path)
+		}
+		if chunked {
+			return EntryChunkedFile, nil
+		}
+		return EntrySingleChunk, nil
+	}
+	if v, ok := node.metadata[MetadataContentLength]; ok {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("%w: content length %q on '%s'", ErrInvalidMetadata, v, path)
+		}
+		if size > ChunkSize {
+			return EntryChunkedFile, nil
+		}
+		return EntrySingleChunk, nil
+	}
+	return EntryFile, nil
+}
+
+// checkPathConflict returns ErrPathConflict if the trie rejects path
+// conflicts and a directory of path holds a file, or if a file is added on
+// path and path is the directory of other entries.
+func (n *Node) checkPathConflict(ctx context.Context, path []byte, file bool, ls LoadSaver) error {
+	cfg := n.configOrDefault()
+	if !cfg.rejectConflicts {
+		return nil
+	}
+	for i := 1; i < len(path); i++ {
+		if path[i] != cfg.separator {
+			continue
+		}
+		node, err := n.LookupNode(ctx, path[:i], ls)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if isFile(node) {
+			return fmt.Errorf("add %q under file %q: %w", path, path[:i], ErrPathConflict)
+		}
+	}
+	if !file || len(path) == 0 || path[len(path)-1] == cfg.separator {
+		return nil
+	}
+	dir := append(path[:len(path):len(path)], cfg.separator)
+	isDir, err := n.HasPrefix(ctx, dir, ls)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		return fmt.Errorf("add file %q on directory: %w", path, ErrPathConflict)
+	}
+	return nil
+}
+
+// checkEntrySize checks that the entry has the reference size of the node,
+// if the node has one yet. Empty entries of directories are always valid.
+func (n *Node) checkEntrySize(entry []byte) error {
+	if n.refBytesSize == 0 {
+		if len(entry) > 256 {
+			return fmt.Errorf("%w: entry size %d", ErrRefTooLarge, len(entry))
+		}
+		return nil
+	}
+	if len(entry) > 0 && n.refBytesSize != len(entry) {
+		return fmt.Errorf("%w: entry size %d, expected %d", ErrInvalidReference, len(entry), n.refBytesSize)
+	}
+	return nil
+}
+
+// checkMetadata checks the metadata against the limit of the trie.
+func (n *Node) checkMetadata(metadata map[string]string) error {
+	max := n.configOrDefault().maxMetadata
+	if max == 0 || len(metadata) == 0 {
+		return nil
+	}
+	b, err := n.metadataCodecOrDefault().Encode(metadata)
+	if err != nil {
+		return err
+	}
+	if len(b) > max {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrMetadataTooLarge, len(b), max)
+	}
+	return nil
+}
+
+// add recursively adds an entry, or an inline value in metadata, to the path.
+// The reference of the node is only cleared once the entry is added, so that
+// a failed load below the node does not orphan its persisted form.
+func (n *Node) add(ctx context.Context, path []byte, entry []byte, metadata map[string]string, inline bool, ls LoadSaver) error {
+	if err := n.insert(ctx, path, entry, metadata, inline, ls); err != nil {
+		return err
+	}
+	// the node is modified and has to be saved again
+	n.ref = nil
+	return nil
+}
+
+func (n *Node) insert(ctx context.Context, path []byte, entry []byte, metadata map[string]string, inline bool, ls LoadSaver) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if n.forks == nil {
+		if err := n.load(ctx, ls); err != nil {
+			return err
+		}
+	}
+	if err := n.checkEntrySize(entry); err != nil {
+		return err
+	}
+	// empty entry for directories
+	if n.refBytesSize == 0 && len(entry) > 0 {
+		n.refBytesSize = len(entry)
+	}
+
+	if len(path) == 0 {
+		n.setValue(entry, metadata, inline)
+		return nil
+	}
+	f := n.forks[path[0]]
+	if f == nil {
+		if err := n.checkForks(); err != nil {
+			return err
+		}
+		nn := n.newChild()
+		// check for prefix size limit
+		if len(path) > nodePrefixMaxSize {
+			prefix := path[:nodePrefixMaxSize]
+			rest := path[nodePrefixMaxSize:]
+			err := nn.add(ctx, rest, entry, metadata, inline, ls)
+			if err != nil {
+				return err
+			}
+			nn.updateIsWithPathSeparator(prefix)
+			n.forks[path[0]] = &fork{prefix, nn}
+			n.makeEdge()
+			return nil
+		}
+		nn.setValue(entry, metadata, inline)
+		nn.updateIsWithPathSeparator(path)
+		n.forks[path[0]] = &fork{path, nn}
+		n.makeEdge()
+		return nil
+	}
+	c := commonPrefix(f.prefix, path)
+	rest := f.prefix[len(c):]
+	nn := f.Node
+	// a chain link which is split is merged with the rest of the chain
+	chained := len(rest) > 0 && len(f.prefix) == nodePrefixMaxSize && !nn.IsValueType()
+	// load before changing the node, so that a failed load leaves it as it
+	// is persisted
+	if len(rest) == 0 && nn.forks == nil {
+		if err := nn.load(ctx, ls); err != nil {
+			return err
+		}
+	}
+	if chained {
+		if err := loadChain(ctx, nn, ls); err != nil {
+			return err
+		}
+	}
+	if len(rest) > 0 {
+		// move current common prefix node
+		nn = n.newChild()
+		f.Node.updateIsWithPathSeparator(rest)
+		nn.forks[rest[0]] = &fork{rest, f.Node}
+		nn.makeEdge()
+		if chained {
+			if err := nn.normalizeFork(ctx, rest[0], ls); err != nil {
+				return err
+			}
+		}
+		// if common path is full path new node is value type
+		if len(path) == len(c) {
+			nn.makeValue()
+		}
+		nn.updateIsWithPathSeparator(c)
+	}
+	// add new for shared prefix
+	err := nn.add(ctx, path[len(c):], entry, metadata, inline, ls)
+	if err != nil {
+		return err
+	}
+	n.forks[path[0]] = &fork{c, nn}
+	n.makeEdge()
+	return nil
+}
+
+// AddStream adds the entries received from in until in is closed or ctx is
+// done, returning the first error.
+func (n *Node) AddStream(ctx context.Context, in <-chan Entry, ls LoadSaver) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-in:
+			if !ok {
+				return nil
+			}
+			if err := checkBinaryMetadata(e.BinaryMetadata); err != nil {
+				return fmt.Errorf("add %q: %w", e.Path, err)
+			}
+			if err := n.Add(ctx, e.Path, e.Ref, e.Metadata, ls); err != nil {
+				return fmt.Errorf("add %q: %w", e.Path, err)
+			}
+			if len(e.BinaryMetadata) > 0 {
+				if err := n.SetBinaryMetadata(ctx, e.Path, e.BinaryMetadata, ls); err != nil {
+					return fmt.Errorf("add %q: %w", e.Path, err)
+				}
+			}
+		}
+	}
+}
+
+// setValue stores the entry and metadata on the node. An empty entry marks
+// the node as an explicit directory, unless the value is inline.
+func (n *Node) setValue(entry []byte, metadata map[string]string, inline bool) {
+	n.entry = entry
+	if !inline {
+		n.removeInlineValue()
+	}
+	if len(metadata) > 0 {
+		n.metadata = metadata
+		n.makeWithMetadata()
+	}
+	n.makeValue()
+	if inline {
+		n.makeInline()
+	} else {
+		n.makeNotInline()
+	}
+	if len(entry) == 0 && !inline {
+		n.makeDirectory()
+	} else {
+		n.makeNotDirectory()
+	}
+}
+
+// removeInlineValue removes the inline value of a replaced entry from the
+// metadata of the node.
+func (n *Node) removeInlineValue() {
+	if _, ok := n.metadata[MetadataInlineValue]; !ok {
+		return
+	}
+	metadata := make(map[string]string, len(n.metadata)-1)
+	for k, v := range n.metadata {
+		if k != MetadataInlineValue {
+			metadata[k] = v
+		}
+	}
+	if len(metadata) == 0 {
+		n.metadata = nil
+		n.makeNotWithMetadata()
+		return
+	}
+	n.metadata = metadata
+}
+
+// newChild creates a node inheriting the settings of the node.
+func (n *Node) newChild() *Node {
+	nn := New()
+	if len(n.obfuscationKey) > 0 {
+		nn.obfuscationKey = append([]byte{}, n.obfuscationKey...)
+	}
+	nn.refBytesSize = n.refBytesSize
+	nn.metadataCodec = n.metadataCodec
+	nn.cfg = n.cfg
+	nn.tracer = n.tracer
+	return nn
+}
+
+func (n *Node) updateIsWithPathSeparator(path []byte) {
+	if bytes.IndexByte(path, n.configOrDefault().separator) > 0 {
+		n.makeWithPathSeparator()
+	} else {
+		n.makeNotWithPathSeparator()
+	}
+}
+
+// IsLoaded returns true if the forks of the node are in memory, false if the
+// node is only a reference to a persisted node.
+func (n *Node) IsLoaded() bool {
+	return n.forks != nil
+}
+
+// Unload releases the forks of a persisted node, which are loaded again when
+// needed. It returns ErrNotSaved if the node has unsaved changes.
+func (n *Node) Unload() error {
+	if n.ref == nil {
+		return ErrNotSaved
+	}
+	n.forks = nil
+	return nil
+}
+
+// Graft mounts the trie rooted at sub on path. Nothing may be stored on or
+// below path, and sub must have the reference size of the node. A copy of
+// sub is grafted, so later changes of the node do not modify sub, and a
+// persisted sub keeps its references and obfuscation keys and is not saved
+// again.
+//
+// Every value of sub is audited as added on its path below path. To that
+// end, the whole of sub is loaded if the node has an audit function.
+func (n *Node) Graft(ctx context.Context, path []byte, sub *Node, ls LoadSaver) error {
+	if len(path) == 0 {
+		return ErrEmptyPath
+	}
+	if sub.forks == nil {
+		if err := sub.load(ctx, ls); err != nil {
+			return err
+		}
+	}
+	// the values are collected before grafting, so that a failure to load
+	// sub leaves the node unchanged
+	var added []Entry
+	if n.audit != nil {
+		err := walkValues(ctx, append([]byte{}, path...), ls, sub, func(p []byte, node *Node) error {
+			added = append(added, Entry{Path: p, Ref: auditRef(node.entry, node.IsInlineType())})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// the conflicts are checked before changing any node
+	if err := n.checkGraft(ctx, path, ls); err != nil {
+		return err
+	}
+	if n.refBytesSize != 0 && sub.refBytesSize != 0 && n.refBytesSize != sub.refBytesSize {
+		return fmt.Errorf("graft on '%s': %w: size %d, expected %d", path, ErrInvalidReference, sub.refBytesSize, n.refBytesSize)
+	}
+	if n.refBytesSize == 0 {
+		n.refBytesSize = sub.refBytesSize
+	}
+	c := sub.snapshot()
+	// the type of the root of a persisted trie is not stored
+	if len(sub.forks) > 0 {
+		c.makeEdge()
+	}
+	if err := n.graft(ctx, path, c, ls); err != nil {
+		return err
+	}
+	for _, e := range added {
+		n.auditOp(AuditAdd, e.Path, e.Ref)
+	}
+	return nil
+}
+
+// checkGraft returns ErrPathExists if anything is stored on or below path,
+// loading the nodes on the way which graft changes.
+func (n *Node) checkGraft(ctx context.Context, path []byte, ls LoadSaver) error {
+	for node, rest := n, path; ; {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if node.forks == nil {
+			if err := node.loadPath(ctx, path[:len(path)-len(rest)], ls); err != nil {
+				return err
+			}
+		}
+		f := node.forks[rest[0]]
+		if f == nil {
+			return nil
+		}
+		c := commonPrefix(f.prefix, rest)
+		if len(c) == len(rest) {
+			return fmt.Errorf("graft on '%s': %w", path, ErrPathExists)
+		}
+		if len(c) < len(f.prefix) {
+			return nil
+		}
+		node, rest = f.Node, rest[len(c):]
+	}
+}
+
+func (n *Node) graft(ctx context.Context, path []byte, sub *Node, ls LoadSaver) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if n.forks == nil {
+		if err := n.load(ctx, ls); err != nil {
+			return err
+		}
+	}
+	n.ref = nil
+	f := n.forks[path[0]]
+	if f == nil {
+		if len(path) > nodePrefixMaxSize {
+			prefix := path[:nodePrefixMaxSize]
+			nn := n.newChild()
+			if err := nn.graft(ctx, path[nodePrefixMaxSize:], sub, ls); err != nil {
+				return err
+			}
+			nn.updateIsWithPathSeparator(prefix)
+			n.forks[path[0]] = &fork{prefix, nn}
+			n.makeEdge()
+			return nil
+		}
+		sub.updateIsWithPathSeparator(path)
+		n.forks[path[0]] = &fork{path, sub}
+		n.makeEdge()
+		return nil
+	}
+	c := commonPrefix(f.prefix, path)
+	if len(c) == len(path) {
+		return fmt.Errorf("graft on '%s': %w", path, ErrPathExists)
+	}
+	nn := f.Node
+	if rest := f.prefix[len(c):]; len(rest) > 0 {
+		nn = n.newChild()
+		f.Node.updateIsWithPathSeparator(rest)
+		nn.forks[rest[0]] = &fork{rest, f.Node}
+		nn.makeEdge()
+		nn.updateIsWithPathSeparator(c)
+	}
+	if err := nn.graft(ctx, path[len(c):], sub, ls); err != nil {
+		return err
+	}
+	n.forks[path[0]] = &fork{c, nn}
+	return nil
+}
+
+// Remove removes the entry on path from the node. Entries below path are
+// kept, and the trie is left in the canonical form it would have if the
+// entry had never been added, so that the reference of a trie depends only
+// on its entries and not on the order of the edits. Removing a path which
+// holds no entry, such as the directory prefix of other entries, fails with
+// ErrNotFound.
+//
+// Tries built with WithPruneDirectories also remove the explicit directory
+// entries emptied by the removal.
+func (n *Node) Remove(ctx context.Context, path []byte, ls LoadSaver) error {
+	if err := n.remove(ctx, path, ls); err != nil {
+		return err
+	}
+	n.auditOp(AuditRemove, path, nil)
+	if n.configOrDefault().pruneDirectories {
+		return n.pruneDirectories(ctx, path, ls)
+	}
+	return nil
+}
+
+// pruneDirectories removes the explicit directory entries of the directories
+// of path left without entries, from the innermost one up to the first
+// directory still holding entries.
+func (n *Node) pruneDirectories(ctx context.Context, path []byte, ls LoadSaver) error {
+	separator := n.configOrDefault().separator
+	// the trailing separator of a removed directory entry is not one of its
+	// directories
+	for i := len(path) - 2; i >= 0; i-- {
+		if path[i] != separator {
+			continue
+		}
+		dir := path[:i+1]
+		node, err := n.LookupNode(ctx, dir, ls)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err == nil && node.IsValueType() && node.IsDirectoryType() {
+			if len(node.forks) > 0 {
+				return nil
+			}
+			if err := n.remove(ctx, dir, ls); err != nil {
+				return err
+			}
+			n.auditOp(AuditRemove, dir, nil)
+			continue
+		}
+		ok, err := n.HasPrefix(ctx, dir, ls)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (n *Node) remove(ctx context.Context, path []byte, ls LoadSaver) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if len(path) == 0 {
+		return ErrEmptyPath
+	}
+	if n.forks == nil {
+		if err := n.load(ctx, ls); err != nil {
+			return err
+		}
+	}
+	f := n.forks[path[0]]
+	if f == nil {
+		return ErrNotFound
+	}
+	prefixIndex := bytes.Index(path, f.prefix)
+	if prefixIndex != 0 {
+		return ErrNotFound
+	}
+	rest := path[len(f.prefix):]
+	if len(rest) == 0 {
+		// full path matched, only a value is removed and never the
+		// entries below it
+		if !f.Node.IsValueType() {
+			return ErrNotFound
+		}
+		if err := loadChain(ctx, f.Node, ls); err != nil {
+			return err
+		}
+		f.Node.removeValue()
+	} else if err := f.Node.remove(ctx, rest, ls); err != nil {
+		return err
+	}
+	n.ref = nil
+	if err := n.normalizeFork(ctx, path[0], ls); err != nil {
+		return err
+	}
+	if len(n.forks) == 0 {
+		n.makeNotEdge()
+		if !n.IsValueType() {
+			// an emptied trie takes the reference size of the next entry
+			// again, so that it is the same as a new one
+			n.refBytesSize = n.configOrDefault().refSize
+		}
+	}
+	return nil
+}
+
+// RemoveWhere removes every entry for which pred returns true and returns the
+// number of removed entries. The trie is walked once to collect the matching
+// entries, which are removed afterwards, leaving the trie in canonical form.
+// Nodes are loaded as needed.
+func (n *Node) RemoveWhere(ctx context.Context, ls LoadSaver, pred func(path []byte, n *Node) bool) (int, error) {
+	var paths [][]byte
+	err := walkValues(ctx, []byte{}, ls, n, func(path []byte, node *Node) error {
+		if len(path) > 0 && pred(path, node) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, path := range paths {
+		if err := n.Remove(ctx, path, ls); err != nil {
+			return i, fmt.Errorf("remove %q: %w", path, err)
+		}
+	}
+	return len(paths), nil
+}
+
+// removeValue removes the entry and metadata of the node, keeping its forks.
+func (n *Node) removeValue() {
+	n.entry = nil
+	n.metadata = nil
+	n.binaryMetadata = nil
+	n.makeNotValue()
+	n.makeNotWithMetadata()
+	n.makeNotWithBinaryMetadata()
+	n.makeNotInline()
+	n.makeNotDirectory()
+	n.ref = nil
+}
+
+// loadChain loads the node and the nodes chained below it which hold no
+// value and have a single fork, so that they can be normalized without
+// failing to load after a change.
+func loadChain(ctx context.Context, n *Node, ls LoadSaver) error {
+	for {
+		if n.forks == nil {
+			if err := n.load(ctx, ls); err != nil {
+				return err
+			}
+		}
+		if n.IsValueType() || len(n.forks) != 1 {
+			return nil
+		}
+		for _, f := range n.forks {
+			n = f.Node
+		}
+	}
+}
+
+// normalizeFork restores the canonical form of the fork on key after its
+// node lost its value or forks. A fork to a node holding neither a value nor
+// forks is removed, and a fork to a node without a value and with a single
+// fork is merged with that fork, filling its prefix up to nodePrefixMaxSize
+// and continuing down the chain, as Add chains prefixes which are too long.
+func (n *Node) normalizeFork(ctx context.Context, key byte, ls LoadSaver) error {
+	f := n.forks[key]
+	if f == nil || f.Node.IsValueType() {
+		return nil
+	}
+	if err := loadChain(ctx, f.Node, ls); err != nil {
+		return err
+	}
+	for !f.Node.IsValueType() {
+		if len(f.Node.forks) == 0 {
+			delete(n.forks, key)
+			n.ref = nil
+			return nil
+		}
+		if len(f.Node.forks) > 1 || len(f.prefix) >= nodePrefixMaxSize {
+			return nil
+		}
+		var g *fork
+		for _, g = range f.Node.forks {
+		}
+		n.ref = nil
+		k := nodePrefixMaxSize - len(f.prefix)
+		if len(g.prefix) <= k {
+			// the node is replaced by the node of its only fork
+			f.prefix = append(f.prefix[:len(f.prefix):len(f.prefix)], g.prefix...)
+			f.Node = g.Node
+			f.Node.updateIsWithPathSeparator(f.prefix)
+			continue
+		}
+		// the start of the only fork is moved to the prefix of the node
+		f.prefix = append(f.prefix[:len(f.prefix):len(f.prefix)], g.prefix[:k]...)
+		f.Node.updateIsWithPathSeparator(f.prefix)
+		f.Node.ref = nil
+		delete(f.Node.forks, g.prefix[0])
+		g = &fork{g.prefix[k:], g.Node}
+		g.Node.updateIsWithPathSeparator(g.prefix)
+		f.Node.forks[g.prefix[0]] = g
+		return f.Node.normalizeFork(ctx, g.prefix[0], ls)
+	}
+	return nil
+}
+
+// common returns the length of the common prefix of a and b.
+func common(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// commonPrefix returns the common prefix of a and b, sharing the memory of a
+// without its spare capacity.
+func commonPrefix(a, b []byte) []byte {
+	c := common(a, b)
+	return a[:c:c]
+}
+
+// Complete returns the completions of partial for autocompletion in byte
+// order: the paths of the values starting with partial, cut after the first
+// separator following partial, so that a directory is completed once with its
+// trailing separator rather than with every path below it. Unlike HasPrefix,
+// partial need not end on a separator or a fork boundary, so "ima" completes
+// to "images/". At most limit completions are returned, all of them if limit
+// is 0, and none if no path starts with partial.
+func (n *Node) Complete(ctx context.Context, partial []byte, limit int, l Loader) ([][]byte, error) {
+	node, rest, err := n.lookupPrefix(ctx, partial, l)
+	if errors.Is(err, ErrNotFound) && !errors.Is(err, ErrStore) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	separator := n.configOrDefault().separator
+	var completions [][]byte
+	path := append(append([]byte{}, partial...), rest...)
+	err = walkValues(ctx, path, l, node, func(path []byte, _ *Node) error {
+		c := path
+		if i := bytes.IndexByte(path[len(partial):], separator); i >= 0 {
+			c = path[:len(partial)+i+1]
+		}
+		// the paths below a directory follow each other in byte order
+		if len(completions) > 0 && bytes.Equal(completions[len(completions)-1], c) {
+			return nil
+		}
+		if limit > 0 && len(completions) == limit {
+			return ErrStopWalk
+		}
+		completions = append(completions, append(c[:0:0], c...))
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrStopWalk) {
+		return nil, err
+	}
+	return completions, nil
+}
+
+// HasPrefix tests whether the node contains prefix path.
+func (n *Node) HasPrefix(ctx context.Context, path []byte, l Loader) (bool, error) {
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	default:
+	}
+	if n.forks == nil {
+		if err := n.load(ctx, l); err != nil {
+			return false, err
+		}
+	}
+	if len(path) == 0 {
+		return true, nil
+	}
+	f := n.forks[path[0]]
+	if f == nil {
+		return false, nil
+	}
+	c := common(f.prefix, path)
+	if c == len(f.prefix) {
+		return f.Node.HasPrefix(ctx, path[c:], l)
+	}
+	if bytes.HasPrefix(f.prefix, path) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// PathClass tells whether a path is a file, a directory or both.
+type PathClass int
+
+// Path classes. ClassFileAndDir is ClassFile and ClassDir combined.
+const (
+	ClassNone       PathClass = 0
+	ClassFile       PathClass = 1
+	ClassDir        PathClass = 2
+	ClassFileAndDir           = ClassFile | ClassDir
+)
+
+// Classify returns the class of path: ClassFile if an entry which is not a
+// directory entry is stored on it, ClassDir if a directory entry is stored on
+// it or entries are stored below it in the directory ending with the
+// separator, ClassFileAndDir if both hold and ClassNone if neither does. The
+// empty path is the root directory.
+func (n *Node) Classify(ctx context.Context, path []byte, l Loader) (PathClass, error) {
+	separator := n.configOrDefault().separator
+	class := ClassNone
+
+	if len(path) > 0 {
+		node, err := n.LookupNode(ctx, path, l)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return ClassNone, err
+		}
+		if err == nil && isFile(node) {
+			class |= ClassFile
+		}
+	}
+
+	dir := path
+	if len(dir) > 0 && dir[len(dir)-1] != separator {
+		dir = append(path[:len(path):len(path)], separator)
+	}
+	node, rest, err := n.lookupPrefix(ctx, dir, l)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return ClassNone, err
+	}
+	if err == nil && (len(rest) > 0 || len(node.forks) > 0 || len(dir) > 0 && node.IsValueType()) {
+		class |= ClassDir
+	}
+	return class, nil
 }
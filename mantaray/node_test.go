@@ -7,8 +7,12 @@ package mantaray
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	mrand "math/rand"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -255,6 +259,28 @@ func TestRemove(t *testing.T) {
 	}
 }
 
+func TestRemoveNonValue(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	paths := []string{"index.html", "img/1.png", "img/2.png"}
+	for _, p := range paths {
+		if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	for _, p := range []string{"img/", "img", "index"} {
+		if err := n.Remove(ctx, []byte(p), nil); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected not found error removing %q, got %v", p, err)
+		}
+	}
+	// entries below the paths are kept
+	for _, p := range paths {
+		if _, err := n.Lookup(ctx, []byte(p), nil); err != nil {
+			t.Fatalf("expected no error looking up %q, got %v", p, err)
+		}
+	}
+}
+
 func TestHasPrefix(t *testing.T) {
 	for _, tc := range []struct {
 		name        string
@@ -326,3 +352,1133 @@ func TestHasPrefix(t *testing.T) {
 		})
 	}
 }
+
+func TestAddHex(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+
+	ref := strings.Repeat("ab", 32)
+	err := n.AddHex(ctx, "index.html", ref, nil, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	node, err := n.LookupNode(ctx, []byte("index.html"), nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if hex.EncodeToString(node.Entry()) != ref {
+		t.Fatalf("expected entry %s, got %x", ref, node.Entry())
+	}
+
+	for _, tc := range []struct {
+		name string
+		ref  string
+	}{
+		{name: "wrong-length", ref: strings.Repeat("ab", 64)},
+		{name: "odd-length", ref: strings.Repeat("a", 63)},
+		{name: "malformed", ref: strings.Repeat("zz", 32)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := n.AddHex(ctx, "robots.txt", tc.ref, nil, nil)
+			if !errors.Is(err, ErrInvalidReference) {
+				t.Fatalf("expected invalid reference error, got %v", err)
+			}
+			_, err = n.Lookup(ctx, []byte("robots.txt"), nil)
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected not found error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAddChecked(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name string
+		ref  []byte
+	}{
+		{name: "zero", ref: make([]byte, 32)},
+		{name: "truncated", ref: bytes.Repeat([]byte{1}, 31)},
+		{name: "empty", ref: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			n := New()
+			err := n.AddChecked(ctx, []byte("index.html"), tc.ref, nil, nil)
+			if !errors.Is(err, ErrInvalidReference) {
+				t.Fatalf("expected invalid reference error, got %v", err)
+			}
+			_, err = n.Lookup(ctx, []byte("index.html"), nil)
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected not found error, got %v", err)
+			}
+		})
+	}
+
+	n := New()
+	ref := bytes.Repeat([]byte{1}, 64)
+	if err := n.AddChecked(ctx, []byte("index.html"), ref, nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// the size is fixed by the first reference
+	err := n.AddChecked(ctx, []byte("robots.txt"), ref[:32], nil, nil)
+	if !errors.Is(err, ErrInvalidReference) {
+		t.Fatalf("expected invalid reference error, got %v", err)
+	}
+	got, err := n.Lookup(ctx, []byte("index.html"), nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(got, ref) {
+		t.Fatalf("expected reference %x, got %x", ref, got)
+	}
+}
+
+func TestAddStream(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	in := make(chan Entry)
+	go func() {
+		defer close(in)
+		for i := 0; i < 1000; i++ {
+			p := []byte(fmt.Sprintf("dir%d/file%d", i%10, i))
+			in <- Entry{Path: p, Ref: append(make([]byte, 32-len(p)), p...)}
+		}
+	}()
+	err := n.AddStream(ctx, in, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	ls := mapLoadSaver{}
+	err = n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	n = NewNodeRef(n.Reference())
+	for i := 0; i < 1000; i++ {
+		p := []byte(fmt.Sprintf("dir%d/file%d", i%10, i))
+		e, err := n.Lookup(ctx, p, ls)
+		if err != nil {
+			t.Fatalf("expected no error on %s, got %v", p, err)
+		}
+		if !bytes.Equal(e, append(make([]byte, 32-len(p)), p...)) {
+			t.Fatalf("expected entry for %s, got %x", p, e)
+		}
+	}
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		err := New().AddStream(ctx, make(chan Entry), nil)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context canceled error, got %v", err)
+		}
+	})
+}
+
+func TestAddInline(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	ref := bytes.Repeat([]byte{1}, 32)
+	err := n.Add(ctx, []byte("index.html"), ref, nil, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	value := []byte("User-agent: *\nDisallow: /\n")
+	err = n.AddInline(ctx, []byte("robots.txt"), value, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.AddInline(ctx, []byte("large.txt"), make([]byte, MaxInlineValueSize+1), nil)
+	if !errors.Is(err, ErrInlineValueTooLarge) {
+		t.Fatalf("expected inline value too large error, got %v", err)
+	}
+
+	ls := mapLoadSaver{}
+	err = n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	n = NewNodeRef(n.Reference())
+
+	got, inline, err := n.LookupValue(ctx, []byte("robots.txt"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !inline || !bytes.Equal(got, value) {
+		t.Fatalf("expected inline value %q, got %q (inline %t)", value, got, inline)
+	}
+	_, isDir, err := n.LookupEntry(ctx, []byte("robots.txt"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if isDir {
+		t.Fatal("expected inline value not to be a directory")
+	}
+
+	got, inline, err = n.LookupValue(ctx, []byte("index.html"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if inline || !bytes.Equal(got, ref) {
+		t.Fatalf("expected reference %x, got %x (inline %t)", ref, got, inline)
+	}
+
+	// replacing the inline value with a reference drops the inline value
+	err = n.Add(ctx, []byte("robots.txt"), ref, nil, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	node, err := n.LookupNode(ctx, []byte("robots.txt"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if node.IsInlineType() || node.Metadata() != nil {
+		t.Fatalf("expected reference without metadata, got %+v", node.Metadata())
+	}
+}
+
+// loadedTrie returns a saved and fully loaded trie with the paths.
+func loadedTrie(tb testing.TB, paths []string) *Node {
+	tb.Helper()
+	ctx := context.Background()
+	n := New()
+	for _, p := range paths {
+		e := make([]byte, 32)
+		copy(e, p)
+		if err := n.Add(ctx, []byte(p), e, nil, nil); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		tb.Fatal(err)
+	}
+	n = NewNodeRef(n.Reference())
+	// load every node
+	if _, err := n.ToMap(ctx, ls); err != nil {
+		tb.Fatal(err)
+	}
+	return n
+}
+
+var lookupPaths = []string{"index.html", "img/1.png", "img/2/test1.png", "img/2/test2.png", "robots.txt"}
+
+func TestLookupAllocs(t *testing.T) {
+	ctx := context.Background()
+	n := loadedTrie(t, lookupPaths)
+	path := []byte("img/2/test2.png")
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := n.Lookup(ctx, path, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	ctx := context.Background()
+	n := loadedTrie(b, lookupPaths)
+	path := []byte("img/2/test2.png")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := n.Lookup(ctx, path, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLookupOrNil(t *testing.T) {
+	ctx := context.Background()
+	n := loadedTrie(t, lookupPaths)
+	for _, tc := range []struct {
+		path  string
+		found bool
+	}{
+		{"img/2/test2.png", true},
+		{"img/2/", false},
+		{"img/2/test3.png", false},
+		{"img/2/test2.png.bak", false},
+		{"", false},
+	} {
+		entry, found, err := n.LookupOrNil(ctx, []byte(tc.path), nil)
+		if err != nil {
+			t.Fatalf("expected no error on %q, got %v", tc.path, err)
+		}
+		if found != tc.found {
+			t.Fatalf("expected found %v on %q, got %v", tc.found, tc.path, found)
+		}
+		expected, err := n.Lookup(ctx, []byte(tc.path), nil)
+		if tc.found && (err != nil || !bytes.Equal(entry, expected)) {
+			t.Fatalf("expected entry %x on %q, got %x", expected, tc.path, entry)
+		}
+		if !tc.found && entry != nil {
+			t.Fatalf("expected no entry on %q, got %x", tc.path, entry)
+		}
+	}
+
+	missing := []byte("img/2/test3.png")
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, _, err := n.LookupOrNil(ctx, missing, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations on a miss, got %v", allocs)
+	}
+
+	if _, _, err := NewNodeRef(make([]byte, 32)).LookupOrNil(ctx, []byte("a"), nil); !errors.Is(err, ErrNoLoader) {
+		t.Fatalf("expected no loader error, got %v", err)
+	}
+}
+
+func BenchmarkLookupMiss(b *testing.B) {
+	ctx := context.Background()
+	n := loadedTrie(b, lookupPaths)
+	path := []byte("img/2/test3.png")
+	b.Run("error", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := n.Lookup(ctx, path, nil); !errors.Is(err, ErrNotFound) {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("found", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, found, err := n.LookupOrNil(ctx, path, nil); found || err != nil {
+				b.Fatal(found, err)
+			}
+		}
+	})
+}
+
+func TestPathConflict(t *testing.T) {
+	ctx := context.Background()
+	file := bytes.Repeat([]byte{1}, 32)
+	subfile := bytes.Repeat([]byte{2}, 32)
+
+	for _, tc := range []struct {
+		name  string
+		order []string
+	}{
+		{name: "file-then-subfile", order: []string{"a/b", "a/b/c"}},
+		{name: "subfile-then-file", order: []string{"a/b/c", "a/b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries := map[string][]byte{"a/b": file, "a/b/c": subfile}
+
+			// allowed by default, storing both
+			n := New()
+			for _, p := range tc.order {
+				if err := n.Add(ctx, []byte(p), entries[p], nil, nil); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+			}
+			node, err := n.LookupNode(ctx, []byte("a/b"), nil)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !node.IsValueType() || !node.IsEdgeType() {
+				t.Fatalf("expected value and edge type, got %s", strconv.FormatInt(int64(node.nodeType), 2))
+			}
+			ls := mapLoadSaver{}
+			if err := n.Save(ctx, ls); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			m, err := NewNodeRef(n.Reference()).ToMap(ctx, ls)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if len(m) != 2 || !bytes.Equal(m["a/b"], file) || !bytes.Equal(m["a/b/c"], subfile) {
+				t.Fatalf("expected both entries, got %x", m)
+			}
+
+			// rejected with the option
+			n, err = NewBuilder().WithRejectPathConflicts().Build()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if err := n.Add(ctx, []byte(tc.order[0]), entries[tc.order[0]], nil, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			err = n.Add(ctx, []byte(tc.order[1]), entries[tc.order[1]], nil, nil)
+			if !errors.Is(err, ErrPathConflict) {
+				t.Fatalf("expected path conflict error, got %v", err)
+			}
+			if _, err := n.Lookup(ctx, []byte(tc.order[1]), nil); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected not found error, got %v", err)
+			}
+		})
+	}
+
+	// directories and siblings do not conflict
+	n, err := NewBuilder().WithRejectPathConflicts().Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, p := range []string{"a/", "a/b/", "a/b/c", "a/bc", "a/b.txt", "a/b/c"} {
+		e := file
+		if strings.HasSuffix(p, "/") {
+			e = nil
+		}
+		if err := n.Add(ctx, []byte(p), e, nil, nil); err != nil {
+			t.Fatalf("expected no error adding %s, got %v", p, err)
+		}
+	}
+	if err := n.AddInline(ctx, []byte("a/bc/d"), []byte("x"), nil); !errors.Is(err, ErrPathConflict) {
+		t.Fatalf("expected path conflict error, got %v", err)
+	}
+}
+
+func TestLookupCaseInsensitive(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, p := range []string{"index.html", "img/Logo.PNG", "README.md", "readme.md", "docs/Guide.html"} {
+		e := make([]byte, 32)
+		copy(e, p)
+		if err := n.Add(ctx, []byte(p), e, nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	n = NewNodeRef(n.Reference())
+
+	for _, tc := range []struct {
+		path   string
+		stored string
+	}{
+		{path: "Index.HTML", stored: "index.html"},
+		{path: "index.html", stored: "index.html"},
+		{path: "IMG/logo.png", stored: "img/Logo.PNG"},
+		{path: "docs/guide.HTML", stored: "docs/Guide.html"},
+		// both match, the first in byte order is returned
+		{path: "readme.MD", stored: "README.md"},
+	} {
+		entry, stored, err := n.LookupCaseInsensitive(ctx, []byte(tc.path), ls)
+		if err != nil {
+			t.Fatalf("expected no error for %s, got %v", tc.path, err)
+		}
+		if string(stored) != tc.stored {
+			t.Fatalf("expected stored path %s for %s, got %s", tc.stored, tc.path, stored)
+		}
+		e := make([]byte, 32)
+		copy(e, tc.stored)
+		if !bytes.Equal(entry, e) {
+			t.Fatalf("expected entry %x for %s, got %x", e, tc.path, entry)
+		}
+	}
+
+	for _, p := range []string{"index.htm", "IMG/", "img/logo.pngx", "docs"} {
+		_, _, err := n.LookupCaseInsensitive(ctx, []byte(p), ls)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected not found error for %s, got %v", p, err)
+		}
+	}
+}
+
+func TestChildReferences(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, p := range []string{"index.html", "img/1.png", "img/2.png", "robots.txt"} {
+		if err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	var children []*Node
+	for _, k := range n.sortedForkKeys() {
+		children = append(children, n.forks[k].Node)
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	nn := NewNodeRef(n.Reference())
+	if refs := nn.ChildReferences(); refs != nil {
+		t.Fatalf("expected no references of unloaded node, got %x", refs)
+	}
+	if err := nn.load(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	refs := nn.ChildReferences()
+	if len(refs) != len(children) {
+		t.Fatalf("expected %d references, got %d", len(children), len(refs))
+	}
+	for i, c := range children {
+		if !bytes.Equal(refs[i], c.Reference()) {
+			t.Fatalf("expected reference %x, got %x", c.Reference(), refs[i])
+		}
+	}
+
+	leaf := NewNodeRef(children[len(children)-1].Reference())
+	if err := leaf.load(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if refs := leaf.ChildReferences(); refs != nil {
+		t.Fatalf("expected no references of leaf, got %x", refs)
+	}
+}
+
+func TestReference(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	if n.Reference() != nil || n.Address() != nil {
+		t.Fatalf("expected no reference of unsaved node, got %x", n.Reference())
+	}
+	for _, p := range []string{"index.html", "img/1.png"} {
+		if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	stored := append([]byte{}, n.ref...)
+
+	ref := n.Reference()
+	ref[0]++
+	if !bytes.Equal(n.ref, stored) {
+		t.Fatalf("expected reference %x, got %x", stored, n.ref)
+	}
+	addr := n.Address()
+	if addr.String() != hex.EncodeToString(stored) {
+		t.Fatalf("expected address %x, got %s", stored, addr)
+	}
+	addr[0]++
+	if !bytes.Equal(n.ref, stored) {
+		t.Fatalf("expected reference %x, got %x", stored, n.ref)
+	}
+
+	if err := n.load(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	refs := n.ChildReferences()
+	refs[0][0]++
+	if bytes.Equal(n.ChildReferences()[0], refs[0]) {
+		t.Fatal("expected child references to be copies")
+	}
+
+	// references returned by saves and lookups are copies as well
+	check := func(name string, ref []byte) {
+		t.Helper()
+		ref[0]++
+		if !bytes.Equal(n.ref, stored) {
+			t.Fatalf("%s: expected reference %x, got %x", name, stored, n.ref)
+		}
+	}
+	ref, err := n.SaveResumable(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	check("SaveResumable", ref)
+	oldRef, newRef, err := n.Update(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	check("Update old", oldRef)
+	check("Update new", newRef)
+	saved, err := n.SaveWith(ctx, ls, SaveConfig{CollectReferences: true, IncludeClean: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	check("SaveWith", saved[len(saved)-1])
+	path, err := n.ResolutionPath(ctx, []byte("index.html"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	check("ResolutionPath", path[0])
+}
+
+func TestCanonicalForm(t *testing.T) {
+	ctx := context.Background()
+	long := "assets/" + strings.Repeat("x", 40)
+	final := []string{
+		"index.html",
+		"img/1.png",
+		"img/2.png",
+		"img/sub/3.png",
+		long + "/a.js",
+		long + "/b.js",
+		"a/b",
+		"a/b/c",
+	}
+	// paths added and removed again
+	extras := []string{
+		"img/10.png",
+		"img",
+		"assets/" + strings.Repeat("x", 20) + "y.js",
+		long,
+		long + strings.Repeat("z", 50),
+		"a/b/c/d",
+		"a",
+	}
+
+	type op struct {
+		path   string
+		remove bool
+	}
+	build := func(ops []op, saveAt int) []byte {
+		ls := mapLoadSaver{}
+		b := NewBuilder().WithDeterministicKeys()
+		n, err := b.Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for i, o := range ops {
+			if i == saveAt {
+				if err := n.Save(ctx, ls); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				if n, err = b.BuildRef(n.Reference()); err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+			}
+			if o.remove {
+				err = n.Remove(ctx, []byte(o.path), ls)
+			} else {
+				e := make([]byte, 32)
+				copy(e, o.path)
+				err = n.Add(ctx, []byte(o.path), e, nil, ls)
+			}
+			if err != nil {
+				t.Fatalf("expected no error on %+v, got %v", o, err)
+			}
+		}
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		m, err := NewNodeRef(n.Reference()).ToMap(ctx, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(m) != len(final) {
+			t.Fatalf("expected %d entries, got %d", len(final), len(m))
+		}
+		for _, p := range final {
+			if _, ok := m[p]; !ok {
+				t.Fatalf("expected entry on %q", p)
+			}
+		}
+		return n.Reference()
+	}
+
+	var ops []op
+	for _, p := range final {
+		ops = append(ops, op{path: p})
+	}
+	expected := build(ops, -1)
+
+	for seed := int64(0); seed < 50; seed++ {
+		r := mrand.New(mrand.NewSource(seed))
+		adds := append(append([]string{}, final...), extras...)
+		r.Shuffle(len(adds), func(i, j int) { adds[i], adds[j] = adds[j], adds[i] })
+		ops := ops[:0:0]
+		for _, p := range adds {
+			ops = append(ops, op{path: p})
+		}
+		// remove the extras, and some of the final paths to add them again,
+		// at random positions after they were added
+		removes := append([]string{}, extras...)
+		for _, p := range final {
+			if r.Intn(3) == 0 {
+				removes = append(removes, p)
+			}
+		}
+		for _, p := range removes {
+			added := 0
+			for ops[added].path != p {
+				added++
+			}
+			i := added + 1 + r.Intn(len(ops)-added)
+			ops = append(ops[:i], append([]op{{path: p, remove: true}}, ops[i:]...)...)
+			if !contains(extras, p) {
+				ops = append(ops, op{path: p})
+			}
+		}
+		if ref := build(ops, r.Intn(len(ops)+1)); !bytes.Equal(ref, expected) {
+			t.Fatalf("expected reference %x for seed %d, got %x", expected, seed, ref)
+		}
+	}
+}
+
+func contains(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClassify(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, e := range []nodeEntry{
+		{path: []byte("index.html")},
+		{path: []byte("a/b")},
+		{path: []byte("a/b/c")},
+		{path: []byte("a/bc")},
+		{path: []byte("empty/")},
+	} {
+		entry := e.entry
+		if len(e.path) > 0 && e.path[len(e.path)-1] != PathSeparator {
+			entry = append(make([]byte, 32-len(e.path)), e.path...)
+		}
+		if err := n.Add(ctx, e.path, entry, nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		path  string
+		class PathClass
+	}{
+		{"", ClassDir},
+		{"index.html", ClassFile},
+		{"a", ClassDir},
+		{"a/", ClassDir},
+		{"a/b", ClassFileAndDir},
+		{"a/b/", ClassDir},
+		{"a/b/c", ClassFile},
+		{"a/bc", ClassFile},
+		{"empty", ClassDir},
+		{"empty/", ClassDir},
+		{"index", ClassNone},
+		{"a/b/c/", ClassNone},
+		{"missing", ClassNone},
+	} {
+		class, err := NewNodeRef(n.Reference()).Classify(ctx, []byte(tc.path), ls)
+		if err != nil {
+			t.Fatalf("expected no error on %q, got %v", tc.path, err)
+		}
+		if class != tc.class {
+			t.Fatalf("expected class %d on %q, got %d", tc.class, tc.path, class)
+		}
+	}
+}
+
+func TestRemoveWhere(t *testing.T) {
+	ctx := context.Background()
+	paths := []string{
+		"index.html",
+		"index.html.tmp",
+		"img/1.png",
+		"img/1.png.tmp",
+		"img/2.tmp",
+		"img/sub/3.png",
+		"img/sub/4.tmp",
+		"tmp/only.tmp",
+		"a.tmp",
+		"a.tmp/b.txt",
+	}
+	build := func(paths []string) (*Node, mapLoadSaver) {
+		n, err := NewBuilder().WithDeterministicKeys().Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, p := range paths {
+			if err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		ls := mapLoadSaver{}
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return n, ls
+	}
+
+	n, ls := build(paths)
+	removed, err := n.RemoveWhere(ctx, ls, func(path []byte, _ *Node) bool {
+		return strings.HasSuffix(string(path), ".tmp")
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if removed != 6 {
+		t.Fatalf("expected 6 removed entries, got %d", removed)
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	survivors := []string{"index.html", "img/1.png", "img/sub/3.png", "a.tmp/b.txt"}
+	m, err := NewNodeRef(n.Reference()).ToMap(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(m) != len(survivors) {
+		t.Fatalf("expected %d entries, got %d", len(survivors), len(m))
+	}
+	for _, p := range survivors {
+		if _, ok := m[p]; !ok {
+			t.Fatalf("expected entry on %q", p)
+		}
+	}
+	// the structure is the one of a trie built from the survivors
+	expected, _ := build(survivors)
+	if !bytes.Equal(n.Reference(), expected.Reference()) {
+		t.Fatalf("expected reference %x, got %x", expected.Reference(), n.Reference())
+	}
+}
+
+func TestComplete(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, p := range []string{
+		"index.html",
+		"images/logo.png",
+		"images/photo1.jpg",
+		"images/photo2.jpg",
+		"images/photos/a.jpg",
+		"images/photos/b.jpg",
+		"img.svg",
+		"robots.txt",
+	} {
+		if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		partial  string
+		limit    int
+		expected []string
+	}{
+		{"empty", "", 0, []string{"images/", "img.svg", "index.html", "robots.txt"}},
+		{"mid-prefix", "ima", 0, []string{"images/"}},
+		{"mid-prefix-files", "i", 0, []string{"images/", "img.svg", "index.html"}},
+		{"mid-segment", "images/ph", 0, []string{"images/photo1.jpg", "images/photo2.jpg", "images/photos/"}},
+		{"directory", "images/", 0, []string{"images/logo.png", "images/photo1.jpg", "images/photo2.jpg", "images/photos/"}},
+		{"full-path", "img.svg", 0, []string{"img.svg"}},
+		{"limit", "images/", 2, []string{"images/logo.png", "images/photo1.jpg"}},
+		{"no-match", "imz", 0, nil},
+		{"past-path", "robots.txt.bak", 0, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := NewNodeRef(n.Reference()).Complete(ctx, []byte(tc.partial), tc.limit, ls)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if len(got) != len(tc.expected) {
+				t.Fatalf("expected completions %q, got %q", tc.expected, got)
+			}
+			for i, c := range got {
+				if string(c) != tc.expected[i] {
+					t.Fatalf("expected completions %q, got %q", tc.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupNearest(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, p := range []string{
+		"index.html",
+		"a/b/c.txt",
+		"a/b/d/e.txt",
+		"a/bin",
+		"docs/",
+		"docs/intro/x.md",
+		"assets/" + strings.Repeat("x", 40) + "/app.js",
+	} {
+		if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		path    string
+		nearest string
+		found   bool
+	}{
+		{"index.html", "index.html", true},
+		{"a/b/c.txt", "a/b/c.txt", true},
+		{"a/b/x.txt", "a/b/", false},
+		{"a/b/d/f/g.txt", "a/b/d/", false},
+		{"a/b/c.txt/more", "a/b/c.txt", false},
+		{"a/bx", "a/", false},
+		{"a/bin/x", "a/bin", false},
+		{"a/b/", "a/b/", false},
+		{"docs/none.md", "docs/", false},
+		{"docs/intro/y.md", "docs/intro/", false},
+		{"index", "", false},
+		{"missing/page.html", "", false},
+		{"assets/" + strings.Repeat("x", 35) + "/y", "assets/", false},
+		{"", "", false},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			nearest, found, err := NewNodeRef(n.Reference()).LookupNearest(ctx, []byte(tc.path), ls)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if string(nearest) != tc.nearest || found != tc.found {
+				t.Fatalf("expected nearest %q found %v, got %q %v", tc.nearest, tc.found, nearest, found)
+			}
+		})
+	}
+
+	t.Run("root-value", func(t *testing.T) {
+		n := New()
+		for _, p := range []string{"", "index.html"} {
+			if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		nearest, found, err := NewNodeRef(n.Reference()).LookupNearest(ctx, []byte{}, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(nearest) != 0 || !found {
+			t.Fatalf("expected root value to be found, got %q %v", nearest, found)
+		}
+	})
+}
+
+func TestAuditFunc(t *testing.T) {
+	ctx := context.Background()
+	type event struct {
+		op, path string
+		ref      []byte
+	}
+	var events []event
+	audit := func(op string, path []byte, ref []byte) {
+		events = append(events, event{op: op, path: string(path), ref: ref})
+	}
+	check := func(t *testing.T, exp ...event) {
+		t.Helper()
+		if len(events) != len(exp) {
+			t.Fatalf("expected %d events, got %d: %v", len(exp), len(events), events)
+		}
+		for i := range exp {
+			if events[i].op != exp[i].op || events[i].path != exp[i].path || !bytes.Equal(events[i].ref, exp[i].ref) {
+				t.Fatalf("expected event %v, got %v", exp[i], events[i])
+			}
+		}
+		events = nil
+	}
+	ref := func(b byte) []byte { return bytes.Repeat([]byte{b}, 32) }
+
+	n := New()
+	n.SetAuditFunc(audit)
+	// the later paths split the nodes of the earlier ones
+	for i, p := range []string{"abcd", "abxy", "ab", "a"} {
+		if err := n.Add(ctx, []byte(p), ref(byte(i+1)), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		check(t, event{op: AuditAdd, path: p, ref: ref(byte(i + 1))})
+	}
+	if err := n.AddFile(ctx, []byte("abc.bin"), ref(5), 10, nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	check(t, event{op: AuditAdd, path: "abc.bin", ref: ref(5)})
+	if err := n.AddInline(ctx, []byte("robots.txt"), []byte("User-agent: *"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	check(t, event{op: AuditAdd, path: "robots.txt"})
+
+	// failed operations are not audited
+	if err := n.Add(ctx, []byte("b"), make([]byte, 20), nil, nil); !errors.Is(err, ErrInvalidReference) {
+		t.Fatalf("expected %v, got %v", ErrInvalidReference, err)
+	}
+	if err := n.Remove(ctx, []byte("missing"), nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+	check(t)
+
+	// removals merging nodes back are audited once
+	if err := n.Remove(ctx, []byte("ab"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	check(t, event{op: AuditRemove, path: "ab"})
+
+	bulk := New()
+	bulk.SetAuditFunc(audit)
+	if err := bulk.AddAll(ctx, [][]byte{[]byte("b"), []byte("a")}, [][]byte{ref(1), ref(2)}, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	check(t, event{op: AuditAdd, path: "b", ref: ref(1)}, event{op: AuditAdd, path: "a", ref: ref(2)})
+
+	// grafted values are audited on their paths below the graft, once the
+	// graft succeeded
+	ls := mapLoadSaver{}
+	sub := New()
+	if err := sub.Add(ctx, []byte("1.png"), ref(6), nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := sub.AddInline(ctx, []byte("2.txt"), []byte("tiny"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := sub.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Graft(ctx, []byte("img/"), NewNodeRef(sub.Reference()), ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	check(t, event{op: AuditAdd, path: "img/1.png", ref: ref(6)}, event{op: AuditAdd, path: "img/2.txt"})
+	if err := n.Graft(ctx, []byte("img/"), NewNodeRef(sub.Reference()), ls); !errors.Is(err, ErrPathExists) {
+		t.Fatalf("expected %v, got %v", ErrPathExists, err)
+	}
+	check(t)
+
+	// no audit function is set on nodes by default
+	if err := New().Add(ctx, []byte("a"), ref(1), nil, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	n.SetAuditFunc(nil)
+	if err := n.Remove(ctx, []byte("a"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	check(t)
+}
+
+func TestPruneDirectories(t *testing.T) {
+	ctx := context.Background()
+	build := func(t *testing.T, b *Builder) *Node {
+		t.Helper()
+		n, err := b.Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, p := range []string{"img/", "img/2/", "img/2/a.png", "img/1.png", "index.html"} {
+			var e []byte
+			if !strings.HasSuffix(p, "/") {
+				e = append(make([]byte, 32-len(p)), p...)
+			}
+			if err := n.Add(ctx, []byte(p), e, nil, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		ls := mapLoadSaver{}
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		n, err = b.BuildRef(n.Reference())
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		n.loader = ls
+		return n
+	}
+	check := func(t *testing.T, n *Node, paths ...string) {
+		t.Helper()
+		m, err := n.ToMap(ctx, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(m) != len(paths) {
+			t.Fatalf("expected paths %v, got %v", paths, m)
+		}
+		for _, p := range paths {
+			if _, ok := m[p]; !ok {
+				t.Fatalf("expected path %s in %v", p, m)
+			}
+		}
+	}
+
+	t.Run("keep", func(t *testing.T) {
+		n := build(t, NewBuilder())
+		if err := n.Remove(ctx, []byte("img/2/a.png"), nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		check(t, n, "img/", "img/2/", "img/1.png", "index.html")
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		n := build(t, NewBuilder().WithPruneDirectories().WithDeterministicKeys())
+		var removed []string
+		n.SetAuditFunc(func(op string, path []byte, _ []byte) {
+			removed = append(removed, string(path))
+		})
+		if err := n.Remove(ctx, []byte("img/2/a.png"), nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		// img/ still holds img/1.png
+		check(t, n, "img/", "img/1.png", "index.html")
+		if err := n.Remove(ctx, []byte("img/1.png"), nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		check(t, n, "index.html")
+		if strings.Join(removed, " ") != "img/2/a.png img/2/ img/1.png img/" {
+			t.Fatalf("expected audited removals of the pruned directories, got %v", removed)
+		}
+
+		// the trie is the same as one never holding the directories
+		exp, err := NewBuilder().WithDeterministicKeys().Build()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := exp.Add(ctx, []byte("index.html"), append(make([]byte, 22), "index.html"...), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		ls := mapLoadSaver{}
+		if err := exp.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !bytes.Equal(n.Reference(), exp.Reference()) {
+			t.Fatalf("expected reference %x, got %x", exp.Reference(), n.Reference())
+		}
+	})
+}
+
+func TestCheckRefSizesMixed(t *testing.T) {
+	ctx := context.Background()
+	ls := mapLoadSaver{}
+
+	n := New()
+	if err := n.Add(ctx, []byte("index.html"), bytes.Repeat([]byte{1}, 32), nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// a subtree of 64 byte references written by another implementation,
+	// which Graft does not mount
+	sub, err := NewBuilder().WithRefSize(64).Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := sub.Add(ctx, []byte{}, bytes.Repeat([]byte{2}, 64), nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	n.forks['b'] = &fork{prefix: []byte("big/"), Node: sub}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	err = NewNodeRef(n.Reference()).CheckRefSizes(ctx, ls)
+	if !errors.Is(err, ErrRefSizeMismatch) {
+		t.Fatalf("expected %v, got %v", ErrRefSizeMismatch, err)
+	}
+	if !strings.Contains(err.Error(), "'big/'") {
+		t.Fatalf("expected error naming the path, got %v", err)
+	}
+}
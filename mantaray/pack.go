@@ -0,0 +1,88 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+)
+
+// PackLeaves saves the trie with ls, storing its empty leaves as a single
+// chunk, and returns its new reference. The values stored on the paths are
+// not changed. It only deduplicates these leaves and does not re-lay out the
+// trie to minimise its chunk count: the layout of the other nodes is left as
+// it is, as a mantaray node cannot hold its forks in its own chunk.
+//
+// The type, metadata and inline value of a node are stored in the fork of its
+// parent, so the leaves holding inline values or explicit directory entries
+// only consist of an empty entry and differ just by their obfuscation key.
+// PackLeaves gives them all the zero key, which hides nothing as they hold no
+// data, so that they are stored as one and the same chunk, which is passed
+// to ls once. Manifests dominated by many tiny resources thus need about one
+// chunk less per resource. As only the keys of leaves change, no node grows and all still
+// fit a chunk. Tries built with deterministic keys already share these
+// chunks.
+func (n *Node) PackLeaves(ctx context.Context, ls LoadSaver) ([]byte, error) {
+	if ls == nil {
+		return nil, ErrNoSaver
+	}
+	if _, err := n.packLeaves(ctx, []byte{}, 0, ls, make(map[int][]byte)); err != nil {
+		return nil, err
+	}
+	if err := n.save(ctx, ls, 0); err != nil {
+		return nil, err
+	}
+	return n.Reference(), nil
+}
+
+// packLeaves gives the empty leaves below the node the zero key, returning
+// true if any was changed. The first of these leaves of each reference size
+// is saved, and its reference in shared given to the others.
+func (n *Node) packLeaves(ctx context.Context, path []byte, depth int, ls LoadSaver, shared map[int][]byte) (bool, error) {
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	default:
+	}
+	if err := n.checkDepth(depth); err != nil {
+		return false, err
+	}
+	if n.forks == nil {
+		if err := n.loadPath(ctx, path, ls); err != nil {
+			return false, err
+		}
+	}
+	deterministic := n.configOrDefault().deterministicKeys
+	changed := false
+	for _, k := range n.sortedForkKeys() {
+		f := n.forks[k]
+		nextPath := append(path[:0:0], path...)
+		nextPath = append(nextPath, f.prefix...)
+		c, err := f.Node.packLeaves(ctx, nextPath, depth+1, ls, shared)
+		if err != nil {
+			return false, err
+		}
+		// the root is saved with a trailer, so only leaves below it qualify
+		leaf := f.Node
+		if !deterministic && len(leaf.forks) == 0 && isZero(leaf.entry) && !bytes.Equal(leaf.obfuscationKey, ZeroObfuscationKey) {
+			leaf.obfuscationKey = append([]byte{}, ZeroObfuscationKey...)
+			leaf.ref = nil
+			if ref, ok := shared[leaf.refBytesSize]; ok {
+				leaf.ref = append([]byte{}, ref...)
+			} else {
+				if err := leaf.save(ctx, ls, depth+1); err != nil {
+					return false, err
+				}
+				shared[leaf.refBytesSize] = leaf.Reference()
+			}
+			c = true
+		}
+		changed = changed || c
+	}
+	if changed {
+		n.ref = nil
+	}
+	return changed, nil
+}
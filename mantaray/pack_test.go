@@ -0,0 +1,95 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ethersphere/manifest/mantaray"
+)
+
+// countingSaver counts the saves of each reference by the wrapped saver.
+type countingSaver struct {
+	mantaray.LoadSaver
+	mtx   sync.Mutex
+	saves map[string]int
+}
+
+func (c *countingSaver) Save(ctx context.Context, b []byte) ([]byte, error) {
+	ref, err := c.LoadSaver.Save(ctx, b)
+	c.mtx.Lock()
+	c.saves[string(ref)]++
+	c.mtx.Unlock()
+	return ref, err
+}
+
+func TestPackLeaves(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	// a trie of inline values only takes its reference size from the builder
+	n, err := mantaray.NewBuilder().WithRefSize(32).Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	value := func(i int) []byte { return []byte(fmt.Sprintf("v%d", i)) }
+	path := func(i int) []byte { return []byte(fmt.Sprintf("dir%d/file%d", i%4, i)) }
+	for i := 0; i < 200; i++ {
+		if err := n.AddInline(ctx, path(i), value(i), ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	chunks := func(ref []byte) int {
+		t.Helper()
+		seen := make(map[string]struct{})
+		err := mantaray.NewNodeRef(ref).EachRawNode(ctx, nil, ls, func(_, ref, _, _ []byte, err error) error {
+			seen[string(ref)] = struct{}{}
+			return err
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return len(seen)
+	}
+	before := chunks(n.Reference())
+
+	cs := &countingSaver{LoadSaver: ls, saves: make(map[string]int)}
+	ref, err := mantaray.NewNodeRef(n.Reference()).PackLeaves(ctx, cs)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for r, c := range cs.saves {
+		if c > 1 {
+			t.Fatalf("expected chunks to be saved once, %x saved %d times", r, c)
+		}
+	}
+	after := chunks(ref)
+	// most entries are leaves, "file1" is not as it prefixes "file10"
+	if after > before/2 {
+		t.Fatalf("expected packing to save about a chunk per entry, got %d chunks before and %d after", before, after)
+	}
+
+	packed := mantaray.NewNodeRef(ref)
+	for i := 0; i < 200; i++ {
+		v, inline, err := packed.LookupValue(ctx, path(i), ls)
+		if err != nil {
+			t.Fatalf("expected no error on %s, got %v", path(i), err)
+		}
+		if !inline || !bytes.Equal(v, value(i)) {
+			t.Fatalf("expected inline value %q on %s, got %q (inline %v)", value(i), path(i), v, inline)
+		}
+	}
+
+	if _, err := mantaray.New().PackLeaves(ctx, nil); !errors.Is(err, mantaray.ErrNoSaver) {
+		t.Fatalf("expected %v, got %v", mantaray.ErrNoSaver, err)
+	}
+}
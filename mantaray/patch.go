@@ -0,0 +1,191 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidPatch is returned when a patch cannot be encoded or decoded.
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// Versions of the patch format, the first byte of encoded patches. Patches
+// carrying binary metadata use patchVersionBinaryMetadata; all others are
+// encoded as patchVersion so that older readers can still apply them.
+const (
+	patchVersion               = 1
+	patchVersionBinaryMetadata = 2
+)
+
+// EncodePatch serialises changes as returned by Diff into a compact patch,
+// which ApplyPatch applies to the old trie to reconstruct the new one. Only
+// what is needed to apply the changes is kept: removed values are encoded by
+// path, added and modified values by path, entry, metadata and binary
+// metadata.
+//
+// The patch starts with a version byte and the number of changes as uvarint.
+// Each change is its type byte followed by the uvarint length prefixed path;
+// added and modified values follow with the length prefixed entry and the
+// length prefixed metadata in the compact metadata encoding, empty if the
+// value has no metadata. In version 2 patches, the length prefixed binary
+// metadata of the value follows, empty if it has none.
+func EncodePatch(changes []Change) ([]byte, error) {
+	version := byte(patchVersion)
+	for _, c := range changes {
+		if c.Type != ChangeRemoved && len(c.New.BinaryMetadata) > 0 {
+			version = patchVersionBinaryMetadata
+			break
+		}
+	}
+	b := []byte{version}
+	b = appendUvarint(b, uint64(len(changes)))
+	for _, c := range changes {
+		b = append(b, byte(c.Type))
+		b = appendUvarint(b, uint64(len(c.Path)))
+		b = append(b, c.Path...)
+		switch c.Type {
+		case ChangeRemoved:
+		case ChangeAdded, ChangeModified:
+			b = appendUvarint(b, uint64(len(c.New.Ref)))
+			b = append(b, c.New.Ref...)
+			var metadata []byte
+			if len(c.New.Metadata) > 0 {
+				var err error
+				if metadata, err = CompactMetadataCodec.Encode(c.New.Metadata); err != nil {
+					return nil, err
+				}
+			}
+			b = appendUvarint(b, uint64(len(metadata)))
+			b = append(b, metadata...)
+			if version == patchVersionBinaryMetadata {
+				var binaryMetadata []byte
+				if len(c.New.BinaryMetadata) > 0 {
+					binaryMetadata = encodeBinaryMetadata(c.New.BinaryMetadata)
+				}
+				b = appendUvarint(b, uint64(len(binaryMetadata)))
+				b = append(b, binaryMetadata...)
+			}
+		default:
+			return nil, fmt.Errorf("%w: change type %v on %q", ErrInvalidPatch, c.Type, c.Path)
+		}
+	}
+	return b, nil
+}
+
+// DecodePatch parses a patch encoded with EncodePatch. The changes only hold
+// what the patch encodes, so the old values are zero.
+func DecodePatch(patch []byte) ([]Change, error) {
+	if len(patch) == 0 || (patch[0] != patchVersion && patch[0] != patchVersionBinaryMetadata) {
+		return nil, fmt.Errorf("%w: unknown version", ErrInvalidPatch)
+	}
+	withBinary := patch[0] == patchVersionBinaryMetadata
+	count, data, err := readUvarint(patch[1:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: change count", ErrInvalidPatch)
+	}
+	// every change takes at least two bytes
+	if count > uint64(len(data)) {
+		return nil, fmt.Errorf("%w: change count %d", ErrInvalidPatch, count)
+	}
+	changes := make([]Change, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%w: truncated", ErrInvalidPatch)
+		}
+		c := Change{Type: ChangeType(data[0])}
+		if c.Path, data, err = readLengthPrefixed(data[1:]); err != nil {
+			return nil, fmt.Errorf("%w: path of change %d", ErrInvalidPatch, i)
+		}
+		switch c.Type {
+		case ChangeRemoved:
+		case ChangeAdded, ChangeModified:
+			var ref, metadata []byte
+			if ref, data, err = readLengthPrefixed(data); err != nil {
+				return nil, fmt.Errorf("%w: entry on %q", ErrInvalidPatch, c.Path)
+			}
+			if metadata, data, err = readLengthPrefixed(data); err != nil {
+				return nil, fmt.Errorf("%w: metadata on %q", ErrInvalidPatch, c.Path)
+			}
+			c.New = Entry{Path: c.Path, Ref: ref}
+			if len(metadata) > 0 {
+				if c.New.Metadata, err = CompactMetadataCodec.Decode(metadata); err != nil {
+					return nil, fmt.Errorf("%w: metadata on %q: %v", ErrInvalidPatch, c.Path, err)
+				}
+			}
+			if withBinary {
+				var binaryMetadata []byte
+				if binaryMetadata, data, err = readLengthPrefixed(data); err != nil {
+					return nil, fmt.Errorf("%w: binary metadata on %q", ErrInvalidPatch, c.Path)
+				}
+				if len(binaryMetadata) > 0 {
+					if c.New.BinaryMetadata, err = decodeBinaryMetadata(binaryMetadata); err != nil {
+						return nil, fmt.Errorf("%w: binary metadata on %q: %v", ErrInvalidPatch, c.Path, err)
+					}
+				}
+			}
+		default:
+			return nil, fmt.Errorf("%w: change type %d on %q", ErrInvalidPatch, c.Type, c.Path)
+		}
+		changes = append(changes, c)
+	}
+	if len(data) > 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidPatch, len(data))
+	}
+	return changes, nil
+}
+
+// ApplyPatch applies a patch encoded with EncodePatch to the trie base and
+// returns the resulting trie, leaving base unchanged. Applied to the trie the
+// patch was computed from, the result holds the same values as the new trie
+// of the diff. Removing a value which base does not hold fails with
+// ErrNotFound. The result is not saved; its persisted branches are loaded
+// with ls as needed.
+func ApplyPatch(ctx context.Context, base *Node, patch []byte, ls LoadSaver) (*Node, error) {
+	changes, err := DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	n := base.snapshot()
+	for _, c := range changes {
+		// a modified value is removed first, as adding does not drop the
+		// metadata or binary metadata of the value it replaces
+		if c.Type == ChangeRemoved || c.Type == ChangeModified {
+			if err := n.removePatched(ctx, c.Path, ls); err != nil {
+				return nil, fmt.Errorf("applying %s change on %q: %w", c.Type, c.Path, err)
+			}
+		}
+		if c.Type == ChangeAdded || c.Type == ChangeModified {
+			if err := n.Add(ctx, c.Path, c.New.Ref, c.New.Metadata, ls); err != nil {
+				return nil, fmt.Errorf("applying %s change on %q: %w", c.Type, c.Path, err)
+			}
+			if len(c.New.BinaryMetadata) > 0 {
+				if err := n.SetBinaryMetadata(ctx, c.Path, c.New.BinaryMetadata, ls); err != nil {
+					return nil, fmt.Errorf("applying %s change on %q: %w", c.Type, c.Path, err)
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// removePatched removes the value on path like Remove, including the value of
+// the node itself on the empty path.
+func (n *Node) removePatched(ctx context.Context, path []byte, ls LoadSaver) error {
+	if len(path) > 0 {
+		return n.Remove(ctx, path, ls)
+	}
+	if n.forks == nil {
+		if err := n.load(ctx, ls); err != nil {
+			return err
+		}
+	}
+	if !n.IsValueType() {
+		return notFound(path)
+	}
+	n.removeValue()
+	return nil
+}
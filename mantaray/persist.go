@@ -5,8 +5,11 @@
 package mantaray
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
@@ -16,8 +19,42 @@ var (
 	ErrNoSaver = errors.New("Node is not persisted but no saver")
 	// ErrNoLoader saver interface not given
 	ErrNoLoader = errors.New("Node is reference but no loader")
+	// ErrStore the store failed to return a node
+	ErrStore = errors.New("store error")
+	// ErrCorrupt a node returned by the store is malformed
+	ErrCorrupt = errors.New("corrupt node")
 )
 
+// LoadError is the error of loading a persisted node. It matches ErrStore
+// if the loader failed, and ErrCorrupt if the loaded data could not be
+// decoded, so that a failure of the store can be told apart from a malformed
+// manifest and from a path which does not exist. The underlying error is
+// kept as well; as stores may report missing chunks with errors matching
+// ErrNotFound, ErrStore and ErrCorrupt should be checked first.
+type LoadError struct {
+	Kind error  // ErrStore or ErrCorrupt
+	Ref  []byte // reference of the node
+	Path []byte // path of the node, nil if not known
+	Err  error
+}
+
+func (e *LoadError) Error() string {
+	if e.Path != nil {
+		return fmt.Sprintf("loading node for path %q: %v %x: %v", e.Path, e.Kind, e.Ref, e.Err)
+	}
+	return fmt.Sprintf("loading node: %v %x: %v", e.Kind, e.Ref, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is the kind of the error.
+func (e *LoadError) Is(target error) bool {
+	return target == e.Kind
+}
+
 // Loader defines a generic interface to retrieve nodes
 // from a persistent storage
 // for read only operations only
@@ -31,6 +68,13 @@ type Saver interface {
 	Save(ctx context.Context, data []byte) (reference []byte, err error)
 }
 
+// BatchSaver is a Saver which can also persist several nodes at once,
+// returning their references in the order of data.
+type BatchSaver interface {
+	Saver
+	SaveBatch(ctx context.Context, data [][]byte) (references [][]byte, err error)
+}
+
 // LoadSaver is a composite interface of Loader and Saver
 // it is meant to be implemented as thin wrappers around persistent storage like Swarm
 type LoadSaver interface {
@@ -43,50 +87,376 @@ func (n *Node) load(ctx context.Context, l Loader) error {
 		return nil
 	}
 	if l == nil {
-		return ErrNoLoader
+		l = n.loader
+	}
+	if l == nil {
+		// name the reference, as lookups in memory often pass no loader and
+		// only fail once they reach a persisted branch
+		return fmt.Errorf("%w: node %x", ErrNoLoader, n.ref)
+	}
+	if err := n.checkCycle(); err != nil {
+		return &LoadError{Kind: ErrCorrupt, Ref: n.Reference(), Err: err}
+	}
+	var start time.Time
+	if n.tracer != nil {
+		start = time.Now()
 	}
 	b, err := l.Load(ctx, n.ref)
+	n.trace(TraceLoad, n.ref, len(b), start, err)
 	if err != nil {
-		return err
+		return &LoadError{Kind: ErrStore, Ref: n.Reference(), Err: err}
+	}
+	// unmarshal into a copy, so that the node is left unloaded if the data
+	// is invalid instead of holding the forks read before the error
+	nn := *n
+	if err := nn.UnmarshalBinary(b); err != nil {
+		return &LoadError{Kind: ErrCorrupt, Ref: n.Reference(), Err: err}
 	}
-	return n.UnmarshalBinary(b)
+	*n = nn
+	n.base = n.ref
+	for _, f := range n.forks {
+		f.Node.loader = n.loader
+		f.Node.cfg = n.cfg
+		f.Node.tracer = n.tracer
+		f.Node.ancestors = &ancestor{ref: n.ref, parent: n.ancestors}
+	}
+	return nil
+}
+
+// checkCycle returns ErrCycleDetected if the reference of the node is the
+// reference of a node it was reached through. A well-formed trie has no
+// cycles, as the reference of a node is derived from the references of its
+// forks, but a crafted store may return a fork pointing back to an ancestor,
+// which would make lookups and walks load the same nodes forever.
+func (n *Node) checkCycle() error {
+	for a := n.ancestors; a != nil; a = a.parent {
+		if bytes.Equal(a.ref, n.ref) {
+			return fmt.Errorf("%w: %x", ErrCycleDetected, n.ref)
+		}
+	}
+	return nil
+}
+
+// loadPath loads the node like load, adding the path of the node to errors.
+func (n *Node) loadPath(ctx context.Context, path []byte, l Loader) error {
+	err := n.load(ctx, l)
+	if err == nil {
+		return nil
+	}
+	var le *LoadError
+	if errors.As(err, &le) {
+		le.Path = append([]byte{}, path...)
+		return le
+	}
+	return fmt.Errorf("loading node for path %q: %w", path, err)
 }
 
 // Save persists a trie recursively  traversing the nodes
+//
+// Nodes not modified since they were loaded or saved are skipped, and
+// modified nodes keep the obfuscation key they were loaded or created with,
+// so a key is only generated for nodes which never had one. Unchanged
+// subtrees thus keep their references across saves even with random keys.
 func (n *Node) Save(ctx context.Context, s Saver) error {
+	_, err := n.SaveWith(ctx, s, SaveConfig{})
+	return err
+}
+
+// SaveConfig configures SaveWith. The zero value saves like Save.
+type SaveConfig struct {
+	// Concurrency limits the number of saves in progress at the same time,
+	// 0 for no limit.
+	Concurrency int
+	// BatchSize is the number of nodes passed at once to a BatchSaver. Nodes
+	// are saved one by one if it is 0 or the saver is not a BatchSaver.
+	BatchSize int
+	// CollectReferences makes SaveWith return the references of the saved
+	// nodes.
+	CollectReferences bool
+	// IncludeClean saves the loaded nodes which were not modified as well,
+	// for example to copy them into another store. Persisted branches which
+	// were not loaded are still skipped.
+	IncludeClean bool
+}
+
+// SaveWith persists a trie like Save as configured by cfg. The nodes are
+// saved starting from the leaves, as a node references its forks, so the
+// nodes of a level are saved concurrently and in batches. The references of
+// the saved nodes are returned in the order they were saved, ending with the
+// node itself, if cfg.CollectReferences is set.
+func (n *Node) SaveWith(ctx context.Context, s Saver, cfg SaveConfig) ([][]byte, error) {
 	if s == nil {
+		return nil, ErrNoSaver
+	}
+	if cfg.Concurrency < 0 || cfg.BatchSize < 0 {
+		return nil, fmt.Errorf("%w: concurrency %d, batch size %d", ErrInvalid, cfg.Concurrency, cfg.BatchSize)
+	}
+	return n.saveWith(ctx, s, cfg, 0)
+}
+
+// SaveLoad persists a trie like Save and remembers ls as the loader of the
+// node, so that the node can be looked up, edited and saved again without
+// passing a loader for the persisted branches.
+func (n *Node) SaveLoad(ctx context.Context, ls LoadSaver) error {
+	if ls == nil {
 		return ErrNoSaver
 	}
-	return n.save(ctx, s)
+	n.loader = ls
+	return n.save(ctx, ls, 0)
 }
 
-func (n *Node) save(ctx context.Context, s Saver) error {
-	if n != nil && n.ref != nil {
-		return nil
+// SaveResumable persists a trie like Save and returns the reference of the
+// node. Subtrees persisted by a previous failed call are skipped, so calling
+// it again after a failure only saves the remaining nodes. Calling it on a
+// persisted trie returns the reference without saving.
+func (n *Node) SaveResumable(ctx context.Context, ls LoadSaver) ([]byte, error) {
+	if ls == nil {
+		return nil, ErrNoSaver
 	}
+	if err := n.save(ctx, ls, 0); err != nil {
+		return nil, err
+	}
+	return n.Reference(), nil
+}
+
+// Update saves the nodes of a trie modified since it was loaded or last saved
+// and returns the reference the node was based on together with its new
+// reference. The old reference is nil for nodes which were neither loaded nor
+// saved before. It is the way to edit large persisted tries: starting from a
+// reference-only node, Add and Remove load only the nodes on the edited
+// paths, and Update saves only those nodes, referencing the untouched
+// subtrees by their existing references, so that memory and storage use are
+// proportional to the depth of the edits rather than to the size of the trie.
+func (n *Node) Update(ctx context.Context, ls LoadSaver) (oldRef, newRef []byte, err error) {
+	if ls == nil {
+		return nil, nil, ErrNoSaver
+	}
+	if n.ref != nil {
+		oldRef = n.Reference()
+	} else if n.base != nil {
+		oldRef = append([]byte{}, n.base...)
+	}
+	if err := n.save(ctx, ls, 0); err != nil {
+		return nil, nil, err
+	}
+	return oldRef, n.Reference(), nil
+}
+
+// CompareAndUpdate loads the trie of oldRoot with l, applies edit to it,
+// saves the modified nodes with s and returns the new root reference. An
+// empty trie is edited if oldRoot is nil. The loader is remembered by the
+// nodes, so edit may pass a nil LoadSaver to Add and Remove.
+//
+// The pair of oldRoot and the returned reference is meant for a
+// compare-and-set on the store publishing the root, which is the
+// responsibility of the caller: the update must be discarded and retried if
+// the published root is no longer oldRoot.
+func CompareAndUpdate(ctx context.Context, oldRoot []byte, l Loader, s Saver, edit func(*Node) error) ([]byte, error) {
+	if s == nil {
+		return nil, ErrNoSaver
+	}
+	n := New()
+	if oldRoot != nil {
+		n = NewNodeRef(oldRoot)
+		n.loader = l
+		if err := n.load(ctx, l); err != nil {
+			return nil, err
+		}
+	}
+	if err := edit(n); err != nil {
+		return nil, err
+	}
+	if err := n.save(ctx, s, 0); err != nil {
+		return nil, err
+	}
+	return n.Reference(), nil
+}
+
+// Rekey loads the whole trie, assigns every node a new obfuscation key
+// returned by keyFn, saves the trie and returns the new reference of the
+// node. The contents of the trie are not changed. Keys must be 32 bytes long.
+func (n *Node) Rekey(ctx context.Context, ls LoadSaver, keyFn func() []byte) ([]byte, error) {
+	if ls == nil {
+		return nil, ErrNoSaver
+	}
+	if err := n.rekey(ctx, ls, keyFn); err != nil {
+		return nil, err
+	}
+	if err := n.save(ctx, ls, 0); err != nil {
+		return nil, err
+	}
+	return n.Reference(), nil
+}
+
+func (n *Node) rekey(ctx context.Context, l Loader, keyFn func() []byte) error {
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
 	}
-	eg, ectx := errgroup.WithContext(ctx)
+	if n.forks == nil {
+		if err := n.load(ctx, l); err != nil {
+			return err
+		}
+	}
+	if err := n.SetObfuscationKey(keyFn()); err != nil {
+		return err
+	}
+	n.ref = nil
+	for _, f := range n.forks {
+		if err := f.Node.rekey(ctx, l, keyFn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Node) save(ctx context.Context, s Saver, depth int) error {
+	_, err := n.saveWith(ctx, s, SaveConfig{}, depth)
+	return err
+}
+
+// saveWith saves the trie level by level, starting from the nodes farthest
+// from the leaves, so that the references of the forks are known when a node
+// is marshalled.
+func (n *Node) saveWith(ctx context.Context, s Saver, cfg SaveConfig, depth int) ([][]byte, error) {
+	var levels [][]*Node
+	if _, err := n.collectUnsaved(depth, cfg.IncludeClean, &levels); err != nil {
+		return nil, err
+	}
+	var refs [][]byte
+	for _, nodes := range levels {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		// only the saved root needs the trailer with its own type and metadata
+		data := make([][]byte, len(nodes))
+		for i, node := range nodes {
+			var err error
+			if data[i], err = node.marshal(node == n && depth == 0); err != nil {
+				return nil, err
+			}
+		}
+		if err := saveLevel(ctx, s, cfg, nodes, data); err != nil {
+			return nil, err
+		}
+		if cfg.CollectReferences {
+			for _, node := range nodes {
+				refs = append(refs, node.Reference())
+			}
+		}
+	}
+	return refs, nil
+}
+
+// collectUnsaved adds the nodes of the trie which need saving to levels by
+// their height, the longest distance to a saved descendant, and returns the
+// height of the node, -1 if it needs no saving.
+func (n *Node) collectUnsaved(depth int, clean bool, levels *[][]*Node) (int, error) {
+	if n.ref != nil && (!clean || n.forks == nil) {
+		return -1, nil
+	}
+	if err := n.checkDepth(depth); err != nil {
+		return 0, err
+	}
+	height := 0
 	for _, f := range n.forks {
-		f := f
+		h, err := f.Node.collectUnsaved(depth+1, clean, levels)
+		if err != nil {
+			return 0, err
+		}
+		if h+1 > height {
+			height = h + 1
+		}
+	}
+	for len(*levels) <= height {
+		*levels = append(*levels, nil)
+	}
+	(*levels)[height] = append((*levels)[height], n)
+	return height, nil
+}
+
+// saveLevel saves the marshalled nodes of a level concurrently, in batches
+// if the saver supports it.
+func saveLevel(ctx context.Context, s Saver, cfg SaveConfig, nodes []*Node, data [][]byte) error {
+	bs, batched := s.(BatchSaver)
+	size := 1
+	if batched && cfg.BatchSize > 0 {
+		size = cfg.BatchSize
+	} else {
+		batched = false
+	}
+	var sem chan struct{}
+	if cfg.Concurrency > 0 {
+		sem = make(chan struct{}, cfg.Concurrency)
+	}
+	eg, ectx := errgroup.WithContext(ctx)
+	for i := 0; i < len(nodes); i += size {
+		end := i + size
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+		batch, batchData := nodes[i:end], data[i:end]
 		eg.Go(func() error {
-			return f.Node.save(ectx, s)
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ectx.Done():
+					return ectx.Err()
+				}
+			}
+			if batched {
+				return saveBatch(ectx, bs, batch, batchData)
+			}
+			node, b := batch[0], batchData[0]
+			var start time.Time
+			if node.tracer != nil {
+				start = time.Now()
+			}
+			ref, err := s.Save(ectx, b)
+			node.trace(TraceSave, ref, len(b), start, err)
+			if err != nil {
+				return err
+			}
+			node.saved(ref)
+			return nil
 		})
 	}
-	if err := eg.Wait(); err != nil {
-		return err
+	return eg.Wait()
+}
+
+func saveBatch(ctx context.Context, bs BatchSaver, nodes []*Node, data [][]byte) error {
+	var start time.Time
+	if nodes[0].tracer != nil {
+		start = time.Now()
 	}
-	bytes, err := n.MarshalBinary()
-	if err != nil {
-		return err
+	refs, err := bs.SaveBatch(ctx, data)
+	if err == nil && len(refs) != len(nodes) {
+		err = fmt.Errorf("%w: %d references saving %d nodes", ErrInvalidReference, len(refs), len(nodes))
 	}
-	n.ref, err = s.Save(ctx, bytes)
 	if err != nil {
+		for i, node := range nodes {
+			node.trace(TraceSave, nil, len(data[i]), start, err)
+		}
 		return err
 	}
-	n.forks = nil
+	for i, node := range nodes {
+		node.trace(TraceSave, refs[i], len(data[i]), start, nil)
+		node.saved(refs[i])
+	}
 	return nil
 }
+
+// saved sets the reference of a node after it was saved and releases its
+// forks.
+func (n *Node) saved(ref []byte) {
+	n.ref = ref
+	n.base = ref
+	n.forks = nil
+	// the new reference was not reached through the references the node was
+	// loaded under
+	n.ancestors = nil
+}
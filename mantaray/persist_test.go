@@ -8,8 +8,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/ethersphere/manifest/mantaray"
 )
@@ -60,6 +64,57 @@ func TestPersistIdempotence(t *testing.T) {
 	}
 }
 
+func TestSaveLoad(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+
+	paths := [][]byte{
+		[]byte("index.html"),
+		[]byte("img/1.png"),
+	}
+	var v [32]byte
+	copy(v[:], paths[0])
+	err := n.Add(ctx, paths[0], v[:], nil, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.SaveLoad(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// the persisted branches are loaded with the remembered loader
+	copy(v[:], paths[1])
+	err = n.Add(ctx, paths[1], v[:], nil, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.SaveLoad(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		n *mantaray.Node
+		l mantaray.Loader
+	}{
+		{n, nil},
+		{mantaray.NewNodeRef(n.Reference()), ls},
+	} {
+		for _, c := range paths {
+			e, err := tc.n.Lookup(ctx, c, tc.l)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			copy(v[:], c)
+			if !bytes.Equal(e, v[:]) {
+				t.Fatalf("expected value %x, got %x", v[:], e)
+			}
+		}
+	}
+}
+
 type addr [32]byte
 type mockLoadSaver struct {
 	mtx   sync.Mutex
@@ -86,6 +141,15 @@ func (m *mockLoadSaver) Save(_ context.Context, b []byte) ([]byte, error) {
 	return a[:], nil
 }
 
+// corrupt truncates the stored data of the reference.
+func (m *mockLoadSaver) corrupt(ref []byte) {
+	var a addr
+	copy(a[:], ref)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.store[a] = m.store[a][:10]
+}
+
 func (m *mockLoadSaver) Load(_ context.Context, ab []byte) ([]byte, error) {
 	var a addr
 	copy(a[:], ab)
@@ -97,3 +161,1468 @@ func (m *mockLoadSaver) Load(_ context.Context, ab []byte) ([]byte, error) {
 	}
 	return b, nil
 }
+
+func TestDirectoryEntry(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+
+	var file [32]byte
+	copy(file[:], "img/1.png")
+	for _, e := range []mantaray.Entry{
+		{Path: []byte("img/1.png"), Ref: file[:]},
+		{Path: []byte("img/")},
+		{Path: []byte("empty/")},
+	} {
+		err := n.Add(ctx, e.Path, e.Ref, nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	check := func(t *testing.T, n *mantaray.Node) {
+		t.Helper()
+		for _, dir := range []string{"img/", "empty/"} {
+			entry, isDir, err := n.LookupEntry(ctx, []byte(dir), ls)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !isDir || entry != nil {
+				t.Fatalf("expected directory entry on %s, got %x (directory %t)", dir, entry, isDir)
+			}
+		}
+
+		entry, isDir, err := n.LookupEntry(ctx, []byte("img/1.png"), ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if isDir || !bytes.Equal(entry, file[:]) {
+			t.Fatalf("expected file entry %x, got %x (directory %t)", file[:], entry, isDir)
+		}
+
+		for _, missing := range []string{"img", "img/2.png", "video/"} {
+			_, _, err = n.LookupEntry(ctx, []byte(missing), ls)
+			if !errors.Is(err, mantaray.ErrNotFound) {
+				t.Fatalf("expected not found error on %s, got %v", missing, err)
+			}
+		}
+	}
+
+	check(t, n)
+
+	err := n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	check(t, mantaray.NewNodeRef(n.Reference()))
+}
+
+// failingLoadSaver fails the first fails saves.
+type failingLoadSaver struct {
+	*mockLoadSaver
+	mtx   sync.Mutex
+	fails int
+	saves int
+}
+
+func (f *failingLoadSaver) Save(ctx context.Context, b []byte) ([]byte, error) {
+	f.mtx.Lock()
+	f.saves++
+	fail := f.fails > 0
+	if fail {
+		f.fails--
+	}
+	f.mtx.Unlock()
+	if fail {
+		return make([]byte, 32), errors.New("save failed")
+	}
+	return f.mockLoadSaver.Save(ctx, b)
+}
+
+func TestSaveResumable(t *testing.T) {
+	ctx := context.Background()
+	ls := &failingLoadSaver{mockLoadSaver: newMockLoadSaver(), fails: 5}
+	n := mantaray.New()
+	var paths [][]byte
+	for i := 0; i < 50; i++ {
+		p := []byte(fmt.Sprintf("dir%d/file%d", i%5, i))
+		paths = append(paths, p)
+		err := n.Add(ctx, p, append(make([]byte, 32-len(p)), p...), nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	var (
+		ref   []byte
+		err   error
+		tries int
+	)
+	for ref == nil {
+		tries++
+		if tries > 10 {
+			t.Fatal("expected save to succeed")
+		}
+		ref, err = n.SaveResumable(ctx, ls)
+	}
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if tries == 1 {
+		t.Fatal("expected failed saves")
+	}
+
+	saves := ls.saves
+	again, err := n.SaveResumable(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(again, ref) {
+		t.Fatalf("expected reference %x, got %x", ref, again)
+	}
+	if ls.saves != saves {
+		t.Fatalf("expected no saves on persisted trie, got %d", ls.saves-saves)
+	}
+
+	nn := mantaray.NewNodeRef(ref)
+	for _, p := range paths {
+		e, err := nn.Lookup(ctx, p, ls)
+		if err != nil {
+			t.Fatalf("expected no error on %s, got %v", p, err)
+		}
+		if !bytes.Equal(e, append(make([]byte, 32-len(p)), p...)) {
+			t.Fatalf("expected entry for %s, got %x", p, e)
+		}
+	}
+}
+
+func TestLoadErrorPath(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	for _, p := range []string{"index.html", "img/1.png", "img/2.png"} {
+		err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	err := n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// corrupt the chunk of the node under "img/"
+	img, err := mantaray.NewNodeRef(n.Reference()).LookupNode(ctx, []byte("img/"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ls.corrupt(img.Reference())
+
+	_, err = mantaray.NewNodeRef(n.Reference()).Lookup(ctx, []byte("img/1.png"), ls)
+	if err == nil || !strings.Contains(err.Error(), `loading node for path "img/"`) {
+		t.Fatalf("expected error with path, got %v", err)
+	}
+
+	err = mantaray.NewNodeRef(n.Reference()).WalkNode(ctx, []byte{}, ls, func(_ []byte, _ *mantaray.Node, err error) error {
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), `loading node for path "img/"`) {
+		t.Fatalf("expected error with path, got %v", err)
+	}
+}
+
+func TestNoLoaderPath(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	for _, p := range []string{"index.html", "img/1.png", "img/2.png"} {
+		err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	img, err := mantaray.NewNodeRef(n.Reference()).LookupNode(ctx, []byte("img/"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// the root and the node under "i" are loaded, the rest is not
+	nn := mantaray.NewNodeRef(n.Reference())
+	if _, err := nn.LookupNode(ctx, []byte("i"), ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	_, err = nn.Lookup(ctx, []byte("img/1.png"), nil)
+	if !errors.Is(err, mantaray.ErrNoLoader) {
+		t.Fatalf("expected no loader error, got %v", err)
+	}
+	for _, s := range []string{`path "img/"`, fmt.Sprintf("%x", img.Reference())} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("expected error naming %s, got %v", s, err)
+		}
+	}
+}
+
+func TestLoadErrorKinds(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	for _, p := range []string{"index.html", "img/1.png", "img/2.png"} {
+		err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	img, err := mantaray.NewNodeRef(n.Reference()).LookupNode(ctx, []byte("img/"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	_, err = mantaray.NewNodeRef(n.Reference()).Lookup(ctx, []byte("video/1.mp4"), ls)
+	if !errors.Is(err, mantaray.ErrNotFound) || errors.Is(err, mantaray.ErrStore) || errors.Is(err, mantaray.ErrCorrupt) {
+		t.Fatalf("expected only not found error, got %v", err)
+	}
+
+	// the root and the node under "i" are loaded, the node under "img/" fails
+	failing := &loadFailingLoadSaver{mockLoadSaver: ls, loads: 2}
+	_, err = mantaray.NewNodeRef(n.Reference()).Lookup(ctx, []byte("img/1.png"), failing)
+	if !errors.Is(err, mantaray.ErrStore) || errors.Is(err, mantaray.ErrCorrupt) {
+		t.Fatalf("expected store error, got %v", err)
+	}
+	var le *mantaray.LoadError
+	if !errors.As(err, &le) {
+		t.Fatalf("expected load error, got %v", err)
+	}
+	if !bytes.Equal(le.Ref, img.Reference()) || string(le.Path) != "img/" {
+		t.Fatalf("expected load error of %x on img/, got %x on %q", img.Reference(), le.Ref, le.Path)
+	}
+
+	ls.corrupt(img.Reference())
+	_, err = mantaray.NewNodeRef(n.Reference()).Lookup(ctx, []byte("img/1.png"), ls)
+	if !errors.Is(err, mantaray.ErrCorrupt) || errors.Is(err, mantaray.ErrStore) {
+		t.Fatalf("expected corrupt error, got %v", err)
+	}
+	if !errors.As(err, &le) || string(le.Path) != "img/" {
+		t.Fatalf("expected load error on img/, got %v", err)
+	}
+}
+
+func TestGraftPreservesReferences(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+
+	nodeRefs := func(n *mantaray.Node, root []byte) map[string][]byte {
+		refs := make(map[string][]byte)
+		err := n.WalkNode(ctx, root, ls, func(path []byte, node *mantaray.Node, err error) error {
+			if err != nil {
+				return err
+			}
+			refs[string(path[len(root):])] = node.Reference()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return refs
+	}
+
+	sub := mantaray.New()
+	for _, p := range []string{"index.js", "lib/a.js", "lib/b.js", "README.md"} {
+		err := sub.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	err := sub.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := nodeRefs(mantaray.NewNodeRef(sub.Reference()), []byte{})
+
+	n := mantaray.New()
+	for _, p := range []string{"index.html", "vendor/other.js"} {
+		err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	err = n.Graft(ctx, []byte("vendor/lib/"), mantaray.NewNodeRef(sub.Reference()), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.Graft(ctx, []byte("vendor/"), mantaray.NewNodeRef(sub.Reference()), ls)
+	if !errors.Is(err, mantaray.ErrPathExists) {
+		t.Fatalf("expected path exists error, got %v", err)
+	}
+	err = n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	nn := mantaray.NewNodeRef(n.Reference())
+	got := nodeRefs(nn, []byte("vendor/lib/"))
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d nodes, got %d", len(expected), len(got))
+	}
+	for p, ref := range expected {
+		if !bytes.Equal(got[p], ref) {
+			t.Fatalf("expected reference %x on %q, got %x", ref, p, got[p])
+		}
+	}
+	for p, c := range map[string]string{
+		"index.html":          "index.html",
+		"vendor/other.js":     "vendor/other.js",
+		"vendor/lib/lib/b.js": "lib/b.js",
+	} {
+		e, err := nn.Lookup(ctx, []byte(p), ls)
+		if err != nil {
+			t.Fatalf("expected no error on %s, got %v", p, err)
+		}
+		if !bytes.Equal(e, append(make([]byte, 32-len(c)), c...)) {
+			t.Fatalf("unexpected entry %x on %s", e, p)
+		}
+	}
+	// a conflicting graft leaves the persisted nodes on its path unchanged
+	for _, p := range []string{"vendor/lib/lib/", "vendor/lib/index.js"} {
+		err = nn.Graft(ctx, []byte(p), mantaray.NewNodeRef(sub.Reference()), ls)
+		if !errors.Is(err, mantaray.ErrPathExists) {
+			t.Fatalf("expected path exists error, got %v", err)
+		}
+		if !bytes.Equal(nn.Reference(), n.Reference()) {
+			t.Fatalf("expected reference %x after failed graft on %s, got %x", n.Reference(), p, nn.Reference())
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	paths := []string{"index.html", "img/1.png", "img/2.png", "robots.txt"}
+	for _, p := range paths {
+		err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), map[string]string{"name": p}, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	err := n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ref := n.Reference()
+
+	var i byte
+	keyFn := func() []byte {
+		i++
+		return bytes.Repeat([]byte{i}, 32)
+	}
+	nn := mantaray.NewNodeRef(ref)
+	newRef, err := nn.Rekey(ctx, ls, keyFn)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if bytes.Equal(newRef, ref) {
+		t.Fatal("expected reference to change")
+	}
+
+	nn = mantaray.NewNodeRef(newRef)
+	for _, p := range paths {
+		node, err := nn.LookupNode(ctx, []byte(p), ls)
+		if err != nil {
+			t.Fatalf("expected no error on %s, got %v", p, err)
+		}
+		if !bytes.Equal(node.Entry(), append(make([]byte, 32-len(p)), p...)) || node.Metadata()["name"] != p {
+			t.Fatalf("unexpected value on %s: %x %v", p, node.Entry(), node.Metadata())
+		}
+	}
+	if key := nn.ObfuscationKey(); key[0] != 1 {
+		t.Fatalf("expected new obfuscation key, got %x", key)
+	}
+
+	_, err = mantaray.NewNodeRef(newRef).Rekey(ctx, ls, func() []byte { return make([]byte, 16) })
+	if !errors.Is(err, mantaray.ErrInvalid) {
+		t.Fatalf("expected invalid error, got %v", err)
+	}
+}
+
+func TestUnload(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	paths := []string{"index.html", "img/1.png", "img/2.png"}
+	for _, p := range paths {
+		err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if !n.IsLoaded() {
+		t.Fatal("expected new node to be loaded")
+	}
+	err := n.Unload()
+	if !errors.Is(err, mantaray.ErrNotSaved) {
+		t.Fatalf("expected not saved error, got %v", err)
+	}
+
+	err = n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n.IsLoaded() {
+		t.Fatal("expected saved node not to be loaded")
+	}
+	img, err := n.LookupNode(ctx, []byte("img/"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !n.IsLoaded() || !img.IsLoaded() {
+		t.Fatal("expected looked up nodes to be loaded")
+	}
+
+	// modified nodes can not be unloaded until saved
+	err = n.Add(ctx, []byte("img/3.png"), make([]byte, 32), nil, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = img.Unload()
+	if !errors.Is(err, mantaray.ErrNotSaved) {
+		t.Fatalf("expected not saved error, got %v", err)
+	}
+	err = n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	_, err = n.LookupNode(ctx, []byte("img/"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.Unload()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n.IsLoaded() {
+		t.Fatal("expected unloaded node")
+	}
+	for _, p := range append(paths, "img/3.png") {
+		_, err := n.Lookup(ctx, []byte(p), ls)
+		if err != nil {
+			t.Fatalf("expected no error on %s, got %v", p, err)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	// every 30 bytes of the path add a chained node
+	path := bytes.Repeat([]byte("a"), 12*30)
+
+	n, err := mantaray.NewBuilder().WithMaxDepth(8).Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.Add(ctx, path, make([]byte, 32), nil, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.Save(ctx, ls)
+	if !errors.Is(err, mantaray.ErrMaxDepthExceeded) {
+		t.Fatalf("expected max depth exceeded error, got %v", err)
+	}
+
+	n = mantaray.New()
+	err = n.Add(ctx, path, make([]byte, 32), nil, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	nn, err := mantaray.NewBuilder().WithMaxDepth(8).BuildRef(n.Reference())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	_, err = nn.Lookup(ctx, path, ls)
+	if !errors.Is(err, mantaray.ErrMaxDepthExceeded) {
+		t.Fatalf("expected max depth exceeded error, got %v", err)
+	}
+	err = nn.WalkNode(ctx, []byte{}, ls, func(_ []byte, _ *mantaray.Node, err error) error {
+		return err
+	})
+	if !errors.Is(err, mantaray.ErrMaxDepthExceeded) {
+		t.Fatalf("expected max depth exceeded error, got %v", err)
+	}
+
+	_, err = mantaray.NewNodeRef(n.Reference()).Lookup(ctx, path, ls)
+	if err != nil {
+		t.Fatalf("expected no error within default max depth, got %v", err)
+	}
+}
+
+func TestCycleDetected(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	for _, p := range []string{"a/x", "a/y"} {
+		if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	root := mantaray.NewNodeRef(n.Reference())
+	if _, err := root.LookupNode(ctx, []byte{}, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	refs := root.ChildReferences()
+	if len(refs) != 1 {
+		t.Fatalf("expected 1 child reference, got %d", len(refs))
+	}
+	// serve the root under the reference of its only fork, so that the fork
+	// of "a/" points back to itself
+	var rootAddr, childAddr addr
+	copy(rootAddr[:], n.Reference())
+	copy(childAddr[:], refs[0])
+	ls.store[childAddr] = ls.store[rootAddr]
+
+	_, err := mantaray.NewNodeRef(n.Reference()).LookupNode(ctx, []byte("a/a/a/x"), ls)
+	if !errors.Is(err, mantaray.ErrCycleDetected) {
+		t.Fatalf("expected cycle detected error, got %v", err)
+	}
+	err = mantaray.NewNodeRef(n.Reference()).WalkNode(ctx, []byte{}, ls, func(_ []byte, _ *mantaray.Node, err error) error {
+		return err
+	})
+	if !errors.Is(err, mantaray.ErrCycleDetected) {
+		t.Fatalf("expected cycle detected error, got %v", err)
+	}
+	err = mantaray.NewNodeRef(n.Reference()).EachRawNode(ctx, []byte{}, ls, func(_, _, _, _ []byte, err error) error {
+		return err
+	})
+	if !errors.Is(err, mantaray.ErrCycleDetected) {
+		t.Fatalf("expected cycle detected error, got %v", err)
+	}
+}
+
+func TestCheckRefSizes(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+
+	n := mantaray.New()
+	for _, p := range []string{"index.html", "img/1.png"} {
+		err := n.Add(ctx, []byte(p), make([]byte, 32), nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	err := n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = mantaray.NewNodeRef(n.Reference()).CheckRefSizes(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// a node written with 64 byte references
+	sub, err := mantaray.NewBuilder().WithRefSize(64).Build()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = sub.Add(ctx, []byte{}, make([]byte, 64), nil, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = sub.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// is not grafted into a trie of 32 byte references
+	err = n.Graft(ctx, []byte("img/big/"), mantaray.NewNodeRef(sub.Reference()), ls)
+	if !errors.Is(err, mantaray.ErrInvalidReference) {
+		t.Fatalf("expected invalid reference error, got %v", err)
+	}
+	err = n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = mantaray.NewNodeRef(n.Reference()).CheckRefSizes(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestGraftCopiesSub(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+
+	sub := mantaray.New()
+	err := sub.Add(ctx, []byte("a.js"), make([]byte, 32), nil, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	n := mantaray.New()
+	err = n.Add(ctx, []byte("index.html"), make([]byte, 32), nil, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.Graft(ctx, []byte("lib/"), sub, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.Add(ctx, []byte("lib/b.js"), make([]byte, 32), nil, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.Remove(ctx, []byte("lib/a.js"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// sub is not changed by the edits of the node
+	_, err = sub.Lookup(ctx, []byte("a.js"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	_, err = sub.Lookup(ctx, []byte("b.js"), ls)
+	if !errors.Is(err, mantaray.ErrNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if sub.IsWithPathSeparatorType() {
+		t.Fatal("expected sub not to be marked with path separator")
+	}
+}
+
+// countingLoader counts the loads of the wrapped loader.
+type countingLoader struct {
+	mantaray.Loader
+	mtx   sync.Mutex
+	loads int
+}
+
+func (c *countingLoader) Load(ctx context.Context, ref []byte) ([]byte, error) {
+	c.mtx.Lock()
+	c.loads++
+	c.mtx.Unlock()
+	return c.Loader.Load(ctx, ref)
+}
+
+func TestLookupMany(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	prefix := "assets/static/build/v1/"
+	var paths [][]byte
+	for i := 0; i < 20; i++ {
+		p := []byte(fmt.Sprintf("%sjs/chunk%d.js", prefix, i))
+		paths = append(paths, p)
+		e := make([]byte, 32)
+		e[0] = byte(i)
+		err := n.Add(ctx, p, e, nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	err := n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	missing := []byte(prefix + "css/missing.css")
+	l := &countingLoader{Loader: ls}
+	entries, err := mantaray.NewNodeRef(n.Reference()).LookupMany(ctx, append(paths, missing), l)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	batchLoads := l.loads
+
+	l = &countingLoader{Loader: ls}
+	for _, p := range paths {
+		e, err := mantaray.NewNodeRef(n.Reference()).Lookup(ctx, p, l)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !bytes.Equal(entries[string(p)], e) {
+			t.Fatalf("expected entry %x on %s, got %x", e, p, entries[string(p)])
+		}
+	}
+	if _, ok := entries[string(missing)]; ok {
+		t.Fatalf("expected no entry on %s", missing)
+	}
+	if len(entries) != len(paths) {
+		t.Fatalf("expected %d entries, got %d", len(paths), len(entries))
+	}
+	if batchLoads >= l.loads {
+		t.Fatalf("expected fewer loads than %d, got %d", l.loads, batchLoads)
+	}
+
+	entries, err = mantaray.NewNodeRef(n.Reference()).LookupMany(ctx, nil, ls)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected no entries, got %v, %v", entries, err)
+	}
+	all, err := mantaray.NewNodeRef(n.Reference()).LookupAll(ctx, nil, ls)
+	if err != nil || len(all) != 0 {
+		t.Fatalf("expected no entries, got %v, %v", all, err)
+	}
+}
+
+func TestResolutionPath(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	paths := []string{"index.html", "img/1.png", "img/2.png", "img/sub/3.png", "robots.txt"}
+	for _, p := range paths {
+		var e [32]byte
+		copy(e[:], p)
+		if err := n.Add(ctx, []byte(p), e[:], nil, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	_, err := n.ResolutionPath(ctx, []byte("img/1.png"), ls)
+	if !errors.Is(err, mantaray.ErrNotSaved) {
+		t.Fatalf("expected not saved error, got %v", err)
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, p := range paths {
+		refs, err := mantaray.NewNodeRef(n.Reference()).ResolutionPath(ctx, []byte(p), ls)
+		if err != nil {
+			t.Fatalf("expected no error for path %s, got %v", p, err)
+		}
+		if !bytes.Equal(refs[0], n.Reference()) {
+			t.Fatalf("expected root reference first for path %s, got %x", p, refs[0])
+		}
+		// the chunks on the path suffice to look it up
+		seeded := newMockLoadSaver()
+		for _, ref := range refs {
+			var a addr
+			copy(a[:], ref)
+			seeded.store[a] = ls.store[a]
+		}
+		entry, err := mantaray.NewNodeRef(n.Reference()).Lookup(ctx, []byte(p), seeded)
+		if err != nil {
+			t.Fatalf("expected no error for path %s, got %v", p, err)
+		}
+		var e [32]byte
+		copy(e[:], p)
+		if !bytes.Equal(entry, e[:]) {
+			t.Fatalf("expected entry %x for path %s, got %x", e, p, entry)
+		}
+	}
+
+	for _, tc := range []struct {
+		path string
+		refs int
+	}{
+		{"img/sub/4.png", 3},
+		{"img/", 3},
+		{"video/1.mp4", 1},
+	} {
+		refs, err := mantaray.NewNodeRef(n.Reference()).ResolutionPath(ctx, []byte(tc.path), ls)
+		if !errors.Is(err, mantaray.ErrNotFound) {
+			t.Fatalf("expected not found error for path %s, got %v", tc.path, err)
+		}
+		if len(refs) != tc.refs {
+			t.Fatalf("expected %d references for path %s, got %d", tc.refs, tc.path, len(refs))
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	ctx := context.Background()
+	n := mantaray.New()
+	for _, p := range []string{"index.html", "img/1.png", "img/sub/2.png", "img/sub/3.png"} {
+		if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := newMockLoadSaver()
+
+	var mtx sync.Mutex
+	var saves int
+	n.SetTracer(func(op string, ref []byte, size int, _ time.Duration, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if op != mantaray.TraceSave || ref == nil || size == 0 || err != nil {
+			t.Errorf("unexpected save trace %s %x %d %v", op, ref, size, err)
+		}
+		saves++
+	})
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// root, "i", "index.html", "img/", "img/1.png", "img/sub/", "2.png", "3.png"
+	if saves != 8 {
+		t.Fatalf("expected 8 traced saves, got %d", saves)
+	}
+
+	// references of the nodes on the path, looked up without tracing
+	expected := [][]byte{n.Reference()}
+	for _, p := range []string{"i", "img/", "img/sub/", "img/sub/2.png"} {
+		node, err := mantaray.NewNodeRef(n.Reference()).LookupNode(ctx, []byte(p), ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		expected = append(expected, node.Reference())
+	}
+
+	var loaded [][]byte
+	root := mantaray.NewNodeRef(n.Reference())
+	root.SetTracer(func(op string, ref []byte, size int, _ time.Duration, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if op != mantaray.TraceLoad || size == 0 || err != nil {
+			t.Errorf("unexpected load trace %s %x %d %v", op, ref, size, err)
+		}
+		loaded = append(loaded, ref)
+	})
+	if _, err := root.Lookup(ctx, []byte("img/sub/2.png"), ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(loaded) != len(expected) {
+		t.Fatalf("expected %d traced loads, got %d", len(expected), len(loaded))
+	}
+	for i := range expected {
+		if !bytes.Equal(loaded[i], expected[i]) {
+			t.Fatalf("expected load %d of %x, got %x", i, expected[i], loaded[i])
+		}
+	}
+
+	// failed loads are traced with the error
+	var traced error
+	failing := mantaray.NewNodeRef(make([]byte, 32))
+	failing.SetTracer(func(_ string, _ []byte, _ int, _ time.Duration, err error) {
+		traced = err
+	})
+	_, err := failing.Lookup(ctx, []byte("index.html"), ls)
+	if err == nil || !errors.Is(err, traced) {
+		t.Fatalf("expected traced error %v, got %v", traced, err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	for i := 0; i < 5000; i++ {
+		p := []byte(fmt.Sprintf("dir%d/sub%d/file%d.txt", i%50, i%7, i))
+		if err := n.Add(ctx, p, append(make([]byte, 32-len(p)), p...), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ref := n.Reference()
+
+	path := []byte("dir7/sub0/file7.txt")
+	// number of nodes on the edited path
+	l := &countingLoader{Loader: ls}
+	if _, err := mantaray.NewNodeRef(ref).Lookup(ctx, path, l); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	spine := l.loads
+
+	edit := struct {
+		*countingLoader
+		*mantaray.CountingSaver
+	}{&countingLoader{Loader: ls}, mantaray.NewCountingSaver(ls)}
+	root := mantaray.NewNodeRef(ref)
+	entry := bytes.Repeat([]byte{1}, 32)
+	if err := root.Add(ctx, path, entry, nil, edit); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	old, updated, err := root.Update(ctx, edit)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(old, ref) {
+		t.Fatalf("expected old reference %x, got %x", ref, old)
+	}
+	if edit.loads != spine {
+		t.Fatalf("expected %d loads, got %d", spine, edit.loads)
+	}
+	if edit.Calls() != spine {
+		t.Fatalf("expected %d saves, got %d", spine, edit.Calls())
+	}
+	if bytes.Equal(updated, ref) {
+		t.Fatal("expected new reference")
+	}
+
+	got, err := mantaray.NewNodeRef(updated).Lookup(ctx, path, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(got, entry) {
+		t.Fatalf("expected entry %x, got %x", entry, got)
+	}
+	other := []byte("dir8/sub1/file8.txt")
+	if _, err := mantaray.NewNodeRef(updated).Lookup(ctx, other, ls); err != nil {
+		t.Fatalf("expected untouched entry, got %v", err)
+	}
+
+	// nothing to save without changes
+	prev := updated
+	old, updated, err = root.Update(ctx, edit)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(old, prev) || !bytes.Equal(updated, prev) {
+		t.Fatalf("expected unchanged reference %x, got %x and %x", prev, old, updated)
+	}
+	if edit.Calls() != spine {
+		t.Fatalf("expected no more saves, got %d", edit.Calls()-spine)
+	}
+	if updated == nil {
+		t.Fatal("expected reference")
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	metadata := map[string]string{"content-type": "image/png"}
+	err := n.AddSized(ctx, []byte("img/1.png"), make([]byte, 32), 1234567, metadata, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, ok := metadata[mantaray.MetadataContentLength]; ok {
+		t.Fatal("expected metadata of the caller to be unchanged")
+	}
+	if err := n.Add(ctx, []byte("index.html"), make([]byte, 32), nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.Add(ctx, []byte("bad.txt"), make([]byte, 32), map[string]string{mantaray.MetadataContentLength: "-1"}, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	n = mantaray.NewNodeRef(n.Reference())
+
+	size, err := n.ContentLength(ctx, []byte("img/1.png"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if size != 1234567 {
+		t.Fatalf("expected content length 1234567, got %d", size)
+	}
+	node, err := n.LookupNode(ctx, []byte("img/1.png"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if node.Metadata()["content-type"] != "image/png" {
+		t.Fatalf("expected metadata to be kept, got %v", node.Metadata())
+	}
+
+	for _, tc := range []struct {
+		path string
+		err  error
+	}{
+		{path: "index.html", err: mantaray.ErrNoContentLength},
+		{path: "bad.txt", err: mantaray.ErrInvalidMetadata},
+		{path: "missing.txt", err: mantaray.ErrNotFound},
+	} {
+		if _, err := n.ContentLength(ctx, []byte(tc.path), ls); !errors.Is(err, tc.err) {
+			t.Fatalf("expected error %v for %s, got %v", tc.err, tc.path, err)
+		}
+	}
+
+	err = n.AddSized(ctx, []byte("negative"), make([]byte, 32), -1, nil, ls)
+	if !errors.Is(err, mantaray.ErrInvalidMetadata) {
+		t.Fatalf("expected invalid metadata error, got %v", err)
+	}
+}
+
+func TestEntryKind(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	for _, add := range []func() error{
+		func() error { return n.AddFile(ctx, []byte("small.txt"), make([]byte, 32), 4096, nil, ls) },
+		func() error { return n.AddFile(ctx, []byte("video.mp4"), make([]byte, 32), 4097, nil, ls) },
+		func() error { return n.AddSized(ctx, []byte("sized.bin"), make([]byte, 32), 1<<20, nil, ls) },
+		func() error { return n.AddInline(ctx, []byte("robots.txt"), []byte("User-agent: *"), ls) },
+		func() error { return n.Add(ctx, []byte("docs/"), nil, nil, ls) },
+		func() error { return n.Add(ctx, []byte("index.html"), make([]byte, 32), nil, ls) },
+		func() error {
+			return n.Add(ctx, []byte("bad.bin"), make([]byte, 32), map[string]string{mantaray.MetadataChunked: "maybe"}, ls)
+		},
+	} {
+		if err := add(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		kind mantaray.EntryKind
+		err  error
+	}{
+		{path: "small.txt", kind: mantaray.EntrySingleChunk},
+		{path: "video.mp4", kind: mantaray.EntryChunkedFile},
+		{path: "sized.bin", kind: mantaray.EntryChunkedFile},
+		{path: "robots.txt", kind: mantaray.EntryInline},
+		{path: "docs/", kind: mantaray.EntryDirectory},
+		{path: "index.html", kind: mantaray.EntryFile},
+		{path: "bad.bin", err: mantaray.ErrInvalidMetadata},
+		{path: "missing", err: mantaray.ErrNotFound},
+	} {
+		kind, err := mantaray.NewNodeRef(n.Reference()).EntryKind(ctx, []byte(tc.path), ls)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("expected error %v for path %s, got %v", tc.err, tc.path, err)
+		}
+		if kind != tc.kind {
+			t.Fatalf("expected kind %v for path %s, got %v", tc.kind, tc.path, kind)
+		}
+	}
+
+	size, err := mantaray.NewNodeRef(n.Reference()).ContentLength(ctx, []byte("video.mp4"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if size != 4097 {
+		t.Fatalf("expected content length 4097, got %d", size)
+	}
+}
+
+// loadFailingLoadSaver fails the loads after the first loads.
+type loadFailingLoadSaver struct {
+	*mockLoadSaver
+	mtx   sync.Mutex
+	loads int
+}
+
+func (f *loadFailingLoadSaver) Load(ctx context.Context, ref []byte) ([]byte, error) {
+	f.mtx.Lock()
+	fail := f.loads == 0
+	if !fail {
+		f.loads--
+	}
+	f.mtx.Unlock()
+	if fail {
+		return nil, errors.New("load failed")
+	}
+	return f.mockLoadSaver.Load(ctx, ref)
+}
+
+func TestAddLoadFailure(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	for _, p := range []string{"index.html", "img/1.png", "img/2.png", "img/sub/3.png"} {
+		err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	_, ref, err := n.Update(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for loads := 1; loads <= 2; loads++ {
+		n := mantaray.NewNodeRef(ref)
+		fls := &loadFailingLoadSaver{mockLoadSaver: ls, loads: loads}
+		err := n.Add(ctx, []byte("img/sub/4.png"), make([]byte, 32), nil, fls)
+		if err == nil {
+			t.Fatalf("expected error after %d loads", loads)
+		}
+		if !bytes.Equal(n.Reference(), ref) {
+			t.Fatalf("expected reference %x after %d loads, got %x", ref, loads, n.Reference())
+		}
+		// the node is unchanged, so it is not saved again
+		s := mantaray.NewCountingSaver(ls)
+		if err := n.Save(ctx, s); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if s.Calls() != 0 {
+			t.Fatalf("expected no saves after %d loads, got %d", loads, s.Calls())
+		}
+
+		// the add succeeds once loading works again
+		err = n.Add(ctx, []byte("img/sub/4.png"), make([]byte, 32), nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, _, err := n.Update(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		m, err := mantaray.NewNodeRef(n.Reference()).ToMap(ctx, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(m) != 5 {
+			t.Fatalf("expected 5 entries, got %d", len(m))
+		}
+	}
+}
+
+func TestCompareAndUpdate(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	entry := func(p string) []byte {
+		return append(make([]byte, 32-len(p)), p...)
+	}
+	add := func(paths ...string) func(*mantaray.Node) error {
+		return func(n *mantaray.Node) error {
+			for _, p := range paths {
+				if err := n.Add(ctx, []byte(p), entry(p), nil, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	root, err := mantaray.CompareAndUpdate(ctx, nil, ls, ls, add("index.html", "img/1.png"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	updated, err := mantaray.CompareAndUpdate(ctx, root, ls, ls, add("img/2.png"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, p := range []string{"index.html", "img/1.png", "img/2.png"} {
+		if _, err := mantaray.NewNodeRef(updated).Lookup(ctx, []byte(p), ls); err != nil {
+			t.Fatalf("expected entry on %q, got %v", p, err)
+		}
+	}
+	// the old root is left as it was
+	if _, err := mantaray.NewNodeRef(root).Lookup(ctx, []byte("img/2.png"), ls); !errors.Is(err, mantaray.ErrNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	// a failed edit saves nothing
+	s := mantaray.NewCountingSaver(ls)
+	editErr := errors.New("edit failed")
+	_, err = mantaray.CompareAndUpdate(ctx, updated, ls, s, func(n *mantaray.Node) error {
+		if err := add("robots.txt")(n); err != nil {
+			return err
+		}
+		return editErr
+	})
+	if !errors.Is(err, editErr) {
+		t.Fatalf("expected edit error, got %v", err)
+	}
+	if s.Calls() != 0 {
+		t.Fatalf("expected no saves, got %d", s.Calls())
+	}
+
+	// Update reports the reference the edit was based on
+	n := mantaray.NewNodeRef(updated)
+	if err := n.Remove(ctx, []byte("index.html"), ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	old, newRef, err := n.Update(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(old, updated) {
+		t.Fatalf("expected old reference %x, got %x", updated, old)
+	}
+	if bytes.Equal(newRef, updated) {
+		t.Fatal("expected new reference")
+	}
+}
+
+// batchLoadSaver records the sizes of the batches saved.
+type batchLoadSaver struct {
+	*mockLoadSaver
+	mtx     sync.Mutex
+	batches []int
+	saves   int
+}
+
+func (b *batchLoadSaver) Save(ctx context.Context, data []byte) ([]byte, error) {
+	b.mtx.Lock()
+	b.saves++
+	b.mtx.Unlock()
+	return b.mockLoadSaver.Save(ctx, data)
+}
+
+func (b *batchLoadSaver) SaveBatch(ctx context.Context, data [][]byte) ([][]byte, error) {
+	b.mtx.Lock()
+	b.batches = append(b.batches, len(data))
+	b.mtx.Unlock()
+	refs := make([][]byte, len(data))
+	for i, d := range data {
+		ref, err := b.mockLoadSaver.Save(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+		refs[i] = ref
+	}
+	return refs, nil
+}
+
+// concurrentLoadSaver records the largest number of saves in progress.
+type concurrentLoadSaver struct {
+	*mockLoadSaver
+	mtx      sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (c *concurrentLoadSaver) Save(ctx context.Context, data []byte) ([]byte, error) {
+	c.mtx.Lock()
+	c.inFlight++
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+	c.mtx.Unlock()
+	time.Sleep(time.Millisecond)
+	c.mtx.Lock()
+	c.inFlight--
+	c.mtx.Unlock()
+	return c.mockLoadSaver.Save(ctx, data)
+}
+
+func TestSaveWith(t *testing.T) {
+	ctx := context.Background()
+	newTrie := func(t *testing.T) *mantaray.Node {
+		t.Helper()
+		n := mantaray.New()
+		for i := 0; i < 40; i++ {
+			p := []byte(fmt.Sprintf("dir%d/file%d", i%8, i))
+			if err := n.Add(ctx, p, append(make([]byte, 32-len(p)), p...), nil, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		return n
+	}
+	checkTrie := func(t *testing.T, ref []byte, l mantaray.Loader) {
+		t.Helper()
+		for i := 0; i < 40; i++ {
+			p := []byte(fmt.Sprintf("dir%d/file%d", i%8, i))
+			e, err := mantaray.NewNodeRef(ref).Lookup(ctx, p, l)
+			if err != nil {
+				t.Fatalf("expected no error on %s, got %v", p, err)
+			}
+			if !bytes.Equal(e, append(make([]byte, 32-len(p)), p...)) {
+				t.Fatalf("expected entry for %s, got %x", p, e)
+			}
+		}
+	}
+
+	t.Run("concurrency", func(t *testing.T) {
+		ls := &concurrentLoadSaver{mockLoadSaver: newMockLoadSaver()}
+		n := newTrie(t)
+		if _, err := n.SaveWith(ctx, ls, mantaray.SaveConfig{Concurrency: 2}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if ls.max > 2 {
+			t.Fatalf("expected at most 2 concurrent saves, got %d", ls.max)
+		}
+		checkTrie(t, n.Reference(), ls)
+	})
+
+	t.Run("batch-size", func(t *testing.T) {
+		ls := &batchLoadSaver{mockLoadSaver: newMockLoadSaver()}
+		n := newTrie(t)
+		if _, err := n.SaveWith(ctx, ls, mantaray.SaveConfig{BatchSize: 3}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if ls.saves != 0 {
+			t.Fatalf("expected only batch saves, got %d saves", ls.saves)
+		}
+		full := false
+		for _, b := range ls.batches {
+			if b > 3 {
+				t.Fatalf("expected batches of at most 3 nodes, got %d", b)
+			}
+			full = full || b == 3
+		}
+		if !full {
+			t.Fatalf("expected full batches, got %v", ls.batches)
+		}
+		checkTrie(t, n.Reference(), ls)
+
+		// the batch saver is used one by one without a batch size
+		ls = &batchLoadSaver{mockLoadSaver: newMockLoadSaver()}
+		if err := newTrie(t).Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(ls.batches) != 0 || ls.saves == 0 {
+			t.Fatalf("expected no batch saves, got %d batches and %d saves", len(ls.batches), ls.saves)
+		}
+	})
+
+	t.Run("collect-references", func(t *testing.T) {
+		ls := newMockLoadSaver()
+		n := newTrie(t)
+		refs, err := n.SaveWith(ctx, ls, mantaray.SaveConfig{})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if refs != nil {
+			t.Fatalf("expected no references, got %d", len(refs))
+		}
+
+		n = newTrie(t)
+		s := mantaray.NewCountingSaver(ls)
+		refs, err = n.SaveWith(ctx, s, mantaray.SaveConfig{CollectReferences: true})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(refs) != s.Calls() {
+			t.Fatalf("expected %d references, got %d", s.Calls(), len(refs))
+		}
+		if !bytes.Equal(refs[len(refs)-1], n.Reference()) {
+			t.Fatalf("expected last reference %x, got %x", n.Reference(), refs[len(refs)-1])
+		}
+		for _, ref := range refs {
+			if _, err := ls.Load(ctx, ref); err != nil {
+				t.Fatalf("expected reference %x to be saved, got %v", ref, err)
+			}
+		}
+
+		// nothing is saved again
+		refs, err = n.SaveWith(ctx, ls, mantaray.SaveConfig{CollectReferences: true})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(refs) != 0 {
+			t.Fatalf("expected no references, got %d", len(refs))
+		}
+	})
+
+	t.Run("include-clean", func(t *testing.T) {
+		ls := newMockLoadSaver()
+		n := newTrie(t)
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		ref := n.Reference()
+		loaded := mantaray.NewNodeRef(ref)
+		// load the whole trie
+		stats, err := loaded.Stats(ctx, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		other := mantaray.NewCountingSaver(newMockLoadSaver())
+		if err := loaded.Save(ctx, other); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if other.Calls() != 0 {
+			t.Fatalf("expected clean nodes to be skipped, got %d saves", other.Calls())
+		}
+
+		copied := newMockLoadSaver()
+		s := mantaray.NewCountingSaver(copied)
+		if _, err := loaded.SaveWith(ctx, s, mantaray.SaveConfig{IncludeClean: true}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if s.Calls() != stats.Nodes {
+			t.Fatalf("expected %d saves, got %d", stats.Nodes, s.Calls())
+		}
+		if !bytes.Equal(loaded.Reference(), ref) {
+			t.Fatalf("expected reference %x, got %x", ref, loaded.Reference())
+		}
+		checkTrie(t, ref, copied)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newTrie(t).SaveWith(ctx, newMockLoadSaver(), mantaray.SaveConfig{Concurrency: -1})
+		if !errors.Is(err, mantaray.ErrInvalid) {
+			t.Fatalf("expected invalid error, got %v", err)
+		}
+	})
+}
+
+func TestReference(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	content := bytes.Repeat([]byte{1}, 32)
+	manifest := bytes.Repeat([]byte{2}, 32)
+	for _, tc := range []struct {
+		path string
+		ref  mantaray.Reference
+	}{
+		{path: "index.html", ref: mantaray.Reference{Kind: mantaray.ReferenceContent, Bytes: content}},
+		{path: "nested/", ref: mantaray.Reference{Kind: mantaray.ReferenceManifest, Bytes: manifest}},
+		{path: "robots.txt", ref: mantaray.Reference{Kind: mantaray.ReferenceInline, Bytes: []byte("User-agent: *")}},
+	} {
+		md := map[string]string{mantaray.MetadataContentType: "text/plain"}
+		if err := n.AddReference(ctx, []byte(tc.path), tc.ref, md, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Add(ctx, []byte("raw.bin"), content, nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.Add(ctx, []byte("docs/"), nil, nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, ref := range []mantaray.Reference{
+		{Kind: mantaray.ReferenceContent},
+		{Kind: mantaray.ReferenceManifest},
+		{Kind: mantaray.ReferenceInline, Bytes: make([]byte, mantaray.MaxInlineValueSize+1)},
+		{Bytes: content},
+	} {
+		if err := n.AddReference(ctx, []byte("bad"), ref, nil, ls); err == nil {
+			t.Fatalf("expected error adding %s reference %x", ref.Kind, ref.Bytes)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		ref  mantaray.Reference
+		err  error
+	}{
+		{path: "index.html", ref: mantaray.Reference{Kind: mantaray.ReferenceContent, Bytes: content}},
+		{path: "nested/", ref: mantaray.Reference{Kind: mantaray.ReferenceManifest, Bytes: manifest}},
+		{path: "robots.txt", ref: mantaray.Reference{Kind: mantaray.ReferenceInline, Bytes: []byte("User-agent: *")}},
+		{path: "raw.bin", ref: mantaray.Reference{Kind: mantaray.ReferenceContent, Bytes: content}},
+		{path: "docs/", err: mantaray.ErrNotFound},
+		{path: "bad", err: mantaray.ErrNotFound},
+	} {
+		loaded := mantaray.NewNodeRef(n.Reference())
+		ref, err := loaded.LookupReference(ctx, []byte(tc.path), ls)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("expected error %v for path %s, got %v", tc.err, tc.path, err)
+		}
+		if ref.Kind != tc.ref.Kind || !bytes.Equal(ref.Bytes, tc.ref.Bytes) {
+			t.Fatalf("expected reference %s %x for path %s, got %s %x", tc.ref.Kind, tc.ref.Bytes, tc.path, ref.Kind, ref.Bytes)
+		}
+		if tc.err != nil {
+			continue
+		}
+		node, err := loaded.LookupNode(ctx, []byte(tc.path), ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if md := node.Metadata(); tc.path != "raw.bin" && md[mantaray.MetadataContentType] != "text/plain" {
+			t.Fatalf("expected metadata to be kept for path %s, got %v", tc.path, md)
+		}
+	}
+
+	// the raw entry of references is still available
+	entry, err := mantaray.NewNodeRef(n.Reference()).Lookup(ctx, []byte("nested/"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(entry, manifest) {
+		t.Fatalf("expected entry %x, got %x", manifest, entry)
+	}
+}
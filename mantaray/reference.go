@@ -0,0 +1,123 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+)
+
+// ReferenceKind is what the bytes of a Reference stand for.
+type ReferenceKind int
+
+// Kinds of references.
+const (
+	// ReferenceContent is a reference to the content of a file.
+	ReferenceContent ReferenceKind = iota + 1
+	// ReferenceManifest is a reference to the root of another manifest.
+	ReferenceManifest
+	// ReferenceInline is a value stored in the node instead of a reference.
+	ReferenceInline
+)
+
+// String returns the name of the reference kind.
+func (k ReferenceKind) String() string {
+	switch k {
+	case ReferenceContent:
+		return "content"
+	case ReferenceManifest:
+		return "manifest"
+	case ReferenceInline:
+		return "inline"
+	default:
+		return "unknown"
+	}
+}
+
+// Reference is an entry of a path together with what it stands for, so that
+// nested manifests and inline values need not be told apart by convention.
+type Reference struct {
+	Kind  ReferenceKind
+	Bytes []byte
+}
+
+// AddReference adds the reference to the path. Content and manifest
+// references are added like with Add, the latter marked with
+// MetadataManifest, and inline references like with AddInline along with the
+// metadata.
+func (n *Node) AddReference(ctx context.Context, path []byte, ref Reference, metadata map[string]string, ls LoadSaver) error {
+	md := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		md[k] = v
+	}
+	delete(md, MetadataManifest)
+	delete(md, MetadataInlineValue)
+	inline := false
+	switch ref.Kind {
+	case ReferenceContent, ReferenceManifest:
+		if len(ref.Bytes) == 0 {
+			return fmt.Errorf("%w: empty %s reference", ErrInvalidReference, ref.Kind)
+		}
+		if ref.Kind == ReferenceManifest {
+			md[MetadataManifest] = "true"
+		}
+	case ReferenceInline:
+		if len(ref.Bytes) > MaxInlineValueSize {
+			return fmt.Errorf("%w: %d bytes, limit %d", ErrInlineValueTooLarge, len(ref.Bytes), MaxInlineValueSize)
+		}
+		md[MetadataInlineValue] = base64.StdEncoding.EncodeToString(ref.Bytes)
+		inline = true
+	default:
+		return fmt.Errorf("%w: reference kind %d", ErrInvalid, ref.Kind)
+	}
+	if len(md) == 0 {
+		md = nil
+	}
+	entry := ref.Bytes
+	if inline {
+		entry = nil
+	}
+	return n.addValue(ctx, path, entry, md, inline, ls)
+}
+
+// LookupReference returns the reference stored on path with its kind.
+// Entries added without AddReference are content references unless inline.
+// ErrNotFound is returned if no value is stored on path, also for explicit
+// directory entries.
+func (n *Node) LookupReference(ctx context.Context, path []byte, l Loader) (Reference, error) {
+	node, err := n.LookupNode(ctx, path, l)
+	if err != nil {
+		return Reference{}, err
+	}
+	if !node.IsValueType() || node.IsDirectoryType() {
+		return Reference{}, notFound(path)
+	}
+	return node.reference(path)
+}
+
+// reference returns the reference of a node holding a value other than an
+// explicit directory.
+func (n *Node) reference(path []byte) (Reference, error) {
+	if n.IsInlineType() {
+		value, err := base64.StdEncoding.DecodeString(n.metadata[MetadataInlineValue])
+		if err != nil {
+			return Reference{}, fmt.Errorf("%w: inline value: %v", ErrInvalidMetadata, err)
+		}
+		return Reference{Kind: ReferenceInline, Bytes: value}, nil
+	}
+	kind := ReferenceContent
+	if v, ok := n.metadata[MetadataManifest]; ok {
+		manifest, err := strconv.ParseBool(v)
+		if err != nil {
+			return Reference{}, fmt.Errorf("%w: manifest flag %q on '%s'", ErrInvalidMetadata, v, path)
+		}
+		if manifest {
+			kind = ReferenceManifest
+		}
+	}
+	return Reference{Kind: kind, Bytes: append([]byte{}, n.entry...)}, nil
+}
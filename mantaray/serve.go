@@ -0,0 +1,176 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"errors"
+)
+
+// ErrErrorDocument is returned by Serve together with the error document
+// when nothing can be served on the requested path.
+var ErrErrorDocument = errors.New("serving error document")
+
+// Serve resolves a request path to the entry to serve. The path is
+// canonicalised by removing leading and repeated separators. Files are
+// served as they are; directories, explicit or implied by the paths below
+// them, are resolved to the index document set on the nearest directory
+// entry above them. The path actually served is returned as resolvedPath.
+//
+// If nothing can be served on the path, the error document set on the
+// nearest directory entry above it is returned together with
+// ErrErrorDocument. ErrNotFound is returned if no error document applies.
+func (n *Node) Serve(ctx context.Context, path []byte, l Loader) (entry, resolvedPath []byte, metadata map[string]string, err error) {
+	separator := n.configOrDefault().separator
+	path = canonicalPath(path, separator)
+
+	node, err := n.LookupNode(ctx, path, l)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, nil, nil, err
+	}
+	if err == nil && isFile(node) {
+		return node.entry, path, node.metadata, nil
+	}
+
+	dir := path
+	if len(dir) > 0 && dir[len(dir)-1] != separator {
+		dir = append(dir, separator)
+	}
+	// a node on path only splits the paths below it, so that "img" is no
+	// directory of "img2.png"
+	isDir := len(path) == 0 || (err == nil && node.IsValueType() && node.IsDirectoryType())
+	if !isDir {
+		if isDir, err = n.HasPrefix(ctx, dir, l); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if isDir {
+		index, _, err := n.inheritedMetadata(ctx, dir, MetadataIndexDocument, l)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if index != "" {
+			resolvedPath = append(dir[:len(dir):len(dir)], index...)
+			node, err := n.LookupNode(ctx, resolvedPath, l)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return nil, nil, nil, err
+			}
+			if err == nil && isFile(node) {
+				return node.entry, resolvedPath, node.metadata, nil
+			}
+		}
+	} else {
+		dir = parentDir(path, separator)
+	}
+
+	errorDocument, base, err := n.inheritedMetadata(ctx, dir, MetadataErrorDocument, l)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if errorDocument == "" {
+		return nil, nil, nil, notFound(path)
+	}
+	resolvedPath = append(base[:len(base):len(base)], errorDocument...)
+	node, err = n.LookupNode(ctx, resolvedPath, l)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !isFile(node) {
+		return nil, nil, nil, notFound(resolvedPath)
+	}
+	return node.entry, resolvedPath, node.metadata, ErrErrorDocument
+}
+
+// LookupInheritedMetadata returns the metadata of the entry on path overlaid
+// on the metadata of the directory entries above it. The metadata of the root
+// entry is applied first, then that of every directory entry from the
+// outermost to the innermost, and the metadata of the entry itself last, so
+// that deeper levels override the keys they set. Directories without an
+// explicit entry contribute nothing.
+//
+// The overlay is computed when resolving and is not stored on the entries;
+// Metadata still returns only the metadata stored on the entry. ErrNotFound
+// is returned if no value is stored on path.
+func (n *Node) LookupInheritedMetadata(ctx context.Context, path []byte, l Loader) (map[string]string, error) {
+	node, err := n.LookupNode(ctx, path, l)
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsValueType() {
+		return nil, notFound(path)
+	}
+	separator := n.configOrDefault().separator
+	metadata := make(map[string]string)
+	dirs := [][]byte{{}}
+	for i := 0; i < len(path)-1; i++ {
+		if path[i] == separator {
+			dirs = append(dirs, path[:i+1])
+		}
+	}
+	for _, dir := range dirs {
+		d, err := n.LookupNode(ctx, dir, l)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d.IsValueType() {
+			for k, v := range d.metadata {
+				metadata[k] = v
+			}
+		}
+	}
+	for k, v := range node.metadata {
+		metadata[k] = v
+	}
+	return metadata, nil
+}
+
+// inheritedMetadata returns the value of the key metadata on the nearest
+// directory entry on or above dir, together with the directory of the entry.
+// An empty value is returned if no directory entry sets the key.
+func (n *Node) inheritedMetadata(ctx context.Context, dir []byte, key string, l Loader) (value string, base []byte, err error) {
+	separator := n.configOrDefault().separator
+	for {
+		node, err := n.LookupNode(ctx, dir, l)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return "", nil, err
+		}
+		if err == nil && node.IsValueType() && node.metadata[key] != "" {
+			return node.metadata[key], dir, nil
+		}
+		if len(dir) == 0 {
+			return "", nil, nil
+		}
+		dir = parentDir(dir, separator)
+	}
+}
+
+// isFile returns true if the node holds an entry which is not a directory.
+func isFile(n *Node) bool {
+	return n.IsValueType() && !n.IsDirectoryType()
+}
+
+// canonicalPath removes leading and repeated separators from path.
+func canonicalPath(path []byte, separator byte) []byte {
+	c := make([]byte, 0, len(path))
+	for i, b := range path {
+		if b == separator && (len(c) == 0 || path[i-1] == separator) {
+			continue
+		}
+		c = append(c, b)
+	}
+	return c
+}
+
+// parentDir returns the directory containing path, including the trailing
+// separator, or an empty path for the root directory.
+func parentDir(path []byte, separator byte) []byte {
+	path = bytes.TrimSuffix(path, []byte{separator})
+	i := bytes.LastIndexByte(path, separator)
+	return path[:i+1]
+}
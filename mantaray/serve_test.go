@@ -0,0 +1,155 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, e := range []nodeEntry{
+		{
+			path:     []byte(""),
+			metadata: map[string]string{MetadataIndexDocument: "index.html", MetadataErrorDocument: "404.html"},
+		},
+		{path: []byte("index.html")},
+		{path: []byte("404.html")},
+		{path: []byte("blog/index.html")},
+		{path: []byte("blog/post.html")},
+		{path: []byte("img/1.png")},
+		{path: []byte("css1.css")},
+		{path: []byte("css2.css")},
+		{
+			path:     []byte("docs/"),
+			metadata: map[string]string{MetadataIndexDocument: "readme.html", MetadataErrorDocument: "missing.html"},
+		},
+		{path: []byte("docs/readme.html")},
+		{path: []byte("docs/missing.html")},
+		{path: []byte("docs/api/readme.html")},
+	} {
+		entry := e.entry
+		if len(e.path) > 0 && e.path[len(e.path)-1] != PathSeparator {
+			entry = append(make([]byte, 32-len(e.path)), e.path...)
+		}
+		err := n.Add(ctx, e.path, entry, e.metadata, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		resolved string
+		err      error
+	}{
+		{name: "file", path: "blog/post.html", resolved: "blog/post.html"},
+		{name: "file-non-canonical", path: "//blog//post.html", resolved: "blog/post.html"},
+		{name: "root", path: "", resolved: "index.html"},
+		{name: "root-separator", path: "/", resolved: "index.html"},
+		{name: "directory-with-index", path: "blog/", resolved: "blog/index.html"},
+		{name: "directory-without-separator", path: "blog", resolved: "blog/index.html"},
+		{name: "nested-index-document", path: "docs/api/", resolved: "docs/api/readme.html"},
+		{name: "directory-without-index", path: "img/", resolved: "404.html", err: ErrErrorDocument},
+		{name: "prefix-of-files", path: "css", resolved: "404.html", err: ErrErrorDocument},
+		{name: "missing-with-error-document", path: "blog/missing.html", resolved: "404.html", err: ErrErrorDocument},
+		{name: "missing-with-nested-error-document", path: "docs/api/missing.html", resolved: "docs/missing.html", err: ErrErrorDocument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entry, resolved, _, err := n.Serve(ctx, []byte(tc.path), nil)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if string(resolved) != tc.resolved {
+				t.Fatalf("expected resolved path %q, got %q", tc.resolved, resolved)
+			}
+			expected := append(make([]byte, 32-len(resolved)), resolved...)
+			if !bytes.Equal(entry, expected) {
+				t.Fatalf("expected entry %x, got %x", expected, entry)
+			}
+		})
+	}
+
+	t.Run("missing-without-error-document", func(t *testing.T) {
+		n := New()
+		err := n.Add(ctx, []byte("index.html"), make([]byte, 32), nil, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		_, _, _, err = n.Serve(ctx, []byte("missing.html"), nil)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected not found error, got %v", err)
+		}
+	})
+}
+
+func TestLookupInheritedMetadata(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, e := range []nodeEntry{
+		{path: []byte(""), metadata: map[string]string{"Cache-Control": "no-cache", "X-Site": "example"}},
+		{path: []byte("assets/"), metadata: map[string]string{"Cache-Control": "max-age=3600"}},
+		{path: []byte("assets/app.js"), entry: make([]byte, 32)},
+		{path: []byte("assets/img/"), metadata: map[string]string{MetadataContentType: "image/png"}},
+		{path: []byte("assets/img/logo.png"), entry: make([]byte, 32), metadata: map[string]string{"Cache-Control": "max-age=60"}},
+		{path: []byte("docs/readme.html"), entry: make([]byte, 32), metadata: map[string]string{MetadataContentType: "text/html"}},
+	} {
+		if err := n.Add(ctx, e.path, e.entry, e.metadata, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		path     string
+		expected map[string]string
+	}{
+		{
+			path:     "assets/app.js",
+			expected: map[string]string{"Cache-Control": "max-age=3600", "X-Site": "example"},
+		},
+		{
+			path:     "assets/img/logo.png",
+			expected: map[string]string{"Cache-Control": "max-age=60", "X-Site": "example", MetadataContentType: "image/png"},
+		},
+		{
+			// docs/ has no directory entry
+			path:     "docs/readme.html",
+			expected: map[string]string{"Cache-Control": "no-cache", "X-Site": "example", MetadataContentType: "text/html"},
+		},
+		{
+			path:     "assets/",
+			expected: map[string]string{"Cache-Control": "max-age=3600", "X-Site": "example"},
+		},
+	} {
+		md, err := n.LookupInheritedMetadata(ctx, []byte(tc.path), nil)
+		if err != nil {
+			t.Fatalf("expected no error for path %s, got %v", tc.path, err)
+		}
+		if !reflect.DeepEqual(md, tc.expected) {
+			t.Fatalf("expected metadata %v for path %s, got %v", tc.expected, tc.path, md)
+		}
+	}
+
+	node, err := n.LookupNode(ctx, []byte("assets/app.js"), nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(node.Metadata()) != 0 {
+		t.Fatalf("expected no stored metadata, got %v", node.Metadata())
+	}
+
+	for _, p := range []string{"assets/missing.js", "docs/"} {
+		_, err := n.LookupInheritedMetadata(ctx, []byte(p), nil)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected not found error for path %s, got %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import "context"
+
+// ChunkSize is the maximum size of a marshalled node that fits a single
+// chunk.
+const ChunkSize = 4096
+
+// MarshalSize returns the size of the node as marshalled by MarshalBinary
+// without marshalling it. References of forks which were not saved yet are
+// counted with the reference size of the node.
+func (n *Node) MarshalSize() (int, error) {
+	return n.marshalSize(true)
+}
+
+// marshalSize returns the size of the node as marshalled by marshal.
+func (n *Node) marshalSize(withTrailer bool) (int, error) {
+	size := nodeHeaderSize + n.refBytesSize + len(bitsForBytes{}.bits)
+	for _, f := range n.forks {
+		s, err := f.marshalSize(n.refBytesSize)
+		if err != nil {
+			return 0, err
+		}
+		size += s
+	}
+	if withTrailer && n.hasTrailer() {
+		b, err := n.trailerBytes()
+		if err != nil {
+			return 0, err
+		}
+		size += len(b)
+	}
+	if n.configOrDefault().checksums {
+		size += nodeTrailerTagSize + nodeTrailerLengthSize + nodeChecksumSize
+	}
+	return size, nil
+}
+
+// marshalSize returns the size of the marshalled fork, using refBytesSize
+// for the reference of a node which was not saved yet.
+func (f *fork) marshalSize(refBytesSize int) (int, error) {
+	size := f.referenceSize(refBytesSize)
+	if f.Node.IsWithMetadataType() {
+		metadataBytes, err := f.Node.metadataCodecOrDefault().Encode(f.Node.metadata)
+		if err != nil {
+			return 0, err
+		}
+		size += nodeForkMetadataBytesSize + len(padMetadata(metadataBytes))
+	}
+	if f.Node.IsWithBinaryMetadataType() {
+		size += nodeForkBinaryMetadataBytesSize + len(encodeBinaryMetadata(f.Node.binaryMetadata))
+	}
+	return size, nil
+}
+
+// referenceSize returns the size of the marshalled fork without metadata.
+func (f *fork) referenceSize(refBytesSize int) int {
+	if f.Node.ref != nil {
+		refBytesSize = len(f.Node.ref)
+	}
+	return nodeForkPreReferenceSize + refBytesSize
+}
+
+// SuggestSplit returns the paths under which the subtree could be extracted
+// into a nested manifest to bring a node exceeding ChunkSize back within the
+// limit. An extracted subtree is referenced from its parent by a fork
+// without metadata, so only forks carrying metadata are candidates, and a
+// path is suggested only if extracting it alone is sufficient. Paths are
+// returned in walk order.
+func (n *Node) SuggestSplit(ctx context.Context, l Loader) ([][]byte, error) {
+	var paths [][]byte
+	err := walkNode(ctx, []byte{}, 0, l, n, nil, func(path []byte, node *Node, err error) error {
+		size, err := node.MarshalSize()
+		if err != nil {
+			return err
+		}
+		if size <= ChunkSize {
+			return nil
+		}
+		for _, k := range node.sortedForkKeys() {
+			f := node.forks[k]
+			s, err := f.marshalSize(node.refBytesSize)
+			if err != nil {
+				return err
+			}
+			if size-s+f.referenceSize(node.refBytesSize) <= ChunkSize {
+				p := append(path[:0:0], path...)
+				paths = append(paths, append(p, f.prefix...))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
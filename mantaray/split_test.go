@@ -0,0 +1,120 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSuggestSplit(t *testing.T) {
+	ctx := context.Background()
+	large := map[string]string{"description": strings.Repeat("x", 1500)}
+	paths := []string{"a/1", "b/1", "c/1", "small"}
+
+	build := func(skip string) *Node {
+		n := New()
+		for _, p := range paths {
+			md := large
+			if p == "small" || p[:2] == skip {
+				md = nil
+			}
+			// the metadata is carried by the directory fork of the root
+			if err := n.Add(ctx, []byte(p[:2]), make([]byte, 32), md, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		return n
+	}
+
+	// sizeOf returns the marshalled size of the saved node reloaded from ls
+	// and asserts that it matches the stored size.
+	sizeOf := func(n *Node, ls mapLoadSaver) int {
+		t.Helper()
+		loaded := NewNodeRef(n.Reference())
+		if err := loaded.load(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		size, err := loaded.MarshalSize()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if stored := len(ls[string(n.Reference())]); size != stored {
+			t.Fatalf("expected marshal size %d, got %d", stored, size)
+		}
+		return size
+	}
+
+	n := build("")
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if size := sizeOf(n, ls); size <= ChunkSize {
+		t.Fatalf("expected node to exceed chunk size, got %d", size)
+	}
+
+	splits, err := NewNodeRef(n.Reference()).SuggestSplit(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	got := []string{}
+	for _, p := range splits {
+		got = append(got, string(p))
+	}
+	exp := []string{"a/", "b/", "c/"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected splits %v, got %v", exp, got)
+	}
+
+	for _, p := range exp {
+		n := build(p)
+		if err := n.Save(ctx, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if size := sizeOf(n, ls); size > ChunkSize {
+			t.Fatalf("expected size within chunk size after splitting %s, got %d", p, size)
+		}
+	}
+}
+
+func TestMarshalSizeBinaryMetadata(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, p := range []string{"a.png", "b.png"} {
+		if err := n.Add(ctx, []byte(p), make([]byte, 32), map[string]string{"name": p}, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	md := map[string][]byte{"thumbnail": make([]byte, 500)}
+	if err := n.SetBinaryMetadata(ctx, []byte("a.png"), md, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := n.SetBinaryMetadata(ctx, []byte("b.png"), md, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ls := mapLoadSaver{}
+	for _, f := range n.forks {
+		if err := f.Node.save(ctx, ls, 1); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	size, err := n.MarshalSize()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	data, err := n.MarshalBinary()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if size != len(data) {
+		t.Fatalf("expected size %d, got %d", len(data), size)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import "context"
+
+// Stats holds the number of nodes of a trie by type.
+type Stats struct {
+	Nodes        int // number of nodes
+	Values       int // number of nodes holding a value
+	Edges        int // number of nodes forking into other nodes
+	WithMetadata int // number of nodes holding metadata
+}
+
+func (s *Stats) add(n *Node) {
+	s.Nodes++
+	if n.IsValueType() {
+		s.Values++
+	}
+	if len(n.forks) > 0 {
+		s.Edges++
+	}
+	if n.IsWithMetadataType() {
+		s.WithMetadata++
+	}
+}
+
+// Stats returns the statistics of the whole trie, including the node itself.
+func (n *Node) Stats(ctx context.Context, l Loader) (Stats, error) {
+	var s Stats
+	if err := subtreeStats(ctx, n, l, &s, true); err != nil {
+		return Stats{}, err
+	}
+	return s, nil
+}
+
+// StatsPrefix returns the statistics of the nodes whose paths start with
+// prefix and are longer than prefix. Zeroed statistics are returned if no
+// such nodes exist, and ErrNotFound if prefix does not match any path.
+func (n *Node) StatsPrefix(ctx context.Context, prefix []byte, l Loader) (Stats, error) {
+	node, rest, err := n.lookupPrefix(ctx, prefix, l)
+	if err != nil {
+		return Stats{}, err
+	}
+	var s Stats
+	// the node is below prefix if prefix ended inside its fork prefix
+	if err := subtreeStats(ctx, node, l, &s, len(rest) > 0); err != nil {
+		return Stats{}, err
+	}
+	return s, nil
+}
+
+func subtreeStats(ctx context.Context, n *Node, l Loader, s *Stats, self bool) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if n.forks == nil {
+		if err := n.load(ctx, l); err != nil {
+			return err
+		}
+	}
+	if self {
+		s.add(n)
+	}
+	for _, f := range n.forks {
+		if err := subtreeStats(ctx, f.Node, l, s, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SerializedSize returns the total size of the saved nodes of the trie, the
+// bytes the manifest occupies in storage apart from the referenced contents.
+// Nodes are loaded as needed and every node is counted once.
+func (n *Node) SerializedSize(ctx context.Context, l Loader) (int64, error) {
+	var total int64
+	err := walkNode(ctx, []byte{}, 0, l, n, nil, func(_ []byte, node *Node, _ error) error {
+		// only the root is saved with the trailer
+		size, err := node.marshalSize(node == n)
+		if err != nil {
+			return err
+		}
+		total += int64(size)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// ContentTypes returns the number of entries of the trie by their
+// MetadataContentType metadata. Entries without a content type are not
+// counted, and an empty map is returned if no entry has one. Nodes are loaded
+// as needed.
+func (n *Node) ContentTypes(ctx context.Context, l Loader) (map[string]int, error) {
+	types := make(map[string]int)
+	err := walkValues(ctx, []byte{}, l, n, func(_ []byte, node *Node) error {
+		if !node.IsWithMetadataType() {
+			return nil
+		}
+		if t := node.metadata[MetadataContentType]; t != "" {
+			types[t]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return types, nil
+}
+
+// LongestPrefixChain returns the length of the longest run of chained forks
+// in the trie. A fork is chained when its prefix was cut at nodePrefixMaxSize
+// and its node neither holds a value nor branches, which happens for paths
+// with a non-branching part longer than the prefix limit. Zero means that no
+// chaining occurs.
+func (n *Node) LongestPrefixChain(ctx context.Context, l Loader) (int, error) {
+	return longestPrefixChain(ctx, n, 0, l)
+}
+
+func longestPrefixChain(ctx context.Context, n *Node, run int, l Loader) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+	if n.forks == nil {
+		if err := n.load(ctx, l); err != nil {
+			return 0, err
+		}
+	}
+	longest := run
+	for _, f := range n.forks {
+		if f.Node.forks == nil {
+			if err := f.Node.load(ctx, l); err != nil {
+				return 0, err
+			}
+		}
+		next := 0
+		if f.isChained() {
+			next = run + 1
+		}
+		c, err := longestPrefixChain(ctx, f.Node, next, l)
+		if err != nil {
+			return 0, err
+		}
+		if c > longest {
+			longest = c
+		}
+	}
+	return longest, nil
+}
+
+// isChained returns true if the fork is a link of a prefix chain.
+func (f *fork) isChained() bool {
+	return len(f.prefix) == nodePrefixMaxSize && !f.Node.IsValueType() && len(f.Node.forks) == 1
+}
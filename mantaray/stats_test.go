@@ -0,0 +1,254 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethersphere/manifest/mantaray"
+)
+
+const prefixMaxSize = 30
+
+func TestStatsPrefix(t *testing.T) {
+	ctx := context.Background()
+	n := mantaray.New()
+	for _, c := range [][]byte{
+		[]byte("index.html"),
+		[]byte("img/1.png"),
+		[]byte("img/2.png"),
+		[]byte("img/sub/3.png"),
+		[]byte("robots.txt"),
+	} {
+		var e [32]byte
+		copy(e[:], c)
+		err := n.Add(ctx, c, e[:], map[string]string{"content-type": "image/png"}, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := newMockLoadSaver()
+	err := n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	n = mantaray.NewNodeRef(n.Reference())
+
+	s, err := n.Stats(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	exp := mantaray.Stats{Nodes: 8, Values: 5, Edges: 3, WithMetadata: 5}
+	if s != exp {
+		t.Fatalf("expected stats %+v, got %+v", exp, s)
+	}
+
+	for _, tc := range []struct {
+		prefix   string
+		expected mantaray.Stats
+	}{
+		{
+			prefix:   "img/",
+			expected: mantaray.Stats{Nodes: 3, Values: 3, WithMetadata: 3},
+		},
+		{
+			prefix:   "im",
+			expected: mantaray.Stats{Nodes: 4, Values: 3, Edges: 1, WithMetadata: 3},
+		},
+		{
+			prefix:   "img/sub/",
+			expected: mantaray.Stats{Nodes: 1, Values: 1, WithMetadata: 1},
+		},
+		{
+			prefix:   "index.html",
+			expected: mantaray.Stats{},
+		},
+	} {
+		s, err := n.StatsPrefix(ctx, []byte(tc.prefix), ls)
+		if err != nil {
+			t.Fatalf("expected no error for prefix %s, got %v", tc.prefix, err)
+		}
+		if s != tc.expected {
+			t.Fatalf("expected stats %+v for prefix %s, got %+v", tc.expected, tc.prefix, s)
+		}
+	}
+
+	_, err = n.StatsPrefix(ctx, []byte("video/"), ls)
+	if !errors.Is(err, mantaray.ErrNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestLongestPrefixChain(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		toAdd    [][]byte
+		expected int
+	}{
+		{
+			name:     "empty",
+			expected: 0,
+		},
+		{
+			name: "short-paths",
+			toAdd: [][]byte{
+				[]byte("index.html"),
+				[]byte("img/1.png"),
+			},
+			expected: 0,
+		},
+		{
+			name: "max-prefix-size",
+			toAdd: [][]byte{
+				bytes.Repeat([]byte("a"), prefixMaxSize),
+			},
+			expected: 0,
+		},
+		{
+			name: "one-over-max-prefix-size",
+			toAdd: [][]byte{
+				bytes.Repeat([]byte("a"), prefixMaxSize+1),
+			},
+			expected: 1,
+		},
+		{
+			name: "very-long-path",
+			toAdd: [][]byte{
+				[]byte("index.html"),
+				append([]byte("img/"), bytes.Repeat([]byte("b"), 4*prefixMaxSize)...),
+			},
+			expected: 4,
+		},
+		{
+			name: "value-breaks-chain",
+			toAdd: [][]byte{
+				bytes.Repeat([]byte("c"), 2*prefixMaxSize),
+				bytes.Repeat([]byte("c"), 4*prefixMaxSize),
+			},
+			expected: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			n := mantaray.New()
+			for _, c := range tc.toAdd {
+				var e [32]byte
+				copy(e[:], c)
+				err := n.Add(ctx, c, e[:], nil, nil)
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+			}
+
+			chain, err := n.LongestPrefixChain(ctx, nil)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if chain != tc.expected {
+				t.Fatalf("expected chain length %d, got %d", tc.expected, chain)
+			}
+
+			ls := newMockLoadSaver()
+			err = n.Save(ctx, ls)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			chain, err = mantaray.NewNodeRef(n.Reference()).LongestPrefixChain(ctx, ls)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if chain != tc.expected {
+				t.Fatalf("expected chain length %d after load, got %d", tc.expected, chain)
+			}
+		})
+	}
+}
+
+func TestSerializedSize(t *testing.T) {
+	ctx := context.Background()
+	n := mantaray.New()
+	// a root value with metadata is saved with the trailer
+	err := n.Add(ctx, []byte{}, make([]byte, 32), map[string]string{mantaray.MetadataIndexDocument: "index.html"}, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, c := range []string{"index.html", "img/1.png", "img/2.png", "img/sub/3.png", "robots.txt"} {
+		var e [32]byte
+		copy(e[:], c)
+		err := n.Add(ctx, []byte(c), e[:], map[string]string{"content-type": "image/png"}, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := newMockLoadSaver()
+	s := mantaray.NewCountingSaver(ls)
+	if err := n.Save(ctx, s); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	size, err := mantaray.NewNodeRef(n.Reference()).SerializedSize(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if size != int64(s.Bytes()) {
+		t.Fatalf("expected size %d, got %d", s.Bytes(), size)
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	ctx := context.Background()
+	n := mantaray.New()
+	types, err := n.ContentTypes(ctx, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(types) != 0 {
+		t.Fatalf("expected no content types, got %v", types)
+	}
+
+	for _, e := range []struct {
+		path        string
+		contentType string
+	}{
+		{"index.html", "text/html"},
+		{"about.html", "text/html"},
+		{"img/1.png", "image/png"},
+		{"img/2.png", "image/png"},
+		{"img/3.jpg", "image/jpeg"},
+		{"style.css", "text/css"},
+		{"robots.txt", ""},
+	} {
+		var ref [32]byte
+		copy(ref[:], e.path)
+		var md map[string]string
+		if e.contentType != "" {
+			md = map[string]string{mantaray.MetadataContentType: e.contentType}
+		}
+		if err := n.Add(ctx, []byte(e.path), ref[:], md, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := newMockLoadSaver()
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	types, err = mantaray.NewNodeRef(n.Reference()).ContentTypes(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := map[string]int{"text/html": 2, "image/png": 2, "image/jpeg": 1, "text/css": 1}
+	if len(types) != len(expected) {
+		t.Fatalf("expected content types %v, got %v", expected, types)
+	}
+	for k, v := range expected {
+		if types[k] != v {
+			t.Fatalf("expected content types %v, got %v", expected, types)
+		}
+	}
+}
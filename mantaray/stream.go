@@ -0,0 +1,170 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// WriteTo writes the node serialised like MarshalBinary to w.
+func (n *Node) WriteTo(w io.Writer) (int64, error) {
+	data, err := n.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	written, err := w.Write(data)
+	return int64(written), err
+}
+
+// ReadFrom reads a serialised node from r and deserialises it like
+// UnmarshalBinary. The length of the node is derived from its header, index
+// and forks, so only the bytes of the node are read. As the trailer of
+// "mantaray:0.3" and later nodes has no length of its own, its records are
+// read until the end of the stream.
+func (n *Node) ReadFrom(r io.Reader) (int64, error) {
+	nr := &nodeReader{r: progressReader{r}}
+	if err := nr.readNode(); err != nil {
+		return int64(len(nr.data)), err
+	}
+	return int64(len(nr.data)), n.UnmarshalBinary(nr.data)
+}
+
+// nodeReader reads a serialised node, keeping the read bytes.
+type nodeReader struct {
+	r    io.Reader
+	data []byte
+}
+
+// maxConsecutiveEmptyReads is the number of reads returning neither data nor
+// an error after which reading fails with io.ErrNoProgress, as in bufio.
+const maxConsecutiveEmptyReads = 100
+
+// progressReader fails with io.ErrNoProgress on readers which keep returning
+// neither data nor an error.
+type progressReader struct {
+	r io.Reader
+}
+
+func (p progressReader) Read(b []byte) (int, error) {
+	for i := 0; i < maxConsecutiveEmptyReads; i++ {
+		n, err := p.r.Read(b)
+		if n > 0 || err != nil || len(b) == 0 {
+			return n, err
+		}
+	}
+	return 0, io.ErrNoProgress
+}
+
+// read reads size bytes and returns them decrypted.
+func (nr *nodeReader) read(size int) ([]byte, error) {
+	start := len(nr.data)
+	nr.data = append(nr.data, make([]byte, size)...)
+	read, err := io.ReadFull(nr.r, nr.data[start:])
+	if err != nil {
+		nr.data = nr.data[:start+read]
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: %d bytes read, expected %d", ErrTooShort, start+read, start+size)
+		}
+		return nil, err
+	}
+	b := make([]byte, size)
+	for i := range b {
+		p := start + i
+		b[i] = nr.data[p]
+		if p >= nodeObfuscationKeySize {
+			b[i] ^= nr.data[p%nodeObfuscationKeySize]
+		}
+	}
+	return b, nil
+}
+
+func (nr *nodeReader) readNode() error {
+	header, err := nr.read(nodeHeaderSize)
+	if err != nil {
+		return err
+	}
+	versionHash := header[nodeObfuscationKeySize : nodeObfuscationKeySize+versionHashSize]
+	refBytesSize := int(header[nodeHeaderSize-1])
+
+	v01 := bytes.Equal(versionHash, version01HashBytes)
+	// forks of nodes since "mantaray:0.4" may have binary metadata
+	withBinary := bytes.Equal(versionHash, version04HashBytes) || bytes.Equal(versionHash, version05HashBytes)
+	// nodes since "mantaray:0.3" have a trailer
+	withTrailer := withBinary || bytes.Equal(versionHash, version03HashBytes)
+	if !v01 && !withTrailer && !bytes.Equal(versionHash, version02HashBytes) {
+		return fmt.Errorf("%w: %x", ErrInvalidVersion, versionHash)
+	}
+
+	// entry
+	if _, err := nr.read(refBytesSize); err != nil {
+		return err
+	}
+
+	// index
+	indexBytes, err := nr.read(32)
+	if err != nil {
+		return err
+	}
+	bb := &bitsForBytes{}
+	bb.fromBytes(indexBytes)
+
+	for i := bb.count(); i > 0; i-- {
+		if v01 {
+			if _, err := nr.read(nodeForkPreReferenceSize + refBytesSize); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := nr.read(nodeForkPreReferenceSize + refBytesSize)
+		if err != nil {
+			return err
+		}
+		if nodeTypeIsWithMetadataType(b[0]) {
+			sizeBytes, err := nr.read(nodeForkMetadataBytesSize)
+			if err != nil {
+				return err
+			}
+			if _, err := nr.read(int(binary.BigEndian.Uint16(sizeBytes))); err != nil {
+				return err
+			}
+		}
+		if withBinary && nodeTypeIsWithBinaryMetadataType(b[0]) {
+			sizeBytes, err := nr.read(nodeForkBinaryMetadataBytesSize)
+			if err != nil {
+				return err
+			}
+			if _, err := nr.read(int(binary.BigEndian.Uint16(sizeBytes))); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !withTrailer {
+		return nil
+	}
+	for {
+		// the trailer ends with the stream at a record boundary
+		var tag [nodeTrailerTagSize]byte
+		read, err := nr.r.Read(tag[:])
+		if read == 0 {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		nr.data = append(nr.data, tag[0])
+		sizeBytes, err := nr.read(nodeTrailerLengthSize)
+		if err != nil {
+			return err
+		}
+		if _, err := nr.read(int(binary.BigEndian.Uint16(sizeBytes))); err != nil {
+			return err
+		}
+	}
+}
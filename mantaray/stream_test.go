@@ -0,0 +1,144 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestWriteToReadFrom(t *testing.T) {
+	ctx := context.Background()
+	build := func(rootValue, binary bool, codec MetadataCodec) *Node {
+		n := New()
+		n.SetMetadataCodec(codec)
+		if rootValue {
+			err := n.Add(ctx, []byte{}, make([]byte, 32), map[string]string{MetadataIndexDocument: "index.html"}, nil)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		for _, p := range []string{"index.html", "img/1.png", "img/2.png", "robots.txt"} {
+			e := make([]byte, 32)
+			copy(e, p)
+			err := n.Add(ctx, []byte(p), e, map[string]string{"content-type": "text/plain"}, nil)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		if binary {
+			md := map[string][]byte{"thumbnail": {0, 1, 2, 255}}
+			if err := n.SetBinaryMetadata(ctx, []byte("robots.txt"), md, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if err := n.SetBinaryMetadata(ctx, []byte{}, md, nil); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		// save the forks, so that the root can be marshalled
+		ls := mapLoadSaver{}
+		for _, f := range n.forks {
+			if err := f.Node.save(ctx, ls, 1); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		return n
+	}
+
+	for _, tc := range []struct {
+		name    string
+		node    *Node
+		version string
+		// the stream continues after the node
+		trailing bool
+	}{
+		{name: "mantaray:0.2", node: build(false, false, nil), version: version02String, trailing: true},
+		{name: "mantaray:0.3", node: build(true, false, nil), version: version03String},
+		{name: "mantaray:0.4", node: build(true, true, nil), version: version04String},
+		{name: "mantaray:0.5", node: build(true, true, CompactMetadataCodec), version: version05String},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			written, err := tc.node.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			data := append([]byte{}, buf.Bytes()...)
+			if tc.trailing {
+				buf.WriteString("next")
+			}
+
+			read := &Node{}
+			n, err := read.ReadFrom(&buf)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if n != written {
+				t.Fatalf("expected %d bytes read, got %d", written, n)
+			}
+			if tc.trailing && buf.String() != "next" {
+				t.Fatalf("expected the rest of the stream to be left, got %q", buf.String())
+			}
+			if read.FormatVersion() != tc.version {
+				t.Fatalf("expected version %s, got %s", tc.version, read.FormatVersion())
+			}
+
+			unmarshalled := &Node{}
+			if err := unmarshalled.UnmarshalBinary(data); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(read, unmarshalled) {
+				t.Fatalf("expected node %v, got %v", unmarshalled, read)
+			}
+
+			_, err = (&Node{}).ReadFrom(bytes.NewReader(data[:len(data)-1]))
+			if !errors.Is(err, ErrTooShort) {
+				t.Fatalf("expected too short error, got %v", err)
+			}
+		})
+	}
+
+	t.Run("no-progress", func(t *testing.T) {
+		data, err := build(true, false, nil).MarshalBinary()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		_, err = (&Node{}).ReadFrom(io.MultiReader(bytes.NewReader(data), emptyReader{}))
+		if !errors.Is(err, io.ErrNoProgress) {
+			t.Fatalf("expected %v, got %v", io.ErrNoProgress, err)
+		}
+	})
+
+	t.Run("mantaray:0.1", func(t *testing.T) {
+		data, _ := hex.DecodeString(testMarshalOutput01)
+		read := &Node{}
+		n, err := read.ReadFrom(bytes.NewReader(append(data, 1, 2, 3)))
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if n != int64(len(data)) {
+			t.Fatalf("expected %d bytes read, got %d", len(data), n)
+		}
+		unmarshalled := &Node{}
+		if err := unmarshalled.UnmarshalBinary(data); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !reflect.DeepEqual(read, unmarshalled) {
+			t.Fatalf("expected node %v, got %v", unmarshalled, read)
+		}
+	})
+}
+
+// emptyReader never returns data nor an error.
+type emptyReader struct{}
+
+func (emptyReader) Read([]byte) (int, error) {
+	return 0, nil
+}
@@ -40,6 +40,12 @@ func nodeStringWithPrefix(n *Node, prefix string, writer io.Writer) {
 	if n.IsWithPathSeparatorType() {
 		io.WriteString(writer, fmt.Sprint(" PathSeparator"))
 	}
+	if n.IsDirectoryType() {
+		io.WriteString(writer, fmt.Sprint(" Directory"))
+	}
+	if n.IsInlineType() {
+		io.WriteString(writer, fmt.Sprint(" Inline"))
+	}
 	io.WriteString(writer, fmt.Sprint(" ]"))
 	io.WriteString(writer, fmt.Sprint("\n"))
 	io.WriteString(writer, prefix)
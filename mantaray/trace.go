@@ -0,0 +1,38 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import "time"
+
+// Tracer operation names.
+const (
+	TraceLoad = "load"
+	TraceSave = "save"
+)
+
+// Tracer is called after every load and save of a node with the operation,
+// the reference of the node, the size of its serialised form, the duration
+// of the operation and its error. The reference is nil for failed saves and
+// the size is zero for failed loads. It may be called concurrently.
+type Tracer func(op string, ref []byte, size int, dur time.Duration, err error)
+
+// SetTracer sets the tracer of the node and of the nodes under it in memory.
+// Nodes created or loaded under the node inherit the tracer. A nil tracer
+// disables tracing.
+func (n *Node) SetTracer(t Tracer) {
+	n.tracer = t
+	for _, f := range n.forks {
+		f.Node.SetTracer(t)
+	}
+}
+
+// trace calls the tracer of the node, if set, for an operation started at
+// start.
+func (n *Node) trace(op string, ref []byte, size int, start time.Time, err error) {
+	if n.tracer == nil {
+		return
+	}
+	n.tracer(op, ref, size, time.Since(start), err)
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// MetadataValidator checks the value of a metadata key, returning the reason
+// it is invalid or nil.
+type MetadataValidator func(value string) error
+
+var (
+	metadataValidatorsMtx sync.RWMutex
+	metadataValidators    = map[string]MetadataValidator{
+		MetadataContentType:   validateContentType,
+		MetadataContentLength: validateContentLength,
+		MetadataRedirectCode:  validateRedirectCode,
+		MetadataChunked:       validateBool,
+		MetadataManifest:      validateBool,
+		MetadataInlineValue:   validateInlineValue,
+	}
+)
+
+// RegisterMetadataValidator sets the validator used by ValidateMetadata for
+// the values of key, replacing the built-in one of reserved keys. A nil
+// validator stops validating the key. It is safe for concurrent use.
+func RegisterMetadataValidator(key string, v MetadataValidator) {
+	metadataValidatorsMtx.Lock()
+	defer metadataValidatorsMtx.Unlock()
+	if v == nil {
+		delete(metadataValidators, key)
+		return
+	}
+	metadataValidators[key] = v
+}
+
+// MetadataIssue is an invalid metadata value found by ValidateMetadata.
+type MetadataIssue struct {
+	Path  []byte // path of the entry holding the metadata
+	Key   string // metadata key, empty for errors loading the manifest
+	Value string
+	Err   error // reason the value is invalid
+}
+
+// ValidateMetadata checks the metadata of every entry with the validators of
+// the keys, so that malformed values are caught before a manifest is
+// published. All issues are returned, ordered by path and key; validation
+// stops at the first error loading the manifest, which is reported as an
+// issue without a key.
+func (n *Node) ValidateMetadata(ctx context.Context, l Loader) []MetadataIssue {
+	metadataValidatorsMtx.RLock()
+	validators := make(map[string]MetadataValidator, len(metadataValidators))
+	for k, v := range metadataValidators {
+		validators[k] = v
+	}
+	metadataValidatorsMtx.RUnlock()
+
+	var issues []MetadataIssue
+	err := walkValues(ctx, []byte{}, l, n, func(path []byte, node *Node) error {
+		keys := make([]string, 0, len(node.metadata))
+		for k := range node.metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v, ok := validators[k]
+			if !ok {
+				continue
+			}
+			if err := v(node.metadata[k]); err != nil {
+				issues = append(issues, MetadataIssue{Path: path, Key: k, Value: node.metadata[k], Err: err})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		issues = append(issues, MetadataIssue{Err: err})
+	}
+	return issues
+}
+
+func validateContentType(value string) error {
+	if _, _, err := mime.ParseMediaType(value); err != nil {
+		return fmt.Errorf("%w: content type %q: %v", ErrInvalidMetadata, value, err)
+	}
+	return nil
+}
+
+func validateContentLength(value string) error {
+	if size, err := strconv.ParseInt(value, 10, 64); err != nil || size < 0 {
+		return fmt.Errorf("%w: content length %q", ErrInvalidMetadata, value)
+	}
+	return nil
+}
+
+func validateRedirectCode(value string) error {
+	if code, err := strconv.Atoi(value); err != nil || code < 300 || code > 399 {
+		return fmt.Errorf("%w: redirect code %q", ErrInvalidMetadata, value)
+	}
+	return nil
+}
+
+func validateBool(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("%w: flag %q", ErrInvalidMetadata, value)
+	}
+	return nil
+}
+
+func validateInlineValue(value string) error {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("%w: inline value: %v", ErrInvalidMetadata, err)
+	}
+	if len(b) > MaxInlineValueSize {
+		return fmt.Errorf("%w: inline value of %d bytes, limit %d", ErrInvalidMetadata, len(b), MaxInlineValueSize)
+	}
+	return nil
+}
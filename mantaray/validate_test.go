@@ -0,0 +1,71 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	ctx := context.Background()
+	errOwner := errors.New("owner is not an email address")
+	RegisterMetadataValidator("owner", func(value string) error {
+		if !strings.Contains(value, "@") {
+			return errOwner
+		}
+		return nil
+	})
+	defer RegisterMetadataValidator("owner", nil)
+
+	n := New()
+	for path, md := range map[string]map[string]string{
+		"index.html": {MetadataContentType: "text/html; charset=utf-8", MetadataContentLength: "1024", "owner": "web@example.com"},
+		"img/1.png":  {MetadataContentType: "image/png", MetadataContentLength: "-1"},
+		"img/2.png":  {MetadataContentType: "image png", MetadataChunked: "maybe"},
+		"old.html":   {MetadataRedirectCode: "200", "owner": "nobody"},
+		"new.html":   {MetadataRedirectCode: "301", "unchecked": "anything"},
+		"video.mp4":  {MetadataContentLength: "1.5MB"},
+	} {
+		if err := n.Add(ctx, []byte(path), append(make([]byte, 32-len(path)), path...), md, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := []struct {
+		path, key string
+		err       error
+	}{
+		{path: "img/1.png", key: MetadataContentLength, err: ErrInvalidMetadata},
+		{path: "img/2.png", key: MetadataChunked, err: ErrInvalidMetadata},
+		{path: "img/2.png", key: MetadataContentType, err: ErrInvalidMetadata},
+		{path: "old.html", key: "owner", err: errOwner},
+		{path: "old.html", key: MetadataRedirectCode, err: ErrInvalidMetadata},
+		{path: "video.mp4", key: MetadataContentLength, err: ErrInvalidMetadata},
+	}
+	issues := NewNodeRef(n.Reference()).ValidateMetadata(ctx, ls)
+	if len(issues) != len(expected) {
+		t.Fatalf("expected %d issues, got %+v", len(expected), issues)
+	}
+	for i, issue := range issues {
+		e := expected[i]
+		if string(issue.Path) != e.path || issue.Key != e.key || !errors.Is(issue.Err, e.err) {
+			t.Fatalf("expected issue with %s on %s (%v), got %+v", e.key, e.path, e.err, issue)
+		}
+	}
+
+	t.Run("load-error", func(t *testing.T) {
+		issues := NewNodeRef(n.Reference()).ValidateMetadata(ctx, mapLoadSaver{})
+		if len(issues) != 1 || issues[0].Key != "" || !errors.Is(issues[0].Err, ErrNotFound) {
+			t.Fatalf("expected a load issue, got %+v", issues)
+		}
+	})
+}
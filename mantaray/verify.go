@@ -0,0 +1,40 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrRefSizeMismatch is returned by CheckRefSizes if nodes of a trie use
+// different reference sizes.
+var ErrRefSizeMismatch = errors.New("reference size mismatch")
+
+// CheckRefSizes loads the whole trie and checks that all nodes use the same
+// reference size, as assumed by the other operations. Tries loaded from
+// untrusted sources may violate this. The error names the path of the first
+// offending node. Nodes without a reference size, such as empty tries, are
+// ignored.
+func (n *Node) CheckRefSizes(ctx context.Context, l Loader) error {
+	size := 0
+	return walkNode(ctx, []byte{}, 0, l, n, nil, func(path []byte, node *Node, err error) error {
+		if err != nil {
+			return err
+		}
+		if node.refBytesSize == 0 {
+			return nil
+		}
+		if size == 0 {
+			size = node.refBytesSize
+			return nil
+		}
+		if node.refBytesSize != size {
+			return fmt.Errorf("node on '%s': %w: %d, expected %d", path, ErrRefSizeMismatch, node.refBytesSize, size)
+		}
+		return nil
+	})
+}
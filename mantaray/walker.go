@@ -4,7 +4,97 @@
 
 package mantaray
 
-import "context"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// sortedForkKeys returns the fork keys of the node in byte order.
+func (n *Node) sortedForkKeys() []byte {
+	keys := make([]byte, 0, len(n.forks))
+	for k := range n.forks {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// orderedForkKeys returns the fork keys of the node ordered by less applied
+// to the fork prefixes, or in byte order if less is nil.
+func (n *Node) orderedForkKeys(less func(a, b []byte) bool) []byte {
+	keys := n.sortedForkKeys()
+	if less != nil {
+		sort.SliceStable(keys, func(i, j int) bool {
+			return less(n.forks[keys[i]].prefix, n.forks[keys[j]].prefix)
+		})
+	}
+	return keys
+}
+
+// WalkOption configures Walk and WalkNode.
+type WalkOption func(*walkOptions)
+
+type walkOptions struct {
+	less func(a, b []byte) bool
+}
+
+// WithForkOrder makes the walk visit the forks of each node in the order
+// defined by less over the fork prefixes instead of byte order, such as a
+// natural or case-insensitive order. Only the order of the emitted paths is
+// affected. As less compares single fork prefixes, paths differing in a part
+// split across several nodes are still ordered by their common parts first.
+func WithForkOrder(less func(a, b []byte) bool) WalkOption {
+	return func(o *walkOptions) {
+		o.less = less
+	}
+}
+
+func newWalkOptions(opts []WalkOption) *walkOptions {
+	o := &walkOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// walkValues recursively descends path in byte order, calling fn for each
+// node holding a value.
+func walkValues(ctx context.Context, path []byte, l Loader, n *Node, fn func(path []byte, n *Node) error) error {
+	return walkValuesDepth(ctx, path, 0, l, n, fn)
+}
+
+func walkValuesDepth(ctx context.Context, path []byte, depth int, l Loader, n *Node, fn func(path []byte, n *Node) error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if err := n.checkDepth(depth); err != nil {
+		return err
+	}
+	if n.forks == nil {
+		if err := n.loadPath(ctx, path, l); err != nil {
+			return err
+		}
+	}
+	if n.IsValueType() {
+		if err := fn(path, n); err != nil {
+			return err
+		}
+	}
+	for _, k := range n.sortedForkKeys() {
+		f := n.forks[k]
+		nextPath := append(path[:0:0], path...)
+		nextPath = append(nextPath, f.prefix...)
+		if err := walkValuesDepth(ctx, nextPath, depth+1, l, f.Node, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
 // WalkNodeFunc is the type of the function called for each node visited
 // by WalkNode.
@@ -14,10 +104,13 @@ func walkNodeFnCopyBytes(ctx context.Context, path []byte, node *Node, err error
 	return walkFn(append(path[:0:0], path...), node, nil)
 }
 
-// walkNode recursively descends path, calling walkFn.
-func walkNode(ctx context.Context, path []byte, l Loader, n *Node, walkFn WalkNodeFunc) error {
+// walkNode recursively descends path in the order of less, calling walkFn.
+func walkNode(ctx context.Context, path []byte, depth int, l Loader, n *Node, less func(a, b []byte) bool, walkFn WalkNodeFunc) error {
+	if err := n.checkDepth(depth); err != nil {
+		return err
+	}
 	if n.forks == nil {
-		if err := n.load(ctx, l); err != nil {
+		if err := n.loadPath(ctx, path, l); err != nil {
 			return err
 		}
 	}
@@ -27,11 +120,12 @@ func walkNode(ctx context.Context, path []byte, l Loader, n *Node, walkFn WalkNo
 		return err
 	}
 
-	for _, v := range n.forks {
+	for _, k := range n.orderedForkKeys(less) {
+		v := n.forks[k]
 		nextPath := append(path[:0:0], path...)
 		nextPath = append(nextPath, v.prefix...)
 
-		err := walkNode(ctx, nextPath, l, v.Node, walkFn)
+		err := walkNode(ctx, nextPath, depth+1, l, v.Node, less, walkFn)
 		if err != nil {
 			return err
 		}
@@ -43,16 +137,164 @@ func walkNode(ctx context.Context, path []byte, l Loader, n *Node, walkFn WalkNo
 // WalkNode walks the node tree structure rooted at root, calling walkFn for
 // each node in the tree, including root. All errors that arise visiting nodes
 // are filtered by walkFn.
-func (n *Node) WalkNode(ctx context.Context, root []byte, l Loader, walkFn WalkNodeFunc) error {
+func (n *Node) WalkNode(ctx context.Context, root []byte, l Loader, walkFn WalkNodeFunc, opts ...WalkOption) error {
+	o := newWalkOptions(opts)
 	node, err := n.LookupNode(ctx, root, l)
 	if err != nil {
 		err = walkFn(root, nil, err)
 	} else {
-		err = walkNode(ctx, root, l, node, walkFn)
+		err = walkNode(ctx, root, 0, l, node, o.less, walkFn)
 	}
 	return err
 }
 
+// WalkNew walks the nodes of the trie like WalkNode, skipping the subtrees
+// of nodes whose references are in known, such as the references visited by
+// a previous walk. As nodes are content addressed, a subtree under a known
+// reference is identical to the one seen before, so after a small edit only
+// the nodes on the paths to the changes are loaded and visited. Nodes with
+// unsaved changes have no reference and are always visited.
+func (n *Node) WalkNew(ctx context.Context, l Loader, known map[string]struct{}, walkFn WalkNodeFunc) error {
+	return walkNew(ctx, []byte{}, 0, l, n, known, walkFn)
+}
+
+func walkNew(ctx context.Context, path []byte, depth int, l Loader, n *Node, known map[string]struct{}, walkFn WalkNodeFunc) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if n.ref != nil {
+		if _, ok := known[string(n.ref)]; ok {
+			return nil
+		}
+	}
+	if err := n.checkDepth(depth); err != nil {
+		return err
+	}
+	if n.forks == nil {
+		if err := n.loadPath(ctx, path, l); err != nil {
+			return err
+		}
+	}
+	if err := walkNodeFnCopyBytes(ctx, path, n, nil, walkFn); err != nil {
+		return err
+	}
+	for _, k := range n.sortedForkKeys() {
+		f := n.forks[k]
+		nextPath := append(path[:0:0], path...)
+		nextPath = append(nextPath, f.prefix...)
+		if err := walkNew(ctx, nextPath, depth+1, l, f.Node, known, walkFn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrStopWalk is returned by the function called by WalkFrom to stop the
+// walk, for example when a page of entries is full.
+var ErrStopWalk = errors.New("stop walk")
+
+// WalkFrom calls fn for each value of the trie whose path sorts after cursor,
+// in byte order of the paths, starting from the first value if cursor is nil.
+// If fn returns ErrStopWalk, the walk stops and the path fn was called with
+// is returned as the cursor to resume the walk from; a nil cursor is returned
+// once all values were visited. On other errors the cursor is the path of the
+// last value fn accepted, so that the walk can be resumed after a failure.
+//
+// The cursor is a path rather than a position, so a walk resumed on a
+// modified trie continues after the same path, neither repeating nor skipping
+// values whose paths sort after it. Subtrees sorting entirely before the
+// cursor are not loaded.
+func (n *Node) WalkFrom(ctx context.Context, l Loader, cursor []byte, fn func(path []byte, node *Node) error) ([]byte, error) {
+	var last []byte
+	err := walkFrom(ctx, []byte{}, 0, l, n, cursor, func(path []byte, node *Node) error {
+		if err := fn(append(path[:0:0], path...), node); err != nil {
+			if errors.Is(err, ErrStopWalk) {
+				last = path
+			}
+			return err
+		}
+		last = path
+		return nil
+	})
+	if errors.Is(err, ErrStopWalk) {
+		return last, nil
+	}
+	if err != nil {
+		return last, err
+	}
+	return nil, nil
+}
+
+func walkFrom(ctx context.Context, path []byte, depth int, l Loader, n *Node, cursor []byte, fn func(path []byte, node *Node) error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if err := n.checkDepth(depth); err != nil {
+		return err
+	}
+	if n.forks == nil {
+		if err := n.loadPath(ctx, path, l); err != nil {
+			return err
+		}
+	}
+	if n.IsValueType() && (cursor == nil || bytes.Compare(path, cursor) > 0) {
+		if err := fn(path, n); err != nil {
+			return err
+		}
+	}
+	for _, k := range n.sortedForkKeys() {
+		f := n.forks[k]
+		nextPath := append(path[:0:0], path...)
+		nextPath = append(nextPath, f.prefix...)
+		nextCursor := cursor
+		if cursor != nil && !bytes.HasPrefix(cursor, nextPath) {
+			// the paths of the subtree sort either all before or all after
+			// the cursor
+			if bytes.Compare(nextPath, cursor) < 0 {
+				continue
+			}
+			nextCursor = nil
+		}
+		if err := walkFrom(ctx, nextPath, depth+1, l, f.Node, nextCursor, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Directories returns the paths of all directories with entries below them,
+// including the trailing separator, in byte order. Directories are implied
+// by the separators in the paths of the entries, so directories inside fork
+// prefixes and without explicit directory entries are included, while an
+// explicit directory entry without entries below it is not.
+func (n *Node) Directories(ctx context.Context, l Loader) ([][]byte, error) {
+	separator := n.configOrDefault().separator
+	seen := make(map[string]struct{})
+	var dirs [][]byte
+	err := walkValues(ctx, []byte{}, l, n, func(path []byte, _ *Node) error {
+		for i := 0; i < len(path)-1; i++ {
+			if path[i] != separator {
+				continue
+			}
+			if _, ok := seen[string(path[:i+1])]; ok {
+				continue
+			}
+			seen[string(path[:i+1])] = struct{}{}
+			dirs = append(dirs, append(path[:0:0], path[:i+1]...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(dirs, func(i, j int) bool { return bytes.Compare(dirs[i], dirs[j]) < 0 })
+	return dirs, nil
+}
+
 // WalkFunc is the type of the function called for each file or directory
 // visited by Walk.
 type WalkFunc func(path []byte, isDir bool, err error) error
@@ -61,18 +303,22 @@ func walkFnCopyBytes(path []byte, isDir bool, err error, walkFn WalkFunc) error
 	return walkFn(append(path[:0:0], path...), isDir, nil)
 }
 
-// walk recursively descends path, calling walkFn.
-func walk(ctx context.Context, path, prefix []byte, l Loader, n *Node, walkFn WalkFunc) error {
+// walk recursively descends path in the order of less, calling walkFn.
+func walk(ctx context.Context, path, prefix []byte, depth int, l Loader, n *Node, less func(a, b []byte) bool, walkFn WalkFunc) error {
+	if err := n.checkDepth(depth); err != nil {
+		return err
+	}
 	if n.forks == nil {
-		if err := n.load(ctx, l); err != nil {
+		if err := n.loadPath(ctx, append(path[:len(path):len(path)], prefix...), l); err != nil {
 			return err
 		}
 	}
 
 	nextPath := append(path[:0:0], path...)
+	separator := n.configOrDefault().separator
 
 	for i := 0; i < len(prefix); i++ {
-		if prefix[i] == PathSeparator {
+		if prefix[i] == separator {
 			// path ends with separator
 			err := walkFnCopyBytes(nextPath, true, nil, walkFn)
 			if err != nil {
@@ -83,7 +329,9 @@ func walk(ctx context.Context, path, prefix []byte, l Loader, n *Node, walkFn Wa
 	}
 
 	if n.IsValueType() {
-		if nextPath[len(nextPath)-1] == PathSeparator {
+		if len(nextPath) == 0 {
+			// value on the root directory
+		} else if nextPath[len(nextPath)-1] == separator {
 			// path ends with separator; already reported
 		} else {
 			err := walkFnCopyBytes(nextPath, false, nil, walkFn)
@@ -93,9 +341,11 @@ func walk(ctx context.Context, path, prefix []byte, l Loader, n *Node, walkFn Wa
 		}
 	}
 
-	if n.IsEdgeType() {
-		for _, v := range n.forks {
-			err := walk(ctx, nextPath, v.prefix, l, v.Node, walkFn)
+	// the edge type of loaded root nodes is not persisted, check the forks
+	if len(n.forks) > 0 {
+		for _, k := range n.orderedForkKeys(less) {
+			v := n.forks[k]
+			err := walk(ctx, nextPath, v.prefix, depth+1, l, v.Node, less, walkFn)
 			if err != nil {
 				return err
 			}
@@ -108,10 +358,140 @@ func walk(ctx context.Context, path, prefix []byte, l Loader, n *Node, walkFn Wa
 // Walk walks the node tree structure rooted at root, calling walkFn for
 // each file or directory in the tree, including root. All errors that arise
 // visiting files and directories are filtered by walkFn.
-func (n *Node) Walk(ctx context.Context, root []byte, l Loader, walkFn WalkFunc) error {
+func (n *Node) Walk(ctx context.Context, root []byte, l Loader, walkFn WalkFunc, opts ...WalkOption) error {
+	o := newWalkOptions(opts)
 	node, err := n.LookupNode(ctx, root, l)
 	if err != nil {
 		return walkFn(root, false, err)
 	}
-	return walk(ctx, root, []byte{}, l, node, walkFn)
+	return walk(ctx, root, []byte{}, 0, l, node, o.less, walkFn)
+}
+
+// WalkTree walks the values under root in byte order like Walk, bracketing
+// the values of each directory with calls to enter and exit. The root is
+// treated as a directory, so enter is called first and exit last with the
+// root path. Every other directory is entered before its first value and
+// exited after its last one, whether or not it has a value node of its own.
+// A value stored on a directory path, such as one holding directory
+// metadata, is passed to leaf right after the directory is entered.
+func (n *Node) WalkTree(ctx context.Context, root []byte, l Loader, enter func(dir []byte) error, leaf func(path []byte, n *Node) error, exit func(dir []byte) error) error {
+	node, rest, err := n.lookupPrefix(ctx, root, l)
+	if err != nil {
+		return err
+	}
+	separator := n.configOrDefault().separator
+
+	if err := enter(append(root[:0:0], root...)); err != nil {
+		return err
+	}
+	// open directories below root, outermost first
+	var dirs [][]byte
+	path := append(append(root[:0:0], root...), rest...)
+	err = walkValues(ctx, path, l, node, func(path []byte, n *Node) error {
+		for len(dirs) > 0 && !bytes.HasPrefix(path, dirs[len(dirs)-1]) {
+			if err := exit(dirs[len(dirs)-1]); err != nil {
+				return err
+			}
+			dirs = dirs[:len(dirs)-1]
+		}
+		start := len(root)
+		if len(dirs) > 0 {
+			start = len(dirs[len(dirs)-1])
+		}
+		for i := start; i < len(path); i++ {
+			if path[i] != separator {
+				continue
+			}
+			dir := append(path[:0:0], path[:i+1]...)
+			if err := enter(dir); err != nil {
+				return err
+			}
+			dirs = append(dirs, dir)
+		}
+		return leaf(path, n)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := exit(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return exit(append(root[:0:0], root...))
+}
+
+// RawNodeFunc is the type of the function called for each persisted node
+// visited by EachRawNode, with the reference of the node, its chunk data as
+// stored, still obfuscated, and its obfuscation key. If the node could not be
+// loaded or decoded, err is set and its subtree is skipped unless the function
+// returns the error.
+type RawNodeFunc func(path, ref, raw, key []byte, err error) error
+
+// EachRawNode walks the persisted nodes of the tree rooted at root in byte
+// order, calling fn with the raw data of each node loaded with l. It is meant
+// for tools inspecting or recovering damaged manifests: nodes are decoded
+// independently of the trie, which is not loaded by the walk, and the walk
+// continues past nodes which fail to load or decode. Nodes with unsaved
+// changes are descended into but not passed to fn, as they have no data.
+func (n *Node) EachRawNode(ctx context.Context, root []byte, l Loader, fn RawNodeFunc) error {
+	node, err := n.LookupNode(ctx, root, l)
+	if err != nil {
+		return fn(root, nil, nil, nil, err)
+	}
+	return eachRawNode(ctx, append(root[:0:0], root...), 0, l, node, fn)
+}
+
+func eachRawNode(ctx context.Context, path []byte, depth int, l Loader, n *Node, fn RawNodeFunc) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if err := n.checkDepth(depth); err != nil {
+		return err
+	}
+	if n.ref != nil {
+		if l == nil {
+			l = n.loader
+		}
+		if l == nil {
+			return fmt.Errorf("loading node for path %q: %w: node %x", path, ErrNoLoader, n.ref)
+		}
+		// fn and the errors get a copy, so that they cannot change the
+		// reference of the node
+		ref := n.Reference()
+		if err := n.checkCycle(); err != nil {
+			return fn(path, ref, nil, nil, &LoadError{Kind: ErrCorrupt, Ref: ref, Path: path, Err: err})
+		}
+		raw, err := l.Load(ctx, n.ref)
+		if err != nil {
+			return fn(path, ref, nil, nil, &LoadError{Kind: ErrStore, Ref: ref, Path: path, Err: err})
+		}
+		var key []byte
+		if len(raw) >= nodeObfuscationKeySize {
+			key = append([]byte{}, raw[:nodeObfuscationKeySize]...)
+		}
+		nn := &Node{ref: n.ref, cfg: n.cfg, loader: n.loader}
+		var decodeErr error
+		if err := nn.UnmarshalBinary(raw); err != nil {
+			decodeErr = &LoadError{Kind: ErrCorrupt, Ref: ref, Path: path, Err: err}
+		}
+		if err := fn(path, ref, raw, key, decodeErr); err != nil || decodeErr != nil {
+			return err
+		}
+		for _, f := range nn.forks {
+			f.Node.ancestors = &ancestor{ref: n.ref, parent: n.ancestors}
+		}
+		n = nn
+	}
+	for _, k := range n.sortedForkKeys() {
+		f := n.forks[k]
+		nextPath := append(path[:0:0], path...)
+		nextPath = append(nextPath, f.prefix...)
+		if err := eachRawNode(ctx, nextPath, depth+1, l, f.Node, fn); err != nil {
+			return err
+		}
+	}
+	return nil
 }
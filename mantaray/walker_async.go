@@ -0,0 +1,130 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// walkNodeAsync recursively descends path, loading forks concurrently and
+// calling walkFn from multiple goroutines.
+func walkNodeAsync(ctx context.Context, path []byte, depth int, l Loader, n *Node, walkFn WalkNodeFunc) error {
+	if err := n.checkDepth(depth); err != nil {
+		return err
+	}
+	if n.forks == nil {
+		if err := n.loadPath(ctx, path, l); err != nil {
+			return err
+		}
+	}
+
+	if err := walkNodeFnCopyBytes(ctx, path, n, nil, walkFn); err != nil {
+		return err
+	}
+
+	eg, ectx := errgroup.WithContext(ctx)
+	for _, v := range n.forks {
+		v := v
+		nextPath := append(path[:0:0], path...)
+		nextPath = append(nextPath, v.prefix...)
+		eg.Go(func() error {
+			return walkNodeAsync(ectx, nextPath, depth+1, l, v.Node, walkFn)
+		})
+	}
+	return eg.Wait()
+}
+
+// asyncNode is a node visited by the ordered async walker. done is closed
+// once the node is loaded, or loading it failed with err, and its forks are
+// set up in key order.
+type asyncNode struct {
+	path  []byte
+	node  *Node
+	forks []*asyncNode
+	err   error
+	done  chan struct{}
+}
+
+func newAsyncNode(path []byte, n *Node) *asyncNode {
+	return &asyncNode{path: path, node: n, done: make(chan struct{})}
+}
+
+// prefetchAsync recursively loads the nodes below a, loading forks
+// concurrently.
+func prefetchAsync(ctx context.Context, wg *sync.WaitGroup, depth int, l Loader, a *asyncNode) {
+	defer wg.Done()
+	defer close(a.done)
+	if a.err = a.node.checkDepth(depth); a.err != nil {
+		return
+	}
+	if a.node.forks == nil {
+		if a.err = a.node.loadPath(ctx, a.path, l); a.err != nil {
+			return
+		}
+	}
+	for _, k := range a.node.sortedForkKeys() {
+		v := a.node.forks[k]
+		nextPath := append(a.path[:0:0], a.path...)
+		nextPath = append(nextPath, v.prefix...)
+		f := newAsyncNode(nextPath, v.Node)
+		a.forks = append(a.forks, f)
+		wg.Add(1)
+		go prefetchAsync(ctx, wg, depth+1, l, f)
+	}
+}
+
+// emitAsync calls walkFn for a and the nodes below it in byte order of their
+// paths, each as soon as it and the nodes before it are loaded.
+func emitAsync(ctx context.Context, a *asyncNode, walkFn WalkNodeFunc) error {
+	<-a.done
+	if a.err != nil {
+		return a.err
+	}
+	if err := walkNodeFnCopyBytes(ctx, a.path, a.node, nil, walkFn); err != nil {
+		return err
+	}
+	for _, f := range a.forks {
+		if err := emitAsync(ctx, f, walkFn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkNodeAsync walks the node tree structure rooted at root like WalkNode,
+// but loads the forks of each node concurrently.
+//
+// If ordered is false, walkFn is called as soon as a node is loaded, from
+// multiple goroutines and in no particular order, so it must be safe for
+// concurrent use. If ordered is true, walkFn is called from the calling
+// goroutine in the same order as WalkNode, each node as soon as it and the
+// nodes before it are loaded, decoupling fetch concurrency from emission
+// order. The nodes below a visited node may still be loading while walkFn is
+// called for it.
+func (n *Node) WalkNodeAsync(ctx context.Context, root []byte, l Loader, ordered bool, walkFn WalkNodeFunc) error {
+	node, err := n.LookupNode(ctx, root, l)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	if !ordered {
+		return walkNodeAsync(ctx, root, 0, l, node, walkFn)
+	}
+
+	// the loads still in progress are cancelled and waited for once the
+	// walk ends
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	a := newAsyncNode(root, node)
+	wg.Add(1)
+	go prefetchAsync(ctx, &wg, 0, l, a)
+	err = emitAsync(ctx, a, walkFn)
+	cancel()
+	wg.Wait()
+	return err
+}
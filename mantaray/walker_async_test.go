@@ -0,0 +1,165 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethersphere/manifest/mantaray"
+)
+
+func TestWalkNodeAsync(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	for i := 0; i < 64; i++ {
+		c := []byte(fmt.Sprintf("dir%d/sub%d/file%d.txt", i%4, i%7, i))
+		e := append(make([]byte, 32-len(c)), c...)
+		err := n.Add(ctx, c, e, nil, ls)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	err := n.Save(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var expected [][]byte
+	err = mantaray.NewNodeRef(n.Reference()).WalkNode(ctx, []byte{}, ls, func(path []byte, _ *mantaray.Node, err error) error {
+		expected = append(expected, path)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !sort.SliceIsSorted(expected, func(i, j int) bool { return bytes.Compare(expected[i], expected[j]) < 0 }) {
+		t.Fatal("expected sync walk in sorted order")
+	}
+
+	t.Run("ordered", func(t *testing.T) {
+		for run := 0; run < 50; run++ {
+			var got [][]byte
+			err := mantaray.NewNodeRef(n.Reference()).WalkNodeAsync(ctx, []byte{}, ls, true, func(path []byte, _ *mantaray.Node, err error) error {
+				got = append(got, path)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if len(got) != len(expected) {
+				t.Fatalf("run %d: expected %d nodes, got %d", run, len(expected), len(got))
+			}
+			for i := range expected {
+				if !bytes.Equal(got[i], expected[i]) {
+					t.Fatalf("run %d: expected path %q at %d, got %q", run, expected[i], i, got[i])
+				}
+			}
+		}
+	})
+
+	t.Run("unordered", func(t *testing.T) {
+		var (
+			mu  sync.Mutex
+			got [][]byte
+		)
+		err := mantaray.NewNodeRef(n.Reference()).WalkNodeAsync(ctx, []byte{}, ls, false, func(path []byte, _ *mantaray.Node, err error) error {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, path)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		sort.Slice(got, func(i, j int) bool { return bytes.Compare(got[i], got[j]) < 0 })
+		if len(got) != len(expected) {
+			t.Fatalf("expected %d nodes, got %d", len(expected), len(got))
+		}
+		for i := range expected {
+			if !bytes.Equal(got[i], expected[i]) {
+				t.Fatalf("expected path %q at %d, got %q", expected[i], i, got[i])
+			}
+		}
+	})
+}
+
+// blockingLoader holds back the load of a reference until release is closed.
+type blockingLoader struct {
+	*mockLoadSaver
+	ref     []byte
+	release chan struct{}
+}
+
+func (b *blockingLoader) Load(ctx context.Context, ref []byte) ([]byte, error) {
+	if bytes.Equal(ref, b.ref) {
+		select {
+		case <-b.release:
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("load held back")
+		}
+	}
+	return b.mockLoadSaver.Load(ctx, ref)
+}
+
+func TestWalkNodeAsyncOrderedStreams(t *testing.T) {
+	ctx := context.Background()
+	ls := newMockLoadSaver()
+	n := mantaray.New()
+	for i := 0; i < 16; i++ {
+		c := []byte(fmt.Sprintf("dir%d/file%d.txt", i%4, i))
+		if err := n.Add(ctx, c, append(make([]byte, 32-len(c)), c...), nil, ls); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	dir, err := mantaray.NewNodeRef(n.Reference()).LookupNode(ctx, []byte("dir"), ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	refs := dir.ChildReferences()
+
+	// the last fork is only loaded once the first one was emitted, which
+	// does not happen if whole subtrees are buffered
+	l := &blockingLoader{mockLoadSaver: ls, ref: refs[len(refs)-1], release: make(chan struct{})}
+	var got []string
+	err = mantaray.NewNodeRef(n.Reference()).WalkNodeAsync(ctx, []byte{}, l, true, func(path []byte, _ *mantaray.Node, err error) error {
+		if strings.HasPrefix(string(path), "dir0/") && len(got) > 0 && !strings.HasPrefix(got[len(got)-1], "dir0/") {
+			close(l.release)
+		}
+		got = append(got, string(path))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !sort.StringsAreSorted(got) {
+		t.Fatalf("expected paths in order, got %v", got)
+	}
+
+	// nodes before a failing one are emitted
+	ls.corrupt(refs[len(refs)-1])
+	got = nil
+	err = mantaray.NewNodeRef(n.Reference()).WalkNodeAsync(ctx, []byte{}, ls, true, func(path []byte, _ *mantaray.Node, err error) error {
+		got = append(got, string(path))
+		return err
+	})
+	if !errors.Is(err, mantaray.ErrCorrupt) {
+		t.Fatalf("expected %v, got %v", mantaray.ErrCorrupt, err)
+	}
+	if len(got) == 0 || !strings.HasPrefix(got[len(got)-1], "dir2/") {
+		t.Fatalf("expected the nodes up to dir2/ to be emitted, got %v", got)
+	}
+}
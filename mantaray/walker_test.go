@@ -8,6 +8,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -157,3 +161,527 @@ func TestWalk(t *testing.T) {
 		})
 	}
 }
+
+func TestWalkPrefixCompressed(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		toAdd []string
+	}{
+		{
+			name:  "single-fork",
+			toAdd: []string{"a/b/c/file.txt"},
+		},
+		{
+			name:  "shared-prefix",
+			toAdd: []string{"a/b/c/file.txt", "a/b/x.txt"},
+		},
+		{
+			name:  "split-on-separator",
+			toAdd: []string{"a/b/c", "a/b/d", "a/bx"},
+		},
+		{
+			name:  "split-after-separator",
+			toAdd: []string{"a/b/c/d/e.txt", "a/b/c/f.txt", "a/b/g/h.txt", "i.txt"},
+		},
+		{
+			name:  "directory-entries",
+			toAdd: []string{"docs/", "docs/api/v1/index.html", "docs/api/"},
+		},
+		{
+			name:  "long-path",
+			toAdd: []string{"very/long/directory/name/that/exceeds/the/prefix/limit/file.txt", "very/short.txt"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			expected := make(map[string]bool)
+			n := New()
+			for _, p := range tc.toAdd {
+				e := make([]byte, 32)
+				if strings.HasSuffix(p, "/") {
+					e = nil
+				} else {
+					expected[p] = false
+				}
+				for i := range p {
+					if p[i] == PathSeparator {
+						expected[p[:i]] = true
+					}
+				}
+				err := n.Add(ctx, []byte(p), e, nil, nil)
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+			}
+
+			check := func(t *testing.T, n *Node, l Loader) {
+				t.Helper()
+				walked := make(map[string]bool)
+				err := n.Walk(ctx, []byte{}, l, func(path []byte, isDir bool, err error) error {
+					if err != nil {
+						return err
+					}
+					if _, ok := walked[string(path)]; ok {
+						return fmt.Errorf("path %s walked twice", path)
+					}
+					walked[string(path)] = isDir
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				if !reflect.DeepEqual(walked, expected) {
+					t.Fatalf("expected paths %v, got %v", expected, walked)
+				}
+			}
+
+			check(t, n, nil)
+
+			ls := mapLoadSaver{}
+			err := n.Save(ctx, ls)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			check(t, NewNodeRef(n.Reference()), ls)
+		})
+	}
+}
+
+func TestWalkRootValue(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	err := n.Add(ctx, []byte{}, nil, map[string]string{MetadataIndexDocument: "index.html"}, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = n.Add(ctx, []byte("index.html"), make([]byte, 32), nil, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var walked []string
+	err = n.Walk(ctx, []byte{}, nil, func(path []byte, isDir bool, err error) error {
+		walked = append(walked, string(path))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(walked) != 1 || walked[0] != "index.html" {
+		t.Fatalf("expected only index.html, got %v", walked)
+	}
+}
+
+func TestWalkTree(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, p := range []string{
+		"a.txt",
+		"img/1.png",
+		"img/sub/2.png",
+		"img/sub/3.png",
+		"img/z.png",
+		"robots.txt",
+	} {
+		if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	// explicit directory carrying metadata
+	err := n.Add(ctx, []byte("img/sub/"), nil, map[string]string{MetadataIndexDocument: "2.png"}, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	walkTree := func(n *Node, root string, l Loader) []string {
+		t.Helper()
+		var events []string
+		depth := 0
+		err := n.WalkTree(ctx, []byte(root), l,
+			func(dir []byte) error {
+				events = append(events, "> "+string(dir))
+				depth++
+				return nil
+			},
+			func(path []byte, _ *Node) error {
+				events = append(events, "  "+string(path))
+				return nil
+			},
+			func(dir []byte) error {
+				events = append(events, "< "+string(dir))
+				depth--
+				if depth < 0 {
+					return fmt.Errorf("unbalanced exit of %s", dir)
+				}
+				return nil
+			},
+		)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if depth != 0 {
+			t.Fatalf("expected balanced enter and exit, got depth %d", depth)
+		}
+		return events
+	}
+
+	exp := []string{
+		"> ",
+		"  a.txt",
+		"> img/",
+		"  img/1.png",
+		"> img/sub/",
+		"  img/sub/",
+		"  img/sub/2.png",
+		"  img/sub/3.png",
+		"< img/sub/",
+		"  img/z.png",
+		"< img/",
+		"  robots.txt",
+		"< ",
+	}
+	if got := walkTree(n, "", nil); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected events %q, got %q", exp, got)
+	}
+
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	exp = []string{
+		"> img/s",
+		"> img/sub/",
+		"  img/sub/",
+		"  img/sub/2.png",
+		"  img/sub/3.png",
+		"< img/sub/",
+		"< img/s",
+	}
+	if got := walkTree(NewNodeRef(n.Reference()), "img/s", ls); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected events %q, got %q", exp, got)
+	}
+}
+
+// naturalLess orders byte strings comparing runs of digits by their numeric
+// value.
+func naturalLess(a, b []byte) bool {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	for len(a) > 0 && len(b) > 0 {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			i, j := 0, 0
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			x, _ := strconv.Atoi(string(a[:i]))
+			y, _ := strconv.Atoi(string(b[:j]))
+			if x != y {
+				return x < y
+			}
+			a, b = a[i:], b[j:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func TestWalkForkOrder(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, p := range []string{"file10.txt", "file2.txt", "file30.txt", "file9.txt"} {
+		if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	var walked []string
+	err := n.Walk(ctx, []byte{}, nil, func(path []byte, isDir bool, err error) error {
+		walked = append(walked, string(path))
+		return err
+	}, WithForkOrder(naturalLess))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	exp := []string{"file2.txt", "file9.txt", "file10.txt", "file30.txt"}
+	if !reflect.DeepEqual(walked, exp) {
+		t.Fatalf("expected walk %v, got %v", exp, walked)
+	}
+
+	walked = nil
+	err = n.WalkNode(ctx, []byte{}, nil, func(path []byte, node *Node, err error) error {
+		if node.IsValueType() {
+			walked = append(walked, string(path))
+		}
+		return err
+	}, WithForkOrder(naturalLess))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(walked, exp) {
+		t.Fatalf("expected walk %v, got %v", exp, walked)
+	}
+
+	// byte order by default
+	walked = nil
+	err = n.Walk(ctx, []byte{}, nil, func(path []byte, isDir bool, err error) error {
+		walked = append(walked, string(path))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	exp = []string{"file10.txt", "file2.txt", "file30.txt", "file9.txt"}
+	if !reflect.DeepEqual(walked, exp) {
+		t.Fatalf("expected walk %v, got %v", exp, walked)
+	}
+}
+
+func TestEachRawNode(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, p := range []string{"index.html", "img/1.png", "img/2.png", "img/sub/3.png", "robots.txt"} {
+		if err := n.Add(ctx, []byte(p), append(make([]byte, 32-len(p)), p...), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ref := n.Reference()
+
+	paths := make(map[string][]byte)
+	err := NewNodeRef(ref).EachRawNode(ctx, nil, ls, func(path, ref, raw, key []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(raw, ls[string(ref)]) {
+			t.Fatalf("expected stored data of %x on %q, got %x", ref, path, raw)
+		}
+		if !bytes.Equal(key, raw[:nodeObfuscationKeySize]) {
+			t.Fatalf("expected obfuscation key %x on %q, got %x", raw[:nodeObfuscationKeySize], path, key)
+		}
+		paths[string(path)] = ref
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(paths) != len(ls) {
+		t.Fatalf("expected %d nodes, got %d", len(ls), len(paths))
+	}
+
+	// a corrupted node is reported and its subtree skipped
+	ls[string(paths["img/"])] = ls[string(paths["img/"])][:10]
+	var visited, failed []string
+	err = NewNodeRef(ref).EachRawNode(ctx, nil, ls, func(path, _, _, _ []byte, err error) error {
+		if err != nil {
+			failed = append(failed, string(path))
+			return nil
+		}
+		visited = append(visited, string(path))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(failed, []string{"img/"}) {
+		t.Fatalf("expected failure on img/, got %v", failed)
+	}
+	if len(visited) != len(paths)-4 {
+		t.Fatalf("expected %d nodes visited, got %v", len(paths)-4, visited)
+	}
+}
+
+func TestWalkNew(t *testing.T) {
+	ctx := context.Background()
+	ls := mapLoadSaver{}
+	n := New()
+	for i := 0; i < 40; i++ {
+		path := []byte(fmt.Sprintf("dir%d/sub%d/file%d.txt", i%4, i%3, i))
+		if err := n.Add(ctx, path, make([]byte, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	known := make(map[string]struct{})
+	visited := 0
+	err := NewNodeRef(n.Reference()).WalkNew(ctx, ls, known, func(_ []byte, node *Node, err error) error {
+		known[string(node.ref)] = struct{}{}
+		visited++
+		return err
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	s, err := NewNodeRef(n.Reference()).Stats(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if visited != s.Nodes {
+		t.Fatalf("expected %d visited nodes without known references, got %d", s.Nodes, visited)
+	}
+
+	edited := "dir1/sub1/file1.txt"
+	nn := NewNodeRef(n.Reference())
+	if err := nn.Add(ctx, []byte(edited), bytes.Repeat([]byte{1}, 32), nil, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := nn.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var paths []string
+	err = NewNodeRef(nn.Reference()).WalkNew(ctx, ls, known, func(path []byte, _ *Node, err error) error {
+		paths = append(paths, string(path))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(paths) == 0 || paths[len(paths)-1] != edited {
+		t.Fatalf("expected walk to reach %s, got %q", edited, paths)
+	}
+	for _, p := range paths {
+		if !strings.HasPrefix(edited, p) {
+			t.Fatalf("expected only nodes on the path to %s, got %q", edited, paths)
+		}
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	dirs, err := n.Directories(ctx, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(dirs) != 0 {
+		t.Fatalf("expected no directories, got %q", dirs)
+	}
+
+	for _, p := range []string{
+		"index.html",
+		"img/1.png",
+		"img/2.png",
+		"a/b/c/d/e.txt",
+		"a/b/f.txt",
+		"docs/",
+		"empty/",
+		"docs/api/v1/readme.md",
+	} {
+		var ref []byte
+		if !strings.HasSuffix(p, "/") {
+			ref = make([]byte, 32)
+		}
+		if err := n.Add(ctx, []byte(p), ref, nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	dirs, err = NewNodeRef(n.Reference()).Directories(ctx, ls)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var got []string
+	for _, d := range dirs {
+		got = append(got, string(d))
+	}
+	expected := []string{"a/", "a/b/", "a/b/c/", "a/b/c/d/", "docs/", "docs/api/", "docs/api/v1/", "img/"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected directories %q, got %q", expected, got)
+	}
+}
+
+func TestWalkFrom(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	var paths []string
+	for i := 0; i < 40; i++ {
+		p := fmt.Sprintf("dir%d/file%d.txt", i%6, i)
+		if i%9 == 0 {
+			p = fmt.Sprintf("assets/%s/%d.js", strings.Repeat("x", 35), i)
+		}
+		paths = append(paths, p)
+	}
+	paths = append(paths, "", "dir1", "dir1/")
+	for _, p := range paths {
+		if err := n.Add(ctx, []byte(p), make([]byte, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	walk := func(cursor []byte, limit int) ([]string, []byte) {
+		t.Helper()
+		var visited []string
+		next, err := NewNodeRef(n.Reference()).WalkFrom(ctx, ls, cursor, func(path []byte, node *Node) error {
+			if !node.IsValueType() {
+				t.Fatalf("expected value on %s", path)
+			}
+			visited = append(visited, string(path))
+			if len(visited) == limit {
+				return ErrStopWalk
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return visited, next
+	}
+
+	full, next := walk(nil, 0)
+	if next != nil {
+		t.Fatalf("expected no cursor after a full walk, got %q", next)
+	}
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	if !reflect.DeepEqual(full, sorted) {
+		t.Fatalf("expected paths %v, got %v", sorted, full)
+	}
+
+	first, cursor := walk(nil, len(full)/2)
+	if string(cursor) != first[len(first)-1] {
+		t.Fatalf("expected cursor %q, got %q", first[len(first)-1], cursor)
+	}
+	second, next := walk(cursor, 0)
+	if next != nil {
+		t.Fatalf("expected no cursor after the last page, got %q", next)
+	}
+	if union := append(first, second...); !reflect.DeepEqual(union, full) {
+		t.Fatalf("expected halves to make up %v, got %v", full, union)
+	}
+
+	// the cursor is a path, so it does not need to be stored
+	tail, _ := walk([]byte("dir3/file"), 0)
+	var expected []string
+	for _, p := range full {
+		if p > "dir3/file" {
+			expected = append(expected, p)
+		}
+	}
+	if !reflect.DeepEqual(tail, expected) {
+		t.Fatalf("expected paths %v, got %v", expected, tail)
+	}
+
+	// the empty cursor skips only the root value
+	rest, _ := walk([]byte{}, 0)
+	if !reflect.DeepEqual(rest, full[1:]) {
+		t.Fatalf("expected paths %v, got %v", full[1:], rest)
+	}
+}
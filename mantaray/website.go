@@ -0,0 +1,156 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+// WebsiteIssueKind is the kind of problem found by ValidateWebsite.
+type WebsiteIssueKind int
+
+// Kinds of website issues.
+const (
+	// IssueMissingIndex means that a directory resolves to no index
+	// document, or to an index document which does not exist.
+	IssueMissingIndex WebsiteIssueKind = iota + 1
+	// IssueUnreachableErrorDocument means that the error document set on a
+	// directory entry does not exist.
+	IssueUnreachableErrorDocument
+	// IssueLoad means that the manifest could not be loaded for validation.
+	IssueLoad
+	// IssueDanglingRedirect means that the redirect target set on an entry
+	// is neither a file nor a directory of the manifest.
+	IssueDanglingRedirect
+)
+
+// String returns the name of the issue kind.
+func (k WebsiteIssueKind) String() string {
+	switch k {
+	case IssueMissingIndex:
+		return "missing index"
+	case IssueUnreachableErrorDocument:
+		return "unreachable error document"
+	case IssueLoad:
+		return "load"
+	case IssueDanglingRedirect:
+		return "dangling redirect"
+	default:
+		return "unknown"
+	}
+}
+
+// WebsiteIssue is a problem which keeps a manifest from being served as a
+// website by Serve.
+type WebsiteIssue struct {
+	Kind   WebsiteIssueKind
+	Path   []byte // entry the issue is found on
+	Target []byte // missing document or redirect target, nil if none applies
+	Err    error  // error of IssueLoad
+}
+
+// ValidateWebsite checks that the manifest can be served as a website. Every
+// directory with entries below it must resolve to an existing index
+// document, every error document set on a directory entry must exist, and
+// every redirect target must be a file or a directory of the manifest.
+// Issues are returned ordered by path; validation stops at the first error
+// loading the manifest, which is reported as an issue of kind IssueLoad.
+func (n *Node) ValidateWebsite(ctx context.Context, l Loader) []WebsiteIssue {
+	separator := n.configOrDefault().separator
+
+	dirs := map[string]struct{}{"": {}}
+	var errorDocuments [][]byte
+	var redirects []WebsiteIssue
+	err := walkValues(ctx, []byte{}, l, n, func(path []byte, node *Node) error {
+		for i, b := range path {
+			if b == separator {
+				dirs[string(path[:i+1])] = struct{}{}
+			}
+		}
+		if node.metadata[MetadataErrorDocument] != "" {
+			errorDocuments = append(errorDocuments, path)
+		}
+		if target, ok := node.metadata[MetadataRedirectTarget]; ok {
+			redirects = append(redirects, WebsiteIssue{Kind: IssueDanglingRedirect, Path: path, Target: []byte(target)})
+		}
+		return nil
+	})
+	if err != nil {
+		return []WebsiteIssue{{Kind: IssueLoad, Err: err}}
+	}
+
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+
+	var issues []WebsiteIssue
+	for _, dir := range sorted {
+		index, _, err := n.inheritedMetadata(ctx, []byte(dir), MetadataIndexDocument, l)
+		if err != nil {
+			return append(issues, WebsiteIssue{Kind: IssueLoad, Path: []byte(dir), Err: err})
+		}
+		if index == "" {
+			issues = append(issues, WebsiteIssue{Kind: IssueMissingIndex, Path: []byte(dir)})
+			continue
+		}
+		target := []byte(dir + index)
+		ok, err := n.hasFile(ctx, target, l)
+		if err != nil {
+			return append(issues, WebsiteIssue{Kind: IssueLoad, Path: []byte(dir), Err: err})
+		}
+		if !ok {
+			issues = append(issues, WebsiteIssue{Kind: IssueMissingIndex, Path: []byte(dir), Target: target})
+		}
+	}
+
+	for _, base := range errorDocuments {
+		node, err := n.LookupNode(ctx, base, l)
+		if err != nil {
+			return append(issues, WebsiteIssue{Kind: IssueLoad, Path: base, Err: err})
+		}
+		target := append(base[:len(base):len(base)], node.metadata[MetadataErrorDocument]...)
+		ok, err := n.hasFile(ctx, target, l)
+		if err != nil {
+			return append(issues, WebsiteIssue{Kind: IssueLoad, Path: base, Err: err})
+		}
+		if !ok {
+			issues = append(issues, WebsiteIssue{Kind: IssueUnreachableErrorDocument, Path: base, Target: target})
+		}
+	}
+
+	for _, r := range redirects {
+		if _, ok := dirs[string(r.Target)]; ok {
+			continue
+		}
+		ok, err := n.hasFile(ctx, r.Target, l)
+		if err != nil {
+			return append(issues, WebsiteIssue{Kind: IssueLoad, Path: r.Path, Err: err})
+		}
+		if !ok {
+			issues = append(issues, r)
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		return string(issues[i].Path) < string(issues[j].Path)
+	})
+	return issues
+}
+
+// hasFile returns true if path holds an entry which is not a directory.
+func (n *Node) hasFile(ctx context.Context, path []byte, l Loader) (bool, error) {
+	node, err := n.LookupNode(ctx, path, l)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return isFile(node), nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mantaray
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestValidateWebsite(t *testing.T) {
+	ctx := context.Background()
+	n := New()
+	for _, e := range []nodeEntry{
+		{
+			path:     []byte(""),
+			metadata: map[string]string{MetadataIndexDocument: "index.html", MetadataErrorDocument: "404.html"},
+		},
+		{path: []byte("index.html")},
+		{path: []byte("404.html")},
+		{path: []byte("blog/index.html")},
+		{path: []byte("img/1.png")},
+		{
+			path:     []byte("docs/"),
+			metadata: map[string]string{MetadataIndexDocument: "readme.html", MetadataErrorDocument: "missing.html"},
+		},
+		{path: []byte("docs/readme.html")},
+		{
+			path:     []byte("old.html"),
+			metadata: map[string]string{MetadataRedirectCode: "301", MetadataRedirectTarget: "blog/index.html"},
+		},
+		{
+			path:     []byte("older.html"),
+			metadata: map[string]string{MetadataRedirectCode: "301", MetadataRedirectTarget: "blog/"},
+		},
+		{
+			path:     []byte("gone.html"),
+			metadata: map[string]string{MetadataRedirectCode: "302", MetadataRedirectTarget: "blog/gone.html"},
+		},
+	} {
+		entry := e.entry
+		if len(e.path) > 0 && e.path[len(e.path)-1] != PathSeparator {
+			entry = append(make([]byte, 32-len(e.path)), e.path...)
+		}
+		if err := n.Add(ctx, e.path, entry, e.metadata, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	ls := mapLoadSaver{}
+	if err := n.Save(ctx, ls); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	n = NewNodeRef(n.Reference())
+
+	expected := []WebsiteIssue{
+		{Kind: IssueUnreachableErrorDocument, Path: []byte("docs/"), Target: []byte("docs/missing.html")},
+		{Kind: IssueDanglingRedirect, Path: []byte("gone.html"), Target: []byte("blog/gone.html")},
+		{Kind: IssueMissingIndex, Path: []byte("img/"), Target: []byte("img/index.html")},
+	}
+	issues := n.ValidateWebsite(ctx, ls)
+	if len(issues) != len(expected) {
+		t.Fatalf("expected %d issues, got %+v", len(expected), issues)
+	}
+	for i, issue := range issues {
+		e := expected[i]
+		if issue.Kind != e.Kind || !bytes.Equal(issue.Path, e.Path) || !bytes.Equal(issue.Target, e.Target) || issue.Err != nil {
+			t.Fatalf("expected issue %+v, got %+v", e, issue)
+		}
+	}
+
+	t.Run("no-index", func(t *testing.T) {
+		n := New()
+		if err := n.Add(ctx, []byte("index.html"), make([]byte, 32), nil, nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		issues := n.ValidateWebsite(ctx, nil)
+		if len(issues) != 1 || issues[0].Kind != IssueMissingIndex || len(issues[0].Path) != 0 || issues[0].Target != nil {
+			t.Fatalf("expected missing root index, got %+v", issues)
+		}
+	})
+}
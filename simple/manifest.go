@@ -5,21 +5,32 @@
 package simple
 
 import (
+	"bytes"
+	"context"
 	"encoding"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+
+	"github.com/ethersphere/manifest/mantaray"
 )
 
 // Error used when lookup path does not match
 var (
 	ErrNotFound  = errors.New("not found")
 	ErrEmptyPath = errors.New("empty path")
+	ErrInvalid   = errors.New("invalid input")
 )
 
 // Manifest is a representation of a manifest.
+//
+// Further operations are defined by the optional interfaces ContextManifest,
+// BulkManifest, Clearer, TreeManifest, AsyncWalker and CanonicalMarshaler,
+// so that implementations outside of this package keep satisfying Manifest.
+// The manifests returned by NewManifest implement all of them.
 type Manifest interface {
 	// Add adds a manifest entry to the specified path.
 	Add(string, string, map[string]string) error
@@ -41,6 +52,57 @@ type Manifest interface {
 	encoding.BinaryUnmarshaler
 }
 
+// ContextManifest is a Manifest whose operations abort if the context is
+// done.
+type ContextManifest interface {
+	Manifest
+	// AddCtx is like Add, but aborts if the context is done.
+	AddCtx(context.Context, string, string, map[string]string) error
+	// RemoveCtx is like Remove, but aborts if the context is done.
+	RemoveCtx(context.Context, string) error
+	// LookupCtx is like Lookup, but aborts if the context is done.
+	LookupCtx(context.Context, string) (Entry, error)
+}
+
+// BulkManifest is a Manifest which adds and looks up entries in bulk.
+type BulkManifest interface {
+	Manifest
+	// AddAll adds the references to the paths of the same index, without
+	// metadata.
+	AddAll([]string, []string) error
+	// LookupAll returns the entries of the paths, failing if any is not found.
+	LookupAll([]string) ([]Entry, error)
+}
+
+// Clearer is implemented by manifests which can be emptied for reuse.
+type Clearer interface {
+	// Clear removes all entries, leaving the manifest empty for reuse.
+	Clear()
+}
+
+// TreeManifest is implemented by manifests with a hierarchical view.
+type TreeManifest interface {
+	// Tree returns a hierarchical view of the manifest, the paths split into
+	// directories on the separator.
+	Tree() *TreeNode
+}
+
+// AsyncWalker is implemented by manifests which walk their entries
+// concurrently.
+type AsyncWalker interface {
+	// WalkEntryAsync walks the entries under the root path like WalkEntry,
+	// calling walkFn concurrently from at most the given number of goroutines.
+	WalkEntryAsync(context.Context, string, int, WalkEntryFunc) error
+}
+
+// CanonicalMarshaler is implemented by manifests with a canonical encoding.
+type CanonicalMarshaler interface {
+	// MarshalCanonical returns the JSON encoding of the manifest with entries
+	// sorted by path and metadata sorted by key, written explicitly so that
+	// the bytes do not depend on the Go version or the entry struct.
+	MarshalCanonical() ([]byte, error)
+}
+
 // manifest is a JSON representation of a manifest.
 // It stores manifest entries in a map based on string keys.
 type manifest struct {
@@ -73,6 +135,33 @@ func (m *manifest) Add(path string, entry string, metadata map[string]string) er
 	return nil
 }
 
+func (m *manifest) AddCtx(ctx context.Context, path string, entry string, metadata map[string]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Add(path, entry, metadata)
+}
+
+func (m *manifest) AddAll(paths []string, entries []string) error {
+	if len(paths) != len(entries) {
+		return fmt.Errorf("%w: %d paths for %d entries", ErrInvalid, len(paths), len(entries))
+	}
+	for _, path := range paths {
+		if len(path) == 0 {
+			return ErrEmptyPath
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, path := range paths {
+		m.Entries[path] = newEntry(entries[i], nil)
+	}
+
+	return nil
+}
+
 func (m *manifest) Remove(path string) error {
 	if len(path) == 0 {
 		return ErrEmptyPath
@@ -86,6 +175,13 @@ func (m *manifest) Remove(path string) error {
 	return nil
 }
 
+func (m *manifest) RemoveCtx(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Remove(path)
+}
+
 func (m *manifest) Lookup(path string) (Entry, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -99,6 +195,29 @@ func (m *manifest) Lookup(path string) (Entry, error) {
 	return newEntry(entry.Reference(), entry.Metadata()), nil
 }
 
+func (m *manifest) LookupAll(paths []string) ([]Entry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := make([]Entry, len(paths))
+	for i, path := range paths {
+		entry, ok := m.Entries[path]
+		if !ok {
+			return nil, notFound(path)
+		}
+		entries[i] = newEntry(entry.Reference(), entry.Metadata())
+	}
+
+	return entries, nil
+}
+
+func (m *manifest) LookupCtx(ctx context.Context, path string) (Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.Lookup(path)
+}
+
 func (m *manifest) HasPrefix(path string) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -119,6 +238,13 @@ func (m *manifest) Length() int {
 	return len(m.Entries)
 }
 
+func (m *manifest) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Entries = make(map[string]*entry)
+}
+
 // MarshalBinary implements encoding.BinaryMarshaler.
 func (m *manifest) MarshalBinary() ([]byte, error) {
 	m.mu.RLock()
@@ -134,3 +260,61 @@ func (m *manifest) UnmarshalBinary(b []byte) error {
 
 	return json.Unmarshal(b, m)
 }
+
+// MarshalCanonical implements CanonicalMarshaler.
+func (m *manifest) MarshalCanonical() ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	if len(m.Entries) > 0 {
+		buf.WriteString(`"entries":{`)
+		for i, path := range sortedKeys(m.Entries) {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			e := m.Entries[path]
+			if err := writeCanonicalString(&buf, path); err != nil {
+				return nil, err
+			}
+			buf.WriteString(`:{"reference":`)
+			if err := writeCanonicalString(&buf, e.Ref); err != nil {
+				return nil, err
+			}
+			if len(e.Meta) > 0 {
+				buf.WriteString(`,"metadata":`)
+				b, err := mantaray.CanonicalMetadataJSON(e.Meta)
+				if err != nil {
+					return nil, err
+				}
+				buf.Write(b)
+			}
+			buf.WriteByte('}')
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// sortedKeys returns the paths of the entries in byte order.
+func sortedKeys(entries map[string]*entry) []string {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeCanonicalString writes s as a JSON string.
+func writeCanonicalString(buf *bytes.Buffer, s string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
@@ -5,6 +5,7 @@
 package simple_test
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
@@ -221,6 +222,119 @@ func TestMarshal(t *testing.T) {
 	}
 }
 
+func TestMarshalCanonical(t *testing.T) {
+	entries := []e{
+		{
+			path:      "img/1.png",
+			reference: randomAddress(),
+			metadata:  map[string]string{"content-type": "image/png", "a": "<b>", "z": "\u00e9"},
+		},
+		{
+			path:      "readme.md",
+			reference: randomAddress(),
+		},
+		{
+			path:     "/",
+			metadata: map[string]string{"index-document": "readme.md", "error-document": "404.html"},
+		},
+	}
+
+	build := func(order []int) simple.Manifest {
+		m := simple.NewManifest()
+		for _, i := range order {
+			err := m.Add(entries[i].path, entries[i].reference, entries[i].metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return m
+	}
+
+	b, err := build([]int{0, 1, 2}).(simple.CanonicalMarshaler).MarshalCanonical()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, order := range [][]int{{2, 1, 0}, {1, 2, 0}, {1, 0, 2}} {
+		ob, err := build(order).(simple.CanonicalMarshaler).MarshalCanonical()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != string(ob) {
+			t.Fatalf("expected canonical output %s for order %v, got %s", b, order, ob)
+		}
+	}
+
+	// the canonical output is valid manifest JSON
+	m := build([]int{0, 1, 2})
+	um := simple.NewManifest()
+	if err := um.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, um) {
+		t.Fatalf("canonical and unmarshalled manifests are not equal: %v, %v", m, um)
+	}
+	jb, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(jb) {
+		t.Fatalf("expected canonical output to match %s, got %s", jb, b)
+	}
+
+	b, err = simple.NewManifest().(simple.CanonicalMarshaler).MarshalCanonical()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "{}" {
+		t.Fatalf("expected empty manifest, got %s", b)
+	}
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	m := simple.NewManifest()
+	for _, iface := range []interface{}{
+		(*simple.ContextManifest)(nil),
+		(*simple.BulkManifest)(nil),
+		(*simple.Clearer)(nil),
+		(*simple.TreeManifest)(nil),
+		(*simple.AsyncWalker)(nil),
+		(*simple.CanonicalMarshaler)(nil),
+	} {
+		if typ := reflect.TypeOf(iface).Elem(); !reflect.TypeOf(m).Implements(typ) {
+			t.Fatalf("expected %T to implement %v", m, typ)
+		}
+	}
+}
+
+func TestClear(t *testing.T) {
+	m := simple.NewManifest()
+	paths := []string{"index.html", "img/1.png", "robots.txt"}
+	for _, p := range paths {
+		if err := m.Add(p, randomAddress(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.(simple.Clearer).Clear()
+
+	if l := m.Length(); l != 0 {
+		t.Fatalf("expected empty manifest, got %d entries", l)
+	}
+	for _, p := range paths {
+		if _, err := m.Lookup(p); !errors.Is(err, simple.ErrNotFound) {
+			t.Fatalf("expected not found error for %s, got %v", p, err)
+		}
+	}
+
+	// the manifest is usable after clearing
+	if err := m.Add("index.html", randomAddress(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if l := m.Length(); l != 1 {
+		t.Fatalf("expected 1 entry, got %d", l)
+	}
+}
+
 func TestHasPrefix(t *testing.T) {
 	for _, tc := range []struct {
 		name        string
@@ -286,3 +400,45 @@ func TestHasPrefix(t *testing.T) {
 		})
 	}
 }
+
+func TestContextOperations(t *testing.T) {
+	m := simple.NewManifest().(simple.ContextManifest)
+	ctx := context.Background()
+	reference := randomAddress()
+
+	err := m.AddCtx(ctx, "index.html", reference, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	e, err := m.LookupCtx(ctx, "index.html")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if e.Reference() != reference {
+		t.Fatalf("expected reference %s, got: %s", reference, e.Reference())
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	err = m.AddCtx(cctx, "robots.txt", randomAddress(), nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	checkLength(t, m, 1)
+	_, err = m.LookupCtx(cctx, "index.html")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	err = m.RemoveCtx(cctx, "index.html")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	checkLength(t, m, 1)
+
+	err = m.RemoveCtx(ctx, "index.html")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	checkLength(t, m, 0)
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package simple
+
+import "sort"
+
+// Conflict describes a path on which both merged manifests define an entry,
+// but with a different reference or metadata.
+type Conflict struct {
+	Path string
+	Dst  Entry // entry defined by the destination manifest before the merge
+	Src  Entry // entry defined by the source manifest
+}
+
+// Merge adds all entries of src to dst. Entries of src replace the entries
+// on the same path in dst. Paths on which both manifests define different
+// entries are returned as conflicts, so that callers can decide whether the
+// overlap is expected. The conflicts are sorted by path, and dst gets its own
+// copies of the metadata of src.
+func Merge(dst, src Manifest) ([]Conflict, error) {
+	entries := make(map[string]Entry)
+	err := src.WalkEntry("", func(path string, entry Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		entries[path] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var conflicts []Conflict
+	for _, path := range paths {
+		entry := entries[path]
+		if existing, err := dst.Lookup(path); err == nil && !entryEqual(existing, entry) {
+			conflicts = append(conflicts, Conflict{
+				Path: path,
+				Dst:  existing,
+				Src:  entry,
+			})
+		}
+		if err := dst.Add(path, entry.Reference(), copyMetadata(entry.Metadata())); err != nil {
+			return nil, err
+		}
+	}
+	return conflicts, nil
+}
+
+// entryEqual returns true if both entries have the same reference and
+// metadata.
+func entryEqual(a, b Entry) bool {
+	if a.Reference() != b.Reference() || len(a.Metadata()) != len(b.Metadata()) {
+		return false
+	}
+	for k, v := range a.Metadata() {
+		if w, ok := b.Metadata()[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// copyMetadata returns a copy of metadata, nil if it is empty.
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		c[k] = v
+	}
+	return c
+}
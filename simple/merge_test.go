@@ -0,0 +1,92 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package simple_test
+
+import (
+	"testing"
+
+	"github.com/ethersphere/manifest/simple"
+)
+
+func TestMergeConflicts(t *testing.T) {
+	dstIndex, srcIndex, robots := randomAddress(), randomAddress(), randomAddress()
+
+	dst := simple.NewManifest()
+	for _, e := range []e{
+		{path: "index.html", reference: dstIndex},
+		{path: "robots.txt", reference: robots},
+	} {
+		if err := dst.Add(e.path, e.reference, e.metadata); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	src := simple.NewManifest()
+	for _, e := range []e{
+		{path: "index.html", reference: srcIndex},
+		{path: "robots.txt", reference: robots},
+		{path: "img/1.png", reference: randomAddress()},
+	} {
+		if err := src.Add(e.path, e.reference, e.metadata); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	conflicts, err := simple.Merge(dst, src)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("expected 1 conflict, got %d", len(conflicts))
+	}
+	c := conflicts[0]
+	if c.Path != "index.html" {
+		t.Fatalf("expected conflict on path index.html, got %s", c.Path)
+	}
+	if c.Dst.Reference() != dstIndex || c.Src.Reference() != srcIndex {
+		t.Fatalf("unexpected conflicting references %s, %s", c.Dst.Reference(), c.Src.Reference())
+	}
+
+	checkLength(t, dst, 3)
+	checkEntry(t, dst, srcIndex, "index.html")
+}
+
+func TestMergeOrderAndMetadata(t *testing.T) {
+	paths := []string{"d.html", "a.html", "c/1.png", "b.txt", "c/0.png"}
+	dst := simple.NewManifest()
+	src := simple.NewManifest()
+	metadata := map[string]string{"Content-Type": "text/html"}
+	for _, p := range paths {
+		if err := dst.Add(p, randomAddress(), nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := src.Add(p, randomAddress(), metadata); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	conflicts, err := simple.Merge(dst, src)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(conflicts) != len(paths) {
+		t.Fatalf("expected %d conflicts, got %d", len(paths), len(conflicts))
+	}
+	for i, c := range conflicts[1:] {
+		if conflicts[i].Path >= c.Path {
+			t.Fatalf("expected conflicts sorted by path, got %s before %s", conflicts[i].Path, c.Path)
+		}
+	}
+
+	// changing the metadata of src leaves dst unchanged
+	metadata["Content-Type"] = "text/plain"
+	e, err := dst.Lookup("a.html")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := e.Metadata()["Content-Type"]; got != "text/html" {
+		t.Fatalf("expected merged metadata text/html, got %s", got)
+	}
+}
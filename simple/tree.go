@@ -0,0 +1,101 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package simple
+
+import (
+	"sort"
+	"strings"
+)
+
+// TreeNode is a file or directory of the hierarchical view of a manifest.
+type TreeNode struct {
+	name     string
+	path     string
+	dir      bool
+	entry    Entry
+	children map[string]*TreeNode
+}
+
+// Name returns the last element of the path of the node.
+func (t *TreeNode) Name() string {
+	return t.name
+}
+
+// Path returns the path of the node, directories ending with a separator.
+func (t *TreeNode) Path() string {
+	return t.path
+}
+
+// IsDir returns true if the node is a directory.
+func (t *TreeNode) IsDir() bool {
+	return t.dir
+}
+
+// Entry returns the entry stored on the path of the node, or nil if there
+// is none, as for directories implied by the paths of their files.
+func (t *TreeNode) Entry() Entry {
+	return t.entry
+}
+
+// Children returns the files and directories in the directory, sorted by
+// name.
+func (t *TreeNode) Children() []*TreeNode {
+	children := make([]*TreeNode, 0, len(t.children))
+	for _, c := range t.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+	return children
+}
+
+func (t *TreeNode) child(name string, dir bool) *TreeNode {
+	c, ok := t.children[name]
+	if !ok {
+		path := t.path + name
+		if dir {
+			path += "/"
+		}
+		c = &TreeNode{
+			name:     name,
+			path:     path,
+			children: make(map[string]*TreeNode),
+		}
+		t.children[name] = c
+	}
+	if dir && !c.dir {
+		c.dir = true
+		c.path = t.path + name + "/"
+	}
+	return c
+}
+
+func (m *manifest) Tree() *TreeNode {
+	m.mu.RLock()
+	entries := make(map[string]Entry, len(m.Entries))
+	for k, v := range m.Entries {
+		entries[k] = newEntry(v.Ref, v.Meta)
+	}
+	m.mu.RUnlock()
+
+	root := &TreeNode{
+		dir:      true,
+		children: make(map[string]*TreeNode),
+	}
+	for path, entry := range entries {
+		node := root
+		elems := strings.Split(strings.Trim(path, "/"), "/")
+		for i, elem := range elems {
+			if elem == "" {
+				continue
+			}
+			last := i == len(elems)-1
+			node = node.child(elem, !last || strings.HasSuffix(path, "/"))
+		}
+		node.entry = entry
+	}
+	return root
+}
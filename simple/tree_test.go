@@ -0,0 +1,57 @@
+// Copyright 2020 The Swarm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package simple_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ethersphere/manifest/simple"
+)
+
+func TestTree(t *testing.T) {
+	m := simple.NewManifest()
+	for _, tc := range testCases {
+		if tc.name != "nested-entries" {
+			continue
+		}
+		for _, e := range tc.entries {
+			err := m.Add(e.path, e.reference, e.metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var paths []string
+	var walk func(n *simple.TreeNode)
+	walk = func(n *simple.TreeNode) {
+		for _, c := range n.Children() {
+			if c.IsDir() != strings.HasSuffix(c.Path(), "/") {
+				t.Fatalf("expected directory %t for %s", c.IsDir(), c.Path())
+			}
+			if !c.IsDir() && c.Entry() == nil {
+				t.Fatalf("expected entry for file %s", c.Path())
+			}
+			paths = append(paths, c.Path())
+			walk(c)
+		}
+	}
+	root := m.(simple.TreeManifest).Tree()
+	walk(root)
+
+	expected := []string{"img/", "img/1.png", "img/2.jpg", "readme.md", "text/", "text/robots.txt"}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected tree %v, got %v", expected, paths)
+	}
+
+	if !root.IsDir() || root.Entry() == nil || root.Entry().Metadata()["index-document"] != "readme.md" {
+		t.Fatal("expected root directory with the entry on /")
+	}
+	img := root.Children()[0]
+	if img.Name() != "img" || img.Entry() != nil {
+		t.Fatalf("expected implied directory img, got %s", img.Name())
+	}
+}
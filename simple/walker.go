@@ -4,6 +4,14 @@
 
 package simple
 
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
 // WalkEntryFunc is the type of the function called for each entry visited
 // by WalkEntry.
 type WalkEntryFunc func(path string, entry Entry, err error) error
@@ -22,3 +30,45 @@ func (m *manifest) WalkEntry(root string, walkFn WalkEntryFunc) (err error) {
 
 	return nil
 }
+
+// WalkEntryAsync calls walkFn for each entry with a path starting with root,
+// from at most limit goroutines at a time, so walkFn must be safe for
+// concurrent use. The entries are a snapshot taken when the walk starts, so
+// walkFn may modify the manifest. No further calls are made once ctx is done
+// or walkFn returns an error, which is returned.
+func (m *manifest) WalkEntryAsync(ctx context.Context, root string, limit int, walkFn WalkEntryFunc) error {
+	if limit <= 0 {
+		return fmt.Errorf("%w: concurrency limit %d", ErrInvalid, limit)
+	}
+
+	m.mu.RLock()
+	entries := make(map[string]Entry, len(m.Entries))
+	for k, v := range m.Entries {
+		if strings.HasPrefix(k, root) {
+			entries[k] = newEntry(v.Ref, v.Meta)
+		}
+	}
+	m.mu.RUnlock()
+
+	eg, ectx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, limit)
+	for k, v := range entries {
+		k, v := k, v
+		select {
+		case sem <- struct{}{}:
+		case <-ectx.Done():
+			if err := eg.Wait(); err != nil {
+				return err
+			}
+			return ectx.Err()
+		}
+		eg.Go(func() error {
+			defer func() { <-sem }()
+			if err := ectx.Err(); err != nil {
+				return err
+			}
+			return walkFn(k, v, nil)
+		})
+	}
+	return eg.Wait()
+}
@@ -5,8 +5,12 @@
 package simple_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ethersphere/manifest/simple"
 )
@@ -63,3 +67,72 @@ func TestWalkEntry(t *testing.T) {
 		})
 	}
 }
+
+func TestWalkEntryAsync(t *testing.T) {
+	m := simple.NewManifest()
+	for i := 0; i < 1000; i++ {
+		err := m.Add(fmt.Sprintf("dir/file%d", i), randomAddress(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := m.Add("other/file", randomAddress(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("limit", func(t *testing.T) {
+		const limit = 4
+		var running, peak, calls int64
+		err := m.(simple.AsyncWalker).WalkEntryAsync(context.Background(), "dir/", limit, func(path string, _ simple.Entry, err error) error {
+			atomic.AddInt64(&calls, 1)
+			r := atomic.AddInt64(&running, 1)
+			defer atomic.AddInt64(&running, -1)
+			for {
+				p := atomic.LoadInt64(&peak)
+				if r <= p || atomic.CompareAndSwapInt64(&peak, p, r) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Microsecond)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if calls != 1000 {
+			t.Fatalf("expected 1000 calls, got %d", calls)
+		}
+		if peak > limit {
+			t.Fatalf("expected at most %d concurrent calls, got %d", limit, peak)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var calls int64
+		err := m.(simple.AsyncWalker).WalkEntryAsync(ctx, "", 2, func(path string, _ simple.Entry, err error) error {
+			if atomic.AddInt64(&calls, 1) == 10 {
+				cancel()
+			}
+			return err
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context canceled error, got %v", err)
+		}
+		// calls already running when canceled may complete
+		if calls > 12 {
+			t.Fatalf("expected walk to stop after cancel, got %d calls", calls)
+		}
+	})
+
+	t.Run("invalid-limit", func(t *testing.T) {
+		err := m.(simple.AsyncWalker).WalkEntryAsync(context.Background(), "", 0, func(path string, _ simple.Entry, err error) error {
+			return err
+		})
+		if !errors.Is(err, simple.ErrInvalid) {
+			t.Fatalf("expected %v, got %v", simple.ErrInvalid, err)
+		}
+	})
+}